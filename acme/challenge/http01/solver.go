@@ -0,0 +1,90 @@
+package http01
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	xacme "golang.org/x/crypto/acme"
+
+	"darvaza.org/darvaza/acme"
+)
+
+var (
+	_ acme.HTTP01Resolver = (*Solver)(nil)
+)
+
+// Solver presents HTTP-01 challenge responses for
+// an ACME client, and resolves them for the
+// ChallengeHandler
+type Solver struct {
+	mu     sync.Mutex
+	tokens map[string]map[string]string
+}
+
+// NewSolver creates a new HTTP-01 Solver
+func NewSolver() *Solver {
+	return &Solver{
+		tokens: make(map[string]map[string]string),
+	}
+}
+
+// Present makes the key authorization of the challenge
+// available for the ChallengeHandler
+func (s *Solver) Present(_ context.Context, cl *xacme.Client, id xacme.AuthzID, chal *xacme.Challenge) error {
+	keyAuth, err := cl.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+
+	host := strings.ToLower(id.Value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.tokens[host]
+	if !ok {
+		m = make(map[string]string)
+		s.tokens[host] = m
+	}
+	m[chal.Token] = keyAuth
+	return nil
+}
+
+// CleanUp removes the challenge response
+func (s *Solver) CleanUp(_ context.Context, _ *xacme.Client, id xacme.AuthzID, chal *xacme.Challenge) error {
+	host := strings.ToLower(id.Value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.tokens[host]; ok {
+		delete(m, chal.Token)
+		if len(m) == 0 {
+			delete(s.tokens, host)
+		}
+	}
+	return nil
+}
+
+// AnnounceHost is a no-op
+func (*Solver) AnnounceHost(string) {}
+
+// LookupChallenge returns the handler for a presented challenge
+func (s *Solver) LookupChallenge(host, token string) acme.HTTP01Challenge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if keyAuth, ok := s.tokens[strings.ToLower(host)][token]; ok {
+		return keyAuthorization(keyAuth)
+	}
+	return nil
+}
+
+type keyAuthorization string
+
+func (ka keyAuthorization) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain")
+	_, _ = rw.Write([]byte(ka))
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"darvaza.org/core"
+)
+
+// Account is an ACME account on a given directory
+type Account struct {
+	// URI is the account URL, used as key ID
+	URI string
+	// Key is the account's private key
+	Key crypto.Signer
+	// Contact is the list of contact URIs registered
+	Contact []string
+}
+
+// AccountStore persists ACME accounts by directory URL
+type AccountStore interface {
+	// GetAccount returns the account registered on a directory
+	// or fs.ErrNotExist
+	GetAccount(ctx context.Context, directoryURL string) (*Account, error)
+	// PutAccount stores the account registered on a directory
+	PutAccount(ctx context.Context, directoryURL string, acct *Account) error
+}
+
+var (
+	_ AccountStore = (*MemoryAccountStore)(nil)
+	_ AccountStore = (*DirAccountStore)(nil)
+)
+
+// MemoryAccountStore is an AccountStore that doesn't persist
+type MemoryAccountStore struct {
+	mu       sync.Mutex
+	accounts map[string]*Account
+}
+
+// NewMemoryAccountStore creates a new in-memory AccountStore
+func NewMemoryAccountStore() *MemoryAccountStore {
+	return &MemoryAccountStore{
+		accounts: make(map[string]*Account),
+	}
+}
+
+// GetAccount returns the account registered on a directory
+func (s *MemoryAccountStore) GetAccount(_ context.Context, directoryURL string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acct, ok := s.accounts[directoryURL]; ok {
+		return acct, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// PutAccount stores the account registered on a directory
+func (s *MemoryAccountStore) PutAccount(_ context.Context, directoryURL string, acct *Account) error {
+	if acct == nil || acct.Key == nil {
+		return core.ErrInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts[directoryURL] = acct
+	return nil
+}
+
+// DirAccountStore is an AccountStore keeping one
+// JSON file per directory URL, named after its host and
+// path followed by a hash of the whole URL
+type DirAccountStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewDirAccountStore creates an AccountStore on the given directory
+func NewDirAccountStore(dir string) (*DirAccountStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirAccountStore{dir: dir}, nil
+}
+
+type accountFile struct {
+	Directory string   `json:"directory"`
+	URI       string   `json:"uri"`
+	Contact   []string `json:"contact,omitempty"`
+	Key       string   `json:"key"`
+}
+
+// GetAccount returns the account registered on a directory
+func (s *DirAccountStore) GetAccount(_ context.Context, directoryURL string) (*Account, error) {
+	var af accountFile
+
+	s.mu.Lock()
+	b, err := os.ReadFile(s.filename(directoryURL))
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, &af); err != nil {
+		return nil, err
+	} else if af.Directory != directoryURL {
+		// name collision
+		return nil, fs.ErrNotExist
+	}
+
+	key, err := decodeKey([]byte(af.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Account{
+		URI:     af.URI,
+		Key:     key,
+		Contact: af.Contact,
+	}, nil
+}
+
+// PutAccount stores the account registered on a directory
+func (s *DirAccountStore) PutAccount(_ context.Context, directoryURL string, acct *Account) error {
+	if acct == nil || acct.Key == nil {
+		return core.ErrInvalid
+	}
+
+	key, err := encodeKey(acct.Key)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(accountFile{
+		Directory: directoryURL,
+		URI:       acct.URI,
+		Contact:   acct.Contact,
+		Key:       string(key),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := s.filename(directoryURL)
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (s *DirAccountStore) filename(directoryURL string) string {
+	// the hash tells apart URLs differing only on scheme or query
+	sum := sha256.Sum256([]byte(directoryURL))
+	name := directoryName(directoryURL) + "_" + hex.EncodeToString(sum[:4])
+	return filepath.Join(s.dir, name+".json")
+}
+
+// directoryName converts a directory URL into a name
+// usable as filename
+func directoryName(directoryURL string) string {
+	var s string
+
+	if u, err := url.Parse(directoryURL); err == nil && u.Host != "" {
+		s = u.Host + u.Path
+	} else {
+		s = directoryURL
+	}
+
+	s = strings.Trim(s, "/")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+func newAccountKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+func decodeKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("invalid account key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer, nil
+	}
+	return nil, errors.New("invalid account key")
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestDirectoryName(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://acme-v02.api.letsencrypt.org/directory", "acme-v02.api.letsencrypt.org_directory"},
+		{"https://acme.zerossl.com/v2/DV90", "acme.zerossl.com_v2_DV90"},
+		{"https://localhost:14000/dir/", "localhost_14000_dir"},
+	} {
+		if s := directoryName(tc.url); s != tc.expected {
+			t.Errorf("directoryName(%q): %q (expected %q)", tc.url, s, tc.expected)
+		}
+	}
+}
+
+func TestDirAccountStore(t *testing.T) {
+	const dirURL = "https://acme.example.org/directory"
+
+	s, err := NewDirAccountStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := s.GetAccount(ctx, dirURL); err == nil {
+		t.Fatal("GetAccount: unexpected account")
+	}
+
+	err = s.PutAccount(ctx, dirURL, &Account{URI: "https://acme.example.org/acct/1", Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acct, err := s.GetAccount(ctx, dirURL)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case acct.URI != "https://acme.example.org/acct/1":
+		t.Errorf("GetAccount: unexpected URI %q", acct.URI)
+	case !key.PublicKey.Equal(acct.Key.Public()):
+		t.Error("GetAccount: key mismatch")
+	}
+
+	// same host and path, different directory
+	for _, other := range []string{
+		"http://acme.example.org/directory",
+		"https://acme.example.org/directory?v=2",
+	} {
+		if _, err := s.GetAccount(ctx, other); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("GetAccount(%q): %v (expected %v)", other, err, fs.ErrNotExist)
+		}
+
+		err = s.PutAccount(ctx, other, &Account{URI: other + "/acct", Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if acct, err := s.GetAccount(ctx, dirURL); err != nil {
+		t.Fatal(err)
+	} else if acct.URI != "https://acme.example.org/acct/1" {
+		t.Errorf("GetAccount: overwritten by %q", acct.URI)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	ea := &ExternalAccount{
+		KeyID:   "kid-1",
+		HMACKey: "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W",
+	}
+
+	eab, err := ea.Binding()
+	if err != nil {
+		t.Fatal(err)
+	} else if eab.KID != "kid-1" || len(eab.Key) != 48 {
+		t.Errorf("Binding: unexpected %v (%d bytes)", eab, len(eab.Key))
+	}
+
+	ea.HMACKey = "not base64!"
+	if _, err := ea.Binding(); err == nil {
+		t.Error("Binding: invalid key accepted")
+	}
+}
@@ -0,0 +1,251 @@
+// Package client implements an ACME client requesting certificates
+// from an ordered list of Certificate Authorities
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	// ErrBackingOff indicates a CA was skipped because it
+	// failed recently
+	ErrBackingOff = errors.New("backing off")
+)
+
+// Solver fulfils challenges of a particular type
+type Solver interface {
+	// Present makes the response to the challenge available
+	Present(ctx context.Context, cl *acme.Client, id acme.AuthzID, chal *acme.Challenge) error
+	// CleanUp removes what Present set up
+	CleanUp(ctx context.Context, cl *acme.Client, id acme.AuthzID, chal *acme.Challenge) error
+}
+
+// State describes the recent history of a CA
+type State struct {
+	Name         string
+	DirectoryURL string
+
+	Failures    int
+	LastError   error
+	NextAttempt time.Time
+}
+
+// Client requests certificates from an ordered list of CAs,
+// moving to the next when one fails
+type Client struct {
+	cfg Config
+	cas []*issuer
+}
+
+type issuer struct {
+	mu sync.Mutex
+	c  *Client
+	ca CA
+
+	client *acme.Client
+	stale  bool
+
+	failures int
+	lastErr  error
+	next     time.Time
+}
+
+// Issue requests a new certificate for the given names using the
+// given key. CAs are tried in order, skipping those backing off
+// after recent failures
+func (c *Client) Issue(ctx context.Context, key crypto.Signer, names []string) (*tls.Certificate, error) {
+	var errs []error
+
+	if key == nil || len(names) == 0 {
+		return nil, core.ErrInvalid
+	}
+
+	for _, is := range c.cas {
+		if until, ok := is.backingOff(); ok {
+			err := core.Wrapf(ErrBackingOff, "%s: until %s", is.ca.Name, until.Format(time.RFC3339))
+			errs = append(errs, err)
+			continue
+		}
+
+		cert, err := is.issue(ctx, key, names)
+		switch {
+		case err == nil:
+			is.succeeded()
+			return cert, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		default:
+			is.failed(err)
+			errs = append(errs, core.Wrap(err, is.ca.Name))
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// States returns the state of each CA, in order
+func (c *Client) States() []State {
+	out := make([]State, 0, len(c.cas))
+	for _, is := range c.cas {
+		is.mu.Lock()
+		out = append(out, State{
+			Name:         is.ca.Name,
+			DirectoryURL: is.ca.DirectoryURL,
+			Failures:     is.failures,
+			LastError:    is.lastErr,
+			NextAttempt:  is.next,
+		})
+		is.mu.Unlock()
+	}
+	return out
+}
+
+func (is *issuer) backingOff() (time.Time, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if is.next.After(time.Now()) {
+		return is.next, true
+	}
+	return time.Time{}, false
+}
+
+func (is *issuer) succeeded() {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	is.failures = 0
+	is.lastErr = nil
+	is.next = time.Time{}
+}
+
+func (is *issuer) failed(err error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	is.failures++
+	is.lastErr = err
+
+	wait := is.c.cfg.BackoffMin
+	for i := 1; i < is.failures && wait < is.c.cfg.BackoffMax; i++ {
+		wait *= 2
+	}
+	wait = min(wait, is.c.cfg.BackoffMax)
+
+	if d, ok := acme.RateLimit(err); ok && d > wait {
+		wait = d
+	}
+
+	if isAccountDoesNotExist(err) {
+		// register again on the next attempt
+		is.client = nil
+		is.stale = true
+	}
+
+	is.next = time.Now().Add(wait)
+
+	if log, ok := is.c.warn(err); ok {
+		log.WithField("ca", is.ca.Name).
+			WithField("failures", is.failures).
+			Printf("order failed, backing off for %s", wait)
+	}
+}
+
+// getClient returns the acme.Client of the CA, loading or
+// registering the account if needed
+func (is *issuer) getClient(ctx context.Context) (*acme.Client, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if is.client != nil {
+		return is.client, nil
+	}
+
+	cl := &acme.Client{
+		DirectoryURL: is.ca.DirectoryURL,
+		HTTPClient:   is.c.cfg.HTTPClient,
+		UserAgent:    is.c.cfg.UserAgent,
+	}
+
+	var acct *Account
+	var err error
+
+	if !is.stale {
+		acct, err = is.c.cfg.Accounts.GetAccount(ctx, is.ca.DirectoryURL)
+	}
+
+	switch {
+	case is.stale, errors.Is(err, fs.ErrNotExist):
+		acct, err = is.register(ctx, cl)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	cl.Key = acct.Key
+	cl.KID = acme.KeyID(acct.URI)
+
+	is.client = cl
+	is.stale = false
+	return cl, nil
+}
+
+func (is *issuer) register(ctx context.Context, cl *acme.Client) (*Account, error) {
+	key, err := newAccountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &acme.Account{
+		Contact: is.ca.Contact,
+	}
+
+	if ea := is.ca.ExternalAccount; ea != nil {
+		req.ExternalAccountBinding, err = ea.Binding()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cl.Key = key
+	acct, err := cl.Register(ctx, req, acme.AcceptTOS)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Account{
+		URI:     acct.URI,
+		Key:     key,
+		Contact: acct.Contact,
+	}
+
+	if err := is.c.cfg.Accounts.PutAccount(ctx, is.ca.DirectoryURL, out); err != nil {
+		return nil, err
+	}
+
+	if log, ok := is.c.info(); ok {
+		log.WithField("ca", is.ca.Name).
+			Printf("registered account %q", acct.URI)
+	}
+
+	return out, nil
+}
+
+func isAccountDoesNotExist(err error) bool {
+	var e *acme.Error
+	if errors.As(err, &e) {
+		return e.ProblemType == "urn:ietf:params:acme:error:accountDoesNotExist"
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const testName = "www.example.org"
+
+// testCA is a minimal ACME CA whose authorizations are
+// always valid
+type testCA struct {
+	t  *testing.T
+	ts *httptest.Server
+
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+
+	mu     sync.Mutex
+	reject bool
+	orders int
+	status string
+	chain  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{t: t, key: key, cert: cert}
+	ca.ts = httptest.NewServer(ca)
+	t.Cleanup(ca.ts.Close)
+	return ca
+}
+
+func (ca *testCA) setReject(reject bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.reject = reject
+}
+
+func (ca *testCA) getOrders() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.orders
+}
+
+func (ca *testCA) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	u := ca.ts.URL
+	rw.Header().Set("Replay-Nonce", "nonce")
+
+	switch req.URL.Path {
+	case "/directory":
+		ca.writeJSON(rw, http.StatusOK, map[string]string{
+			"newNonce":   u + "/nonce",
+			"newAccount": u + "/account",
+			"newOrder":   u + "/order",
+		})
+	case "/nonce":
+		rw.WriteHeader(http.StatusOK)
+	case "/account":
+		rw.Header().Set("Location", u+"/account/1")
+		ca.writeJSON(rw, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		if ca.reject {
+			rw.Header().Set("Content-Type", "application/problem+json")
+			ca.writeJSON(rw, http.StatusForbidden, map[string]string{
+				"type":   "urn:ietf:params:acme:error:unauthorized",
+				"detail": "rejected",
+			})
+			return
+		}
+
+		ca.orders++
+		ca.status = acme.StatusReady
+		ca.writeOrder(rw, http.StatusCreated)
+	case "/order/1":
+		ca.writeOrder(rw, http.StatusOK)
+	case "/authz/1":
+		ca.writeJSON(rw, http.StatusOK, map[string]any{
+			"status":     acme.StatusValid,
+			"identifier": map[string]string{"type": "dns", "value": testName},
+			"challenges": []any{},
+		})
+	case "/finalize/1":
+		if err := ca.finalize(req); err != nil {
+			ca.t.Error(err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ca.writeOrder(rw, http.StatusOK)
+	case "/cert/1":
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = rw.Write(ca.chain)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (ca *testCA) writeJSON(rw http.ResponseWriter, status int, v any) {
+	if rw.Header().Get("Content-Type") == "" {
+		rw.Header().Set("Content-Type", "application/json")
+	}
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func (ca *testCA) writeOrder(rw http.ResponseWriter, status int) {
+	u := ca.ts.URL
+	o := map[string]any{
+		"status":         ca.status,
+		"identifiers":    []any{map[string]string{"type": "dns", "value": testName}},
+		"authorizations": []string{u + "/authz/1"},
+		"finalize":       u + "/finalize/1",
+	}
+	if ca.status == acme.StatusValid {
+		o["certificate"] = u + "/cert/1"
+	}
+
+	rw.Header().Set("Location", u+"/order/1")
+	ca.writeJSON(rw, status, o)
+}
+
+// finalize signs the CSR in the payload of the request
+func (ca *testCA) finalize(req *http.Request) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	} else if err := json.Unmarshal(b, &payload); err != nil {
+		return err
+	}
+	b, err = base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		return err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+
+	ca.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	ca.status = acme.StatusValid
+	return nil
+}
+
+// nopSolver is never used as authorizations are already valid
+type nopSolver struct{}
+
+func (nopSolver) Present(context.Context, *acme.Client, acme.AuthzID, *acme.Challenge) error {
+	return nil
+}
+
+func (nopSolver) CleanUp(context.Context, *acme.Client, acme.AuthzID, *acme.Challenge) error {
+	return nil
+}
+
+func newTestClient(t *testing.T, cas ...*testCA) *Client {
+	cfg := &Config{
+		Solvers:    map[string]Solver{"http-01": nopSolver{}},
+		BackoffMin: time.Hour,
+		BackoffMax: 4 * time.Hour,
+	}
+
+	for _, ca := range cas {
+		cfg.CAs = append(cfg.CAs, CA{DirectoryURL: ca.ts.URL + "/directory"})
+	}
+
+	c, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func issue(t *testing.T, c *Client) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := c.Issue(context.Background(), key, []string{testName})
+	if err == nil && (cert.Leaf == nil || cert.Leaf.DNSNames[0] != testName) {
+		t.Errorf("Issue: unexpected certificate %v", cert.Leaf)
+	}
+	return err
+}
+
+func TestIssueFallback(t *testing.T) {
+	ca1, ca2 := newTestCA(t), newTestCA(t)
+	ca1.setReject(true)
+
+	c := newTestClient(t, ca1, ca2)
+	if err := issue(t, c); err != nil {
+		t.Fatal(err)
+	}
+
+	states := c.States()
+	switch {
+	case states[0].Failures != 1 || states[0].LastError == nil:
+		t.Errorf("first CA: %+v (expected a failure)", states[0])
+	case time.Until(states[0].NextAttempt) < 59*time.Minute:
+		t.Errorf("first CA: next attempt at %s (expected in an hour)", states[0].NextAttempt)
+	case states[1].Failures != 0:
+		t.Errorf("second CA: %+v (expected no failures)", states[1])
+	}
+
+	// the first CA is skipped while backing off
+	ca1.setReject(false)
+	if err := issue(t, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if n1, n2 := ca1.getOrders(), ca2.getOrders(); n1 != 0 || n2 != 2 {
+		t.Errorf("%v and %v orders (expected 0 and 2)", n1, n2)
+	}
+}
+
+func TestIssueBackoff(t *testing.T) {
+	ca := newTestCA(t)
+	ca.setReject(true)
+
+	c := newTestClient(t, ca)
+	is := c.cas[0]
+
+	for _, expected := range []time.Duration{
+		time.Hour,
+		2 * time.Hour,
+		4 * time.Hour,
+		4 * time.Hour,
+	} {
+		is.mu.Lock()
+		is.next = time.Time{}
+		is.mu.Unlock()
+
+		if err := issue(t, c); err == nil {
+			t.Fatal("Issue: unexpected success")
+		}
+
+		if d := time.Until(c.States()[0].NextAttempt); d > expected || d < expected-time.Minute {
+			t.Errorf("backing off for %s (expected %s)", d, expected)
+		}
+	}
+
+	if err := issue(t, c); !errors.Is(err, ErrBackingOff) {
+		t.Errorf("Issue: %v (expected %v)", err, ErrBackingOff)
+	}
+
+	// success resets the backoff
+	ca.setReject(false)
+	is.mu.Lock()
+	is.next = time.Time{}
+	is.mu.Unlock()
+
+	if err := issue(t, c); err != nil {
+		t.Fatal(err)
+	} else if s := c.States()[0]; s.Failures != 0 || !s.NextAttempt.IsZero() {
+		t.Errorf("%+v (expected a reset)", s)
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// DefaultOrderTimeout is the maximum time given to a single
+	// CA to complete an order
+	DefaultOrderTimeout = 5 * time.Minute
+	// DefaultBackoffMin is the initial backoff after a CA fails
+	DefaultBackoffMin = time.Minute
+	// DefaultBackoffMax is the maximum backoff after repeated failures
+	DefaultBackoffMax = 6 * time.Hour
+)
+
+// ExternalAccount is the External Account Binding a CA
+// requires to register new accounts
+type ExternalAccount struct {
+	// KeyID identifies the MAC key on the CA's side
+	KeyID string
+	// HMACKey is the base64url encoded MAC key, as provided by
+	// the CA
+	HMACKey string
+}
+
+// Binding decodes the ExternalAccount into what the acme
+// client uses when registering
+func (ea *ExternalAccount) Binding() (*acme.ExternalAccountBinding, error) {
+	if ea.KeyID == "" {
+		return nil, core.Wrap(core.ErrInvalid, "EAB: missing key ID")
+	}
+
+	s := strings.TrimRight(ea.HMACKey, "=")
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, core.Wrap(err, "EAB: invalid HMAC key")
+	} else if len(key) == 0 {
+		return nil, core.Wrap(core.ErrInvalid, "EAB: missing HMAC key")
+	}
+
+	return &acme.ExternalAccountBinding{
+		KID: ea.KeyID,
+		Key: key,
+	}, nil
+}
+
+// CA describes an ACME Certificate Authority to request
+// certificates from
+type CA struct {
+	// Name identifies the CA in logs and states,
+	// defaults to the directory's host
+	Name string
+	// DirectoryURL is the ACME directory endpoint
+	DirectoryURL string
+	// Contact is the list of contact URIs used when
+	// registering the account
+	Contact []string
+	// ExternalAccount is required by some commercial CAs
+	ExternalAccount *ExternalAccount
+	// PreferredChain is the Common Name of the issuer of the
+	// topmost certificate of the chain we prefer, when the CA
+	// offers alternatives
+	PreferredChain string
+}
+
+// Config describes how a Client requests certificates
+type Config struct {
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+	// HTTPClient is an optional http.Client to talk to the CAs
+	HTTPClient *http.Client
+	// UserAgent is prepended to the User-Agent header sent to the CAs
+	UserAgent string
+
+	// CAs is the ordered list of Certificate Authorities to try
+	CAs []CA
+	// Accounts persists the accounts on each CA. If not
+	// provided accounts only live in memory
+	Accounts AccountStore
+	// Solvers handle the challenges, by type
+	Solvers map[string]Solver
+
+	// OrderTimeout is the maximum time given to one CA per attempt
+	OrderTimeout time.Duration
+	// BackoffMin is the initial backoff after a CA fails
+	BackoffMin time.Duration
+	// BackoffMax is the maximum backoff after repeated failures
+	BackoffMax time.Duration
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *Config) SetDefaults() error {
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	if cfg.Accounts == nil {
+		cfg.Accounts = NewMemoryAccountStore()
+	}
+
+	for i := range cfg.CAs {
+		if err := cfg.CAs[i].setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	cfg.OrderTimeout = core.IIf(cfg.OrderTimeout > 0, cfg.OrderTimeout, DefaultOrderTimeout)
+	cfg.BackoffMin = core.IIf(cfg.BackoffMin > 0, cfg.BackoffMin, DefaultBackoffMin)
+	cfg.BackoffMax = core.IIf(cfg.BackoffMax >= cfg.BackoffMin, cfg.BackoffMax, DefaultBackoffMax)
+	return nil
+}
+
+func (ca *CA) setDefaults() error {
+	if ca.DirectoryURL == "" {
+		return core.Wrap(core.ErrInvalid, "CA without DirectoryURL")
+	}
+
+	if ca.Name == "" {
+		ca.Name = directoryName(ca.DirectoryURL)
+	}
+
+	if ca.ExternalAccount != nil {
+		if _, err := ca.ExternalAccount.Binding(); err != nil {
+			return core.Wrap(err, ca.Name)
+		}
+	}
+
+	return nil
+}
+
+// New creates a new Client from a Config
+func (cfg *Config) New() (*Client, error) {
+	if len(cfg.CAs) == 0 {
+		return nil, core.Wrap(core.ErrInvalid, "no CAs")
+	} else if len(cfg.Solvers) == 0 {
+		return nil, core.Wrap(core.ErrInvalid, "no challenge solvers")
+	}
+
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg: *cfg,
+		cas: make([]*issuer, len(cfg.CAs)),
+	}
+
+	for i, ca := range cfg.CAs {
+		c.cas[i] = &issuer{
+			c:  c,
+			ca: ca,
+		}
+	}
+
+	return c, nil
+}
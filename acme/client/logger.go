@@ -0,0 +1,27 @@
+package client
+
+import (
+	"darvaza.org/slog"
+)
+
+func (c *Client) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return c.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (c *Client) debug() (slog.Logger, bool) {
+	return c.withLogger(slog.Debug)
+}
+
+func (c *Client) info() (slog.Logger, bool) {
+	return c.withLogger(slog.Info)
+}
+
+func (c *Client) warn(err error) (slog.Logger, bool) {
+	if l, ok := c.withLogger(slog.Warn); ok {
+		if err != nil {
+			l = l.WithField(slog.ErrorFieldName, err)
+		}
+		return l, true
+	}
+	return nil, false
+}
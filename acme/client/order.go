@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/acme"
+)
+
+// issue runs a whole order against the CA
+func (is *issuer) issue(ctx context.Context, key crypto.Signer, names []string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, is.c.cfg.OrderTimeout)
+	defer cancel()
+
+	cl, err := is.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := cl.AuthorizeOrder(ctx, authzIDs(names))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := is.authorize(ctx, cl, u); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = cl.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := newCSR(key, names)
+	if err != nil {
+		return nil, err
+	}
+
+	der, certURL, err := cl.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	der = is.preferredChain(ctx, cl, der, certURL)
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if log, ok := is.c.info(); ok {
+		log.WithField("ca", is.ca.Name).
+			WithField("names", names).
+			Printf("certificate issued, serial %x", leaf.SerialNumber)
+	}
+
+	return &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// authorize completes one authorization of the order
+func (is *issuer) authorize(ctx context.Context, cl *acme.Client, u string) error {
+	az, err := cl.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	} else if az.Status == acme.StatusValid {
+		return nil
+	}
+
+	chal, solver := is.pickChallenge(az)
+	if chal == nil {
+		return fmt.Errorf("%s: no supported challenge", az.Identifier.Value)
+	}
+
+	if err := solver.Present(ctx, cl, az.Identifier, chal); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := solver.CleanUp(context.Background(), cl, az.Identifier, chal); err != nil {
+			if log, ok := is.c.warn(err); ok {
+				log.WithField("ca", is.ca.Name).
+					Printf("%s: failed to clean up %s challenge", az.Identifier.Value, chal.Type)
+			}
+		}
+	}()
+
+	if log, ok := is.c.debug(); ok {
+		log.WithField("ca", is.ca.Name).
+			Printf("%s: accepting %s challenge", az.Identifier.Value, chal.Type)
+	}
+
+	if _, err := cl.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err = cl.WaitAuthorization(ctx, az.URI)
+	return err
+}
+
+// pickChallenge returns the first challenge offered we
+// have a Solver for
+func (is *issuer) pickChallenge(az *acme.Authorization) (*acme.Challenge, Solver) {
+	for _, chal := range az.Challenges {
+		if solver, ok := is.c.cfg.Solvers[chal.Type]; ok && solver != nil {
+			return chal, solver
+		}
+	}
+	return nil, nil
+}
+
+// preferredChain checks if the chain is the preferred one or
+// tries the alternatives offered by the CA. On failure the
+// default chain is used
+func (is *issuer) preferredChain(ctx context.Context, cl *acme.Client, der [][]byte, certURL string) [][]byte {
+	want := is.ca.PreferredChain
+	if want == "" || chainIssuedBy(der, want) {
+		return der
+	}
+
+	alts, err := cl.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		if log, ok := is.c.warn(err); ok {
+			log.WithField("ca", is.ca.Name).Print("failed to list alternative chains")
+		}
+		return der
+	}
+
+	for _, u := range alts {
+		alt, err := cl.FetchCert(ctx, u, true)
+		if err == nil && chainIssuedBy(alt, want) {
+			return alt
+		}
+	}
+
+	if log, ok := is.c.warn(nil); ok {
+		log.WithField("ca", is.ca.Name).
+			Printf("preferred chain %q not offered, using default", want)
+	}
+	return der
+}
+
+// chainIssuedBy tells if the topmost certificate of the
+// chain was issued by the given CN
+func chainIssuedBy(der [][]byte, issuer string) bool {
+	if len(der) == 0 {
+		return false
+	}
+
+	top, err := x509.ParseCertificate(der[len(der)-1])
+	if err != nil {
+		return false
+	}
+	return top.Issuer.CommonName == issuer
+}
+
+func authzIDs(names []string) []acme.AuthzID {
+	ids := make([]acme.AuthzID, 0, len(names))
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ids = append(ids, acme.AuthzID{Type: "ip", Value: ip.String()})
+		} else {
+			ids = append(ids, acme.AuthzID{Type: "dns", Value: name})
+		}
+	}
+	return ids
+}
+
+func newCSR(key crypto.Signer, names []string) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names")
+	}
+
+	req := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: names[0]},
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			req.IPAddresses = append(req.IPAddresses, ip)
+		} else {
+			req.DNSNames = append(req.DNSNames, name)
+		}
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, req, key)
+}
@@ -3,14 +3,17 @@ module darvaza.org/darvaza/acme
 go 1.22
 
 require (
-	darvaza.org/core v0.16.0 // indirect
+	darvaza.org/core v0.16.1
 	darvaza.org/middleware v0.3.1
+	darvaza.org/slog v0.6.1
+	darvaza.org/slog/handlers/discard v0.5.1
 	darvaza.org/x/fs v0.4.0 // indirect
 	darvaza.org/x/web v0.10.0 // indirect
+	golang.org/x/crypto v0.33.0
 )
 
 require (
 	github.com/gobwas/glob v0.2.3 // indirect
-	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 )
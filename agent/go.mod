@@ -7,6 +7,7 @@ toolchain go1.22.10
 require (
 	darvaza.org/core v0.16.1
 	darvaza.org/darvaza/acme v0.3.0
+	darvaza.org/darvaza/shared v0.7.0
 	darvaza.org/middleware v0.3.1
 	darvaza.org/slog v0.6.1
 	darvaza.org/slog/handlers/discard v0.5.1
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"darvaza.org/darvaza/acme"
+	"darvaza.org/darvaza/shared/net/acl"
 	"darvaza.org/slog"
 	"darvaza.org/slog/handlers/discard"
 	"darvaza.org/x/tls/sni"
@@ -24,6 +25,9 @@ type Config struct {
 
 	// Bind defines the ports and addresses we listen
 	Bind BindingConfig
+	// ClientACL optionally restricts the client addresses
+	// accepted by the TCP listeners
+	ClientACL *acl.List
 
 	// ReadTimeout is the maximum duration for reading the entire
 	// request, including the body. A zero or negative value means
@@ -56,6 +60,11 @@ type Config struct {
 	// zero, there is no timeout.
 	IdleTimeout time.Duration
 
+	// ShutdownTimeout is the time given to the workers to
+	// finish gracefully once cancelled. If zero,
+	// httpgroup.DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+
 	// MaxHeaderBytes controls the maximum number of bytes the
 	// server will read parsing the request header's keys and
 	// values, including the request line. It does not limit the
@@ -0,0 +1,57 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+type helloContextKey struct{}
+
+// withClientHello stores the recording connection under the
+// request contexts, as the ClientHello is only read during
+// the handshake
+func withClientHello(ctx context.Context, conn net.Conn) context.Context {
+	if tc, ok := conn.(*tls.Conn); ok {
+		if hc, ok := tc.NetConn().(*hello.Conn); ok {
+			return context.WithValue(ctx, helloContextKey{}, hc)
+		}
+	}
+	return ctx
+}
+
+// ClientHello returns the ClientHello of the TLS connection
+// of a request, if known
+func ClientHello(ctx context.Context) (*hello.ClientHello, bool) {
+	if hc, ok := ctx.Value(helloContextKey{}).(*hello.Conn); ok {
+		return hc.ClientHello()
+	}
+	return nil, false
+}
+
+// Fingerprint returns the JA4 fingerprint of the TLS connection
+// of a request, if known
+func Fingerprint(ctx context.Context) (string, bool) {
+	if ch, ok := ClientHello(ctx); ok {
+		return ch.JA4(), true
+	}
+	return "", false
+}
+
+// FingerprintMiddleware logs the JA4 fingerprint of the
+// client of each request
+func (srv *Server) FingerprintMiddleware(next http.Handler) http.Handler {
+	h := func(rw http.ResponseWriter, req *http.Request) {
+		if fp, ok := Fingerprint(req.Context()); ok {
+			srv.debug().
+				WithField("remote", req.RemoteAddr).
+				WithField("ja4", fp).
+				Printf("%s %s%s", req.Method, req.Host, req.URL.Path)
+		}
+		next.ServeHTTP(rw, req)
+	}
+	return http.HandlerFunc(h)
+}
@@ -1,12 +1,13 @@
 package httpserver
 
 import (
-	"context"
 	"net"
 	"net/http"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
+
+	"darvaza.org/darvaza/shared/sync/httpgroup"
 )
 
 // NewHTTPServer creates a new http.Server
@@ -46,21 +47,17 @@ func (srv *Server) NewH2CHandler() http.Handler {
 	return h
 }
 
-func (srv *Server) spawnH2C(listeners []*net.TCPListener) {
+func (srv *Server) spawnH2C(listeners []*net.TCPListener) error {
 	h := srv.NewH2CHandler()
 
-	for _, lsn := range listeners {
-		w := srv.NewH2CServer(h)
-		addr := lsn.Addr()
-
-		srv.wg.Go(func() error {
-			srv.logListening("http", addr)
-			return w.Serve(lsn)
-		})
-		srv.wg.Go(func() error {
-			<-srv.ctx.Done()
-			srv.logClosing("http", addr)
-			return w.Shutdown(context.Background())
+	for _, tcpLsn := range listeners {
+		err := srv.spawn("http", tcpLsn.Addr(), &httpgroup.Worker{
+			Server:   srv.NewH2CServer(h),
+			Listener: srv.applyClientACL(tcpLsn),
 		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -12,6 +12,8 @@ import (
 	"darvaza.org/core"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+
+	"darvaza.org/darvaza/shared/sync/httpgroup"
 )
 
 const (
@@ -53,52 +55,24 @@ func (srv *Server) prepareQuicListeners(listeners []*net.UDPConn) ([]*quic.Early
 	return out, nil
 }
 
-// prepareAndSpawnH3 binds a quic.EarlyListener to an
-// HTTP/3 server and spawn the corresponding worker
-func (srv *Server) prepareAndSpawnH3(lsn *quic.EarlyListener) error {
-	h3s := &http3.Server{
-		Addr:    lsn.Addr().String(),
-		Handler: srv.mux,
-	}
-
-	addr := lsn.Addr()
-
-	srv.wg.GoCatch(func() error {
-		srv.logListening("quic", addr)
-		return h3s.ServeListener(lsn)
-	}, func(err error) error {
-		switch err {
-		case nil, quic.ErrServerClosed:
-			srv.debug().Printf("%s: done", addr)
-			err = nil
-		default:
-			srv.error(err).Printf("%s: failed", addr)
+func (srv *Server) spawnH3(listeners []*quic.EarlyListener) error {
+	for _, lsn := range listeners {
+		h3s := &http3.Server{
+			Addr:    lsn.Addr().String(),
+			Handler: srv.mux,
 		}
 
-		return err
-	})
-
-	srv.wg.Go(func() error {
-		<-srv.ctx.Done()
-		srv.logClosing("quic", addr)
-		// TODO: h3s.CloseGracefully isn't implemented yet
-		srv.warn(nil).Printf("%s: closing UDP listener abruptly", addr)
-		return h3s.Close()
-	})
-
-	srv.wg.Go(func() error {
-		return srv.grabQuicHeaders(srv.ctx, h3s)
-	})
-
-	return nil
-}
-
-func (srv *Server) spawnH3(listeners []*quic.EarlyListener) {
-	for _, lsn := range listeners {
-		srv.wg.Go(func() error {
-			return srv.prepareAndSpawnH3(lsn)
+		err := srv.spawn("quic", lsn.Addr(), &httpgroup.ListenerWorker[http3.QUICEarlyListener]{
+			Server:   h3s,
+			Listener: lsn,
 		})
+		if err != nil {
+			return err
+		}
+
+		go func() { _ = srv.grabQuicHeaders(srv.ctx, h3s) }()
 	}
+	return nil
 }
 
 // SetQuicHeaders appends Quic's Alt-Svc to the headers
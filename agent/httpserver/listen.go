@@ -9,6 +9,8 @@ import (
 
 	"darvaza.org/core"
 	"darvaza.org/x/net/bind"
+
+	"darvaza.org/darvaza/shared/net/acl"
 )
 
 // ServerListeners is the list of all listeners on a Server
@@ -316,3 +318,19 @@ func getAllStringAddrPort(port uint16) ([]string, bool) {
 
 	return nil, false
 }
+
+// applyClientACL wraps a listener to reject clients
+// not allowed by the ClientACL, if any
+func (srv *Server) applyClientACL(lsn net.Listener) net.Listener {
+	if srv.cfg.ClientACL == nil {
+		return lsn
+	}
+
+	return &acl.Listener{
+		Listener: lsn,
+		List:     srv.cfg.ClientACL,
+		OnReject: func(conn net.Conn) {
+			srv.debug().Printf("%s: client denied", conn.RemoteAddr())
+		},
+	}
+}
@@ -6,22 +6,6 @@ import (
 	"darvaza.org/slog"
 )
 
-func (srv *Server) error(err error) slog.Logger {
-	log := srv.cfg.Logger.Error()
-	if err != nil {
-		log = log.WithField(slog.ErrorFieldName, err)
-	}
-	return log
-}
-
-func (srv *Server) warn(err error) slog.Logger {
-	log := srv.cfg.Logger.Warn()
-	if err != nil {
-		log = log.WithField(slog.ErrorFieldName, err)
-	}
-	return log
-}
-
 func (srv *Server) withInfo() (slog.Logger, bool) {
 	return srv.cfg.Logger.Info().WithEnabled()
 }
@@ -18,7 +18,7 @@ func (srv *Server) Handle(pattern string, handler http.Handler) {
 // HandleFunc registers the handler function for the given pattern.
 // If a handler already exists for pattern, Handle panics.
 func (srv *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	srv.mux.Handle(pattern, http.HandlerFunc(handler))
+	srv.Handle(pattern, http.HandlerFunc(handler))
 }
 
 // NewHTTPSRedirectHandler creates a new handler that redirects everything to
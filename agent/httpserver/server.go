@@ -3,18 +3,21 @@ package httpserver
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"sync/atomic"
 
-	"darvaza.org/core"
 	"darvaza.org/slog"
+
+	"darvaza.org/darvaza/shared/sync/httpgroup"
 )
 
 // Server is an instance of our H1/H2C/H2/H3 server
 type Server struct {
 	mu        sync.Mutex
-	wg        core.WaitGroup
+	hg        httpgroup.Group
 	ctx       context.Context
 	cancel    context.CancelFunc
 	cancelled atomic.Bool
@@ -45,6 +48,9 @@ func (cfg *Config) New() (*Server, error) {
 		cfg:    *cfg,
 	}
 
+	srv.hg.SetContext(ctx1)
+	srv.hg.SetLogger(cfg.Logger)
+	srv.hg.SetShutdownTimeout(cfg.ShutdownTimeout)
 	return srv, nil
 }
 
@@ -122,7 +128,7 @@ func (srv *Server) doCancel(err error) {
 
 // Wait waits until all workers are done
 func (srv *Server) Wait() error {
-	_ = srv.wg.Wait()
+	_ = srv.hg.Wait()
 	return srv.Err()
 }
 
@@ -140,47 +146,77 @@ func (srv *Server) ListenAndServe(h http.Handler) error {
 // you can provide one here. if you do it in both places the underlying
 // http.ServeMux will panic
 func (srv *Server) Serve(h http.Handler) error {
-	var ok bool
-
-	defer func() {
-		if !ok {
-			_ = srv.sl.Close()
-		}
-	}()
-
 	if h != nil {
 		// this will panic if the user has already set one.
 		// pass `nil` in that case
 		srv.Handle("/", h)
+	} else {
+		srv.mightInitMux()
+	}
+
+	if err := srv.spawnAll(); err != nil {
+		// shut down the workers already spawned
+		_ = srv.sl.Close()
+		srv.Fail(err)
+		_ = srv.hg.Wait()
+		return err
+	}
+
+	return srv.hg.Wait()
+}
+
+func (srv *Server) spawnAll() error {
+	tlsListeners, err := srv.prepareSecureListeners(srv.sl.Secure)
+	if err != nil {
+		return err
 	}
 
-	tlsListeners := srv.prepareSecureListeners(srv.sl.Secure)
 	quicListeners, err := srv.prepareQuicListeners(srv.sl.Quic)
 	if err != nil {
 		return err
 	}
 
-	srv.wg.OnError(srv.onWorkerError)
-
-	// from here onward we don't need to worry about the listeners
-	ok = true
-	srv.spawnH2(tlsListeners)
-	srv.spawnH2C(srv.sl.Insecure)
-	srv.spawnH3(quicListeners)
-	return srv.wg.Wait()
-}
-
-func (srv *Server) onWorkerError(err error) error {
-	switch err {
-	case http.ErrServerClosed:
-		srv.debug().Println("httpserver:", err.Error())
-		return nil
-	case nil:
-		srv.debug().Println("httpserver:", "I hear crickets")
-		return nil
-	default:
-		srv.error(err).Println("httpserver:", "worker failed", err.Error())
-		srv.Fail(err)
+	if err := srv.spawnH2(tlsListeners); err != nil {
 		return err
 	}
+	if err := srv.spawnH2C(srv.sl.Insecure); err != nil {
+		return err
+	}
+	return srv.spawnH3(quicListeners)
+}
+
+// spawn runs a worker of the Server on the httpgroup.Group
+func (srv *Server) spawn(scheme string, addr net.Addr, r httpgroup.Runner) error {
+	name := fmt.Sprintf("%s://%s", scheme, addr)
+	return srv.hg.Spawn(name, &worker{
+		Runner: r,
+		srv:    srv,
+		scheme: scheme,
+		addr:   addr,
+	})
+}
+
+// worker is a httpgroup.Runner logging its addresses and
+// failing the Server if it fails
+type worker struct {
+	httpgroup.Runner
+
+	srv    *Server
+	scheme string
+	addr   net.Addr
+}
+
+func (w *worker) Run() error {
+	w.srv.logListening(w.scheme, w.addr)
+
+	err := w.Runner.Run()
+	if err != nil {
+		w.srv.Fail(err)
+	}
+	return err
+}
+
+func (w *worker) Shutdown(ctx context.Context) error {
+	w.srv.logClosing(w.scheme, w.addr)
+	return w.Runner.Shutdown(ctx)
 }
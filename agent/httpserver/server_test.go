@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"darvaza.org/x/tls/sni"
+	"golang.org/x/net/http2"
+)
+
+const testShutdownTimeout = 200 * time.Millisecond
+
+// newTestCertificate creates a self-signed certificate
+// for localhost and the name the SNI dispatcher handles
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost", "raw.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// newTestListeners listens on localhost, secure and quic
+// on the same port
+func newTestListeners(t *testing.T) *ServerListeners {
+	for i := 0; i < 10; i++ {
+		tcpLsn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, _ := tcpLsn.Addr().(*net.TCPAddr)
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+		if err != nil {
+			// port taken for UDP, try again
+			_ = tcpLsn.Close()
+			continue
+		}
+
+		insecure, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sl := &ServerListeners{
+			Secure:   []*net.TCPListener{tcpLsn},
+			Quic:     []*net.UDPConn{udpConn},
+			Insecure: []*net.TCPListener{insecure},
+		}
+		t.Cleanup(func() { _ = sl.Close() })
+		return sl
+	}
+
+	t.Fatal("no port available for TCP and UDP")
+	return nil
+}
+
+// testServer is a running Server whose /slow requests
+// wait until the test finishes
+type testServer struct {
+	*Server
+
+	done     chan error
+	slow     chan struct{}
+	secure   string
+	insecure string
+	roots    *x509.CertPool
+}
+
+func newTestServer(t *testing.T) *testServer {
+	cert, roots := newTestCertificate(t)
+	release := make(chan struct{})
+	ts := &testServer{
+		done:  make(chan error, 1),
+		slow:  make(chan struct{}, 1),
+		roots: roots,
+	}
+	t.Cleanup(func() { close(release) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, req.Proto)
+	})
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		ts.slow <- struct{}{}
+		<-release
+	})
+
+	cfg := &Config{
+		TLSConfig:       &tls.Config{Certificates: []tls.Certificate{cert}},
+		ShutdownTimeout: testShutdownTimeout,
+		Handler:         mux,
+		HandleInsecure:  true,
+		GetHandlerForClient: func(chi *tls.ClientHelloInfo) sni.Handler {
+			if chi.ServerName != "raw.test" {
+				return nil
+			}
+			return func(_ context.Context, conn net.Conn) error {
+				defer conn.Close()
+
+				tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				_, err := io.WriteString(tc, "raw\n")
+				return err
+			}
+		},
+	}
+
+	srv, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := newTestListeners(t)
+	if err := srv.WithListeners(sl); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Server = srv
+	ts.secure = sl.Secure[0].Addr().String()
+	ts.insecure = sl.Insecure[0].Addr().String()
+
+	go func() { ts.done <- srv.Serve(nil) }()
+	t.Cleanup(srv.Cancel)
+	return ts
+}
+
+// get requests a path and returns the body
+func get(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServe(t *testing.T) {
+	ts := newTestServer(t)
+
+	tlsConf := &tls.Config{RootCAs: ts.roots, ServerName: "localhost"}
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer h2c.CloseIdleConnections()
+	h2 := &http.Transport{TLSClientConfig: tlsConf, ForceAttemptHTTP2: true}
+	defer h2.CloseIdleConnections()
+
+	for _, tc := range []struct {
+		name     string
+		client   *http.Client
+		url      string
+		expected string
+	}{
+		{"h1", &http.Client{}, "http://" + ts.insecure + "/", "HTTP/1.1"},
+		{"h2c", &http.Client{Transport: h2c}, "http://" + ts.insecure + "/", "HTTP/2.0"},
+		{"h2", &http.Client{Transport: h2}, "https://" + ts.secure + "/", "HTTP/2.0"},
+	} {
+		if got := get(t, tc.client, tc.url); got != tc.expected {
+			t.Errorf("%s: %q (expected %q)", tc.name, got, tc.expected)
+		}
+	}
+
+	// dispatched by name
+	conn, err := tls.Dial("tcp", ts.secure, &tls.Config{RootCAs: ts.roots, ServerName: "raw.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if s, err := bufio.NewReader(conn).ReadString('\n'); err != nil || s != "raw\n" {
+		t.Errorf("sni: %q, %v (expected %q)", s, err, "raw\n")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, err := http.Get("http://" + ts.insecure + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-ts.slow
+
+	start := time.Now()
+	ts.Cancel()
+
+	select {
+	case <-ts.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+
+	if d := time.Since(start); d < testShutdownTimeout {
+		t.Errorf("Serve returned after %s, before the shutdown timeout", d)
+	}
+}
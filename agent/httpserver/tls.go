@@ -4,9 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"sync"
 	"time"
 
 	"darvaza.org/x/tls/sni"
+
+	"darvaza.org/darvaza/shared/sync/httpgroup"
+	"darvaza.org/darvaza/shared/tls/hello"
 )
 
 // NewTLSConfig returns the tls.Config to be used on the Server
@@ -33,7 +37,7 @@ func (srv *Server) NewTLSConfig() *tls.Config {
 	return conf
 }
 
-func (srv *Server) prepareSecureListeners(listeners []*net.TCPListener) []net.Listener {
+func (srv *Server) prepareSecureListeners(listeners []*net.TCPListener) ([]net.Listener, error) {
 	var out []net.Listener
 
 	if l := len(listeners); l > 0 {
@@ -45,8 +49,15 @@ func (srv *Server) prepareSecureListeners(listeners []*net.TCPListener) []net.Li
 		for _, tcpLsn := range listeners {
 			var lsn net.Listener
 
+			// client ACL
+			lsn = srv.applyClientACL(tcpLsn)
 			// sni.Dispatcher
-			lsn = srv.applySNIDispatcher(tcpLsn, rtio)
+			lsn, err := srv.applySNIDispatcher(lsn, rtio)
+			if err != nil {
+				return out, err
+			}
+			// record ClientHellos for fingerprinting
+			lsn = hello.NewListener(lsn)
 			// tls.Listener
 			lsn = tls.NewListener(lsn, tlsServerConfig)
 
@@ -54,43 +65,123 @@ func (srv *Server) prepareSecureListeners(listeners []*net.TCPListener) []net.Li
 		}
 	}
 
-	return out
+	return out, nil
 }
 
-func (srv *Server) applySNIDispatcher(lsn net.Listener, rtio time.Duration) net.Listener {
+func (srv *Server) applySNIDispatcher(lsn net.Listener, rtio time.Duration) (net.Listener, error) {
 	if cb := srv.cfg.GetHandlerForClient; cb != nil {
-		d := &sni.Dispatcher{
-			Logger:  srv.log,
-			Context: srv.ctx,
-
-			GetHandler: cb,
-			OnError: func(err error) bool {
-				srv.Fail(err)
-				return true
-			},
-			OnAccept: func(conn net.Conn) (net.Conn, error) {
-				_ = conn.SetReadDeadline(getTimeout(rtio))
-				return conn, nil
-			},
-		}
+		sl := srv.newSNIListener(lsn, cb, rtio)
+		err := srv.spawn("tls", lsn.Addr(), &httpgroup.Worker{
+			Server:   sl,
+			Listener: lsn,
+		})
+		return sl, err
+	}
+	return lsn, nil
+}
+
+// sniListener dispatches the connections of a listener using
+// a sni.Dispatcher, and passes those without a dedicated handler
+// to Accept. Unlike the sni.Dispatcher, Accept returns once closed
+type sniListener struct {
+	d   sni.Dispatcher
+	lsn net.Listener
+
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (srv *Server) newSNIListener(lsn net.Listener, cb func(*tls.ClientHelloInfo) sni.Handler,
+	rtio time.Duration) *sniListener {
+	//
+	sl := &sniListener{
+		lsn:    lsn,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	sl.d = sni.Dispatcher{
+		Logger:  srv.log,
+		Context: srv.ctx,
+
+		GetHandler: func(chi *tls.ClientHelloInfo) sni.Handler {
+			if h := cb(chi); h != nil {
+				return h
+			}
+			return sl.pass
+		},
+		OnError: func(err error) bool {
+			srv.Fail(err)
+			return true
+		},
+		OnAccept: func(conn net.Conn) (net.Conn, error) {
+			_ = conn.SetReadDeadline(getTimeout(rtio))
+			return conn, nil
+		},
+	}
+	return sl
+}
 
-		srv.spawnDispatcher(d, lsn)
-		return d
+// pass hands a connection over to Accept
+func (sl *sniListener) pass(_ context.Context, conn net.Conn) error {
+	select {
+	case sl.conns <- conn:
+	case <-sl.closed:
+		_ = conn.Close()
 	}
-	return lsn
+	return nil
 }
 
-func (srv *Server) spawnDispatcher(d *sni.Dispatcher, lsn net.Listener) {
-	addr := lsn.Addr()
+// Serve dispatches the connections of the listener
+func (sl *sniListener) Serve(lsn net.Listener) error {
+	return sl.d.Serve(lsn)
+}
 
-	srv.wg.Go(func() error {
-		srv.logListening("tls", addr)
-		return d.Serve(lsn)
-	})
+// Shutdown closes the listener and waits for the
+// dedicated handlers to finish
+func (sl *sniListener) Shutdown(ctx context.Context) error {
+	_ = sl.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = sl.d.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	srv.wg.Go(func() error {
-		<-srv.ctx.Done()
-		srv.logClosing("tls", addr)
-		return d.Shutdown(context.Background())
+// Accept returns the next connection without a dedicated handler
+func (sl *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case <-sl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops dispatching and closes the listener
+func (sl *sniListener) Close() error {
+	sl.once.Do(func() {
+		close(sl.closed)
+		// the Dispatcher can only be cancelled once serving.
+		// Addr syncs with its start
+		if sl.d.Addr() != nil {
+			sl.d.Cancel()
+		}
+		_ = sl.lsn.Close()
 	})
+	return nil
+}
+
+// Addr returns the address of the listener
+func (sl *sniListener) Addr() net.Addr {
+	return sl.lsn.Addr()
 }
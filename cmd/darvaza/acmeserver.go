@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/agent/httpserver"
+	"darvaza.org/darvaza/server/acmeserver"
+	"darvaza.org/darvaza/shared/cblog"
+	"darvaza.org/darvaza/shared/storage/simple"
+	tlsserver "darvaza.org/darvaza/shared/tls/server"
+)
+
+// ACMEServerConfig describes the ACME directory served
+// by the acme-server command
+type ACMEServerConfig struct {
+	// Listen is the address and port of the HTTPS listener
+	Listen string `hcl:"listen"`
+	// BaseURL is the external URL of the directory. By
+	// default it's served at /acme of the listener
+	BaseURL string `hcl:"base_url,optional"`
+	// Certificate and Key are the files of the certificate
+	// of the listener
+	Certificate string `hcl:"certificate"`
+	Key         string `hcl:"key"`
+
+	// CA are PEM contents, files or directories with the
+	// certificate and key of the issuing CA
+	CA []string `hcl:"ca"`
+	// CAName selects the CA by CommonName when there
+	// is more than one
+	CAName string `hcl:"ca_name,optional"`
+	// Validity of the issued certificates, like "2160h"
+	Validity string `hcl:"validity,optional"`
+	// OrderLifetime is how long orders remain usable
+	OrderLifetime string `hcl:"order_lifetime,optional"`
+	// MaxPendingOrders limits the unfinished orders of each account
+	MaxPendingOrders int `hcl:"max_pending_orders,optional"`
+
+	// RequireExternalAccount rejects accounts not bound
+	// to one of the external accounts
+	RequireExternalAccount bool `hcl:"require_external_account,optional"`
+	// Policy applies to accounts without binding
+	Policy *ACMEPolicyConfig `hcl:"policy,block"`
+	// ExternalAccounts are the accounts known by key ID
+	ExternalAccounts []ACMEExternalAccountConfig `hcl:"external_account,block"`
+}
+
+// ACMEPolicyConfig restricts the names that can be requested
+type ACMEPolicyConfig struct {
+	PermittedDomains []string `hcl:"permitted_domains,optional"`
+	ExcludedDomains  []string `hcl:"excluded_domains,optional"`
+	// PermittedIPs are CIDRs, empty means none
+	PermittedIPs  []string `hcl:"permitted_ips,optional"`
+	AllowWildcard bool     `hcl:"allow_wildcard,optional"`
+}
+
+// ACMEExternalAccountConfig is an External Account Binding key
+type ACMEExternalAccountConfig struct {
+	KID string `hcl:"kid,label"`
+	// HMACKey is the base64url encoded shared secret
+	HMACKey string            `hcl:"hmac_key"`
+	Policy  *ACMEPolicyConfig `hcl:"policy,block"`
+}
+
+func (c *ACMEPolicyConfig) export() (*acmeserver.Policy, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	p := &acmeserver.Policy{
+		PermittedDNSDomains: c.PermittedDomains,
+		ExcludedDNSDomains:  c.ExcludedDomains,
+		AllowWildcard:       c.AllowWildcard,
+	}
+
+	for _, s := range c.PermittedIPs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, core.Wrap(err, "permitted_ips")
+		}
+		p.PermittedIPRanges = append(p.PermittedIPRanges, prefix)
+	}
+	return p, nil
+}
+
+// baseURL returns the BaseURL, or one derived from the listener
+func (c *ACMEServerConfig) baseURL() string {
+	if c.BaseURL != "" {
+		return c.BaseURL
+	}
+
+	host := c.Listen
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	return "https://" + host + "/acme"
+}
+
+// export converts the ACMEServerConfig into an acmeserver.Config
+func (c *ACMEServerConfig) export() (*acmeserver.Config, error) {
+	store, err := simple.New(c.CA...)
+	if err != nil {
+		return nil, core.Wrap(err, "ca")
+	}
+
+	conf := &acmeserver.Config{
+		BaseURL:                c.baseURL(),
+		Store:                  store,
+		CAName:                 c.CAName,
+		MaxPendingOrders:       c.MaxPendingOrders,
+		RequireExternalAccount: c.RequireExternalAccount,
+	}
+
+	if err := tlsserver.ParseDuration(c.Validity, &conf.Validity); err != nil {
+		return nil, core.Wrap(err, "validity")
+	}
+	if err := tlsserver.ParseDuration(c.OrderLifetime, &conf.OrderLifetime); err != nil {
+		return nil, core.Wrap(err, "order_lifetime")
+	}
+
+	if conf.DefaultPolicy, err = c.Policy.export(); err != nil {
+		return nil, core.Wrap(err, "policy")
+	}
+
+	if len(c.ExternalAccounts) > 0 {
+		conf.ExternalAccounts = make(map[string]*acmeserver.ExternalAccount)
+	}
+
+	for _, ea := range c.ExternalAccounts {
+		if err := c.addExternalAccount(conf, ea); err != nil {
+			return nil, fmt.Errorf("external_account %q: %w", ea.KID, err)
+		}
+	}
+	return conf, nil
+}
+
+func (*ACMEServerConfig) addExternalAccount(conf *acmeserver.Config, ea ACMEExternalAccountConfig) error {
+	if _, ok := conf.ExternalAccounts[ea.KID]; ok {
+		return errors.New("duplicated")
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(ea.HMACKey, "="))
+	if err != nil {
+		return core.Wrap(err, "hmac_key")
+	}
+
+	policy, err := ea.Policy.export()
+	if err != nil {
+		return core.Wrap(err, "policy")
+	}
+
+	conf.ExternalAccounts[ea.KID] = &acmeserver.ExternalAccount{
+		HMACKey: key,
+		Policy:  policy,
+	}
+	return nil
+}
+
+// tlsConfig creates the tls.Config of the listener
+func (c *ACMEServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.Certificate == "" || c.Key == "" {
+		return nil, errors.New("certificate and key required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// httpConfig creates the httpserver.Config of the listener
+func (c *ACMEServerConfig) httpConfig() (*httpserver.Config, error) {
+	tc, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return nil, core.Wrap(err, "listen")
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, core.Wrap(err, "listen")
+	}
+
+	hc := &httpserver.Config{
+		Bind: httpserver.BindingConfig{
+			Port:       uint16(n),
+			PortStrict: true,
+		},
+		TLSConfig:         tc,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if host != "" {
+		hc.Bind.Addresses = []string{host}
+	}
+	return hc, nil
+}
+
+// Command
+var acmeServerCmd = &cobra.Command{
+	Use:   "acme-server",
+	Short: "issues certificates from a local CA over ACME",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		c := cfg.ACMEServer
+		if c == nil {
+			return errors.New("acme_server not configured")
+		}
+
+		conf, err := c.export()
+		if err != nil {
+			return err
+		}
+
+		hc, err := c.httpConfig()
+		if err != nil {
+			return err
+		}
+
+		logger := cblog.New()
+		logger.SetLogger("console", nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		conf.Context = ctx
+		conf.Logger = logger
+		hc.Context = ctx
+		hc.Logger = logger
+
+		acme, err := conf.New()
+		if err != nil {
+			return err
+		}
+
+		srv, err := hc.New()
+		if err != nil {
+			return err
+		}
+
+		acme.Mount(srv)
+
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.Serve(nil)
+		}()
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sig)
+
+		select {
+		case <-sig:
+			log.Println("Terminating")
+			srv.Cancel()
+			return <-done
+		case err := <-done:
+			return err
+		}
+	},
+}
+
+// Flags
+func init() {
+	rootCmd.AddCommand(acmeServerCmd)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+
+	"darvaza.org/darvaza/shared/cblog"
+	"darvaza.org/darvaza/shared/net/tunnel"
+)
+
+// AgentConfig describes a tunnel agent exposing local
+// services through an edge
+type AgentConfig struct {
+	// Edge is the host:port of the tunnel listener
+	Edge string `hcl:"edge,label"`
+	// ServerName is verified on the certificate of the
+	// edge. Defaults to the host of Edge
+	ServerName string `hcl:"server_name,optional"`
+	// Certificate and Key are the files of the client
+	// certificate presented to the edge
+	Certificate string `hcl:"certificate"`
+	Key         string `hcl:"key"`
+	// CA are PEM contents, files or directories with the CAs
+	// verifying the edge. Defaults to the system's
+	CA []string `hcl:"ca,optional"`
+	// Targets maps the hostnames to register to the local
+	// host:port their connections are forwarded to
+	Targets map[string]string `hcl:"targets"`
+}
+
+// New creates a tunnel.Agent from the AgentConfig
+func (ac *AgentConfig) New(logger slog.Logger) (*tunnel.Agent, error) {
+	conf, err := clientTLSConfig(ac.CA, ac.Certificate, ac.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.ServerName = ac.ServerName
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(ac.Edge)
+	}
+
+	return (&tunnel.AgentConfig{
+		Edge:      ac.Edge,
+		TLSConfig: conf,
+		Targets:   ac.Targets,
+		Logger:    logger,
+	}).New()
+}
+
+// Command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "exposes local services through tunnels to edges",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		if len(cfg.Agents) == 0 {
+			return errors.New("no agents configured")
+		}
+
+		logger := cblog.New()
+		logger.SetLogger("console", nil)
+
+		agents := make([]*tunnel.Agent, 0, len(cfg.Agents))
+		for i := range cfg.Agents {
+			a, err := cfg.Agents[i].New(logger)
+			if err != nil {
+				return core.Wrapf(err, "agent %q", cfg.Agents[i].Edge)
+			}
+			agents = append(agents, a)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, a := range agents {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = a.Run(ctx)
+			}()
+		}
+
+		<-ctx.Done()
+		log.Println("Terminating")
+		wg.Wait()
+		return nil
+	},
+}
+
+// Flags
+func init() {
+	rootCmd.AddCommand(agentCmd)
+}
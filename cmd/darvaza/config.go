@@ -17,6 +17,19 @@ import (
 // the ProxyConfigs.
 type Config struct {
 	Proxies []server.ProxyConfig `hcl:"proxy,block"`
+	// Agents are run by the agent command
+	Agents []AgentConfig `hcl:"agent,block"`
+	// Control is the control plane serve gets the
+	// configuration of its proxies from, if any. While
+	// set, SIGHUP doesn't reload the proxies from the file
+	Control *ControlConfig `hcl:"control,block"`
+	// ControlPlane is served by the control-plane command
+	ControlPlane *ControlPlaneConfig `hcl:"control_plane,block"`
+	// Admin is the administrative API of serve, queried
+	// by the status command
+	Admin *AdminConfig `hcl:"admin,block"`
+	// ACMEServer is served by the acme-server command
+	ACMEServer *ACMEServerConfig `hcl:"acme_server,block"`
 }
 
 // SetDefaults is calling Set to set the default values
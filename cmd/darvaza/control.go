@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+
+	"darvaza.org/darvaza/shared/control"
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+// ControlConfig describes the control plane the proxies
+// of serve get their configuration from
+type ControlConfig struct {
+	// URL is the base URL of the control plane
+	URL string `hcl:"url"`
+	// Token is the bearer token of this agent, if any
+	Token string `hcl:"token,optional"`
+	// CA are PEM contents, files or directories with the CAs
+	// verifying the control plane. Defaults to the system's
+	CA []string `hcl:"ca,optional"`
+	// Certificate and Key are the files of the client
+	// certificate presented to the control plane, if any
+	Certificate string `hcl:"certificate,optional"`
+	Key         string `hcl:"key,optional"`
+}
+
+// New creates a control.Client applying the snapshots
+// with the given function
+func (cc *ControlConfig) New(apply control.ApplyFunc, logger slog.Logger) (*control.Client, error) {
+	conf, err := clientTLSConfig(cc.CA, cc.Certificate, cc.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&control.ClientConfig{
+		URL:       cc.URL,
+		Token:     cc.Token,
+		TLSConfig: conf,
+		Apply:     apply,
+		Logger:    logger,
+	}).New()
+}
+
+// clientTLSConfig creates a tls.Config for a client
+// with optional CAs and certificate
+func clientTLSConfig(ca []string, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(ca) > 0 {
+		roots, err := loadCAs(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = roots.Export()
+	}
+	return conf, nil
+}
+
+// loadCAs reads PEM contents, files or directories
+func loadCAs(ca []string) (*certpool.CertPool, error) {
+	var pb certpool.PoolBuffer
+	if err := pb.Add(ca...); err != nil {
+		return nil, core.Wrap(err, "ca")
+	}
+	return pb.Pool(), nil
+}
+
+// readFiles reads the files of a map of names
+func readFiles(files map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(files))
+	for name, filename := range files {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, core.Wrapf(err, "certificate %q", name)
+		}
+		out[name] = string(b)
+	}
+	return out, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+
+	"darvaza.org/darvaza/server/controlplane"
+	"darvaza.org/darvaza/shared/cblog"
+	tlsserver "darvaza.org/darvaza/shared/tls/server"
+)
+
+// ControlPlaneConfig describes the control plane served
+// by the control-plane command
+type ControlPlaneConfig struct {
+	Listen string `hcl:"listen"`
+	// Certificate and Key are the files of the certificate
+	// of the listener. Without them it serves plaintext HTTP
+	Certificate string `hcl:"certificate,optional"`
+	Key         string `hcl:"key,optional"`
+	// ClientCA are PEM contents, files or directories with
+	// the CAs verifying agents authenticating by certificate
+	// instead of by token. Their CommonName is their name
+	ClientCA []string `hcl:"client_ca,optional"`
+
+	// Certificates maps names to PEM files with a
+	// certificate and its key, to assign to agents
+	Certificates map[string]string `hcl:"certificates,optional"`
+	// Agents are the configurations of the agents
+	Agents []ControlAgentConfig `hcl:"agent,block"`
+}
+
+// ControlAgentConfig is the configuration of an agent
+// held by the control plane
+type ControlAgentConfig struct {
+	Name string `hcl:"name,label"`
+	// Token authenticates the agent, if any
+	Token string `hcl:"token,optional"`
+	// Certificates are the names of the certificates
+	// given to all the proxies of the agent
+	Certificates []string `hcl:"certificates,optional"`
+
+	Proxies []tlsserver.ProxyConfig `hcl:"proxy,block"`
+}
+
+// validate checks the agents and their certificates
+func (c *ControlPlaneConfig) validate() error {
+	seen := make(map[string]bool)
+	tokens := make(map[string]bool)
+
+	for _, ac := range c.Agents {
+		switch {
+		case seen[ac.Name]:
+			return fmt.Errorf("agent %q: duplicated", ac.Name)
+		case ac.Token != "" && tokens[ac.Token]:
+			return fmt.Errorf("agent %q: duplicated token", ac.Name)
+		}
+		seen[ac.Name], tokens[ac.Token] = true, true
+
+		for _, name := range ac.Certificates {
+			if _, ok := c.Certificates[name]; !ok {
+				return fmt.Errorf("agent %q: unknown certificate %q", ac.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// tlsConfig creates the tls.Config of the listener, if any
+func (c *ControlPlaneConfig) tlsConfig() (*tls.Config, error) {
+	if c.Certificate == "" && c.Key == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(c.ClientCA) > 0 {
+		roots, err := loadCAs(c.ClientCA)
+		if err != nil {
+			return nil, core.Wrap(err, "client_ca")
+		}
+		conf.ClientCAs = roots.Export()
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// controlPlane is a running control plane
+type controlPlane struct {
+	plane    *controlplane.Server
+	tokens   atomic.Pointer[map[string]string]
+	assigned []string
+}
+
+func newControlPlane(ctx context.Context, c *ControlPlaneConfig, logger slog.Logger) (*controlPlane, error) {
+	cp := &controlPlane{}
+
+	auth := []controlplane.AuthenticateFunc{cp.byToken}
+	if len(c.ClientCA) > 0 {
+		auth = append(auth, controlplane.ByCertificate)
+	}
+
+	plane, err := (&controlplane.Config{
+		Context:      ctx,
+		Logger:       logger,
+		Authenticate: controlplane.Any(auth...),
+	}).New()
+	if err != nil {
+		return nil, err
+	}
+	cp.plane = plane
+
+	if err := cp.apply(c); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *controlPlane) byToken(req *http.Request) (string, error) {
+	return controlplane.ByToken(*cp.tokens.Load())(req)
+}
+
+// apply replaces the certificates and agents of the
+// control plane, pushing new snapshots to all agents
+func (cp *controlPlane) apply(c *ControlPlaneConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	certs, err := readFiles(c.Certificates)
+	if err != nil {
+		return err
+	}
+
+	for name, content := range certs {
+		if err := cp.plane.SetCertificate(name, content); err != nil {
+			return err
+		}
+	}
+
+	tokens := make(map[string]string)
+	names := make([]string, 0, len(c.Agents))
+	for _, ac := range c.Agents {
+		_, err := cp.plane.Assign(ac.Name, controlplane.Assignment{
+			Proxies:      ac.Proxies,
+			Certificates: ac.Certificates,
+		})
+		if err != nil {
+			return err
+		}
+
+		if ac.Token != "" {
+			tokens[ac.Token] = ac.Name
+		}
+		names = append(names, ac.Name)
+	}
+
+	for _, name := range core.SliceMinus(cp.assigned, names) {
+		cp.plane.Unassign(name)
+	}
+	cp.assigned = names
+	cp.tokens.Store(&tokens)
+	return nil
+}
+
+// Command
+var controlPlaneCmd = &cobra.Command{
+	Use:   "control-plane",
+	Short: "serves the configuration of agents",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		c := cfg.ControlPlane
+		if c == nil {
+			return errors.New("control_plane not configured")
+		}
+
+		conf, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		logger := cblog.New()
+		logger.SetLogger("console", nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		cp, err := newControlPlane(ctx, c, logger)
+		if err != nil {
+			return err
+		}
+
+		srv := &http.Server{
+			Addr:              c.Listen,
+			Handler:           cp.plane,
+			TLSConfig:         conf,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- listenAndServe(srv) }()
+
+		return cp.serve(done, func() error {
+			cancel()
+			ctx, cancel := context.WithTimeout(context.Background(), tlsserver.DefaultDrainTimeout)
+			defer cancel()
+			return srv.Shutdown(ctx)
+		})
+	},
+}
+
+func listenAndServe(srv *http.Server) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+// serve handles the signals until the server stops, reloading
+// the agents on SIGHUP and calling shutdown on SIGINT and SIGTERM
+func (cp *controlPlane) serve(done <-chan error, shutdown func() error) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case signum := <-sig:
+			if signum != syscall.SIGHUP {
+				log.Println("Terminating")
+				return shutdown()
+			}
+
+			log.Println("Reloading")
+			if err := cp.reload(); err != nil {
+				log.Println("reload failed:", err)
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// reload re-reads the config file and applies its agents
+func (cp *controlPlane) reload() error {
+	c := NewConfig()
+	if err := c.ReadInFile(cfgFile); err != nil {
+		return err
+	} else if c.ControlPlane == nil {
+		return errors.New("control_plane not configured")
+	}
+	return cp.apply(c.ControlPlane)
+}
+
+// Flags
+func init() {
+	rootCmd.AddCommand(controlPlaneCmd)
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 
 	"github.com/spf13/cobra"
 
+	"darvaza.org/core"
+
 	darvaza "darvaza.org/darvaza/server"
+	"darvaza.org/darvaza/shared"
+	"darvaza.org/darvaza/shared/cblog"
+	"darvaza.org/darvaza/shared/control"
+	tlsserver "darvaza.org/darvaza/shared/tls/server"
 )
 
 // Command
@@ -17,16 +27,38 @@ var serveCmd = &cobra.Command{
 	Short: "starts serving a proxy",
 	RunE: func(_ *cobra.Command, _ []string) error {
 		server := darvaza.NewServer()
+		rp := &runningProxies{server: server}
 		for i := range cfg.Proxies {
-			if z := cfg.Proxies[i].New(); z != nil {
-				server.Append(z)
+			z, err := cfg.Proxies[i].New()
+			if err != nil {
+				return err
+			}
+			if err := server.Append(z, shared.WithName(proxyName(i))); err != nil {
+				return err
 			}
+			rp.proxies = append(rp.proxies, z)
 		}
 
 		go func() {
 			_ = server.Run()
 		}()
 
+		if cfg.Admin != nil {
+			stop, err := serveAdmin(cfg.Admin, server)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+
+		if cfg.Control != nil {
+			stop, err := followControl(cfg.Control, rp.apply)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 		defer close(sig)
@@ -36,11 +68,15 @@ var serveCmd = &cobra.Command{
 			case signum := <-sig:
 				switch signum {
 				case syscall.SIGHUP:
+					if cfg.Control != nil {
+						// the snapshots would be overwritten
+						log.Println("Not reloading, proxies follow the control plane")
+						break
+					}
+
 					log.Println("Reloading")
-					err := server.Reload()
-					if err != nil {
-						log.Println(err)
-						return err
+					if err := rp.reload(); err != nil {
+						log.Println("reload failed:", err)
 					}
 				case syscall.SIGINT, syscall.SIGTERM:
 					log.Println("Terminating")
@@ -57,6 +93,107 @@ var serveCmd = &cobra.Command{
 	},
 }
 
+// proxyName is the name of a proxy in the WorkGroup
+func proxyName(i int) string {
+	return fmt.Sprintf("proxy-%v", i)
+}
+
+// runningProxies are the proxies of serve, replaced on
+// reload and configured by the control plane
+type runningProxies struct {
+	mu      sync.Mutex
+	server  *shared.WorkGroup
+	proxies []*tlsserver.Proxy
+}
+
+// apply applies a snapshot of the control plane
+func (rp *runningProxies) apply(ctx context.Context, snap *control.Snapshot) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return control.ApplyTo(rp.proxies)(ctx, snap)
+}
+
+// reload re-reads the config file and applies it to the
+// running proxies, starting the new ones and draining the
+// ones gone. Proxies are matched by position. The running
+// ones change only if every proxy config is valid and can
+// be applied, and the new ones are started once those gone
+// stopped listening. If a new proxy can't be started the
+// reload fails keeping the ones before it
+func (rp *runningProxies) reload() error {
+	c := NewConfig()
+	if err := c.ReadInFile(cfgFile); err != nil {
+		return err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	n := min(len(rp.proxies), len(c.Proxies))
+	for i := n; i < len(c.Proxies); i++ {
+		if err := c.Proxies[i].Validate(); err != nil {
+			return core.Wrapf(err, "proxy %v", i)
+		}
+	}
+
+	kept, removed := rp.proxies[:n], rp.proxies[n:]
+	if err := tlsserver.ApplyAll(kept, c.Proxies[:n]); err != nil {
+		return err
+	}
+
+	// their names and addresses are freed now, and
+	// they are drained in the background
+	drains := make([]func() error, 0, len(removed))
+	for _, p := range removed {
+		drains = append(drains, rp.server.Detach(p))
+		if err := p.StopListening(); err != nil {
+			log.Println(err)
+		}
+	}
+	go func() {
+		for _, drain := range drains {
+			if err := drain(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	rp.proxies = slices.Clone(kept)
+	cfg = c
+
+	for i := n; i < len(c.Proxies); i++ {
+		z, err := c.Proxies[i].New()
+		if err != nil {
+			return core.Wrapf(err, "proxy %v", i)
+		}
+
+		name := proxyName(i)
+		if err := rp.server.Append(z, shared.WithName(name)); err != nil {
+			_ = z.Cancel()
+			return core.Wrap(err, name)
+		}
+		rp.proxies = append(rp.proxies, z)
+	}
+	return nil
+}
+
+// followControl applies the snapshots of the control
+// plane until stopped
+func followControl(cc *ControlConfig, apply control.ApplyFunc) (func(), error) {
+	logger := cblog.New()
+	logger.SetLogger("console", nil)
+
+	client, err := cc.New(apply, logger)
+	if err != nil {
+		return nil, core.Wrap(err, "control")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = client.Run(ctx) }()
+	return cancel, nil
+}
+
 // Flags
 func init() {
 	rootCmd.AddCommand(serveCmd)
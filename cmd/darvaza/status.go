@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"darvaza.org/darvaza/server/admin"
+)
+
+// AdminConfig describes the administrative API of serve
+type AdminConfig struct {
+	// Listen is the host:port of the API. It isn't
+	// authenticated, so keep it private
+	Listen string `hcl:"listen"`
+}
+
+// serveAdmin serves the admin API until stopped
+func serveAdmin(ac *AdminConfig, src admin.Source) (func(), error) {
+	lsn, err := net.Listen("tcp", ac.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Handler:           admin.NewHandler(src),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(lsn); err != http.ErrServerClosed {
+			log.Println("admin:", err)
+		}
+	}()
+
+	return func() { _ = srv.Close() }, nil
+}
+
+var adminAddr string
+
+// Command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "prints the state of the workers of serve",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		addr := adminAddr
+		if addr == "" && cfg.Admin != nil {
+			addr = cfg.Admin.Listen
+		}
+		if addr == "" {
+			return errors.New("admin not configured")
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Second)
+		defer cancel()
+
+		status, err := admin.GetStatus(ctx, addr)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSTATE\tRESTARTS\tUPTIME\tLAST ERROR")
+		for _, st := range status.Workers {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\n", st.Name, st.State, st.Restarts,
+				st.Uptime.Round(time.Second), st.LastError)
+		}
+		return w.Flush()
+	},
+}
+
+// Flags
+func init() {
+	flags := statusCmd.Flags()
+	flags.StringVar(&adminAddr, "admin", "", "address of the admin API (default from the config file)")
+
+	rootCmd.AddCommand(statusCmd)
+}
@@ -6,9 +6,10 @@ toolchain go1.22.10
 
 require (
 	darvaza.org/core v0.16.1
+	darvaza.org/darvaza/agent v0.1.0
 	darvaza.org/darvaza/server v0.2.0
 	darvaza.org/darvaza/shared v0.7.0
-	darvaza.org/slog v0.6.1 // indirect
+	darvaza.org/slog v0.6.1
 	darvaza.org/slog/handlers/cblog v0.6.1 // indirect
 	darvaza.org/x/config v0.4.2
 	darvaza.org/x/tls v0.5.1 // indirect
@@ -21,6 +22,12 @@ require (
 )
 
 require (
+	darvaza.org/darvaza/acme v0.3.0 // indirect
+	darvaza.org/middleware v0.3.1 // indirect
+	darvaza.org/slog/handlers/discard v0.5.1 // indirect
+	darvaza.org/x/fs v0.4.1 // indirect
+	darvaza.org/x/net v0.5.1 // indirect
+	darvaza.org/x/web v0.10.0 // indirect
 	github.com/agext/levenshtein v1.2.3 // indirect
 	github.com/amery/defaults v0.1.0 // indirect
 	github.com/apparentlymart/go-textseg/v15 v15.0.0 // indirect
@@ -28,15 +35,25 @@ require (
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.25.0 // indirect
+	github.com/go-task/slim-sprig/v3 v3.0.0 // indirect
+	github.com/gobwas/glob v0.2.3 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/google/pprof v0.0.0-20241210010833-40e02aabc2ad // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.9 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/naoina/toml v0.1.1 // indirect
+	github.com/onsi/ginkgo/v2 v2.22.2 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	github.com/quic-go/quic-go v0.49.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/zclconf/go-cty v1.16.0 // indirect
+	github.com/zeebo/blake3 v0.2.4 // indirect
+	go.uber.org/mock v0.5.0 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8 // indirect
 	golang.org/x/mod v0.22.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
@@ -0,0 +1,195 @@
+package acmeserver
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type newAccountRequest struct {
+	Contact                []string        `json:"contact"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+}
+
+type updateAccountRequest struct {
+	Status  Status   `json:"status"`
+	Contact []string `json:"contact"`
+}
+
+func (s *Server) serveNewAccount(rw http.ResponseWriter, req *http.Request) error {
+	var p newAccountRequest
+
+	r, err := s.authenticate(req, true)
+	if err != nil {
+		return err
+	} else if err := r.Decode(&p); err != nil {
+		return err
+	}
+
+	thumbprint := r.jwk.Thumbprint()
+	if acct, ok := s.findAccount(thumbprint); ok {
+		rw.Header().Set("Location", s.url("account", acct.id))
+		return writeJSON(rw, http.StatusOK, &acct)
+	} else if p.OnlyReturnExisting {
+		return badRequest(ProblemAccountDoesNotExist, "account does not exist")
+	}
+
+	policy, err := s.bindExternalAccount(r, p.ExternalAccountBinding)
+	if err != nil {
+		return err
+	}
+
+	acct := &account{
+		id:         randomID(),
+		key:        r.key,
+		thumbprint: thumbprint,
+		policy:     policy,
+		orders:     make(map[string]*order),
+		Status:     StatusValid,
+		Contact:    p.Contact,
+	}
+	acct.Orders = s.url("account", acct.id, "orders")
+
+	out, created := s.addAccount(acct)
+	rw.Header().Set("Location", s.url("account", out.id))
+	if !created {
+		// another request registered the same key first
+		return writeJSON(rw, http.StatusOK, &out)
+	}
+
+	if log, ok := s.info(); ok {
+		log.WithField("account", out.id).Print("account created")
+	}
+
+	return writeJSON(rw, http.StatusCreated, &out)
+}
+
+// findAccount returns a copy of the account using the given key
+func (s *Server) findAccount(thumbprint string) (account, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acct := s.findAccountLocked(thumbprint); acct != nil {
+		return *acct, true
+	}
+	return account{}, false
+}
+
+// addAccount registers the account unless one using the same key
+// already exists, and returns a copy of the one that won
+func (s *Server) addAccount(acct *account) (account, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if prev := s.findAccountLocked(acct.thumbprint); prev != nil {
+		return *prev, false
+	}
+
+	s.accounts[acct.id] = acct
+	return *acct, true
+}
+
+func (s *Server) findAccountLocked(thumbprint string) *account {
+	for _, acct := range s.accounts {
+		if acct.thumbprint == thumbprint {
+			return acct
+		}
+	}
+	return nil
+}
+
+// bindExternalAccount validates the External Account Binding and
+// returns the Policy the new account will have
+func (s *Server) bindExternalAccount(r *request, raw json.RawMessage) (*Policy, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		if s.cfg.RequireExternalAccount {
+			return nil, badRequest(ProblemExternalAccountRequired,
+				"external account binding required")
+		}
+		return s.cfg.DefaultPolicy, nil
+	}
+
+	eab, err := parseJWS(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &eab.header
+	ea, ok := s.cfg.ExternalAccounts[h.KID]
+	switch {
+	case !ok:
+		return nil, unauthorized("unknown external account %q", h.KID)
+	case h.Nonce != "":
+		return nil, malformed("external account binding must not have a nonce")
+	case h.URL != r.jws.header.URL:
+		return nil, unauthorized("external account binding url mismatch")
+	}
+
+	// the payload is the account key itself
+	_, k, err := parseJWK(eab.payload)
+	if err != nil {
+		return nil, err
+	} else if k.Thumbprint() != r.jwk.Thumbprint() {
+		return nil, unauthorized("external account binding key mismatch")
+	}
+
+	if err := eab.VerifyHMAC(ea.HMACKey); err != nil {
+		return nil, err
+	}
+
+	return ea.Policy, nil
+}
+
+func (s *Server) serveAccount(rw http.ResponseWriter, req *http.Request) error {
+	var p updateAccountRequest
+
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	} else if r.account.id != req.PathValue("id") {
+		return unauthorized("account mismatch")
+	}
+
+	if !r.IsPostAsGet() {
+		if err := r.Decode(&p); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	acct := r.account
+	if p.Contact != nil {
+		acct.Contact = p.Contact
+	}
+	if p.Status == StatusDeactivated {
+		acct.Status = StatusDeactivated
+	}
+	out := *acct
+	s.mu.Unlock()
+
+	return writeJSON(rw, http.StatusOK, &out)
+}
+
+func (s *Server) serveAccountOrders(rw http.ResponseWriter, req *http.Request) error {
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	} else if r.account.id != req.PathValue("id") {
+		return unauthorized("account mismatch")
+	}
+
+	out := struct {
+		Orders []string `json:"orders"`
+	}{
+		Orders: []string{},
+	}
+
+	s.mu.Lock()
+	for _, o := range r.account.orders {
+		out.Orders = append(out.Orders, s.url("order", o.id))
+	}
+	s.mu.Unlock()
+
+	return writeJSON(rw, http.StatusOK, out)
+}
@@ -0,0 +1,110 @@
+package acmeserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/x509utils"
+)
+
+var (
+	// ErrNoCA indicates the Store doesn't hold a usable CA
+	ErrNoCA = errors.New("no CA certificate with private key found")
+)
+
+var errFound = errors.New("found")
+
+// getCA finds the signing CA in the Store
+func (s *Server) getCA() (*tls.Certificate, error) {
+	var out *tls.Certificate
+
+	err := s.cfg.Store.ForEachCertificate(context.Background(), func(c *tls.Certificate) error {
+		leaf := c.Leaf
+		if !leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return nil
+		} else if s.cfg.CAName != "" && leaf.Subject.CommonName != s.cfg.CAName {
+			return nil
+		} else if _, ok := c.PrivateKey.(crypto.Signer); !ok {
+			return nil
+		}
+
+		out = c
+		return errFound
+	})
+
+	switch {
+	case out != nil:
+		return out, nil
+	case err != nil:
+		return nil, err
+	default:
+		return nil, ErrNoCA
+	}
+}
+
+// sign issues a certificate for the given CSR, returning the
+// PEM encoded chain
+func (s *Server) sign(csr *x509.CertificateRequest, ids []Identifier) ([]byte, *x509.Certificate, error) {
+	ca, err := s.getCA()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(s.cfg.Validity)
+	if notAfter.After(ca.Leaf.NotAfter) {
+		notAfter = ca.Leaf.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ids[0].Value},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, id := range ids {
+		if id.Type == IdentifierIP {
+			addr, _ := core.ParseNetIP(id.Value)
+			tmpl.IPAddresses = append(tmpl.IPAddresses, addr)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, id.Value)
+		}
+	}
+
+	signer, _ := ca.PrivateKey.(crypto.Signer)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, csr.PublicKey, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// leaf followed by the CA's chain
+	chain := x509utils.EncodeCertificate(der)
+	for _, b := range ca.Certificate {
+		chain = append(chain, x509utils.EncodeCertificate(b)...)
+	}
+
+	return chain, cert, nil
+}
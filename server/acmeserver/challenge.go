@@ -0,0 +1,82 @@
+package acmeserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+func (s *Server) serveChallenge(rw http.ResponseWriter, req *http.Request) error {
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	ch, ok := s.chals[req.PathValue("id")]
+	if !ok {
+		s.mu.Unlock()
+		return notFound("challenge not found")
+	}
+
+	az := s.authzs[ch.authzID]
+	if az.accountID != r.account.id {
+		s.mu.Unlock()
+		return notFound("challenge not found")
+	}
+
+	if !r.IsPostAsGet() && ch.Status == StatusPending && az.Status == StatusPending {
+		// respond to challenge
+		ch.Status = StatusProcessing
+		s.spawnValidation(r.account, az, ch)
+	}
+
+	out, err := snapshot(ch)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Add("Link", link(s.url("authz", az.id), "up"))
+	return writeJSON(rw, http.StatusOK, out)
+}
+
+func (s *Server) spawnValidation(acct *account, az *authorization, ch *challenge) {
+	keyAuth := ch.Token + "." + acct.thumbprint
+	id := az.Identifier
+	typ := ch.Type
+
+	go func() {
+		ctx, cancel := context.WithTimeout(s.cfg.Context, s.cfg.ValidationTimeout)
+		defer cancel()
+
+		err := s.validate(ctx, typ, id, keyAuth)
+		s.completeValidation(az, ch, err)
+	}()
+}
+
+func (s *Server) completeValidation(az *authorization, ch *challenge, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		ch.Status = StatusInvalid
+		ch.Error = asProblem(err)
+		az.Status = StatusInvalid
+
+		if log, ok := s.error(err); ok {
+			log.WithField("identifier", az.Identifier.Value).
+				Printf("%s validation failed", ch.Type)
+		}
+	} else {
+		now := time.Now()
+		ch.Status = StatusValid
+		ch.Validated = &now
+		az.Status = StatusValid
+	}
+
+	if o, ok := s.orders[az.orderID]; ok {
+		s.refreshOrderUnlocked(o)
+	}
+}
@@ -0,0 +1,139 @@
+package acmeserver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/storage/simple"
+)
+
+const (
+	// DefaultValidity is how long issued certificates are valid
+	DefaultValidity = 90 * 24 * time.Hour
+	// DefaultOrderLifetime is how long orders and authorizations
+	// remain usable
+	DefaultOrderLifetime = 24 * time.Hour
+	// DefaultNonceLifetime is how long a nonce remains valid
+	DefaultNonceLifetime = time.Hour
+	// DefaultValidationTimeout is the maximum time spent validating
+	// a challenge
+	DefaultValidationTimeout = 30 * time.Second
+	// DefaultMaxPendingOrders is the maximum number of unfinished
+	// orders an account can have
+	DefaultMaxPendingOrders = 100
+)
+
+// Config describes how the ACME Server operates
+type Config struct {
+	// Context is the parent context of challenge validations
+	Context context.Context
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+
+	// BaseURL is the external URL where the Server is mounted,
+	// the directory will be found at BaseURL + "/directory"
+	BaseURL string
+
+	// Store holds the CA certificate and key used to sign
+	Store *simple.Store
+	// CAName optionally selects the CA by Subject CommonName when
+	// the Store contains more than one
+	CAName string
+
+	// Validity is how long issued certificates are valid
+	Validity time.Duration
+	// OrderLifetime is how long orders remain usable
+	OrderLifetime time.Duration
+	// NonceLifetime is how long issued nonces are accepted
+	NonceLifetime time.Duration
+	// ValidationTimeout limits the time spent validating a challenge
+	ValidationTimeout time.Duration
+	// MaxPendingOrders limits the unfinished orders of each account
+	MaxPendingOrders int
+
+	// DefaultPolicy applies to accounts not bound to an
+	// external account. nil means unrestricted.
+	DefaultPolicy *Policy
+	// ExternalAccounts are the known External Account Binding
+	// keys, by key ID
+	ExternalAccounts map[string]*ExternalAccount
+	// RequireExternalAccount rejects accounts without binding
+	RequireExternalAccount bool
+
+	// Resolver is used for dns-01 validations and to resolve
+	// the other challenges' targets
+	Resolver *net.Resolver
+	// HTTPPort is the port used for http-01 validations
+	HTTPPort uint16
+	// TLSPort is the port used for tls-alpn-01 validations
+	TLSPort uint16
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *Config) SetDefaults() error {
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+
+	cfg.Validity = core.IIf(cfg.Validity > 0, cfg.Validity, DefaultValidity)
+	cfg.OrderLifetime = core.IIf(cfg.OrderLifetime > 0, cfg.OrderLifetime, DefaultOrderLifetime)
+	cfg.NonceLifetime = core.IIf(cfg.NonceLifetime > 0, cfg.NonceLifetime, DefaultNonceLifetime)
+	cfg.ValidationTimeout = core.IIf(cfg.ValidationTimeout > 0,
+		cfg.ValidationTimeout, DefaultValidationTimeout)
+	cfg.MaxPendingOrders = core.IIf(cfg.MaxPendingOrders > 0,
+		cfg.MaxPendingOrders, DefaultMaxPendingOrders)
+	cfg.HTTPPort = core.IIf[uint16](cfg.HTTPPort > 0, cfg.HTTPPort, 80)
+	cfg.TLSPort = core.IIf[uint16](cfg.TLSPort > 0, cfg.TLSPort, 443)
+
+	return nil
+}
+
+// New creates a new ACME Server from a Config
+func (cfg *Config) New() (*Server, error) {
+	if cfg.Store == nil {
+		return nil, core.Wrap(core.ErrInvalid, "Store not specified")
+	}
+
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || !u.IsAbs() {
+		return nil, core.Wrap(core.ErrInvalid, "BaseURL must be an absolute URL")
+	}
+
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		cfg:      *cfg,
+		baseURL:  strings.TrimSuffix(u.String(), "/"),
+		prefix:   strings.TrimSuffix(u.Path, "/"),
+		accounts: make(map[string]*account),
+		orders:   make(map[string]*order),
+		authzs:   make(map[string]*authorization),
+		chals:    make(map[string]*challenge),
+		certs:    make(map[string]*certificate),
+	}
+
+	if _, err := srv.getCA(); err != nil {
+		return nil, err
+	}
+
+	srv.nonces.init(cfg.NonceLifetime)
+	srv.initMux()
+	return srv, nil
+}
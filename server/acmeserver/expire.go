@@ -0,0 +1,59 @@
+package acmeserver
+
+import "time"
+
+// collectInterval is how often expired objects are removed
+const collectInterval = time.Minute
+
+// collectUnlocked removes the orders, with their authorizations
+// and challenges, and the certificates that have expired.
+// Orders with a certificate are kept until it expires.
+func (s *Server) collectUnlocked(now time.Time) {
+	if now.Before(s.nextCollect) {
+		return
+	}
+	s.nextCollect = now.Add(collectInterval)
+
+	for _, o := range s.orders {
+		if s.orderExpiredUnlocked(o, now) {
+			s.removeOrderUnlocked(o)
+		}
+	}
+
+	for id, cert := range s.certs {
+		if now.After(cert.expires) {
+			delete(s.certs, id)
+		}
+	}
+}
+
+func (s *Server) orderExpiredUnlocked(o *order, now time.Time) bool {
+	switch {
+	case o.Status == StatusProcessing:
+		// being finalized
+		return false
+	case o.certID != "":
+		cert, ok := s.certs[o.certID]
+		return !ok || now.After(cert.expires)
+	default:
+		return now.After(o.Expires)
+	}
+}
+
+func (s *Server) removeOrderUnlocked(o *order) {
+	for _, id := range o.authzIDs {
+		if az, ok := s.authzs[id]; ok {
+			for _, ch := range az.Challenges {
+				delete(s.chals, ch.id)
+			}
+			delete(s.authzs, id)
+		}
+	}
+
+	if acct, ok := s.accounts[o.accountID]; ok {
+		delete(acct.orders, o.id)
+	}
+
+	delete(s.certs, o.certID)
+	delete(s.orders, o.id)
+}
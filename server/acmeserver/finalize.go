@@ -0,0 +1,165 @@
+package acmeserver
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"darvaza.org/core"
+)
+
+func (s *Server) serveFinalize(rw http.ResponseWriter, req *http.Request) error {
+	var p struct {
+		CSR string `json:"csr"`
+	}
+
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	} else if err := r.Decode(&p); err != nil {
+		return err
+	}
+
+	o, err := s.startFinalize(r.account, req.PathValue("id"))
+	if err != nil {
+		return err
+	}
+
+	chain, cert, err := s.finalize(o, p.CSR)
+
+	s.mu.Lock()
+	if err != nil {
+		o.Status = StatusInvalid
+		o.Error = asProblem(err)
+	} else {
+		id := randomID()
+		s.certs[id] = &certificate{
+			accountID: o.accountID,
+			chain:     chain,
+			expires:   cert.NotAfter,
+		}
+		o.certID = id
+		o.Certificate = s.url("cert", id)
+		o.Status = StatusValid
+	}
+	out := *o
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Location", s.url("order", o.id))
+	return writeJSON(rw, http.StatusOK, &out)
+}
+
+// startFinalize moves a ready order to processing
+func (s *Server) startFinalize(acct *account, id string) (*order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok || o.accountID != acct.id {
+		return nil, notFound("order not found")
+	}
+
+	s.refreshOrderUnlocked(o)
+	if o.Status != StatusReady {
+		return nil, NewProblem(ProblemOrderNotReady, http.StatusForbidden, "order is %s", o.Status)
+	}
+
+	o.Status = StatusProcessing
+	return o, nil
+}
+
+func (s *Server) finalize(o *order, b64csr string) ([]byte, *x509.Certificate, error) {
+	der, err := b64decode(b64csr)
+	if err != nil {
+		return nil, nil, badRequest(ProblemBadCSR, "invalid CSR encoding")
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, badRequest(ProblemBadCSR, "%s", err)
+	} else if err := csr.CheckSignature(); err != nil {
+		return nil, nil, badRequest(ProblemBadCSR, "%s", err)
+	}
+
+	if !csrMatches(csr, o.Identifiers) {
+		return nil, nil, badRequest(ProblemBadCSR, "CSR identifiers don't match the order")
+	}
+
+	chain, cert, err := s.sign(csr, o.Identifiers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if log, ok := s.info(); ok {
+		log.WithField("account", o.accountID).
+			WithField("names", cert.DNSNames).
+			Printf("certificate issued, serial %x", cert.SerialNumber)
+	}
+
+	return chain, cert, nil
+}
+
+// csrMatches checks the CSR requests exactly the identifiers of the order
+func csrMatches(csr *x509.CertificateRequest, ids []Identifier) bool {
+	var requested []Identifier
+
+	for _, name := range csr.DNSNames {
+		requested = append(requested, Identifier{IdentifierDNS, strings.ToLower(name)})
+	}
+	for _, ip := range csr.IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			requested = append(requested, Identifier{IdentifierIP, addr.Unmap().String()})
+		}
+	}
+
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		id := Identifier{IdentifierDNS, cn}
+		if _, err := core.ParseAddr(cn); err == nil {
+			id.Type = IdentifierIP
+		}
+
+		if !containsIdentifier(ids, id) {
+			return false
+		} else if !containsIdentifier(requested, id) {
+			requested = append(requested, id)
+		}
+	}
+
+	if len(requested) != len(ids) {
+		return false
+	}
+
+	for _, id := range requested {
+		if !containsIdentifier(ids, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) serveCertificate(rw http.ResponseWriter, req *http.Request) error {
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	}
+
+	id := req.PathValue("id")
+
+	s.mu.Lock()
+	cert, ok := s.certs[id]
+	s.mu.Unlock()
+
+	if !ok || cert.accountID != r.account.id {
+		return notFound("certificate not found")
+	}
+
+	rw.Header().Set("Content-Type", contentTypePEM)
+	rw.WriteHeader(http.StatusOK)
+	_, err = rw.Write(cert.chain)
+	return err
+}
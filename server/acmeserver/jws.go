@@ -0,0 +1,267 @@
+package acmeserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// jwsRequest is a flattened JWS as used by ACME requests
+type jwsRequest struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce,omitempty"`
+	URL   string          `json:"url"`
+	KID   string          `json:"kid,omitempty"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+}
+
+// jwk is a JSON Web Key, only public keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// parsedJWS is a JWS after decoding but before verifying
+type parsedJWS struct {
+	header    jwsHeader
+	payload   []byte
+	signed    []byte
+	signature []byte
+}
+
+func b64decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func b64encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseJWS(body []byte) (*parsedJWS, error) {
+	var req jwsRequest
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, malformed("invalid JWS: %s", err)
+	}
+
+	protected, err := b64decode(req.Protected)
+	if err != nil {
+		return nil, malformed("invalid JWS protected header")
+	}
+
+	out := &parsedJWS{
+		signed: []byte(req.Protected + "." + req.Payload),
+	}
+
+	if err := json.Unmarshal(protected, &out.header); err != nil {
+		return nil, malformed("invalid JWS protected header: %s", err)
+	}
+
+	if out.payload, err = b64decode(req.Payload); err != nil {
+		return nil, malformed("invalid JWS payload")
+	}
+
+	if out.signature, err = b64decode(req.Signature); err != nil {
+		return nil, malformed("invalid JWS signature")
+	}
+
+	return out, nil
+}
+
+// Verify checks the signature of the JWS against a public key
+func (j *parsedJWS) Verify(pub crypto.PublicKey) error {
+	if !verifySignature(j.header.Alg, pub, j.signed, j.signature) {
+		return malformed("JWS verification failed")
+	}
+	return nil
+}
+
+// VerifyHMAC checks the signature of a JWS against a shared key
+func (j *parsedJWS) VerifyHMAC(key []byte) error {
+	var h func() hash.Hash
+
+	switch j.header.Alg {
+	case "HS256":
+		h = sha256.New
+	case "HS384":
+		h = sha512.New384
+	case "HS512":
+		h = sha512.New
+	default:
+		return badRequest(ProblemBadSignatureAlgorithm, "unsupported MAC algorithm %q", j.header.Alg)
+	}
+
+	mac := hmac.New(h, key)
+	mac.Write(j.signed)
+	if !hmac.Equal(mac.Sum(nil), j.signature) {
+		return unauthorized("external account binding verification failed")
+	}
+	return nil
+}
+
+// revive:disable:cognitive-complexity
+
+func verifySignature(alg string, pub crypto.PublicKey, signed, sig []byte) bool {
+	// revive:enable:cognitive-complexity
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			h := sha256.Sum256(signed)
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+		}
+	case *ecdsa.PublicKey:
+		var digest []byte
+
+		switch {
+		case alg == "ES256" && k.Curve == elliptic.P256():
+			h := sha256.Sum256(signed)
+			digest = h[:]
+		case alg == "ES384" && k.Curve == elliptic.P384():
+			h := sha512.Sum384(signed)
+			digest = h[:]
+		case alg == "ES512" && k.Curve == elliptic.P521():
+			h := sha512.Sum512(signed)
+			digest = h[:]
+		default:
+			return false
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			return ed25519.Verify(k, signed, sig)
+		}
+	}
+
+	return false
+}
+
+// parseJWK decodes a public JWK
+func parseJWK(raw []byte) (crypto.PublicKey, *jwk, error) {
+	var k jwk
+
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, nil, malformed("invalid JWK: %s", err)
+	}
+
+	pub, err := k.PublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pub, &k, nil
+}
+
+// PublicKey returns the crypto.PublicKey represented by the JWK
+func (k *jwk) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		return k.rsaPublicKey()
+	case "EC":
+		return k.ecdsaPublicKey()
+	case "OKP":
+		if k.Crv == "Ed25519" {
+			x, err := b64decode(k.X)
+			if err == nil && len(x) == ed25519.PublicKeySize {
+				return ed25519.PublicKey(x), nil
+			}
+		}
+	}
+
+	return nil, badRequest(ProblemBadSignatureAlgorithm, "unsupported JWK %q/%q", k.Kty, k.Crv)
+}
+
+func (k *jwk) rsaPublicKey() (crypto.PublicKey, error) {
+	n, err1 := b64decode(k.N)
+	e, err2 := b64decode(k.E)
+	if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+		return nil, malformed("invalid RSA JWK")
+	}
+
+	pub := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+
+	if pub.N.BitLen() < 2048 {
+		return nil, badRequest(ProblemBadSignatureAlgorithm, "RSA key too small")
+	}
+	return pub, nil
+}
+
+func (k *jwk) ecdsaPublicKey() (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, badRequest(ProblemBadSignatureAlgorithm, "unsupported curve %q", k.Crv)
+	}
+
+	x, err1 := b64decode(k.X)
+	y, err2 := b64decode(k.Y)
+	if err1 != nil || err2 != nil {
+		return nil, malformed("invalid EC JWK")
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+
+	if _, err := pub.ECDH(); err != nil {
+		return nil, malformed("invalid EC JWK point")
+	}
+	return pub, nil
+}
+
+// Thumbprint computes the RFC7638 thumbprint of the JWK
+func (k *jwk) Thumbprint() string {
+	var s string
+
+	// members in lexicographic order, no whitespace
+	switch k.Kty {
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		s = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+
+	h := sha256.Sum256([]byte(s))
+	return b64encode(h[:])
+}
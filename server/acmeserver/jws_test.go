@@ -0,0 +1,241 @@
+package acmeserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"darvaza.org/core"
+)
+
+// rawClient signs ACME requests by hand, to send invalid ones
+type rawClient struct {
+	env *testEnv
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+// newRawClient registers an account and returns a rawClient using it
+func (env *testEnv) newRawClient() *rawClient {
+	c := env.newClient()
+	acct, err := c.Register(context.Background(), &acme.Account{}, acme.AcceptTOS)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+
+	return &rawClient{
+		env: env,
+		key: c.Key.(*ecdsa.PrivateKey),
+		kid: acct.URI,
+	}
+}
+
+func (rc *rawClient) nonce() string {
+	t := rc.env.t
+
+	resp, err := rc.env.ts.Client().Head(rc.env.srv.url("new-nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.Header.Get("Replay-Nonce")
+}
+
+// newJWS creates an unsigned JWS of the payload for the given URL
+func (rc *rawClient) newJWS(url, nonce string, payload any) (*jwsHeader, *jwsRequest) {
+	t := rc.env.t
+
+	h := &jwsHeader{
+		Alg:   "ES256",
+		Nonce: nonce,
+		URL:   url,
+		KID:   rc.kid,
+	}
+
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return h, &jwsRequest{Payload: b64encode(body)}
+}
+
+// sign signs a JWS
+func (rc *rawClient) sign(h *jwsHeader, req *jwsRequest) {
+	t := rc.env.t
+
+	protected, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Protected = b64encode(protected)
+
+	digest := sha256.Sum256([]byte(req.Protected + "." + req.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, rc.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	req.Signature = b64encode(sig)
+}
+
+// post sends a signed request, returning the Problem if it fails
+func (rc *rawClient) post(url, contentType string, req *jwsRequest) (int, *Problem) {
+	t := rc.env.t
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := rc.env.ts.Client().Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+
+	p := new(Problem)
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, p
+}
+
+func TestJWS(t *testing.T) {
+	env := newTestEnv(t, &Config{})
+	rc := env.newRawClient()
+	url := env.srv.url("new-order")
+	order := newOrderRequest{
+		Identifiers: []Identifier{{IdentifierDNS, "www." + testDomain}},
+	}
+
+	reused := rc.nonce()
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		// before and after signing
+		before   func(*jwsHeader)
+		after    func(*jwsRequest)
+		status   int
+		expected ProblemType
+	}{
+		{name: "valid", before: func(h *jwsHeader) {
+			h.Nonce = reused
+		}, status: http.StatusCreated},
+		{name: "reused nonce", before: func(h *jwsHeader) {
+			h.Nonce = reused
+		}, status: http.StatusBadRequest, expected: ProblemBadNonce},
+		{name: "unknown nonce", before: func(h *jwsHeader) {
+			h.Nonce = randomID()
+		}, status: http.StatusBadRequest, expected: ProblemBadNonce},
+		{name: "no nonce", before: func(h *jwsHeader) {
+			h.Nonce = ""
+		}, status: http.StatusBadRequest, expected: ProblemBadNonce},
+		{name: "bad signature", after: func(req *jwsRequest) {
+			req.Signature = b64encode(make([]byte, 64))
+		}, status: http.StatusBadRequest, expected: ProblemMalformed},
+		{name: "tampered payload", after: func(req *jwsRequest) {
+			req.Payload = b64encode([]byte(`{"identifiers":[]}`))
+		}, status: http.StatusBadRequest, expected: ProblemMalformed},
+		{name: "wrong algorithm", before: func(h *jwsHeader) {
+			h.Alg = "ES384"
+		}, status: http.StatusBadRequest, expected: ProblemMalformed},
+		{name: "url mismatch", before: func(h *jwsHeader) {
+			h.URL = env.srv.url("new-account")
+		}, status: http.StatusForbidden, expected: ProblemUnauthorized},
+		{name: "unknown account", before: func(h *jwsHeader) {
+			h.KID = env.srv.url("account", "unknown")
+		}, status: http.StatusBadRequest, expected: ProblemAccountDoesNotExist},
+		{name: "kid and jwk", before: func(h *jwsHeader) {
+			h.JWK = json.RawMessage(`{"kty":"EC"}`)
+		}, status: http.StatusBadRequest, expected: ProblemMalformed},
+		{name: "content type", contentType: "application/json",
+			status: http.StatusUnsupportedMediaType, expected: ProblemMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, req := rc.newJWS(url, rc.nonce(), order)
+			if tc.before != nil {
+				tc.before(h)
+			}
+
+			rc.sign(h, req)
+			if tc.after != nil {
+				tc.after(req)
+			}
+
+			ct := core.Coalesce(tc.contentType, contentTypeJOSE)
+			status, p := rc.post(url, ct, req)
+			switch {
+			case status != tc.status:
+				t.Errorf("status %v (expected %v): %v", status, tc.status, p)
+			case tc.expected == "" && p != nil:
+				t.Errorf("%v (expected no problem)", p)
+			case tc.expected != "" && (p == nil || p.Type != tc.expected):
+				t.Errorf("%v (expected %s)", p, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPendingOrders(t *testing.T) {
+	env := newTestEnv(t, &Config{
+		MaxPendingOrders: 2,
+		OrderLifetime:    time.Hour,
+	})
+
+	rc := env.newRawClient()
+	url := env.srv.url("new-order")
+	order := newOrderRequest{
+		Identifiers: []Identifier{{IdentifierDNS, "www." + testDomain}},
+	}
+
+	newOrder := func() (int, *Problem) {
+		h, req := rc.newJWS(url, rc.nonce(), order)
+		rc.sign(h, req)
+		return rc.post(url, contentTypeJOSE, req)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, p := newOrder(); p != nil {
+			t.Fatal(p)
+		}
+	}
+
+	if _, p := newOrder(); p == nil || p.Type != ProblemRateLimited {
+		t.Errorf("%v (expected %s)", p, ProblemRateLimited)
+	}
+
+	// once expired, they are collected
+	s := env.srv
+	s.mu.Lock()
+	s.collectUnlocked(time.Now().Add(2 * time.Hour))
+	n := len(s.orders) + len(s.authzs) + len(s.chals)
+	s.mu.Unlock()
+
+	if n != 0 {
+		t.Errorf("%v objects left after expiring", n)
+	}
+
+	if _, p := newOrder(); p != nil {
+		t.Error(p)
+	}
+}
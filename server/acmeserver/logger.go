@@ -0,0 +1,23 @@
+package acmeserver
+
+import (
+	"darvaza.org/slog"
+)
+
+func (s *Server) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return s.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (s *Server) info() (slog.Logger, bool) {
+	return s.withLogger(slog.Info)
+}
+
+func (s *Server) error(err error) (slog.Logger, bool) {
+	if l, ok := s.withLogger(slog.Error); ok {
+		if err != nil {
+			l = l.WithField(slog.ErrorFieldName, err)
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,80 @@
+package acmeserver
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxNonces is the maximum number of outstanding nonces,
+// the oldest are forgotten first
+const MaxNonces = 1 << 16
+
+// nonces keeps track of the issued anti-replay nonces
+type nonces struct {
+	mu     sync.Mutex
+	issued map[string]time.Time
+	ttl    time.Duration
+
+	// queue holds the issued nonces in order. All share the
+	// same lifetime so the oldest always expire first
+	queue []issuedNonce
+}
+
+type issuedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+func (n *nonces) init(ttl time.Duration) {
+	n.issued = make(map[string]time.Time)
+	n.ttl = ttl
+}
+
+// New issues a new nonce
+func (n *nonces) New() string {
+	s := randomID()
+	now := time.Now()
+	expires := now.Add(n.ttl)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.expireUnlocked(now)
+
+	n.issued[s] = expires
+	n.queue = append(n.queue, issuedNonce{s, expires})
+	return s
+}
+
+// Consume checks a nonce is valid and removes it
+func (n *nonces) Consume(s string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expires, ok := n.issued[s]
+	if ok {
+		// the queue entry stays until it expires
+		delete(n.issued, s)
+		ok = time.Now().Before(expires)
+	}
+	return ok
+}
+
+// expireUnlocked forgets the expired nonces, and the oldest
+// ones if there are too many
+func (n *nonces) expireUnlocked(now time.Time) {
+	var i int
+
+	for ; i < len(n.queue); i++ {
+		v := n.queue[i]
+		if len(n.queue)-i < MaxNonces && !now.After(v.expires) {
+			break
+		}
+		delete(n.issued, v.nonce)
+	}
+
+	if i > 0 {
+		clear(n.queue[:i])
+		n.queue = n.queue[i:]
+	}
+}
@@ -0,0 +1,276 @@
+package acmeserver
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+type newOrderRequest struct {
+	Identifiers []Identifier `json:"identifiers"`
+	NotBefore   *time.Time   `json:"notBefore"`
+	NotAfter    *time.Time   `json:"notAfter"`
+}
+
+func (s *Server) serveNewOrder(rw http.ResponseWriter, req *http.Request) error {
+	var p newOrderRequest
+
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	} else if err := r.Decode(&p); err != nil {
+		return err
+	} else if len(p.Identifiers) == 0 {
+		return malformed("no identifiers")
+	} else if p.NotBefore != nil || p.NotAfter != nil {
+		return malformed("notBefore/notAfter not supported")
+	}
+
+	ids := make([]Identifier, 0, len(p.Identifiers))
+	for _, id := range p.Identifiers {
+		id, err := normalizeIdentifier(id)
+		if err != nil {
+			return err
+		} else if err := r.account.policy.Check(id); err != nil {
+			return err
+		}
+
+		if !containsIdentifier(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	o, err := s.newOrder(r.account, ids)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Location", s.url("order", o.id))
+	return writeJSON(rw, http.StatusCreated, o)
+}
+
+func (s *Server) newOrder(acct *account, ids []Identifier) (*order, error) {
+	now := time.Now()
+	expires := now.Add(s.cfg.OrderLifetime)
+
+	o := &order{
+		id:          randomID(),
+		accountID:   acct.id,
+		Status:      StatusPending,
+		Expires:     expires,
+		Identifiers: ids,
+	}
+	o.Finalize = s.url("order", o.id, "finalize")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collectUnlocked(now)
+	if s.pendingOrdersUnlocked(acct) >= s.cfg.MaxPendingOrders {
+		return nil, NewProblem(ProblemRateLimited, http.StatusTooManyRequests,
+			"too many pending orders")
+	}
+
+	for _, id := range ids {
+		az := s.newAuthorizationUnlocked(o, id)
+		o.authzIDs = append(o.authzIDs, az.id)
+		o.Authorizations = append(o.Authorizations, s.url("authz", az.id))
+	}
+
+	s.orders[o.id] = o
+	acct.orders[o.id] = o
+
+	out := *o
+	return &out, nil
+}
+
+// pendingOrdersUnlocked counts the unfinished orders of an account
+func (s *Server) pendingOrdersUnlocked(acct *account) int {
+	var n int
+	for _, o := range acct.orders {
+		s.refreshOrderUnlocked(o)
+		switch o.Status {
+		case StatusPending, StatusReady, StatusProcessing:
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) newAuthorizationUnlocked(o *order, id Identifier) *authorization {
+	az := &authorization{
+		id:         randomID(),
+		accountID:  o.accountID,
+		orderID:    o.id,
+		Identifier: id,
+		Status:     StatusPending,
+		Expires:    o.Expires,
+	}
+
+	var types []string
+	switch {
+	case strings.HasPrefix(id.Value, "*."):
+		// wildcards can only be validated via DNS
+		az.Identifier.Value = id.Value[2:]
+		az.Wildcard = true
+		types = []string{ChallengeDNS01}
+	case id.Type == IdentifierIP:
+		types = []string{ChallengeHTTP01, ChallengeTLSALPN01}
+	default:
+		types = []string{ChallengeHTTP01, ChallengeDNS01, ChallengeTLSALPN01}
+	}
+
+	token := randomID()
+	for _, typ := range types {
+		ch := &challenge{
+			id:      randomID(),
+			authzID: az.id,
+			Type:    typ,
+			Status:  StatusPending,
+			Token:   token,
+		}
+		ch.URL = s.url("chall", ch.id)
+
+		s.chals[ch.id] = ch
+		az.Challenges = append(az.Challenges, ch)
+	}
+
+	s.authzs[az.id] = az
+	return az
+}
+
+func (s *Server) serveOrder(rw http.ResponseWriter, req *http.Request) error {
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	o, ok := s.orders[req.PathValue("id")]
+	if ok && o.accountID == r.account.id {
+		s.refreshOrderUnlocked(o)
+		out := *o
+		s.mu.Unlock()
+
+		return writeJSON(rw, http.StatusOK, &out)
+	}
+	s.mu.Unlock()
+
+	return notFound("order not found")
+}
+
+// refreshOrderUnlocked updates the status of an order based
+// on its authorizations and lifetime
+func (s *Server) refreshOrderUnlocked(o *order) {
+	if o.Status != StatusPending {
+		return
+	}
+
+	if time.Now().After(o.Expires) {
+		o.Status = StatusInvalid
+		return
+	}
+
+	ready := true
+	for _, id := range o.authzIDs {
+		az := s.authzs[id]
+		switch az.Status {
+		case StatusValid:
+		case StatusPending:
+			ready = false
+		default:
+			o.Status = StatusInvalid
+			o.Error = unauthorized("authorization for %q failed", az.Identifier.Value)
+			return
+		}
+	}
+
+	if ready {
+		o.Status = StatusReady
+	}
+}
+
+func (s *Server) serveAuthorization(rw http.ResponseWriter, req *http.Request) error {
+	var p struct {
+		Status Status `json:"status"`
+	}
+
+	r, err := s.authenticate(req, false)
+	if err != nil {
+		return err
+	} else if !r.IsPostAsGet() {
+		if err := r.Decode(&p); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	az, ok := s.authzs[req.PathValue("id")]
+	if !ok || az.accountID != r.account.id {
+		s.mu.Unlock()
+		return notFound("authorization not found")
+	}
+
+	if p.Status == StatusDeactivated && az.Status == StatusValid {
+		az.Status = StatusDeactivated
+	}
+	if az.Status == StatusPending && time.Now().After(az.Expires) {
+		az.Status = StatusExpired
+	}
+
+	out, err := snapshot(az)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return writeJSON(rw, http.StatusOK, out)
+}
+
+func normalizeIdentifier(id Identifier) (Identifier, error) {
+	switch id.Type {
+	case IdentifierDNS:
+		return normalizeDNSIdentifier(id)
+	case IdentifierIP:
+		addr, err := netip.ParseAddr(id.Value)
+		if err != nil || addr.Zone() != "" {
+			return id, malformed("invalid IP address %q", id.Value)
+		}
+		id.Value = addr.Unmap().String()
+		return id, nil
+	default:
+		return id, badRequest(ProblemUnsupportedIdentifier, "unsupported identifier type %q", id.Type)
+	}
+}
+
+func normalizeDNSIdentifier(id Identifier) (Identifier, error) {
+	name := strings.TrimSuffix(strings.ToLower(id.Value), ".")
+	base, wildcard := strings.CutPrefix(name, "*.")
+
+	ascii, err := idna.Lookup.ToASCII(base)
+	switch {
+	case err != nil:
+		return id, badRequest(ProblemRejectedIdentifier, "invalid name %q", id.Value)
+	case net.ParseIP(ascii) != nil, !strings.Contains(ascii, "."):
+		return id, badRequest(ProblemRejectedIdentifier, "invalid name %q", id.Value)
+	case wildcard:
+		id.Value = "*." + ascii
+	default:
+		id.Value = ascii
+	}
+
+	return id, nil
+}
+
+func containsIdentifier(ids []Identifier, id Identifier) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
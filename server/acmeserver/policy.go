@@ -0,0 +1,107 @@
+package acmeserver
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Policy restricts the identifiers an account can request
+// certificates for
+type Policy struct {
+	// PermittedDNSDomains lists the domains, and their subdomains,
+	// that can be requested. Empty means any.
+	PermittedDNSDomains []string
+	// ExcludedDNSDomains lists domains, and their subdomains,
+	// that can't be requested even if permitted.
+	ExcludedDNSDomains []string
+	// PermittedIPRanges lists the IP ranges that can be requested.
+	// Empty means none.
+	PermittedIPRanges []netip.Prefix
+	// AllowWildcard permits wildcard names
+	AllowWildcard bool
+}
+
+// ExternalAccount is a pre-arranged account identified using
+// External Account Binding
+type ExternalAccount struct {
+	// HMACKey is the shared secret used to sign the binding
+	HMACKey []byte
+	// Policy restricts the names accounts bound to this
+	// external account can use
+	Policy *Policy
+}
+
+// Check verifies the identifier is allowed by the policy
+func (p *Policy) Check(id Identifier) error {
+	if p == nil {
+		// no constraints
+		return nil
+	}
+
+	switch id.Type {
+	case IdentifierDNS:
+		return p.checkName(id.Value)
+	case IdentifierIP:
+		return p.checkIP(id.Value)
+	default:
+		return badRequest(ProblemUnsupportedIdentifier, "unsupported identifier type %q", id.Type)
+	}
+}
+
+func (p *Policy) checkName(name string) error {
+	base, wildcard := strings.CutPrefix(name, "*.")
+	if wildcard && !p.AllowWildcard {
+		return rejected("wildcard names not allowed")
+	}
+
+	for _, domain := range p.ExcludedDNSDomains {
+		if matchDomain(base, domain) {
+			return rejected("%q is excluded", name)
+		}
+	}
+
+	if len(p.PermittedDNSDomains) == 0 {
+		return nil
+	}
+
+	for _, domain := range p.PermittedDNSDomains {
+		if matchDomain(base, domain) {
+			return nil
+		}
+	}
+
+	return rejected("%q not permitted", name)
+}
+
+func (p *Policy) checkIP(s string) error {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return malformed("invalid IP address %q", s)
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range p.PermittedIPRanges {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+
+	return rejected("%q not permitted", s)
+}
+
+// matchDomain tells if name is the domain or one of its subdomains
+func matchDomain(name, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	switch {
+	case domain == "":
+		return false
+	case name == domain:
+		return true
+	default:
+		return strings.HasSuffix(name, "."+domain)
+	}
+}
+
+func rejected(format string, args ...any) *Problem {
+	return badRequest(ProblemRejectedIdentifier, format, args...)
+}
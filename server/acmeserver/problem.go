@@ -0,0 +1,98 @@
+package acmeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ProblemType is an ACME error type as defined in RFC8555 section 6.7
+type ProblemType string
+
+const problemPrefix = "urn:ietf:params:acme:error:"
+
+// Problem types used by the server
+const (
+	ProblemAccountDoesNotExist     ProblemType = problemPrefix + "accountDoesNotExist"
+	ProblemBadCSR                  ProblemType = problemPrefix + "badCSR"
+	ProblemBadNonce                ProblemType = problemPrefix + "badNonce"
+	ProblemBadSignatureAlgorithm   ProblemType = problemPrefix + "badSignatureAlgorithm"
+	ProblemConnection              ProblemType = problemPrefix + "connection"
+	ProblemDNS                     ProblemType = problemPrefix + "dns"
+	ProblemExternalAccountRequired ProblemType = problemPrefix + "externalAccountRequired"
+	ProblemIncorrectResponse       ProblemType = problemPrefix + "incorrectResponse"
+	ProblemMalformed               ProblemType = problemPrefix + "malformed"
+	ProblemOrderNotReady           ProblemType = problemPrefix + "orderNotReady"
+	ProblemRateLimited             ProblemType = problemPrefix + "rateLimited"
+	ProblemRejectedIdentifier      ProblemType = problemPrefix + "rejectedIdentifier"
+	ProblemServerInternal          ProblemType = problemPrefix + "serverInternal"
+	ProblemTLS                     ProblemType = problemPrefix + "tls"
+	ProblemUnauthorized            ProblemType = problemPrefix + "unauthorized"
+	ProblemUnsupportedIdentifier   ProblemType = problemPrefix + "unsupportedIdentifier"
+)
+
+var (
+	_ error = (*Problem)(nil)
+)
+
+// Problem is an RFC7807 problem document used by ACME
+// to report errors
+type Problem struct {
+	Type   ProblemType `json:"type"`
+	Detail string      `json:"detail,omitempty"`
+	Status int         `json:"status,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return string(p.Type)
+	}
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+// NewProblem creates a new Problem of the given type
+func NewProblem(typ ProblemType, status int, format string, args ...any) *Problem {
+	return &Problem{
+		Type:   typ,
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+func badRequest(typ ProblemType, format string, args ...any) *Problem {
+	return NewProblem(typ, http.StatusBadRequest, format, args...)
+}
+
+func malformed(format string, args ...any) *Problem {
+	return badRequest(ProblemMalformed, format, args...)
+}
+
+func unauthorized(format string, args ...any) *Problem {
+	return NewProblem(ProblemUnauthorized, http.StatusForbidden, format, args...)
+}
+
+func notFound(format string, args ...any) *Problem {
+	return NewProblem(ProblemMalformed, http.StatusNotFound, format, args...)
+}
+
+func internal(err error) *Problem {
+	return NewProblem(ProblemServerInternal, http.StatusInternalServerError, "%s", err)
+}
+
+func asProblem(err error) *Problem {
+	if p, ok := err.(*Problem); ok {
+		return p
+	}
+	return internal(err)
+}
+
+func writeProblem(rw http.ResponseWriter, err error) {
+	p := asProblem(err)
+	if p.Status == 0 {
+		p.Status = http.StatusBadRequest
+	}
+
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(p.Status)
+	_ = json.NewEncoder(rw).Encode(p)
+}
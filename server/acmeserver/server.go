@@ -0,0 +1,272 @@
+// Package acmeserver implements an ACME (RFC8555) directory issuing
+// certificates from a local CA, for internal networks
+package acmeserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+)
+
+var (
+	_ http.Handler = (*Server)(nil)
+)
+
+const (
+	// MaxRequestSize is the maximum size of a JWS request body
+	MaxRequestSize = 1 << 20
+
+	contentTypeJOSE = "application/jose+json"
+	contentTypePEM  = "application/pem-certificate-chain"
+)
+
+// Server is an ACME directory issuing certificates from a local CA
+type Server struct {
+	mu  sync.Mutex
+	cfg Config
+
+	baseURL string
+	prefix  string
+
+	mux    *http.ServeMux
+	nonces nonces
+
+	accounts map[string]*account
+	orders   map[string]*order
+	authzs   map[string]*authorization
+	chals    map[string]*challenge
+	certs    map[string]*certificate
+
+	nextCollect time.Time
+}
+
+// request is an authenticated ACME request
+type request struct {
+	jws     *parsedJWS
+	account *account
+
+	// only for requests signed with a JWK
+	key crypto.PublicKey
+	jwk *jwk
+}
+
+// IsPostAsGet tells if the request has an empty payload
+func (r *request) IsPostAsGet() bool {
+	return len(r.jws.payload) == 0
+}
+
+// Decode unmarshals the payload of the request
+func (r *request) Decode(out any) error {
+	if err := json.Unmarshal(r.jws.payload, out); err != nil {
+		return malformed("invalid payload: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) initMux() {
+	mux := http.NewServeMux()
+	p := s.prefix
+
+	mux.HandleFunc("GET "+p+"/directory", s.handle(s.serveDirectory))
+	mux.HandleFunc("HEAD "+p+"/new-nonce", s.serveNewNonce)
+	mux.HandleFunc("GET "+p+"/new-nonce", s.serveNewNonce)
+	mux.HandleFunc("POST "+p+"/new-account", s.handle(s.serveNewAccount))
+	mux.HandleFunc("POST "+p+"/new-order", s.handle(s.serveNewOrder))
+	mux.HandleFunc("POST "+p+"/revoke-cert", s.handle(s.serveNotImplemented))
+	mux.HandleFunc("POST "+p+"/key-change", s.handle(s.serveNotImplemented))
+	mux.HandleFunc("POST "+p+"/account/{id}", s.handle(s.serveAccount))
+	mux.HandleFunc("POST "+p+"/account/{id}/orders", s.handle(s.serveAccountOrders))
+	mux.HandleFunc("POST "+p+"/order/{id}", s.handle(s.serveOrder))
+	mux.HandleFunc("POST "+p+"/order/{id}/finalize", s.handle(s.serveFinalize))
+	mux.HandleFunc("POST "+p+"/authz/{id}", s.handle(s.serveAuthorization))
+	mux.HandleFunc("POST "+p+"/chall/{id}", s.handle(s.serveChallenge))
+	mux.HandleFunc("POST "+p+"/cert/{id}", s.handle(s.serveCertificate))
+
+	s.mux = mux
+}
+
+// ServeHTTP handles the ACME requests
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	hdr := rw.Header()
+	hdr.Set("Replay-Nonce", s.nonces.New())
+	hdr.Set("Cache-Control", "no-store")
+	hdr.Add("Link", link(s.url("directory"), "index"))
+
+	s.mux.ServeHTTP(rw, req)
+}
+
+// Mux is where a Server can be mounted, like an
+// httpserver.Server or an http.ServeMux
+type Mux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// Mount registers the Server on a Mux at the path of its BaseURL
+func (s *Server) Mount(mux Mux) {
+	mux.Handle(s.prefix+"/", s)
+}
+
+func (s *Server) handle(fn func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if err := fn(rw, req); err != nil {
+			p := asProblem(err)
+			if p.Type == ProblemServerInternal {
+				if log, ok := s.error(err); ok {
+					log.Print(req.URL.Path)
+				}
+			}
+
+			writeProblem(rw, p)
+		}
+	}
+}
+
+func (s *Server) url(parts ...string) string {
+	return s.baseURL + "/" + strings.Join(parts, "/")
+}
+
+func link(url, rel string) string {
+	return "<" + url + `>;rel="` + rel + `"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) error {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	return json.NewEncoder(rw).Encode(v)
+}
+
+// snapshot encodes an object while the lock is held
+func snapshot(v any) (json.RawMessage, error) {
+	return json.Marshal(v)
+}
+
+func (s *Server) serveDirectory(rw http.ResponseWriter, _ *http.Request) error {
+	dir := directory{
+		NewNonce:   s.url("new-nonce"),
+		NewAccount: s.url("new-account"),
+		NewOrder:   s.url("new-order"),
+		RevokeCert: s.url("revoke-cert"),
+		KeyChange:  s.url("key-change"),
+		Meta: directoryMeta{
+			ExternalAccountRequired: s.cfg.RequireExternalAccount,
+		},
+	}
+
+	return writeJSON(rw, http.StatusOK, dir)
+}
+
+func (*Server) serveNewNonce(rw http.ResponseWriter, req *http.Request) {
+	// Replay-Nonce already set by ServeHTTP
+	if req.Method == http.MethodGet {
+		rw.WriteHeader(http.StatusNoContent)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+func (*Server) serveNotImplemented(_ http.ResponseWriter, _ *http.Request) error {
+	return NewProblem(ProblemServerInternal, http.StatusNotImplemented, "not implemented")
+}
+
+// authenticate reads and verifies the JWS of a POST request
+func (s *Server) authenticate(req *http.Request, withJWK bool) (*request, error) {
+	if ct := req.Header.Get("Content-Type"); ct != contentTypeJOSE {
+		return nil, NewProblem(ProblemMalformed, http.StatusUnsupportedMediaType,
+			"invalid Content-Type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxRequestSize))
+	if err != nil {
+		return nil, malformed("%s", err)
+	}
+
+	jws, err := parseJWS(body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &jws.header
+	if !s.nonces.Consume(h.Nonce) {
+		return nil, badRequest(ProblemBadNonce, "invalid nonce")
+	} else if h.URL != s.baseURL+strings.TrimPrefix(req.URL.Path, s.prefix) {
+		return nil, unauthorized("url mismatch")
+	}
+
+	r := &request{jws: jws}
+	if withJWK {
+		err = s.authenticateJWK(r)
+	} else {
+		err = s.authenticateKID(r)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (*Server) authenticateJWK(r *request) error {
+	h := &r.jws.header
+	if len(h.JWK) == 0 || h.KID != "" {
+		return malformed("jwk required")
+	}
+
+	key, k, err := parseJWK(h.JWK)
+	if err != nil {
+		return err
+	} else if err := r.jws.Verify(key); err != nil {
+		return err
+	}
+
+	r.key, r.jwk = key, k
+	return nil
+}
+
+func (s *Server) authenticateKID(r *request) error {
+	h := &r.jws.header
+	if h.KID == "" || len(h.JWK) > 0 {
+		return malformed("kid required")
+	}
+
+	id, ok := strings.CutPrefix(h.KID, s.url("account", ""))
+	if !ok {
+		return badRequest(ProblemAccountDoesNotExist, "unknown account")
+	}
+
+	s.mu.Lock()
+	acct, ok := s.accounts[id]
+	var status Status
+	if ok {
+		status = acct.Status
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !ok:
+		return badRequest(ProblemAccountDoesNotExist, "unknown account")
+	case status != StatusValid:
+		return unauthorized("account %s", status)
+	}
+
+	if err := r.jws.Verify(acct.key); err != nil {
+		return err
+	}
+
+	r.account = acct
+	return nil
+}
+
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		core.PanicWrap(err, "crypto/rand")
+	}
+	return b64encode(b[:])
+}
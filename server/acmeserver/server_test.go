@@ -0,0 +1,561 @@
+package acmeserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+
+	"darvaza.org/darvaza/shared/storage/simple"
+)
+
+const testDomain = "example.test"
+
+// testEnv is an ACME Server with the resolver and ports
+// its challenges are validated against
+type testEnv struct {
+	t   *testing.T
+	srv *Server
+	ts  *httptest.Server
+	ca  *x509.Certificate
+
+	dns *testDNS
+
+	httpPort uint16
+	tlsPort  uint16
+
+	mu        sync.Mutex
+	http01    map[string]string
+	tlsALPN01 *tls.Certificate
+}
+
+func newTestEnv(t *testing.T, cfg *Config) *testEnv {
+	env := &testEnv{
+		t:      t,
+		http01: make(map[string]string),
+	}
+
+	env.dns = newTestDNS(t)
+	env.httpPort = env.serveHTTP01()
+	env.tlsPort = env.serveTLSALPN01()
+
+	store, ca := newTestStore(t)
+	env.ca = ca
+
+	mux := http.NewServeMux()
+	env.ts = httptest.NewServer(mux)
+	t.Cleanup(env.ts.Close)
+
+	cfg.BaseURL = env.ts.URL + "/acme"
+	cfg.Store = store
+	cfg.Resolver = env.dns.resolver()
+	cfg.HTTPPort = env.httpPort
+	cfg.TLSPort = env.tlsPort
+	cfg.ValidationTimeout = 5 * time.Second
+
+	srv, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.srv = srv
+	srv.Mount(mux)
+	return env
+}
+
+func (env *testEnv) directoryURL() string {
+	return env.srv.url("directory")
+}
+
+// newClient creates an acme.Client with a new key
+func (env *testEnv) newClient() *acme.Client {
+	return &acme.Client{
+		Key:          newTestKey(env.t),
+		DirectoryURL: env.directoryURL(),
+		HTTPClient:   env.ts.Client(),
+	}
+}
+
+// register creates an ACME account, optionally bound
+// to an external account
+func (env *testEnv) register(eab *acme.ExternalAccountBinding) (*acme.Client, error) {
+	c := env.newClient()
+	_, err := c.Register(context.Background(), &acme.Account{
+		ExternalAccountBinding: eab,
+	}, acme.AcceptTOS)
+	return c, err
+}
+
+func (env *testEnv) serveHTTP01() uint16 {
+	lsn := listen(env.t)
+
+	srv := &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			env.mu.Lock()
+			s, ok := env.http01[req.URL.Path]
+			env.mu.Unlock()
+
+			if !ok {
+				http.NotFound(rw, req)
+				return
+			}
+			_, _ = rw.Write([]byte(s))
+		}),
+	}
+
+	go func() { _ = srv.Serve(lsn) }()
+	env.t.Cleanup(func() { _ = srv.Close() })
+	return port(lsn)
+}
+
+func (env *testEnv) serveTLSALPN01() uint16 {
+	lsn := tls.NewListener(listen(env.t), &tls.Config{
+		NextProtos: []string{ALPNProto},
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			env.mu.Lock()
+			defer env.mu.Unlock()
+			if env.tlsALPN01 == nil {
+				return nil, errors.New("no challenge")
+			}
+			return env.tlsALPN01, nil
+		},
+	})
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	return port(lsn)
+}
+
+// respond sets up the response to a challenge
+func (env *testEnv) respond(c *acme.Client, name string, ch *acme.Challenge) {
+	t := env.t
+
+	switch ch.Type {
+	case ChallengeHTTP01:
+		s, err := c.HTTP01ChallengeResponse(ch.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.mu.Lock()
+		env.http01[c.HTTP01ChallengePath(ch.Token)] = s
+		env.mu.Unlock()
+	case ChallengeTLSALPN01:
+		cert, err := c.TLSALPN01ChallengeCert(ch.Token, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.mu.Lock()
+		env.tlsALPN01 = &cert
+		env.mu.Unlock()
+	case ChallengeDNS01:
+		s, err := c.DNS01ChallengeRecord(ch.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.dns.setTXT("_acme-challenge."+name, s)
+	}
+}
+
+// authorize solves the authorizations of a new order using
+// the given challenge type
+func (env *testEnv) authorize(c *acme.Client, typ string, names ...string) (*acme.Order, error) {
+	ctx := context.Background()
+
+	o, err := c.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range o.AuthzURLs {
+		az, err := c.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+
+		ch := findChallenge(az, typ)
+		if ch == nil {
+			env.t.Fatalf("%s: no %s challenge", az.Identifier.Value, typ)
+		}
+
+		env.respond(c, az.Identifier.Value, ch)
+		if _, err := c.Accept(ctx, ch); err != nil {
+			return nil, err
+		} else if _, err := c.WaitAuthorization(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.WaitOrder(ctx, o.URI)
+}
+
+func findChallenge(az *acme.Authorization, typ string) *acme.Challenge {
+	for _, ch := range az.Challenges {
+		if ch.Type == typ {
+			return ch
+		}
+	}
+	return nil
+}
+
+// issue finalizes an order with a CSR for the given names
+func (env *testEnv) issue(c *acme.Client, o *acme.Order, names ...string) (*x509.Certificate, error) {
+	key := newTestKey(env.t)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+
+	chain, _, err := c.CreateOrderCert(context.Background(), o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(chain[0])
+}
+
+func TestACMEChallenges(t *testing.T) {
+	env := newTestEnv(t, &Config{})
+
+	for _, typ := range []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01} {
+		t.Run(typ, func(t *testing.T) {
+			name := "www." + testDomain
+			c, err := env.register(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o, err := env.authorize(c, typ, name)
+			if err != nil {
+				t.Fatal(err)
+			} else if o.Status != acme.StatusReady {
+				t.Fatalf("order %s (expected %s)", o.Status, acme.StatusReady)
+			}
+
+			cert, err := env.issue(c, o, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(env.ca)
+			_, err = cert.Verify(x509.VerifyOptions{
+				DNSName: name,
+				Roots:   roots,
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestACMEChallengeFailure(t *testing.T) {
+	env := newTestEnv(t, &Config{})
+
+	c, err := env.register(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	o, err := c.AuthorizeOrder(ctx, acme.DomainIDs("www."+testDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	az, err := c.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not responding
+	if _, err := c.Accept(ctx, findChallenge(az, ChallengeHTTP01)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.WaitAuthorization(ctx, o.AuthzURLs[0])
+	if !isAuthorizationError(err) {
+		t.Errorf("%v (expected authorization error)", err)
+	}
+
+	// the order is invalid now
+	if _, err := c.WaitOrder(ctx, o.URI); !isOrderError(err, acme.StatusInvalid) {
+		t.Errorf("%v (expected invalid order)", err)
+	}
+}
+
+func TestACMEFinalize(t *testing.T) {
+	env := newTestEnv(t, &Config{})
+	name := "www." + testDomain
+
+	c, err := env.register(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		names []string
+		ready bool
+	}{
+		{"not ready", []string{name}, false},
+		{"extra name", []string{name, "other." + testDomain}, true},
+		{"missing name", []string{"other." + testDomain}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var o *acme.Order
+			var err error
+
+			if tc.ready {
+				o, err = env.authorize(c, ChallengeHTTP01, name)
+			} else {
+				o, err = c.AuthorizeOrder(context.Background(), acme.DomainIDs(name))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := ProblemBadCSR
+			if !tc.ready {
+				expected = ProblemOrderNotReady
+			}
+
+			_, err = env.issue(c, o, tc.names...)
+			expectProblem(t, err, expected)
+		})
+	}
+}
+
+func TestACMEPolicy(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+
+	env := newTestEnv(t, &Config{
+		RequireExternalAccount: true,
+		ExternalAccounts: map[string]*ExternalAccount{
+			"team": {
+				HMACKey: hmacKey,
+				Policy: &Policy{
+					PermittedDNSDomains: []string{testDomain},
+					ExcludedDNSDomains:  []string{"private." + testDomain},
+				},
+			},
+		},
+	})
+
+	// external account binding
+	_, err := env.register(nil)
+	expectProblem(t, err, ProblemExternalAccountRequired)
+
+	_, err = env.register(&acme.ExternalAccountBinding{KID: "team", Key: []byte("wrong")})
+	expectProblem(t, err, ProblemUnauthorized)
+
+	_, err = env.register(&acme.ExternalAccountBinding{KID: "other", Key: hmacKey})
+	expectProblem(t, err, ProblemUnauthorized)
+
+	c, err := env.register(&acme.ExternalAccountBinding{KID: "team", Key: hmacKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// name constraints
+	for _, tc := range []struct {
+		name     string
+		expected ProblemType
+	}{
+		{"www." + testDomain, ""},
+		{testDomain, ""},
+		{"www.example.org", ProblemRejectedIdentifier},
+		{"www.private." + testDomain, ProblemRejectedIdentifier},
+		{"*." + testDomain, ProblemRejectedIdentifier},
+		{"localhost", ProblemRejectedIdentifier},
+	} {
+		_, err := c.AuthorizeOrder(context.Background(), acme.DomainIDs(tc.name))
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		expectProblem(t, err, tc.expected)
+	}
+
+	_, err = c.AuthorizeOrder(context.Background(), acme.IPIDs("127.0.0.1"))
+	expectProblem(t, err, ProblemRejectedIdentifier)
+}
+
+func expectProblem(t *testing.T, err error, expected ProblemType) {
+	t.Helper()
+
+	var e *acme.Error
+	switch {
+	case err == nil:
+		t.Errorf("no error (expected %s)", expected)
+	case !errors.As(err, &e):
+		t.Errorf("%v (expected %s)", err, expected)
+	case e.ProblemType != string(expected):
+		t.Errorf("%s (expected %s)", e.ProblemType, expected)
+	}
+}
+
+func isAuthorizationError(err error) bool {
+	var e *acme.AuthorizationError
+	return errors.As(err, &e)
+}
+
+func isOrderError(err error, status string) bool {
+	var e *acme.OrderError
+	return errors.As(err, &e) && e.Status == status
+}
+
+// testDNS is a DNS server resolving everything to 127.0.0.1,
+// and the TXT records set
+type testDNS struct {
+	addr string
+
+	mu  sync.Mutex
+	txt map[string]string
+}
+
+func newTestDNS(t *testing.T) *testDNS {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &testDNS{
+		addr: pc.LocalAddr().String(),
+		txt:  make(map[string]string),
+	}
+
+	srv := &dns.Server{PacketConn: pc, Handler: d}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return d
+}
+
+func (d *testDNS) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	for _, q := range req.Question {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Rrtype: q.Qtype, Ttl: 1}
+
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeTXT:
+			d.mu.Lock()
+			s, ok := d.txt[q.Name]
+			d.mu.Unlock()
+
+			if ok {
+				m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{s}})
+			}
+		}
+	}
+
+	_ = rw.WriteMsg(m)
+}
+
+func (d *testDNS) setTXT(name, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.txt[dns.Fqdn(name)] = value
+}
+
+func (d *testDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, "udp", d.addr)
+		},
+	}
+}
+
+// newTestStore creates a simple.Store holding a new CA
+func newTestStore(t *testing.T) (*simple.Store, *x509.Certificate) {
+	key := newTestKey(t)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+
+	store, err := simple.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, ca
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func listen(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lsn.Close() })
+	return lsn
+}
+
+func port(lsn net.Listener) uint16 {
+	_, s, _ := net.SplitHostPort(lsn.Addr().String())
+	p, _ := strconv.ParseUint(s, 10, 16)
+	return uint16(p)
+}
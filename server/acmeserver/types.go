@@ -0,0 +1,113 @@
+package acmeserver
+
+import (
+	"crypto"
+	"time"
+)
+
+// Status is the state of an ACME object
+type Status string
+
+// Statuses used by ACME objects
+const (
+	StatusPending     Status = "pending"
+	StatusReady       Status = "ready"
+	StatusProcessing  Status = "processing"
+	StatusValid       Status = "valid"
+	StatusInvalid     Status = "invalid"
+	StatusDeactivated Status = "deactivated"
+	StatusExpired     Status = "expired"
+)
+
+// Identifier types
+const (
+	IdentifierDNS = "dns"
+	IdentifierIP  = "ip"
+)
+
+// Challenge types
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeDNS01     = "dns-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// Identifier is the subject of an Authorization
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type directoryMeta struct {
+	ExternalAccountRequired bool `json:"externalAccountRequired,omitempty"`
+}
+
+type directory struct {
+	NewNonce   string        `json:"newNonce"`
+	NewAccount string        `json:"newAccount"`
+	NewOrder   string        `json:"newOrder"`
+	RevokeCert string        `json:"revokeCert"`
+	KeyChange  string        `json:"keyChange"`
+	Meta       directoryMeta `json:"meta"`
+}
+
+type account struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	policy     *Policy
+	orders     map[string]*order
+
+	Status  Status   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders,omitempty"`
+}
+
+type order struct {
+	id        string
+	accountID string
+	authzIDs  []string
+	certID    string
+	err       *Problem
+
+	Status         Status       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	NotBefore      *time.Time   `json:"notBefore,omitempty"`
+	NotAfter       *time.Time   `json:"notAfter,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+}
+
+// certificate is an issued certificate chain
+type certificate struct {
+	accountID string
+	chain     []byte
+	expires   time.Time
+}
+
+type authorization struct {
+	id        string
+	accountID string
+	orderID   string
+
+	Identifier Identifier   `json:"identifier"`
+	Status     Status       `json:"status"`
+	Expires    time.Time    `json:"expires"`
+	Challenges []*challenge `json:"challenges"`
+	Wildcard   bool         `json:"wildcard,omitempty"`
+}
+
+type challenge struct {
+	id      string
+	authzID string
+
+	Type      string     `json:"type"`
+	URL       string     `json:"url"`
+	Status    Status     `json:"status"`
+	Token     string     `json:"token"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *Problem   `json:"error,omitempty"`
+}
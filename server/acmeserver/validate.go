@@ -0,0 +1,202 @@
+package acmeserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ALPNProto is the ALPN protocol used by tls-alpn-01
+	ALPNProto = "acme-tls/1"
+
+	maxHTTP01Response = 1 << 10
+)
+
+// idPeAcmeIdentifier is the OID of the acmeIdentifier extension
+// used by tls-alpn-01, RFC8737
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+func (s *Server) validate(ctx context.Context, typ string, id Identifier, keyAuth string) error {
+	switch typ {
+	case ChallengeHTTP01:
+		return s.validateHTTP01(ctx, id, keyAuth)
+	case ChallengeDNS01:
+		return s.validateDNS01(ctx, id, keyAuth)
+	case ChallengeTLSALPN01:
+		return s.validateTLSALPN01(ctx, id, keyAuth)
+	default:
+		return malformed("unsupported challenge %q", typ)
+	}
+}
+
+func (s *Server) newDialer() *net.Dialer {
+	return &net.Dialer{
+		Resolver: s.cfg.Resolver,
+	}
+}
+
+func (s *Server) validateHTTP01(ctx context.Context, id Identifier, keyAuth string) error {
+	token, _, _ := strings.Cut(keyAuth, ".")
+	host := net.JoinHostPort(id.Value, strconv.Itoa(int(s.cfg.HTTPPort)))
+	url := "http://" + host + "/.well-known/acme-challenge/" + token
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       s.newDialer().DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return malformed("%s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return NewProblem(ProblemConnection, http.StatusBadRequest, "%s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return unauthorized("%s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTP01Response))
+	if err != nil {
+		return NewProblem(ProblemConnection, http.StatusBadRequest, "%s", err)
+	}
+
+	body = bytes.TrimSpace(body)
+	if subtle.ConstantTimeCompare(body, []byte(keyAuth)) != 1 {
+		return badRequest(ProblemIncorrectResponse, "%s: key authorization mismatch", url)
+	}
+	return nil
+}
+
+func (s *Server) validateDNS01(ctx context.Context, id Identifier, keyAuth string) error {
+	if id.Type != IdentifierDNS {
+		return malformed("dns-01 can't validate %q identifiers", id.Type)
+	}
+
+	name := "_acme-challenge." + id.Value
+	txts, err := s.cfg.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return NewProblem(ProblemDNS, http.StatusBadRequest, "%s", err)
+	}
+
+	h := sha256.Sum256([]byte(keyAuth))
+	expected := b64encode(h[:])
+
+	for _, txt := range txts {
+		if txt == expected {
+			return nil
+		}
+	}
+
+	return badRequest(ProblemIncorrectResponse, "%s: no matching TXT record", name)
+}
+
+func (s *Server) validateTLSALPN01(ctx context.Context, id Identifier, keyAuth string) error {
+	conf := &tls.Config{
+		NextProtos: []string{ALPNProto},
+		ServerName: id.Value,
+		// the certificate is self-signed by design
+		InsecureSkipVerify: true, // #nosec G402
+	}
+
+	if id.Type == IdentifierIP {
+		// RFC8738 section 6
+		addr, _ := netip.ParseAddr(id.Value)
+		conf.ServerName = reverseName(addr)
+	}
+
+	d := &tls.Dialer{
+		NetDialer: s.newDialer(),
+		Config:    conf,
+	}
+
+	host := net.JoinHostPort(id.Value, strconv.Itoa(int(s.cfg.TLSPort)))
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return NewProblem(ProblemTLS, http.StatusBadRequest, "%s", err)
+	}
+	defer conn.Close()
+
+	cs := conn.(*tls.Conn).ConnectionState()
+	if cs.NegotiatedProtocol != ALPNProto || len(cs.PeerCertificates) == 0 {
+		return unauthorized("%s: %s not negotiated", host, ALPNProto)
+	}
+
+	return checkALPNCert(cs.PeerCertificates[0], id, keyAuth)
+}
+
+func checkALPNCert(cert *x509.Certificate, id Identifier, keyAuth string) error {
+	if !certHasExactIdentifier(cert, id) {
+		return unauthorized("tls-alpn-01 certificate doesn't match %q", id.Value)
+	}
+
+	h := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+
+		var value []byte
+		if !ext.Critical {
+			return unauthorized("acmeIdentifier extension not critical")
+		} else if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+			return unauthorized("invalid acmeIdentifier extension")
+		} else if subtle.ConstantTimeCompare(value, h[:]) != 1 {
+			return badRequest(ProblemIncorrectResponse, "key authorization mismatch")
+		}
+		return nil
+	}
+
+	return unauthorized("acmeIdentifier extension missing")
+}
+
+func certHasExactIdentifier(cert *x509.Certificate, id Identifier) bool {
+	switch id.Type {
+	case IdentifierDNS:
+		return len(cert.IPAddresses) == 0 && len(cert.DNSNames) == 1 &&
+			strings.EqualFold(cert.DNSNames[0], id.Value)
+	case IdentifierIP:
+		if len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 1 {
+			addr, ok := netip.AddrFromSlice(cert.IPAddresses[0])
+			return ok && addr.Unmap().String() == id.Value
+		}
+	}
+	return false
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of an address
+func reverseName(addr netip.Addr) string {
+	var parts []string
+
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			parts = append(parts, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(parts, ".") + ".in-addr.arpa"
+	}
+
+	b := addr.As16()
+	for i := len(b) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+	}
+	return strings.Join(parts, ".") + ".ip6.arpa"
+}
@@ -0,0 +1,77 @@
+// Package admin implements the administrative HTTP API of
+// a running darvaza, reporting the state of its workers
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"darvaza.org/darvaza/shared"
+)
+
+// StatusPath is the path reporting the Status
+const StatusPath = "/status"
+
+// MetricsPath is the path reporting the expvar variables,
+// like the tls_fingerprints counted by the TLS proxies
+const MetricsPath = "/debug/vars"
+
+// Status describes the workers of a running darvaza
+type Status struct {
+	Workers []shared.WorkerStatus `json:"workers"`
+}
+
+// Source provides the snapshots reported, like
+// a shared.WorkGroup
+type Source interface {
+	Status() []shared.WorkerStatus
+}
+
+// NewHandler creates the http.Handler of the admin API
+func NewHandler(src Source) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+StatusPath, func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(Status{Workers: src.Status()})
+	})
+	mux.Handle("GET "+MetricsPath, expvar.Handler())
+	return mux
+}
+
+// GetStatus queries the admin API at the given base URL,
+// or host:port
+func GetStatus(ctx context.Context, baseURL string) (*Status, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+
+	u := strings.TrimSuffix(baseURL, "/") + StatusPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
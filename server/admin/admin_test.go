@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"darvaza.org/darvaza/shared"
+)
+
+type testSource []shared.WorkerStatus
+
+func (s testSource) Status() []shared.WorkerStatus { return s }
+
+func TestGetStatus(t *testing.T) {
+	src := testSource{
+		{Name: "proxy-0", State: shared.StateRunning, Restarts: 2},
+		{Name: "proxy-1", State: shared.StateFailed, LastError: "failed"},
+	}
+
+	srv := httptest.NewServer(NewHandler(src))
+	defer srv.Close()
+
+	status, err := GetStatus(context.Background(), srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.Workers) != len(src) {
+		t.Fatalf("%v workers (expected %v)", len(status.Workers), len(src))
+	}
+	for i, st := range status.Workers {
+		if st != src[i] {
+			t.Errorf("%v: %+v (expected %+v)", i, st, src[i])
+		}
+	}
+}
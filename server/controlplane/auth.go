@@ -0,0 +1,64 @@
+package controlplane
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrUnauthenticated indicates a request doesn't identify an agent
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// AuthenticateFunc identifies the agent making a request
+type AuthenticateFunc func(req *http.Request) (string, error)
+
+// ByToken authenticates agents by bearer token, given
+// a map of tokens to agent names
+func ByToken(tokens map[string]string) AuthenticateFunc {
+	return func(req *http.Request) (string, error) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return "", ErrUnauthenticated
+		}
+
+		// compare all to not tell how close it was
+		var name string
+		for t, agent := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				name = agent
+			}
+		}
+
+		if name == "" {
+			return "", ErrUnauthenticated
+		}
+		return name, nil
+	}
+}
+
+// ByCertificate authenticates agents by the CommonName of
+// their client certificate, verified by the TLS listener
+func ByCertificate(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", ErrUnauthenticated
+	}
+
+	name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return "", ErrUnauthenticated
+	}
+	return name, nil
+}
+
+// Any tries each AuthenticateFunc in order
+func Any(fns ...AuthenticateFunc) AuthenticateFunc {
+	return func(req *http.Request) (string, error) {
+		for _, fn := range fns {
+			if name, err := fn(req); err == nil {
+				return name, nil
+			}
+		}
+		return "", ErrUnauthenticated
+	}
+}
@@ -0,0 +1,59 @@
+package controlplane
+
+import (
+	"context"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/control"
+)
+
+// Config describes how the control plane Server operates
+type Config struct {
+	// Context ends the streams of snapshots when cancelled
+	Context context.Context
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+
+	// Authenticate identifies the agent making a request
+	Authenticate AuthenticateFunc
+	// Heartbeat is how often whitespace is written to
+	// idle streams, so agents detect dead connections
+	Heartbeat time.Duration
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *Config) SetDefaults() error {
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	cfg.Heartbeat = core.IIf(cfg.Heartbeat > 0, cfg.Heartbeat, control.DefaultHeartbeat)
+	return nil
+}
+
+// New creates a control plane Server from a Config
+func (cfg *Config) New() (*Server, error) {
+	if cfg.Authenticate == nil {
+		return nil, core.Wrap(core.ErrInvalid, "Authenticate not specified")
+	}
+
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:    *cfg,
+		certs:  make(map[string]string),
+		agents: make(map[string]*agent),
+	}
+	s.initMux()
+	return s, nil
+}
@@ -0,0 +1,100 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"darvaza.org/darvaza/shared/control"
+	"darvaza.org/darvaza/shared/tls/server"
+)
+
+const testCert = "-----BEGIN CERTIFICATE-----\nMA==\n-----END CERTIFICATE-----\n"
+
+func TestControlPlane(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := (&Config{
+		Context:      ctx,
+		Authenticate: ByToken(map[string]string{"secret": "edge1"}),
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetCertificate("web", testCert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Assign("edge1", Assignment{Certificates: []string{"other"}}); err == nil {
+		t.Error("unknown certificate assigned")
+	}
+	v1, err := s.Assign("edge1", Assignment{
+		Proxies:      []server.ProxyConfig{{Protocol: "http"}},
+		Certificates: []string{"web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// ends the streams before closing the server
+	defer cancel()
+
+	if resp, err := http.Get(ts.URL + control.SnapshotsPath); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated: %s", resp.Status)
+	}
+
+	snaps := make(chan *control.Snapshot, 4)
+	c, err := (&control.ClientConfig{
+		URL:   ts.URL,
+		Token: "secret",
+		Apply: func(_ context.Context, snap *control.Snapshot) error {
+			snaps <- snap
+			return nil
+		},
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = c.Run(ctx) }()
+
+	snap := waitSnapshot(t, snaps)
+	if snap.Version != v1 || len(snap.Proxies) != 1 ||
+		len(snap.Proxies[0].Certificates) != 1 || snap.Proxies[0].Certificates[0] != testCert {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	// rotating the certificate pushes a new snapshot
+	if err := s.SetCertificate("web", testCert+testCert); err != nil {
+		t.Fatal(err)
+	}
+	snap = waitSnapshot(t, snaps)
+	if snap.Version <= v1 || snap.Proxies[0].Certificates[0] != testCert+testCert {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	for range 100 {
+		if st, _ := s.Agent("edge1"); st.Connected && st.Version == snap.Version {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	st, _ := s.Agent("edge1")
+	t.Errorf("status not reported: %+v", st)
+}
+
+func waitSnapshot(t *testing.T, snaps <-chan *control.Snapshot) *control.Snapshot {
+	select {
+	case snap := <-snaps:
+		return snap
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for snapshot")
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"darvaza.org/darvaza/shared/control"
+)
+
+var (
+	_ http.Handler = (*Server)(nil)
+)
+
+// MaxStatusSize is the maximum size of a Status report
+const MaxStatusSize = 64 << 10
+
+func (s *Server) initMux() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+control.SnapshotsPath, s.handle(s.serveSnapshots))
+	mux.HandleFunc("POST "+control.StatusPath, s.handle(s.serveStatus))
+	s.mux = mux
+}
+
+// ServeHTTP handles the requests of the agents
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	s.mux.ServeHTTP(rw, req)
+}
+
+// handle authenticates the agent before calling the handler
+func (s *Server) handle(fn func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		name, err := s.cfg.Authenticate(req)
+		if err != nil {
+			if log, ok := s.warn(err); ok {
+				log.WithField("remote", req.RemoteAddr).Print(req.URL.Path)
+			}
+
+			http.Error(rw, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+
+		fn(rw, req, name)
+	}
+}
+
+func (s *Server) serveStatus(rw http.ResponseWriter, req *http.Request, name string) {
+	var status control.Status
+
+	dec := json.NewDecoder(io.LimitReader(req.Body, MaxStatusSize))
+	if err := dec.Decode(&status); err != nil {
+		http.Error(rw, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	s.setStatus(name, status)
+	rw.WriteHeader(http.StatusNoContent)
+
+	if log, ok := s.info(); ok {
+		log.WithField("agent", name).
+			WithField("version", status.Version).
+			Print("status reported")
+	}
+}
+
+// serveSnapshots streams the Snapshots of an agent
+func (s *Server) serveSnapshots(rw http.ResponseWriter, req *http.Request, name string) {
+	known, _ := strconv.ParseUint(req.URL.Query().Get("version"), 10, 64)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+
+	s.connected(name)
+	defer s.disconnected(name)
+
+	if log, ok := s.info(); ok {
+		log.WithField("agent", name).Print("connected")
+	}
+
+	st := &stream{
+		w:       rw,
+		rc:      http.NewResponseController(rw),
+		version: known,
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.cfg.Context, cancel)
+	defer stop()
+
+	err := s.stream(ctx, st, name)
+	if log, ok := s.info(); ok {
+		log.WithField("agent", name).Printf("disconnected: %s", err)
+	}
+}
+
+// stream writes the Snapshots of an agent as they are
+// published, until it fails or the context is cancelled
+func (s *Server) stream(ctx context.Context, st *stream, name string) error {
+	ticker := time.NewTicker(s.cfg.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		snap, changed := s.latest(name)
+		if err := st.send(snap); err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if err := st.heartbeat(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stream is a response streaming Snapshots
+type stream struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	version uint64
+}
+
+// send writes a Snapshot unless the agent has it already
+func (st *stream) send(snap *control.Snapshot) error {
+	if snap == nil || snap.Version == st.version {
+		return st.rc.Flush()
+	}
+
+	if err := json.NewEncoder(st.w).Encode(snap); err != nil {
+		return err
+	}
+
+	st.version = snap.Version
+	return st.rc.Flush()
+}
+
+func (st *stream) heartbeat() error {
+	if _, err := st.w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	return st.rc.Flush()
+}
@@ -0,0 +1,21 @@
+package controlplane
+
+import (
+	"darvaza.org/slog"
+)
+
+func (s *Server) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return s.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (s *Server) info() (slog.Logger, bool) {
+	return s.withLogger(slog.Info)
+}
+
+func (s *Server) warn(err error) (slog.Logger, bool) {
+	l, ok := s.withLogger(slog.Warn)
+	if ok && err != nil {
+		l = l.WithField(slog.ErrorFieldName, err)
+	}
+	return l, ok
+}
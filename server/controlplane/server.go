@@ -0,0 +1,233 @@
+// Package controlplane holds the configuration of the proxies of
+// many agents and pushes versioned snapshots of it to them over
+// authenticated streams, collecting the status they report back
+package controlplane
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/control"
+	"darvaza.org/darvaza/shared/tls/server"
+)
+
+// Assignment is the configuration of an agent
+type Assignment struct {
+	// Proxies are the configurations of the proxies of the
+	// agent. Paths in them are resolved by the agent
+	Proxies []server.ProxyConfig
+	// Certificates are the names of the certificates of the
+	// Server added to the Certificates of every proxy
+	Certificates []string
+}
+
+// AgentStatus describes an agent known to the Server
+type AgentStatus struct {
+	// Status is what the agent reported last
+	control.Status
+	// Latest is the version of the newest Snapshot
+	// of the agent, zero if it has none
+	Latest uint64
+	// Connected tells if the agent is streaming Snapshots
+	Connected bool
+	// Seen is the last time the agent connected or
+	// reported its Status
+	Seen time.Time
+}
+
+// Server is a control plane
+type Server struct {
+	cfg Config
+	mux *http.ServeMux
+
+	mu      sync.Mutex
+	version uint64
+	certs   map[string]string
+	agents  map[string]*agent
+}
+
+// agent is the state of an agent
+type agent struct {
+	assignment *Assignment
+	snapshot   *control.Snapshot
+	// changed is closed when the snapshot is replaced
+	changed chan struct{}
+
+	status  control.Status
+	streams int
+	seen    time.Time
+}
+
+// getAgent returns the state of an agent, creating
+// it if needed. The lock must be held
+func (s *Server) getAgent(name string) *agent {
+	a, ok := s.agents[name]
+	if !ok {
+		a = &agent{changed: make(chan struct{})}
+		s.agents[name] = a
+	}
+	return a
+}
+
+// Assign replaces the configuration of an agent and
+// returns the version of its new Snapshot
+func (s *Server) Assign(name string, asg Assignment) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	asg.Proxies = slices.Clone(asg.Proxies)
+	asg.Certificates = slices.Clone(asg.Certificates)
+
+	snap, err := s.newSnapshot(&asg)
+	if err != nil {
+		return 0, core.Wrapf(err, "agent %q", name)
+	}
+
+	a := s.getAgent(name)
+	a.assignment = &asg
+	s.publish(a, snap)
+	return snap.Version, nil
+}
+
+// Unassign removes the configuration of an agent. The
+// agent keeps using its last Snapshot
+func (s *Server) Unassign(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.agents[name]; ok {
+		a.assignment = nil
+		s.publish(a, nil)
+	}
+}
+
+// SetCertificate adds or replaces a PEM encoded certificate
+// and its key, pushing new Snapshots to the agents using it
+func (s *Server) SetCertificate(name, content string) error {
+	if b, _ := pem.Decode([]byte(content)); b == nil {
+		return core.Wrap(core.ErrInvalid, fmt.Sprintf("certificate %q: no PEM data", name))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.certs[name] == content {
+		return nil
+	}
+
+	s.certs[name] = content
+	for _, a := range s.agents {
+		if a.assignment != nil && core.SliceContains(a.assignment.Certificates, name) {
+			snap, _ := s.newSnapshot(a.assignment)
+			s.publish(a, snap)
+		}
+	}
+	return nil
+}
+
+// newSnapshot builds the next Snapshot of an Assignment.
+// The lock must be held
+func (s *Server) newSnapshot(asg *Assignment) (*control.Snapshot, error) {
+	certs := make([]string, 0, len(asg.Certificates))
+	for _, name := range asg.Certificates {
+		content, ok := s.certs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown certificate %q", name)
+		}
+		certs = append(certs, content)
+	}
+
+	proxies := make([]server.ProxyConfig, len(asg.Proxies))
+	for i, pc := range asg.Proxies {
+		pc.Store = nil
+		pc.Certificates = append(slices.Clone(pc.Certificates), certs...)
+		proxies[i] = pc
+	}
+
+	s.version++
+	return &control.Snapshot{
+		Version: s.version,
+		Proxies: proxies,
+	}, nil
+}
+
+// publish replaces the Snapshot of an agent and wakes
+// its streams. The lock must be held
+func (s *Server) publish(a *agent, snap *control.Snapshot) {
+	a.snapshot = snap
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// latest returns the Snapshot of an agent and a channel
+// closed when it's replaced
+func (s *Server) latest(name string) (*control.Snapshot, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.getAgent(name)
+	return a.snapshot, a.changed
+}
+
+// Agents returns the names of the agents known
+func (s *Server) Agents() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return core.SortedKeys(s.agents)
+}
+
+// Agent returns the status of an agent
+func (s *Server) Agent(name string) (AgentStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.agents[name]
+	if !ok {
+		return AgentStatus{}, false
+	}
+
+	out := AgentStatus{
+		Status:    a.status,
+		Connected: a.streams > 0,
+		Seen:      a.seen,
+	}
+	if a.snapshot != nil {
+		out.Latest = a.snapshot.Version
+	}
+	return out, true
+}
+
+// connected tracks a new stream of an agent
+func (s *Server) connected(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.getAgent(name)
+	a.streams++
+	a.seen = time.Now()
+}
+
+// disconnected tracks the end of a stream of an agent
+func (s *Server) disconnected(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.agents[name].streams--
+}
+
+// setStatus records the Status reported by an agent
+func (s *Server) setStatus(name string, status control.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.getAgent(name)
+	a.status = status
+	a.seen = time.Now()
+}
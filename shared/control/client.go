@@ -0,0 +1,271 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// ClientConfig describes a Client
+type ClientConfig struct {
+	// URL is the base URL of the control plane
+	URL string
+	// Token is sent as bearer token, if any
+	Token string
+	// TLSConfig optionally verifies the control plane
+	// and provides a client certificate
+	TLSConfig *tls.Config
+	// Apply applies the Snapshots received
+	Apply ApplyFunc
+
+	// Heartbeat is the interval of the heartbeats of the
+	// control plane. Streams quiet for three are dropped
+	Heartbeat time.Duration
+	// Backoff is the wait between attempts to connect
+	Backoff proxy.Backoff
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+}
+
+// SetDefaults fills the gaps in the ClientConfig
+func (cfg *ClientConfig) SetDefaults() error {
+	if cfg.Apply == nil {
+		return core.Wrap(core.ErrInvalid, "Apply missing")
+	}
+
+	cfg.Heartbeat = core.IIf(cfg.Heartbeat > 0, cfg.Heartbeat, DefaultHeartbeat)
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+	return nil
+}
+
+// New creates a Client from the ClientConfig
+func (cfg *ClientConfig) New() (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || !u.IsAbs() {
+		return nil, core.Wrap(core.ErrInvalid, "URL must be an absolute URL")
+	} else if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		cfg:     *cfg,
+		baseURL: strings.TrimSuffix(u.String(), "/"),
+		hc: &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   cfg.TLSConfig,
+				ForceAttemptHTTP2: true,
+			},
+		},
+	}, nil
+}
+
+// Client watches the Snapshots of an agent on the control plane
+// and applies them, reporting the outcome
+type Client struct {
+	cfg     ClientConfig
+	baseURL string
+	hc      *http.Client
+
+	mu     sync.Mutex
+	status Status
+
+	// version of the last Snapshot received
+	version atomic.Uint64
+}
+
+// Status returns the Status last reported
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Run keeps watching the Snapshots, reconnecting when the
+// stream fails, until the context is cancelled
+func (c *Client) Run(ctx context.Context) error {
+	for retry := 0; ctx.Err() == nil; retry++ {
+		start := time.Now()
+		c.disconnected(ctx, c.watch(ctx))
+
+		if time.Since(start) > c.cfg.Backoff.Duration(retry) {
+			// it worked for a while
+			retry = 0
+		}
+
+		_ = c.cfg.Backoff.Wait(ctx, retry)
+	}
+	return nil
+}
+
+func (c *Client) disconnected(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if log, ok := c.warn(err); ok {
+		log.WithField("url", c.baseURL).Print("disconnected")
+	}
+}
+
+// watch applies the Snapshots of a stream until it fails
+func (c *Client) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u := c.baseURL + SnapshotsPath
+	if v := c.version.Load(); v > 0 {
+		u += "?version=" + strconv.FormatUint(v, 10)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := newIdleReader(resp.Body, 3*c.cfg.Heartbeat, cancel)
+	defer body.Stop()
+
+	dec := json.NewDecoder(body)
+	for {
+		var snap Snapshot
+		if err := dec.Decode(&snap); err != nil {
+			return core.CoalesceError(body.Err(), err)
+		}
+		c.apply(ctx, &snap)
+	}
+}
+
+// apply applies a Snapshot and reports the outcome
+func (c *Client) apply(ctx context.Context, snap *Snapshot) {
+	c.version.Store(snap.Version)
+	err := c.cfg.Apply(ctx, snap)
+
+	c.mu.Lock()
+	if err == nil {
+		c.status = Status{Version: snap.Version}
+	} else {
+		c.status.Rejected = snap.Version
+		c.status.Error = err.Error()
+	}
+	status := c.status
+	c.mu.Unlock()
+
+	if err != nil {
+		if log, ok := c.warn(err); ok {
+			log.WithField("version", snap.Version).Print("snapshot rejected")
+		}
+	} else if log, ok := c.info(); ok {
+		log.WithField("version", snap.Version).Print("snapshot applied")
+	}
+
+	if err := c.report(ctx, status); err != nil {
+		if log, ok := c.warn(err); ok {
+			log.Print("status not reported")
+		}
+	}
+}
+
+// report sends the Status to the control plane
+func (c *Client) report(ctx context.Context, status Status) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, c.baseURL+StatusPath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// do sends an authenticated request, failing
+// unless the response is successful
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	resp, err := c.hc.Do(req)
+	switch {
+	case err != nil:
+		return nil, err
+	case resp.StatusCode/100 != 2:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	default:
+		return resp, nil
+	}
+}
+
+// ErrIdle indicates a stream was quiet for too long
+var ErrIdle = errors.New("stream idle")
+
+// idleReader cancels a stream not read from for too long
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleReader {
+	ir := &idleReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.expired.Store(true)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleReader) Read(b []byte) (int, error) {
+	n, err := ir.r.Read(b)
+	if n > 0 {
+		ir.timer.Reset(ir.timeout)
+	}
+	return n, err
+}
+
+// Err returns ErrIdle if the stream was cancelled
+func (ir *idleReader) Err() error {
+	if ir.expired.Load() {
+		return ErrIdle
+	}
+	return nil
+}
+
+// Stop releases the timer
+func (ir *idleReader) Stop() {
+	ir.timer.Stop()
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"darvaza.org/darvaza/shared/tls/server"
+)
+
+// standIn is a stand-in control plane sending the
+// Snapshots newer than the version of the agent, and
+// ending the stream. If there are none it waits
+type standIn struct {
+	t     *testing.T
+	snaps []Snapshot
+
+	mu       sync.Mutex
+	versions []string
+	reports  chan Status
+}
+
+func (si *standIn) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch req.URL.Path {
+	case SnapshotsPath:
+		si.serveSnapshots(rw, req)
+	case StatusPath:
+		var status Status
+		if err := json.NewDecoder(req.Body).Decode(&status); err != nil {
+			si.t.Error(err)
+		}
+		si.reports <- status
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (si *standIn) serveSnapshots(rw http.ResponseWriter, req *http.Request) {
+	version := req.URL.Query().Get("version")
+	known, _ := strconv.ParseUint(version, 10, 64)
+
+	si.mu.Lock()
+	si.versions = append(si.versions, version)
+	si.mu.Unlock()
+
+	var sent bool
+	enc := json.NewEncoder(rw)
+	for i := range si.snaps {
+		if si.snaps[i].Version > known {
+			_ = enc.Encode(&si.snaps[i])
+			sent = true
+		}
+	}
+
+	if !sent {
+		<-req.Context().Done()
+	}
+}
+
+func (si *standIn) connections() []string {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return slices.Clone(si.versions)
+}
+
+func TestClient(t *testing.T) {
+	si := &standIn{
+		t: t,
+		snaps: []Snapshot{
+			{Version: 1, Proxies: []server.ProxyConfig{{Protocol: "http"}}},
+			{Version: 2, Proxies: []server.ProxyConfig{{Protocol: "http"}, {Protocol: "http"}}},
+		},
+		reports: make(chan Status, 4),
+	}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+
+	applied := make(chan uint64, 4)
+	c, err := (&ClientConfig{
+		URL:   ts.URL,
+		Token: "secret",
+		Apply: func(_ context.Context, snap *Snapshot) error {
+			if len(snap.Proxies) != 1 {
+				return errors.New("one proxy only")
+			}
+			applied <- snap.Version
+			return nil
+		},
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = c.Run(ctx) }()
+
+	for _, want := range []Status{
+		{Version: 1},
+		{Version: 1, Rejected: 2, Error: "one proxy only"},
+	} {
+		select {
+		case got := <-si.reports:
+			if got != want {
+				t.Errorf("reported %+v (expected %+v)", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for status")
+		}
+	}
+
+	if v := <-applied; v != 1 || len(applied) > 0 {
+		t.Errorf("applied %v, %v more", v, len(applied))
+	}
+
+	// reconnects after the stream ends, asking for
+	// newer snapshots
+	for range 100 {
+		if len(si.connections()) > 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := si.connections(); !slices.Equal(got, []string{"", "2"}) {
+		t.Errorf("connected with versions %q", got)
+	}
+}
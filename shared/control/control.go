@@ -0,0 +1,61 @@
+// Package control implements the agent side of the control plane.
+// Agents watch a stream of versioned Snapshots of the configuration
+// of their proxies, apply them and report their Status back
+package control
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/tls/server"
+)
+
+const (
+	// SnapshotsPath streams the Snapshots of an agent as
+	// JSON documents, starting with the current one unless
+	// its version is given in the version query parameter
+	SnapshotsPath = "/v1/snapshots"
+	// StatusPath receives the Status of an agent
+	StatusPath = "/v1/status"
+
+	// DefaultHeartbeat is how often whitespace is written
+	// to idle streams, so dead connections are detected
+	DefaultHeartbeat = 30 * time.Second
+)
+
+// Snapshot is a version of the configuration of an agent
+type Snapshot struct {
+	Version uint64               `json:"version"`
+	Proxies []server.ProxyConfig `json:"proxies"`
+}
+
+// Status is what an agent reports after each Snapshot
+type Status struct {
+	// Version of the Snapshot in use
+	Version uint64 `json:"version"`
+	// Rejected is the version of the last Snapshot that
+	// couldn't be applied, if newer than Version
+	Rejected uint64 `json:"rejected,omitempty"`
+	// Error tells why the Rejected Snapshot wasn't applied
+	Error string `json:"error,omitempty"`
+}
+
+// ApplyFunc applies a Snapshot atomically. If it fails
+// the previous configuration remains in use
+type ApplyFunc func(ctx context.Context, snap *Snapshot) error
+
+// ApplyTo returns an ApplyFunc replacing the configuration of
+// running proxies. The number of proxies can't change, and
+// either all the configurations are applied or none
+func ApplyTo(proxies []*server.Proxy) ApplyFunc {
+	return func(_ context.Context, snap *Snapshot) error {
+		if len(snap.Proxies) != len(proxies) {
+			return core.Wrap(core.ErrInvalid, fmt.Sprintf("%d proxies configured but %d running",
+				len(snap.Proxies), len(proxies)))
+		}
+		return server.ApplyAll(proxies, snap.Proxies)
+	}
+}
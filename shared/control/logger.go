@@ -0,0 +1,21 @@
+package control
+
+import (
+	"darvaza.org/slog"
+)
+
+func (c *Client) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return c.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (c *Client) info() (slog.Logger, bool) {
+	return c.withLogger(slog.Info)
+}
+
+func (c *Client) warn(err error) (slog.Logger, bool) {
+	l, ok := c.withLogger(slog.Warn)
+	if ok && err != nil {
+		l = l.WithField(slog.ErrorFieldName, err)
+	}
+	return l, ok
+}
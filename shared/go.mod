@@ -8,18 +8,20 @@ require (
 	darvaza.org/slog/handlers/cblog v0.6.1
 	darvaza.org/slog/handlers/discard v0.5.1
 	darvaza.org/x/fs v0.4.1
-	darvaza.org/x/tls v0.5.1
 )
 
 require (
+	github.com/quic-go/quic-go v0.49.0
 	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/crypto v0.33.0
 	golang.org/x/net v0.35.0
 	golang.org/x/sync v0.11.0
 )
 
 require (
 	github.com/klauspost/cpuid/v2 v2.2.9 // indirect
-	golang.org/x/crypto v0.33.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
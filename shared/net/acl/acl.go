@@ -0,0 +1,138 @@
+// Package acl implements client IP address access control lists
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"darvaza.org/core"
+)
+
+// Private is the name of the preset matching private,
+// loopback and link-local networks
+const Private = "private"
+
+// PrivateNetworks are the prefixes of the Private preset
+var PrivateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// List decides if clients are allowed by their address. The
+// most specific prefix containing the address decides. Addresses
+// not contained by any are allowed only if the List has no allowed
+// prefixes. A nil List allows everyone.
+type List struct {
+	trie    Trie[bool]
+	allowed int
+}
+
+// New creates a List from allowed and denied prefixes, given
+// as CIDR, single addresses or the Private preset
+func New(allow, deny []string) (*List, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	l := &List{}
+	for _, s := range allow {
+		if err := l.add(s, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range deny {
+		if err := l.add(s, false); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *List) add(s string, allow bool) error {
+	prefixes, err := parse(s)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range prefixes {
+		l.Add(p, allow)
+	}
+	return nil
+}
+
+// Add allows or denies a prefix
+func (l *List) Add(prefix netip.Prefix, allow bool) {
+	l.trie.Insert(prefix.Masked(), allow)
+	if allow {
+		l.allowed++
+	}
+}
+
+func parse(s string) ([]netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.EqualFold(s, Private):
+		return PrivateNetworks, nil
+	case strings.Contains(s, "/"):
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid prefix %q", s))
+		}
+		return []netip.Prefix{p}, nil
+	default:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid address %q", s))
+		}
+		return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+}
+
+// Allowed tells if the address is allowed
+func (l *List) Allowed(addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	if allow, ok := l.trie.Lookup(addr.Unmap()); ok {
+		return allow
+	}
+	return l.allowed == 0
+}
+
+// AllowedAddr tells if the IP address of a net.Addr is
+// allowed. Addresses without IP are only allowed by nil
+// Lists
+func (l *List) AllowedAddr(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	ip, ok := addrIP(addr)
+	return ok && l.Allowed(ip)
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case nil:
+		return netip.Addr{}, false
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		return ap.Addr().Unmap(), err == nil
+	}
+}
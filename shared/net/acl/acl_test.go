@@ -0,0 +1,54 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		addrs       map[string]bool
+	}{
+		{"empty", nil, nil, map[string]bool{"192.0.2.1": true, "2001:db8::1": true}},
+		{"private", []string{Private}, nil, map[string]bool{
+			"10.1.2.3":        true,
+			"::ffff:10.1.2.3": true,
+			"192.168.1.1":     true,
+			"::1":             true,
+			"fd00::1":         true,
+			"192.0.2.1":       false,
+			"2001:db8::1":     false,
+		}},
+		{"deny only", nil, []string{"192.0.2.0/24", "2001:db8::/32"}, map[string]bool{
+			"192.0.2.1":    false,
+			"192.0.3.1":    true,
+			"2001:db8::1":  false,
+			"2001:db9::1":  true,
+			"198.51.100.1": true,
+		}},
+		{"most specific", []string{"10.0.0.0/8", "10.1.1.1"}, []string{"10.1.0.0/16", "::/0"}, map[string]bool{
+			"10.2.0.1":    true,
+			"10.1.0.1":    false,
+			"10.1.1.1":    true,
+			"2001:db8::1": false,
+			"192.0.2.1":   false,
+		}},
+	} {
+		l, err := New(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		for s, expected := range tc.addrs {
+			if ok := l.Allowed(netip.MustParseAddr(s)); ok != expected {
+				t.Errorf("%s: %s: %v (expected %v)", tc.name, s, ok, expected)
+			}
+		}
+	}
+
+	if _, err := New([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
@@ -0,0 +1,29 @@
+package acl
+
+import "net"
+
+// Listener is a net.Listener closing the connections of
+// clients not allowed by its List
+type Listener struct {
+	net.Listener
+
+	List *List
+	// OnReject is optionally called with rejected
+	// connections before closing them
+	OnReject func(net.Conn)
+}
+
+// Accept waits for the next allowed connection
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.List.AllowedAddr(conn.RemoteAddr()) {
+			return conn, err
+		}
+
+		if l.OnReject != nil {
+			l.OnReject(conn)
+		}
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package acl
+
+import (
+	"net/netip"
+)
+
+// Trie is a binary trie of IP prefixes, finding the most
+// specific one containing an address. IPv4 and IPv6 prefixes
+// are kept apart, IPv4-mapped IPv6 addresses are only found
+// by IPv6 prefixes
+type Trie[T any] struct {
+	roots [2]node[T]
+	size  int
+}
+
+type node[T any] struct {
+	child [2]*node[T]
+	value T
+	set   bool
+}
+
+// Insert sets the value of a prefix, replacing the
+// previous if any
+func (t *Trie[T]) Insert(prefix netip.Prefix, value T) {
+	n := t.root(prefix.Addr())
+	b := prefix.Addr().AsSlice()
+
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bitAt(b, i)
+		if n.child[bit] == nil {
+			n.child[bit] = new(node[T])
+		}
+		n = n.child[bit]
+	}
+
+	if !n.set {
+		t.size++
+	}
+	n.value, n.set = value, true
+}
+
+// Lookup returns the value of the most specific prefix
+// containing the address
+func (t *Trie[T]) Lookup(addr netip.Addr) (T, bool) {
+	var value T
+	var found bool
+
+	if !addr.IsValid() {
+		return value, false
+	}
+
+	b := addr.AsSlice()
+	n := t.root(addr)
+	for i := 0; n != nil; i++ {
+		if n.set {
+			value, found = n.value, true
+		}
+		if i == len(b)*8 {
+			break
+		}
+		n = n.child[bitAt(b, i)]
+	}
+	return value, found
+}
+
+// Len returns the number of prefixes in the Trie
+func (t *Trie[T]) Len() int {
+	return t.size
+}
+
+func (t *Trie[T]) root(addr netip.Addr) *node[T] {
+	if addr.Is4() {
+		return &t.roots[0]
+	}
+	return &t.roots[1]
+}
+
+func bitAt(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
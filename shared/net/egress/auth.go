@@ -0,0 +1,62 @@
+package egress
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authenticate checks a username and password
+func (g *Gateway) authenticate(user, password string) bool {
+	stored, ok := g.cfg.Users[user]
+	switch {
+	case !ok:
+		return false
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// isBcrypt tells if a password is a bcrypt hash
+func isBcrypt(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifyHTTP authenticates the client of a request by its
+// verified certificate or its Proxy-Authorization credentials
+func (g *Gateway) identifyHTTP(req *http.Request) (string, error) {
+	if name, ok := certName(req.TLS); ok {
+		return name, nil
+	}
+
+	user, password, ok := proxyBasicAuth(req)
+	switch {
+	case ok && g.authenticate(user, password):
+		return user, nil
+	case !ok && g.cfg.Anonymous:
+		return "", nil
+	default:
+		return "", ErrUnauthorized
+	}
+}
+
+// proxyBasicAuth returns the credentials of the
+// Proxy-Authorization header, if any
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
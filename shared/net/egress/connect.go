@@ -0,0 +1,200 @@
+package egress
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// ServeHTTP handles CONNECT requests, over HTTP/1.1
+// by hijacking the connection, or over HTTP/2 and
+// HTTP/3 using the stream of the request
+func (g *Gateway) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		rw.Header().Set("Allow", http.MethodConnect)
+		http.Error(rw, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := &Session{Protocol: "connect", Destination: req.Host}
+	s.Client = remoteAddr(req.RemoteAddr)
+
+	addr, err := g.authorizeHTTP(req, s)
+	if err != nil {
+		g.refuse(rw, s, err)
+		return
+	}
+
+	conn, reply, err := connectConn(rw, req)
+	if err != nil {
+		g.refuse(rw, s, err)
+		return
+	}
+
+	g.forward(req.Context(), s, conn, addr, reply)
+}
+
+// refuse answers a CONNECT request not forwarded
+func (g *Gateway) refuse(rw http.ResponseWriter, s *Session, err error) {
+	g.done(s, err)
+
+	if errors.Is(err, ErrUnauthorized) {
+		rw.Header().Set("Proxy-Authenticate", `Basic realm="egress"`)
+	}
+	http.Error(rw, err.Error(), statusCode(err))
+}
+
+// authorizeHTTP authenticates the client and
+// resolves the destination
+func (g *Gateway) authorizeHTTP(req *http.Request, s *Session) (netip.AddrPort, error) {
+	user, err := g.identifyHTTP(req)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	s.User = user
+	return g.Resolve(req.Context(), req.Host)
+}
+
+// statusCode returns the HTTP status describing
+// why a request wasn't forwarded
+func statusCode(err error) int {
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusProxyAuthRequired
+	case errors.Is(err, ErrNotAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway
+	default:
+		return proxy.StatusCode(err)
+	}
+}
+
+// connectConn returns the connection of a CONNECT request,
+// and the function replying to it
+func connectConn(rw http.ResponseWriter, req *http.Request) (net.Conn, func(net.Conn, error) error, error) {
+	if req.ProtoMajor > 1 {
+		c := newStreamConn(rw, req)
+		return c, c.reply, nil
+	}
+
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hc := &hijackedConn{Conn: conn, r: brw.Reader}
+	return hc, hc.reply, nil
+}
+
+// hijackedConn is the connection of an HTTP/1.1 CONNECT
+// request, reading first what the server buffered
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *hijackedConn) CloseWrite() error {
+	if w, ok := c.Conn.(proxy.CloseWriter); ok {
+		return w.CloseWrite()
+	}
+	return nil
+}
+
+func (c *hijackedConn) reply(_ net.Conn, err error) error {
+	code := statusCode(err)
+	if err == nil {
+		_, err = io.WriteString(c.Conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+
+	_, _ = fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code))
+	return nil
+}
+
+// streamConn is the stream of an HTTP/2 or HTTP/3
+// CONNECT request
+type streamConn struct {
+	rw    http.ResponseWriter
+	rc    *http.ResponseController
+	body  io.ReadCloser
+	local net.Addr
+	peer  net.Addr
+}
+
+func newStreamConn(rw http.ResponseWriter, req *http.Request) *streamConn {
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &streamConn{
+		rw:    rw,
+		rc:    http.NewResponseController(rw),
+		body:  req.Body,
+		local: local,
+		peer:  remoteAddr(req.RemoteAddr),
+	}
+}
+
+func (c *streamConn) reply(_ net.Conn, err error) error {
+	c.rw.WriteHeader(statusCode(err))
+	if err == nil {
+		return c.rc.Flush()
+	}
+	return nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+// Write flushes every write so the stream isn't delayed
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.rw.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+// Close closes the request body. The stream ends
+// when the handler returns
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.peer }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// remoteAddr parses the RemoteAddr of a request
+func remoteAddr(s string) net.Addr {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
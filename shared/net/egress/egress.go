@@ -0,0 +1,158 @@
+// Package egress implements an audited forward proxy gateway,
+// accepting HTTP CONNECT and SOCKS5 requests to the destinations
+// it allows. The Gateway is an http.Handler, so it can be served
+// by HTTP/3 servers as well
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+var (
+	// ErrNotAllowed indicates the destination isn't allowed
+	ErrNotAllowed = errors.New("destination not allowed")
+	// ErrUnauthorized indicates the client didn't authenticate
+	ErrUnauthorized = errors.New("authentication required")
+)
+
+// DefaultDialTimeout is the default time given to
+// connect to a destination
+const DefaultDialTimeout = 10 * time.Second
+
+// Config describes a Gateway
+type Config struct {
+	// Allow are the destinations allowed, as hostnames,
+	// "*.example.com" for the subdomains of a domain, IP
+	// addresses, CIDR prefixes or "private". If empty
+	// everything not denied is
+	Allow []string
+	// Deny are the destinations rejected, in the same
+	// forms. They win over Allow
+	Deny []string
+	// Ports are the destination ports allowed. If
+	// empty any is
+	Ports []uint16
+
+	// Resolver is the address of the DNS server resolving
+	// destinations, like a gnocco resolver. If empty the
+	// system's is used
+	Resolver string
+
+	// Users maps usernames to their passwords, in plain
+	// or as bcrypt hashes
+	Users map[string]string
+	// Anonymous accepts clients without credentials nor
+	// a verified certificate
+	Anonymous bool
+
+	// DialTimeout is the time given to connect to
+	// a destination
+	DialTimeout time.Duration
+	// Options are applied when forwarding connections
+	Options []proxy.ForwardOption
+	// OnSession is called when each request finishes,
+	// forwarded or not, for auditing
+	OnSession func(*Session)
+}
+
+// SetDefaults fills the gaps in the Config
+func (cfg *Config) SetDefaults() {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+}
+
+// New creates a Gateway from the Config
+func (cfg *Config) New() (*Gateway, error) {
+	cfg.SetDefaults()
+
+	rules, err := newRules(cfg.Allow, cfg.Deny, cfg.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gateway{
+		cfg:      *cfg,
+		rules:    rules,
+		resolver: newResolver(cfg.Resolver),
+		dialer: &proxy.Dialer{
+			Timeout: cfg.DialTimeout,
+			// destinations are arbitrary
+			MaxFails: -1,
+		},
+	}
+	return g, nil
+}
+
+// Gateway is a forward proxy
+type Gateway struct {
+	cfg      Config
+	rules    *rules
+	resolver *net.Resolver
+	dialer   *proxy.Dialer
+}
+
+// Session describes a request to the Gateway
+type Session struct {
+	// Protocol is "connect" or "socks5"
+	Protocol string
+	// User is the username or the name on the verified
+	// certificate of the client, if any
+	User string
+	// Destination is the host:port requested
+	Destination string
+
+	// Stats are the counters of the forwarded connection,
+	// and its Err why it was rejected or closed
+	proxy.Stats
+}
+
+// done finishes a Session
+func (g *Gateway) done(s *Session, err error) {
+	if s.Err == nil {
+		s.Err = err
+	}
+
+	if g.cfg.OnSession != nil {
+		g.cfg.OnSession(s)
+	}
+}
+
+// forward connects the client to the destination, calling reply
+// before forwarding the data. The Session is finished
+func (g *Gateway) forward(ctx context.Context, s *Session, conn net.Conn, addr netip.AddrPort,
+	reply func(net.Conn, error) error) {
+	//
+	opts := append([]proxy.ForwardOption{
+		proxy.WithDialer(g.dialer),
+		proxy.WithReply(reply),
+	}, g.cfg.Options...)
+
+	opts = append(opts, proxy.WithStats(func(st proxy.Stats) {
+		s.Stats = st
+	}))
+
+	err := proxy.Forward(ctx, conn, addr, opts...)
+	g.done(s, err)
+}
+
+// certName returns the name on the verified certificate
+// of a client, if any
+func certName(cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	cert := cs.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" && len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], true
+	}
+	return cert.Subject.CommonName, true
+}
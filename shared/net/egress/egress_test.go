@@ -0,0 +1,203 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
+
+	"darvaza.org/core"
+)
+
+func TestRules(t *testing.T) {
+	r, err := newRules(
+		[]string{"*.example.com", "192.0.2.0/24"},
+		[]string{"bad.example.com", "192.0.2.66", "private"},
+		[]uint16{443})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		addr     string
+		expected bool
+	}{
+		{"www.example.com", "203.0.113.5", true},
+		{"bad.example.com", "203.0.113.5", false},
+		{"www.example.com", "10.0.0.1", false},
+		{"example.org", "203.0.113.5", false},
+		{"", "192.0.2.1", true},
+		{"", "192.0.2.66", false},
+		{"example.org", "192.0.2.1", true},
+	} {
+		if got := r.allowed(tc.name, netip.MustParseAddr(tc.addr)); got != tc.expected {
+			t.Errorf("allowed(%q, %s): %v (expected %v)", tc.name, tc.addr, got, tc.expected)
+		}
+	}
+
+	if r.allowedPort(80) || !r.allowedPort(443) {
+		t.Error("unexpected port decision")
+	}
+
+	if _, err := newRules([]string{"*"}, nil, nil); !errors.Is(err, core.ErrInvalid) {
+		t.Errorf("invalid destination: %v", err)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	echo := newEcho(t)
+	defer echo.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := make(chan *Session, 8)
+	g, err := (&Config{
+		Allow: []string{"127.0.0.1"},
+		Users: map[string]string{"build": string(hash)},
+		OnSession: func(s *Session) {
+			sessions <- s
+		},
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(g)
+	defer ts.Close()
+
+	gateway, target := ts.Listener.Addr().String(), echo.Addr().String()
+	if code := testConnect(t, gateway, target, ""); code != http.StatusProxyAuthRequired {
+		t.Errorf("anonymous: %v", code)
+	}
+	if code := testConnect(t, gateway, "192.0.2.1:443", "build:secret"); code != http.StatusForbidden {
+		t.Errorf("not allowed: %v", code)
+	}
+	if code := testConnect(t, gateway, target, "build:secret"); code != http.StatusOK {
+		t.Errorf("connect: %v", code)
+	}
+
+	testSOCKS(t, g, target)
+
+	for _, expected := range []struct {
+		user      string
+		forwarded bool
+	}{
+		{"", false},
+		{"build", false},
+		{"build", true},
+		{"build", true},
+	} {
+		s := <-sessions
+		forwarded := s.Err == nil && s.Destination == target && s.Sent == 4
+		if s.User != expected.user || forwarded != expected.forwarded {
+			t.Errorf("unexpected session %+v", s)
+		}
+	}
+}
+
+// testConnect sends a CONNECT request, exchanging a
+// message if accepted
+func testConnect(t *testing.T, proxyAddr, target, auth string) int {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode == http.StatusOK {
+		exchange(t, &bufferedConn{Conn: conn, r: br})
+	}
+	return resp.StatusCode
+}
+
+func testSOCKS(t *testing.T, g *Gateway, target string) {
+	client, conn := net.Pipe()
+	go g.ServeSOCKS5(context.Background(), conn, nil)
+
+	d, err := proxy.SOCKS5("tcp", "gateway", &proxy.Auth{User: "build", Password: "secret"},
+		pipeDialer{client})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exchange(t, c)
+}
+
+func exchange(t *testing.T, conn net.Conn) {
+	var buf [4]byte
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "ping" {
+		t.Fatalf("echo %q: %v", buf, err)
+	}
+	_ = conn.Close()
+}
+
+// newEcho starts a server echoing what it receives
+func newEcho(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lsn
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(_, _ string) (net.Conn, error) {
+	return d.conn, nil
+}
@@ -0,0 +1,196 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/acl"
+)
+
+// rules decide which destinations are allowed
+type rules struct {
+	allowNames names
+	denyNames  names
+	// allowIPs is nil if no addresses are allowed, and
+	// denyIPs allows everything not denied
+	allowIPs *acl.List
+	denyIPs  *acl.List
+	ports    []uint16
+}
+
+func newRules(allow, deny []string, ports []uint16) (*rules, error) {
+	r := &rules{ports: ports}
+
+	allowIPs, err := r.allowNames.split(allow)
+	if err != nil {
+		return nil, core.Wrap(err, "allow")
+	}
+	denyIPs, err := r.denyNames.split(deny)
+	if err != nil {
+		return nil, core.Wrap(err, "deny")
+	}
+
+	if r.allowIPs, err = acl.New(allowIPs, nil); err != nil {
+		return nil, core.Wrap(err, "allow")
+	}
+	if r.denyIPs, err = acl.New(nil, denyIPs); err != nil {
+		return nil, core.Wrap(err, "deny")
+	}
+	return r, nil
+}
+
+// allowsAny tells if there are no allowed destinations
+// listed, so only denials apply
+func (r *rules) allowsAny() bool {
+	return r.allowIPs == nil && r.allowNames.empty()
+}
+
+// allowedPort tells if a destination port is allowed
+func (r *rules) allowedPort(port uint16) bool {
+	return len(r.ports) == 0 || core.SliceContains(r.ports, port)
+}
+
+// allowed tells if an address, reached by a name if
+// not empty, is allowed
+func (r *rules) allowed(name string, addr netip.Addr) bool {
+	switch {
+	case !r.denyIPs.Allowed(addr), r.denyNames.match(name):
+		return false
+	case r.allowsAny(), r.allowNames.match(name):
+		return true
+	default:
+		return r.allowIPs != nil && r.allowIPs.Allowed(addr)
+	}
+}
+
+// names are hostnames, and domains whose
+// subdomains match
+type names struct {
+	hosts   map[string]bool
+	domains []string
+}
+
+// split adds the names and returns the rest, addresses
+// and prefixes
+func (n *names) split(entries []string) ([]string, error) {
+	var ips []string
+	for _, s := range entries {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch {
+		case strings.HasPrefix(s, "*."):
+			n.domains = append(n.domains, s[1:])
+		case isAddress(s):
+			ips = append(ips, s)
+		case s == "" || strings.ContainsAny(s, "*/:"):
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid destination %q", s))
+		default:
+			if n.hosts == nil {
+				n.hosts = make(map[string]bool)
+			}
+			n.hosts[strings.TrimSuffix(s, ".")] = true
+		}
+	}
+	return ips, nil
+}
+
+// isAddress tells if an entry is for addresses
+func isAddress(s string) bool {
+	if s == acl.Private || strings.Contains(s, "/") {
+		return true
+	}
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+func (n *names) empty() bool {
+	return len(n.hosts) == 0 && len(n.domains) == 0
+}
+
+func (n *names) match(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if n.hosts[name] {
+		return true
+	}
+	for _, suffix := range n.domains {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newResolver creates a net.Resolver using the given DNS
+// server, or the system's if empty
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolve returns the address to connect to reach a host:port,
+// the first allowed address of the host
+func (g *Gateway) Resolve(ctx context.Context, hostport string) (netip.AddrPort, error) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil || port == 0 || !g.rules.allowedPort(uint16(port)) {
+		return netip.AddrPort{}, fmt.Errorf("%w: port %q", ErrNotAllowed, p)
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !g.rules.allowed("", addr.Unmap()) {
+			return netip.AddrPort{}, fmt.Errorf("%w: %s", ErrNotAllowed, hostport)
+		}
+		return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+	}
+
+	addr, err := g.lookup(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// lookup resolves a name to its first allowed address
+func (g *Gateway) lookup(ctx context.Context, name string) (netip.Addr, error) {
+	if g.rules.denyNames.match(name) {
+		return netip.Addr{}, fmt.Errorf("%w: %q", ErrNotAllowed, name)
+	}
+
+	addrs, err := g.resolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, addr := range addrs {
+		if addr = addr.Unmap(); g.rules.allowed(name, addr) {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%w: %q", ErrNotAllowed, name)
+}
@@ -0,0 +1,87 @@
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"darvaza.org/darvaza/shared/net/socks5"
+)
+
+// HandshakeTimeout is the time given to SOCKS5
+// clients to send their request
+const HandshakeTimeout = 10 * time.Second
+
+// ServeSOCKS5 handles a SOCKS5 client. cs is the state of the
+// TLS connection it came through, if any, authenticating it
+// by its verified certificate instead of credentials
+func (g *Gateway) ServeSOCKS5(ctx context.Context, conn net.Conn, cs *tls.ConnectionState) {
+	defer conn.Close()
+
+	s := &Session{Protocol: "socks5"}
+	s.Client = conn.RemoteAddr()
+
+	name, verified := certName(cs)
+
+	_ = conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	req, err := g.socksServer(verified).Handshake(conn)
+	if err != nil {
+		g.done(s, err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	s.User = name
+	if !verified {
+		s.User = req.User
+	}
+	s.Destination = req.Addr()
+
+	addr, err := g.Resolve(ctx, s.Destination)
+	if err != nil {
+		_ = socks5.WriteReply(conn, replyCode(err), netip.AddrPort{})
+		g.done(s, err)
+		return
+	}
+
+	g.forward(ctx, s, conn, addr, func(upstream net.Conn, err error) error {
+		if err != nil {
+			return socks5.WriteReply(conn, replyCode(err), netip.AddrPort{})
+		}
+
+		bound, _ := netip.ParseAddrPort(upstream.LocalAddr().String())
+		return socks5.WriteReply(conn, socks5.Succeeded, bound)
+	})
+}
+
+// socksServer returns the socks5.Server authenticating clients
+// not identified by their certificate
+func (g *Gateway) socksServer(verified bool) *socks5.Server {
+	if verified {
+		return &socks5.Server{}
+	}
+
+	return &socks5.Server{
+		// without users only anonymous clients are accepted
+		Authenticate: g.authenticate,
+		Anonymous:    g.cfg.Anonymous,
+	}
+}
+
+// replyCode returns the socks5.ReplyCode describing
+// why a request wasn't forwarded
+func replyCode(err error) socks5.ReplyCode {
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return socks5.NotAllowed
+	case errors.As(err, &dnsErr):
+		return socks5.HostUnreachable
+	default:
+		return socks5.ReplyCodeOf(err)
+	}
+}
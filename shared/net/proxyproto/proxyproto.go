@@ -0,0 +1,135 @@
+// Package proxyproto implements the HAProxy PROXY protocol,
+// versions 1 and 2
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+
+	"darvaza.org/core"
+)
+
+var (
+	// ErrNoSignature indicates the data doesn't start with
+	// a PROXY protocol header
+	ErrNoSignature = errors.New("no PROXY protocol signature")
+	// ErrInvalidHeader indicates a malformed PROXY protocol header
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+var (
+	// SignatureV1 is the start of a version 1 header
+	SignatureV1 = []byte("PROXY ")
+	// SignatureV2 is the start of a version 2 header
+	SignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// MaxV1Length is the maximum length of a version 1 header,
+	// including the CRLF
+	MaxV1Length = 107
+	// V2HeaderLength is the length of the fixed part of a
+	// version 2 header
+	V2HeaderLength = 16
+)
+
+// Command is the command of a version 2 header
+type Command byte
+
+const (
+	// CommandLocal indicates a connection established by the proxy
+	// itself, the addresses should be ignored
+	CommandLocal Command = 0x0
+	// CommandProxy indicates a relayed connection
+	CommandProxy Command = 0x1
+)
+
+// Transport is the transport protocol of the relayed connection
+type Transport byte
+
+const (
+	// TransportUnspec is an unknown or unsupported transport
+	TransportUnspec Transport = 0x0
+	// TransportStream is a stream connection, like TCP
+	TransportStream Transport = 0x1
+	// TransportDatagram is a datagram connection, like UDP
+	TransportDatagram Transport = 0x2
+)
+
+// TLV is a Type-Length-Value extension of a version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header
+type Header struct {
+	Version   int
+	Command   Command
+	Transport Transport
+
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	TLVs []TLV
+}
+
+// IsLocal tells if the addresses should be ignored
+func (h *Header) IsLocal() bool {
+	return h.Command == CommandLocal || !h.Source.IsValid()
+}
+
+// SourceAddr returns the source of the relayed connection
+// as net.Addr, or nil if not known
+func (h *Header) SourceAddr() net.Addr {
+	return h.netAddr(h.Source)
+}
+
+// DestinationAddr returns the destination of the relayed
+// connection as net.Addr, or nil if not known
+func (h *Header) DestinationAddr() net.Addr {
+	return h.netAddr(h.Destination)
+}
+
+func (h *Header) netAddr(ap netip.AddrPort) net.Addr {
+	switch {
+	case h.IsLocal() || !ap.IsValid():
+		return nil
+	case h.Transport == TransportDatagram:
+		return net.UDPAddrFromAddrPort(ap)
+	default:
+		return net.TCPAddrFromAddrPort(ap)
+	}
+}
+
+// TLV returns the value of the first TLV of the given type
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// HasSignature tells if the data starts with a PROXY protocol
+// signature, or could if more data was available. The returned
+// version is zero when undecided
+func HasSignature(b []byte) (version int, ok bool) {
+	switch {
+	case hasPrefix(b, SignatureV1):
+		return core.IIf(len(b) >= len(SignatureV1), 1, 0), true
+	case hasPrefix(b, SignatureV2):
+		return core.IIf(len(b) >= len(SignatureV2), 2, 0), true
+	default:
+		return 0, false
+	}
+}
+
+// hasPrefix tells if b and prefix agree on their common length
+func hasPrefix(b, prefix []byte) bool {
+	n := min(len(b), len(prefix))
+	return n > 0 && bytes.Equal(b[:n], prefix[:n])
+}
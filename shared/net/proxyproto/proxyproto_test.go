@@ -0,0 +1,98 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestReadV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /")))
+
+	h, err := Read(r)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case h.Version != 1 || h.Command != CommandProxy:
+		t.Errorf("unexpected header %+v", h)
+	case h.Source != netip.MustParseAddrPort("192.0.2.1:56324"):
+		t.Errorf("unexpected source %s", h.Source)
+	case h.Destination != netip.MustParseAddrPort("198.51.100.1:443"):
+		t.Errorf("unexpected destination %s", h.Destination)
+	}
+
+	if rest, _ := r.Peek(5); string(rest) != "GET /" {
+		t.Errorf("payload not preserved: %q", rest)
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	b := append([]byte{}, SignatureV2...)
+	b = append(b, 0x21, 0x11, 0, 12+7)
+	b = append(b, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb)
+	b = append(b, 0x01, 0, 4, 'h', 't', 't', 'p')
+	b = append(b, "payload"...)
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	h, err := Read(r)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case h.Version != 2 || h.Command != CommandProxy || h.Transport != TransportStream:
+		t.Errorf("unexpected header %+v", h)
+	case h.Source != netip.MustParseAddrPort("192.0.2.1:56324"):
+		t.Errorf("unexpected source %s", h.Source)
+	case h.Destination != netip.MustParseAddrPort("198.51.100.1:443"):
+		t.Errorf("unexpected destination %s", h.Destination)
+	}
+
+	if v, ok := h.TLV(0x01); !ok || string(v) != "http" {
+		t.Errorf("unexpected TLV %q", v)
+	}
+
+	if rest, _ := r.Peek(7); string(rest) != "payload" {
+		t.Errorf("payload not preserved: %q", rest)
+	}
+}
+
+func TestReadNoSignature(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))
+	if _, err := Read(r); err != ErrNoSignature {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, h := range []*Header{
+		{Version: 1, Command: CommandProxy, Transport: TransportStream,
+			Source:      netip.MustParseAddrPort("192.0.2.1:56324"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443")},
+		{Version: 1, Command: CommandLocal},
+		{Version: 2, Command: CommandProxy, Transport: TransportStream,
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:56324"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			TLVs: []TLV{
+				{TypeAuthority, []byte("www.example.org")},
+				{TypeALPN, []byte("h2")},
+				SSLInfo{Version: "TLSv1.3", CN: "client"}.TLV(),
+			}},
+		{Version: 2, Command: CommandLocal},
+	} {
+		b, err := h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h2, err := Read(bufio.NewReader(bytes.NewReader(b)))
+		switch {
+		case err != nil:
+			t.Errorf("%q: %s", b, err)
+		case h2.Version != h.Version || h2.Command != h.Command ||
+			h2.Source != h.Source || h2.Destination != h.Destination:
+			t.Errorf("%q: got %+v", b, h2)
+		case len(h2.TLVs) != len(h.TLVs):
+			t.Errorf("%q: got %v TLVs", b, len(h2.TLVs))
+		}
+	}
+}
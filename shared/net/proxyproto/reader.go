@@ -0,0 +1,250 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"darvaza.org/core"
+)
+
+// Read consumes a PROXY protocol header, of either version,
+// from the reader. ErrNoSignature is returned, without consuming
+// anything, if the data doesn't start with one
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(SignatureV1))
+	if err != nil {
+		return nil, err
+	} else if bytes.Equal(b, SignatureV1) {
+		return readV1(r)
+	}
+
+	b, err = r.Peek(len(SignatureV2))
+	switch {
+	case err != nil && !hasPrefix(b, SignatureV2):
+		return nil, ErrNoSignature
+	case err != nil:
+		return nil, err
+	case !bytes.Equal(b, SignatureV2):
+		return nil, ErrNoSignature
+	default:
+		return readV2(r)
+	}
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+
+	// find the CRLF within the maximum length
+	for n := len(SignatureV1); ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return nil, err
+		} else if bytes.HasSuffix(b, []byte("\r\n")) {
+			line = b
+			break
+		} else if n >= MaxV1Length {
+			return nil, core.Wrap(ErrInvalidHeader, "v1: line too long")
+		}
+	}
+
+	h, err := ParseV1(string(line[:len(line)-2]))
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = r.Discard(len(line))
+	return h, nil
+}
+
+// ParseV1 parses a version 1 header line, without the CRLF
+func ParseV1(line string) (*Header, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, core.Wrap(ErrInvalidHeader, "v1: bad signature")
+	}
+
+	h := &Header{
+		Version: 1,
+		Command: CommandProxy,
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// rest of the line is ignored
+		h.Command = CommandLocal
+		return h, nil
+	case "TCP4", "TCP6":
+		h.Transport = TransportStream
+	default:
+		return nil, core.Wrap(ErrInvalidHeader, "v1: bad protocol")
+	}
+
+	if len(fields) != 6 {
+		return nil, core.Wrap(ErrInvalidHeader, "v1: bad number of fields")
+	}
+
+	src, err1 := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err1 != nil || err2 != nil {
+		return nil, core.Wrap(ErrInvalidHeader, "v1: bad address")
+	}
+
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(addr, port string, is4 bool) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	} else if ip.Is4() != is4 || ip.Zone() != "" {
+		return netip.AddrPort{}, ErrInvalidHeader
+	}
+
+	// no leading zeros allowed
+	if len(port) > 1 && port[0] == '0' {
+		return netip.AddrPort{}, ErrInvalidHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(V2HeaderLength)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if r.Size() < V2HeaderLength+length {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: header too long")
+	}
+
+	b, err = r.Peek(V2HeaderLength + length)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := ParseV2(b)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = r.Discard(len(b))
+	return h, nil
+}
+
+// ParseV2 parses a whole version 2 header
+func ParseV2(b []byte) (*Header, error) {
+	if len(b) < V2HeaderLength || !bytes.HasPrefix(b, SignatureV2) {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: bad signature")
+	}
+
+	if b[12]>>4 != 2 {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: bad version")
+	}
+
+	h := &Header{
+		Version:   2,
+		Command:   Command(b[12] & 0xf),
+		Transport: Transport(b[13] & 0xf),
+	}
+
+	if h.Command > CommandProxy || h.Transport > TransportDatagram {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: bad command or transport")
+	}
+
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) != V2HeaderLength+length {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: bad length")
+	}
+
+	rest, err := h.parseV2Addrs(b[13]>>4, b[V2HeaderLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	h.TLVs, err = parseTLVs(rest)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	addrLenInet  = 4 + 4 + 2 + 2
+	addrLenInet6 = 16 + 16 + 2 + 2
+	addrLenUnix  = 108 + 108
+)
+
+func (h *Header) parseV2Addrs(family byte, b []byte) ([]byte, error) {
+	var size int
+
+	switch family {
+	case familyUnspec:
+		return b, nil
+	case familyInet:
+		size = addrLenInet
+	case familyInet6:
+		size = addrLenInet6
+	case familyUnix:
+		// addresses not supported, skipped
+		if len(b) < addrLenUnix {
+			return nil, core.Wrap(ErrInvalidHeader, "v2: short address")
+		}
+		return b[addrLenUnix:], nil
+	default:
+		return nil, core.Wrap(ErrInvalidHeader, "v2: bad address family")
+	}
+
+	if len(b) < size {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: short address")
+	}
+
+	n := (size - 4) / 2
+	src, _ := netip.AddrFromSlice(b[:n])
+	dst, _ := netip.AddrFromSlice(b[n : 2*n])
+	sport := binary.BigEndian.Uint16(b[2*n:])
+	dport := binary.BigEndian.Uint16(b[2*n+2:])
+
+	h.Source = netip.AddrPortFrom(src, sport)
+	h.Destination = netip.AddrPortFrom(dst, dport)
+	return b[size:], nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var out []TLV
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, core.Wrap(ErrInvalidHeader, "v2: short TLV")
+		}
+
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, core.Wrap(ErrInvalidHeader, "v2: short TLV")
+		}
+
+		out = append(out, TLV{
+			Type:  b[0],
+			Value: bytes.Clone(b[3 : 3+n]),
+		})
+		b = b[3+n:]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,166 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"darvaza.org/core"
+)
+
+// TLV types of version 2 headers
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+
+	// sub-types of TypeSSL
+	SubtypeSSLVersion byte = 0x21
+	SubtypeSSLCN      byte = 0x22
+	SubtypeSSLCipher  byte = 0x23
+	SubtypeSSLSigAlg  byte = 0x24
+	SubtypeSSLKeyAlg  byte = 0x25
+)
+
+// Flags of the client field of TypeSSL
+const (
+	ClientSSL      byte = 0x01
+	ClientCertConn byte = 0x02
+	ClientCertSess byte = 0x04
+)
+
+// SSLInfo describes the TLS session of the client, for TypeSSL
+type SSLInfo struct {
+	// Version is the name of the TLS version, like "TLSv1.3"
+	Version string
+	// Cipher is the name of the cipher suite
+	Cipher string
+	// CN is the Common Name of the client certificate
+	CN string
+	// CertVerified tells if the client presented a
+	// certificate that was verified
+	CertVerified bool
+}
+
+// TLV encodes the SSLInfo as TypeSSL TLV
+func (si SSLInfo) TLV() TLV {
+	var buf bytes.Buffer
+
+	client := ClientSSL
+	if si.CertVerified {
+		client |= ClientCertConn | ClientCertSess
+	}
+	buf.WriteByte(client)
+
+	// verify, zero when the certificate was verified
+	_ = binary.Write(&buf, binary.BigEndian, uint32(core.IIf(si.CertVerified, 0, 1)))
+
+	for _, sub := range []TLV{
+		{SubtypeSSLVersion, []byte(si.Version)},
+		{SubtypeSSLCipher, []byte(si.Cipher)},
+		{SubtypeSSLCN, []byte(si.CN)},
+	} {
+		if len(sub.Value) > 0 {
+			writeTLV(&buf, sub)
+		}
+	}
+
+	return TLV{Type: TypeSSL, Value: buf.Bytes()}
+}
+
+// Format encodes the header according to its Version. Version 1
+// headers can't carry TLVs, and describe anything but TCP
+// connections as UNKNOWN
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return []byte(h.formatV1()), nil
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, fmt.Errorf("%w: version %v", ErrInvalidHeader, h.Version)
+	}
+}
+
+// WriteTo writes the encoded header
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() string {
+	src, dst, ok := h.addrs()
+	if !ok || h.Transport != TransportStream {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	proto := core.IIf(src.Addr().Is4(), "TCP4", "TCP6")
+	return fmt.Sprintf("PROXY %s %s %s %v %v\r\n", proto,
+		src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var body bytes.Buffer
+
+	command, family := h.Command, byte(familyUnspec)
+	if src, dst, ok := h.addrs(); ok {
+		family = core.IIf[byte](src.Addr().Is4(), familyInet, familyInet6)
+		body.Write(src.Addr().AsSlice())
+		body.Write(dst.Addr().AsSlice())
+		_ = binary.Write(&body, binary.BigEndian, src.Port())
+		_ = binary.Write(&body, binary.BigEndian, dst.Port())
+	} else {
+		command = CommandLocal
+	}
+
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, core.Wrap(ErrInvalidHeader, "v2: TLV too long")
+		}
+		writeTLV(&body, tlv)
+	}
+
+	if body.Len() > 0xffff {
+		return nil, core.Wrap(ErrInvalidHeader, "v2: header too long")
+	}
+
+	out := make([]byte, 0, V2HeaderLength+body.Len())
+	out = append(out, SignatureV2...)
+	out = append(out, 0x20|byte(command), family<<4|byte(h.Transport))
+	out = binary.BigEndian.AppendUint16(out, uint16(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+// addrs returns the addresses of a relayed connection, both
+// of the same family
+func (h *Header) addrs() (src, dst netip.AddrPort, ok bool) {
+	if h.IsLocal() || !h.Destination.IsValid() {
+		return src, dst, false
+	}
+
+	src = netip.AddrPortFrom(h.Source.Addr().Unmap(), h.Source.Port())
+	dst = netip.AddrPortFrom(h.Destination.Addr().Unmap(), h.Destination.Port())
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		// mixed families, use IPv6 for both
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return src, dst, true
+}
+
+func writeTLV(buf *bytes.Buffer, tlv TLV) {
+	buf.WriteByte(tlv.Type)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(tlv.Value)))
+	buf.Write(tlv.Value)
+}
@@ -0,0 +1,196 @@
+package quic
+
+import (
+	"sort"
+
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+// Frame types allowed on client Initial packets
+const (
+	framePadding         = 0x00
+	framePing            = 0x01
+	frameACK             = 0x02
+	frameACKECN          = 0x03
+	frameCrypto          = 0x06
+	frameConnectionClose = 0x1c
+)
+
+// CryptoFrame is the data of a CRYPTO frame
+type CryptoFrame struct {
+	Offset uint64
+	Data   []byte
+}
+
+// CryptoFrames extracts the CRYPTO frames from the payload
+// of an Initial packet
+func CryptoFrames(payload []byte) ([]CryptoFrame, error) {
+	var out []CryptoFrame
+	var ok bool
+
+	for off := 0; off < len(payload); {
+		typ := payload[off]
+		off++
+
+		switch typ {
+		case framePadding, framePing:
+			continue
+		case frameACK, frameACKECN:
+			off, ok = skipACK(payload, off, typ == frameACKECN)
+		case frameCrypto:
+			var f CryptoFrame
+			f, off, ok = readCrypto(payload, off)
+			out = append(out, f)
+		case frameConnectionClose:
+			off, ok = skipConnectionClose(payload, off)
+		default:
+			ok = false
+		}
+
+		if !ok {
+			return nil, ErrInvalidPacket
+		}
+	}
+
+	return out, nil
+}
+
+func readCrypto(b []byte, off int) (CryptoFrame, int, bool) {
+	offset, off, ok := readVarint(b, off)
+	if !ok {
+		return CryptoFrame{}, off, false
+	}
+
+	n, off, ok := readVarint(b, off)
+	if !ok || uint64(len(b)-off) < n {
+		return CryptoFrame{}, off, false
+	}
+
+	end := off + int(n)
+	return CryptoFrame{Offset: offset, Data: b[off:end]}, end, true
+}
+
+func skipACK(b []byte, off int, ecn bool) (int, bool) {
+	var v [4]uint64
+	var ok bool
+
+	// largest acknowledged, delay, range count, first range
+	for i := range v {
+		if v[i], off, ok = readVarint(b, off); !ok {
+			return off, false
+		}
+	}
+
+	// gap and length of each range, and the ECN counts
+	n := 2 * v[2]
+	if ecn {
+		n += 3
+	}
+	return skipVarints(b, off, n)
+}
+
+func skipVarints(b []byte, off int, n uint64) (int, bool) {
+	var ok bool
+	for i := uint64(0); i < n; i++ {
+		if _, off, ok = readVarint(b, off); !ok {
+			return off, false
+		}
+	}
+	return off, true
+}
+
+func skipConnectionClose(b []byte, off int) (int, bool) {
+	var n uint64
+
+	// error code, frame type
+	off, ok := skipVarints(b, off, 2)
+	if !ok {
+		return off, false
+	}
+
+	if n, off, ok = readVarint(b, off); !ok || uint64(len(b)-off) < n {
+		return off, false
+	}
+	return off + int(n), true
+}
+
+// CryptoStream reassembles the CRYPTO frames of the Initial
+// packets of a client, which may come in any order and
+// spread across packets
+type CryptoStream struct {
+	// MaxSize limits the size of the ClientHello
+	MaxSize int
+
+	buf    []byte
+	ranges [][2]uint64
+}
+
+// Add adds the data of a CRYPTO frame to the stream
+func (s *CryptoStream) Add(f CryptoFrame) error {
+	end := f.Offset + uint64(len(f.Data))
+	if end > uint64(s.maxSize()) {
+		return hello.ErrTooLarge
+	} else if len(f.Data) == 0 {
+		return nil
+	}
+
+	if end > uint64(len(s.buf)) {
+		s.buf = append(s.buf, make([]byte, int(end)-len(s.buf))...)
+	}
+	copy(s.buf[f.Offset:], f.Data)
+	s.addRange(f.Offset, end)
+	return nil
+}
+
+func (s *CryptoStream) addRange(start, end uint64) {
+	s.ranges = append(s.ranges, [2]uint64{start, end})
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return s.ranges[i][0] < s.ranges[j][0]
+	})
+
+	merged := s.ranges[:1]
+	for _, r := range s.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	s.ranges = merged
+}
+
+func (s *CryptoStream) maxSize() int {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return hello.DefaultMaxSize
+}
+
+// contiguous returns the data received without gaps
+// from the start of the stream
+func (s *CryptoStream) contiguous() []byte {
+	if len(s.ranges) == 0 || s.ranges[0][0] != 0 {
+		return nil
+	}
+	return s.buf[:s.ranges[0][1]]
+}
+
+// ClientHello returns the ClientHello once it has been
+// completely received, or nil otherwise
+func (s *CryptoStream) ClientHello() (*hello.ClientHello, error) {
+	b := s.contiguous()
+	if len(b) < 4 {
+		return nil, nil
+	}
+
+	n := 4 + (int(b[1])<<16 | int(b[2])<<8 | int(b[3]))
+	switch {
+	case n > s.maxSize():
+		return nil, hello.ErrTooLarge
+	case len(b) < n:
+		return nil, nil
+	default:
+		return hello.Parse(b[:n])
+	}
+}
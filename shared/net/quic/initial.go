@@ -0,0 +1,139 @@
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// initialSalts are the salts used to derive the Initial
+// secrets, RFC 9001 section 5.2 and RFC 9369 section 3.3.1
+var initialSalts = map[uint32][]byte{
+	Version1: {
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	},
+	Version2: {
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	},
+}
+
+// keyLabels are the HKDF labels for the packet protection keys
+var keyLabels = map[uint32][3]string{
+	Version1: {"quic key", "quic iv", "quic hp"},
+	Version2: {"quicv2 key", "quicv2 iv", "quicv2 hp"},
+}
+
+// InitialKeys are the keys protecting the Initial packets
+// sent by a client
+type InitialKeys struct {
+	Key []byte
+	IV  []byte
+	HP  []byte
+}
+
+// ClientInitialKeys derives the keys protecting the Initial
+// packets of a client from the Destination Connection ID
+// it chose
+func ClientInitialKeys(version uint32, dcid []byte) (*InitialKeys, error) {
+	salt, ok := initialSalts[version]
+	if !ok {
+		return nil, ErrUnsupportedVersion
+	}
+	labels := keyLabels[version]
+
+	initial := hkdf.Extract(sha256.New, dcid, salt)
+	secret := expandLabel(initial, "client in", sha256.Size)
+
+	return &InitialKeys{
+		Key: expandLabel(secret, labels[0], 16),
+		IV:  expandLabel(secret, labels[1], 12),
+		HP:  expandLabel(secret, labels[2], 16),
+	}, nil
+}
+
+// expandLabel implements HKDF-Expand-Label from TLS 1.3
+// with an empty context
+func expandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 "))
+		b.AddBytes([]byte(label))
+	})
+	b.AddUint8LengthPrefixed(func(*cryptobyte.Builder) {})
+
+	out := make([]byte, length)
+	r := hkdf.Expand(sha256.New, secret, b.BytesOrPanic())
+	if _, err := io.ReadFull(r, out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Decrypt removes the protection of a client Initial packet
+// and returns its payload
+func (p *Packet) Decrypt() ([]byte, error) {
+	if p.Type != PacketInitial {
+		return nil, ErrInvalidPacket
+	}
+
+	keys, err := ClientInitialKeys(p.Version, p.DCID)
+	if err != nil {
+		return nil, err
+	}
+	return keys.open(p)
+}
+
+func (keys *InitialKeys) open(p *Packet) ([]byte, error) {
+	// the sample starts 4 bytes after the packet number
+	// regardless of its length
+	sampleOffset := p.pnOffset + 4
+	if len(p.Raw) < sampleOffset+aes.BlockSize {
+		return nil, ErrTruncated
+	}
+
+	hp, err := aes.NewCipher(keys.HP)
+	if err != nil {
+		return nil, err
+	}
+
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], p.Raw[sampleOffset:sampleOffset+aes.BlockSize])
+
+	// unprotect a copy of the header
+	b0 := p.Raw[0] ^ mask[0]&0x0f
+	pnLen := int(b0&0x3) + 1
+	hdr := make([]byte, p.pnOffset+pnLen)
+	copy(hdr, p.Raw)
+	hdr[0] = b0
+
+	// the first packets of a client are numbered low enough
+	// for the truncated packet number to be the full one
+	nonce := make([]byte, len(keys.IV))
+	copy(nonce, keys.IV)
+	for i := 0; i < pnLen; i++ {
+		hdr[p.pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLen+i] ^= hdr[p.pnOffset+i]
+	}
+
+	block, err := aes.NewCipher(keys.Key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := aead.Open(nil, nonce, p.Raw[len(hdr):], hdr)
+	if err != nil {
+		return nil, ErrInvalidPacket
+	}
+	return payload, nil
+}
@@ -0,0 +1,23 @@
+package quic
+
+import (
+	"darvaza.org/slog"
+)
+
+func (r *Relay) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return r.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (r *Relay) info() (slog.Logger, bool) {
+	return r.withLogger(slog.Info)
+}
+
+func (r *Relay) warn(err error) (slog.Logger, bool) {
+	if l, ok := r.withLogger(slog.Warn); ok {
+		if err != nil {
+			l = l.WithField(slog.ErrorFieldName, err)
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,189 @@
+// Package quic inspects the Initial packets of QUIC connections
+// to route them without terminating them
+package quic
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Versions of QUIC with known Initial secrets
+const (
+	Version1 uint32 = 0x00000001
+	Version2 uint32 = 0x6b3343cf
+)
+
+// MaxConnIDLength is the maximum length of a connection ID
+// on QUIC v1 and v2
+const MaxConnIDLength = 20
+
+var (
+	// ErrShortHeader indicates a packet with short header
+	ErrShortHeader = errors.New("short header packet")
+	// ErrTruncated indicates the packet is incomplete
+	ErrTruncated = errors.New("truncated packet")
+	// ErrUnsupportedVersion indicates a version of QUIC
+	// we don't know the Initial secrets of
+	ErrUnsupportedVersion = errors.New("unsupported QUIC version")
+	// ErrInvalidPacket indicates a packet that couldn't be
+	// parsed or decrypted
+	ErrInvalidPacket = errors.New("invalid QUIC packet")
+)
+
+// PacketType is the type of long header packet
+type PacketType int
+
+// Long header packet types
+const (
+	PacketInitial PacketType = iota
+	Packet0RTT
+	PacketHandshake
+	PacketRetry
+	PacketVersionNegotiation
+)
+
+var packetTypeNames = map[PacketType]string{
+	PacketInitial:            "Initial",
+	Packet0RTT:               "0-RTT",
+	PacketHandshake:          "Handshake",
+	PacketRetry:              "Retry",
+	PacketVersionNegotiation: "VersionNegotiation",
+}
+
+func (t PacketType) String() string {
+	if s, ok := packetTypeNames[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// IsLongHeader tells if a datagram starts with a long header packet
+func IsLongHeader(b []byte) bool {
+	return len(b) > 0 && b[0]&0x80 != 0
+}
+
+// Packet is a long header packet
+type Packet struct {
+	Version uint32
+	Type    PacketType
+	DCID    []byte
+	SCID    []byte
+	Token   []byte
+
+	// Raw is the whole packet, still protected
+	Raw []byte
+
+	// pnOffset is where the protected packet number starts
+	pnOffset int
+}
+
+// ParsePacket parses the long header packet at the start of a
+// datagram, returning what follows it as rest when packets
+// are coalesced
+func ParsePacket(b []byte) (p *Packet, rest []byte, err error) {
+	if !IsLongHeader(b) {
+		return nil, nil, ErrShortHeader
+	} else if len(b) < 7 {
+		return nil, nil, ErrTruncated
+	}
+
+	p = &Packet{Version: binary.BigEndian.Uint32(b[1:5])}
+
+	off := 5
+	if p.DCID, off, err = readConnID(b, off); err != nil {
+		return nil, nil, err
+	}
+	if p.SCID, off, err = readConnID(b, off); err != nil {
+		return nil, nil, err
+	}
+
+	if p.Version == 0 {
+		p.Type = PacketVersionNegotiation
+		p.Raw = b
+		return p, nil, nil
+	}
+
+	p.Type, err = packetType(p.Version, b[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p.parseRest(b, off)
+}
+
+func (p *Packet) parseRest(b []byte, off int) (*Packet, []byte, error) {
+	var ok bool
+
+	switch p.Type {
+	case PacketRetry:
+		// Retry packets take the rest of the datagram
+		p.Raw = b
+		return p, nil, nil
+	case PacketInitial:
+		var n uint64
+		if n, off, ok = readVarint(b, off); !ok || uint64(len(b)-off) < n {
+			return nil, nil, ErrTruncated
+		}
+		p.Token = b[off : off+int(n)]
+		off += int(n)
+	}
+
+	length, off, ok := readVarint(b, off)
+	if !ok || uint64(len(b)-off) < length {
+		return nil, nil, ErrTruncated
+	}
+
+	end := off + int(length)
+	p.Raw, p.pnOffset = b[:end], off
+	return p, b[end:], nil
+}
+
+// packetType decodes the type of long header packet, which
+// QUIC v2 encodes differently
+func packetType(version uint32, b0 byte) (PacketType, error) {
+	t := PacketType(b0>>4) & 0x3
+
+	switch version {
+	case Version1:
+		return t, nil
+	case Version2:
+		return (t + 3) & 0x3, nil
+	default:
+		return 0, ErrUnsupportedVersion
+	}
+}
+
+func readConnID(b []byte, off int) ([]byte, int, error) {
+	if off >= len(b) {
+		return nil, off, ErrTruncated
+	}
+
+	n := int(b[off])
+	off++
+	switch {
+	case n > MaxConnIDLength:
+		return nil, off, ErrInvalidPacket
+	case off+n > len(b):
+		return nil, off, ErrTruncated
+	default:
+		return b[off : off+n], off + n, nil
+	}
+}
+
+// readVarint reads a QUIC variable-length integer
+func readVarint(b []byte, off int) (uint64, int, bool) {
+	if off >= len(b) {
+		return 0, off, false
+	}
+
+	n := 1 << (b[off] >> 6)
+	if off+n > len(b) {
+		return 0, off, false
+	}
+
+	v := uint64(b[off] & 0x3f)
+	for _, c := range b[off+1 : off+n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, off + n, true
+}
@@ -0,0 +1,174 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9001 Appendix A.1 and RFC 9369 Appendix A.1
+func TestClientInitialKeys(t *testing.T) {
+	dcid := mustHex("8394c8f03e515708")
+
+	for _, tc := range []struct {
+		version     uint32
+		key, iv, hp string
+	}{
+		{Version1,
+			"1f369613dd76d5467730efcbe3b1a22d",
+			"fa044b2f42a3fd3b46fb255c",
+			"9f50449e04a0e810283a1e9933adedd2"},
+		{Version2,
+			"8b1a0bc121284290a29e0971b5cd045d",
+			"91f73e2351d8fa91660e909f",
+			"45b95e15235d6f45a6b19cbcb0294ba9"},
+	} {
+		keys, err := ClientInitialKeys(tc.version, dcid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hex.EncodeToString(keys.Key) != tc.key ||
+			hex.EncodeToString(keys.IV) != tc.iv ||
+			hex.EncodeToString(keys.HP) != tc.hp {
+			t.Errorf("%#x: key:%x iv:%x hp:%x", tc.version, keys.Key, keys.IV, keys.HP)
+		}
+	}
+}
+
+// sealInitial builds a protected client Initial packet
+func sealInitial(t *testing.T, version uint32, dcid []byte, pn byte, payload []byte) []byte {
+	keys, err := ClientInitialKeys(version, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b0 := byte(0xc0)
+	if version == Version2 {
+		b0 |= 0x10
+	}
+
+	// one byte packet number, 16 bytes of tag
+	length := 1 + len(payload) + 16
+	hdr := []byte{b0, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	hdr = append(hdr, byte(len(dcid)))
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, 0, 0, 0x40|byte(length>>8), byte(length), pn)
+	pnOffset := len(hdr) - 1
+
+	block, _ := aes.NewCipher(keys.Key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := bytes.Clone(keys.IV)
+	nonce[len(nonce)-1] ^= pn
+	out := aead.Seal(hdr, nonce, payload, hdr)
+
+	hp, _ := aes.NewCipher(keys.HP)
+	var mask [16]byte
+	hp.Encrypt(mask[:], out[pnOffset+4:pnOffset+20])
+	out[0] ^= mask[0] & 0x0f
+	out[pnOffset] ^= mask[1]
+	return out
+}
+
+// cryptoFrame encodes a CRYPTO frame using two byte varints
+func cryptoFrame(offset int, data []byte) []byte {
+	return append([]byte{frameCrypto,
+		0x40 | byte(offset>>8), byte(offset),
+		0x40 | byte(len(data)>>8), byte(len(data)),
+	}, data...)
+}
+
+// clientHello captures the ClientHello sent by crypto/tls
+func clientHello(t *testing.T) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{
+			ServerName: "quic.example.org",
+			NextProtos: []string{"h3"},
+		}).Handshake()
+	}()
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(server, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestInitialClientHello(t *testing.T) {
+	ch := clientHello(t)
+	dcid := mustHex("8394c8f03e515708")
+	half := len(ch) / 2
+
+	for _, version := range []uint32{Version1, Version2} {
+		// second half first, coalesced in one datagram
+		// with a PING and padding
+		p1 := sealInitial(t, version, dcid, 0, cryptoFrame(half, ch[half:]))
+		p2 := sealInitial(t, version, dcid, 1,
+			append(append([]byte{framePing}, cryptoFrame(0, ch[:half])...), make([]byte, 64)...))
+		datagram := append(p1, p2...)
+
+		var s CryptoStream
+		var n int
+		for rest := datagram; len(rest) > 0; n++ {
+			p, next, err := ParsePacket(rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest = next
+
+			if p.Type != PacketInitial || !bytes.Equal(p.DCID, dcid) {
+				t.Fatalf("%#x: unexpected %s packet", version, p.Type)
+			}
+
+			payload, err := p.Decrypt()
+			if err != nil {
+				t.Fatalf("%#x: %s", version, err)
+			}
+
+			frames, err := CryptoFrames(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range frames {
+				if err := s.Add(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m, err := s.ClientHello()
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case n == 0 && m != nil:
+				t.Fatalf("%#x: ClientHello from half", version)
+			case n == 1 && (m == nil || m.ServerName != "quic.example.org"):
+				t.Fatalf("%#x: ClientHello %v", version, m)
+			}
+		}
+
+		if n != 2 {
+			t.Errorf("%#x: %v packets (expected 2)", version, n)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+const (
+	// DefaultIdleTimeout is how long a connection is remembered
+	// without traffic in either direction
+	DefaultIdleTimeout = 30 * time.Second
+	// DefaultMaxPending is the default number of datagrams held
+	// while waiting for the rest of the ClientHello
+	DefaultMaxPending = 16
+
+	// MinInitialSize is the minimum size of a datagram
+	// carrying a client Initial packet
+	MinInitialSize = 1200
+
+	maxDatagramSize = 1 << 16
+)
+
+// RouteFunc chooses the upstream of a QUIC connection using
+// its ClientHello, and returns a UDP socket connected to it
+type RouteFunc func(ctx context.Context, ch *hello.ClientHello, client net.Addr) (net.Conn, error)
+
+// RelayConfig describes a Relay
+type RelayConfig struct {
+	// Route chooses the upstream of new connections
+	Route RouteFunc
+	// IdleTimeout is how long connections are remembered
+	// without traffic
+	IdleTimeout time.Duration
+	// MaxPending is the number of datagrams held while
+	// waiting for the rest of the ClientHello
+	MaxPending int
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+}
+
+// SetDefaults fills the gaps in the RelayConfig
+func (cfg *RelayConfig) SetDefaults() error {
+	if cfg.Route == nil {
+		return core.Wrap(core.ErrInvalid, "Route missing")
+	}
+
+	cfg.IdleTimeout = core.IIf(cfg.IdleTimeout > 0, cfg.IdleTimeout, DefaultIdleTimeout)
+	cfg.MaxPending = core.IIf(cfg.MaxPending > 0, cfg.MaxPending, DefaultMaxPending)
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+	return nil
+}
+
+// New creates a Relay from the RelayConfig
+func (cfg *RelayConfig) New() (*Relay, error) {
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+	return &Relay{cfg: *cfg}, nil
+}
+
+// Relay forwards QUIC connections to upstreams chosen by the
+// ClientHello carried by their Initial packets, without
+// terminating them.
+//
+// Connections are followed by the address of the client and
+// by the connection IDs seen on long header packets, so
+// clients changing address are followed as long as they
+// keep using one of those. Connection IDs issued later
+// using NEW_CONNECTION_ID frames are encrypted and can't be.
+type Relay struct {
+	cfg RelayConfig
+}
+
+// Serve relays the QUIC connections arriving to the PacketConn
+// until the context is cancelled or the PacketConn closed
+func (r *Relay) Serve(ctx context.Context, pc net.PacketConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rs := &relayServer{
+		Relay:  r,
+		ctx:    ctx,
+		pc:     pc,
+		byAddr: make(map[string]*session),
+		byCID:  make(map[string]*session),
+		lens:   make(map[int]bool),
+	}
+	defer rs.closeAll()
+
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	go rs.expire()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		switch {
+		case err == nil:
+			rs.handle(buf[:n], addr)
+		case ctx.Err() != nil, errors.Is(err, net.ErrClosed):
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// relayServer is the state of a Relay serving a PacketConn
+type relayServer struct {
+	*Relay
+
+	ctx context.Context
+	pc  net.PacketConn
+
+	mu     sync.Mutex
+	byAddr map[string]*session
+	byCID  map[string]*session
+	lens   map[int]bool
+}
+
+// session is a QUIC connection being relayed
+type session struct {
+	client   atomic.Pointer[net.Addr]
+	lastSeen atomic.Int64
+	cids     []string
+	removed  bool
+
+	// upstream is nil until the ClientHello is complete
+	upstream net.Conn
+	crypto   CryptoStream
+	pending  [][]byte
+}
+
+func (s *session) clientAddr() net.Addr {
+	return *s.client.Load()
+}
+
+func (s *session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (rs *relayServer) handle(b []byte, addr net.Addr) {
+	s := rs.lookup(b, addr)
+	switch {
+	case s == nil:
+		rs.newSession(b, addr)
+	case s.upstream == nil:
+		rs.feed(s, b)
+	default:
+		s.touch()
+		_, _ = s.upstream.Write(b)
+	}
+}
+
+// lookup finds the session of a datagram by the address of
+// the client or by its Destination Connection ID, following
+// clients that changed address
+func (rs *relayServer) lookup(b []byte, addr net.Addr) *session {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if s, ok := rs.byAddr[addr.String()]; ok {
+		return s
+	}
+
+	s := rs.lookupCID(b)
+	if s != nil && s.upstream != nil {
+		delete(rs.byAddr, s.clientAddr().String())
+		s.client.Store(&addr)
+		rs.byAddr[addr.String()] = s
+
+		if log, ok := rs.info(); ok {
+			log.WithField("client", addr.String()).Print("connection migrated")
+		}
+	}
+	return s
+}
+
+func (rs *relayServer) lookupCID(b []byte) *session {
+	if IsLongHeader(b) {
+		if dcid, _, err := readConnID(b, 5); err == nil {
+			return rs.byCID[string(dcid)]
+		}
+		return nil
+	}
+
+	// short header packets don't say the length of
+	// the connection ID so we try those we know
+	for n := range rs.lens {
+		if len(b) > n {
+			if s, ok := rs.byCID[string(b[1:1+n])]; ok {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// newSession starts tracking a connection if the datagram
+// begins with a client Initial packet
+func (rs *relayServer) newSession(b []byte, addr net.Addr) {
+	if len(b) < MinInitialSize {
+		return
+	}
+
+	p, _, err := ParsePacket(b)
+	if err != nil || p.Type != PacketInitial || len(p.DCID) < 8 {
+		return
+	}
+
+	s := &session{}
+	s.client.Store(&addr)
+	s.touch()
+
+	rs.mu.Lock()
+	rs.byAddr[addr.String()] = s
+	rs.addCID(s, p.DCID)
+	rs.mu.Unlock()
+
+	rs.feed(s, b)
+}
+
+// feed collects the CRYPTO frames of the Initial packets in
+// the datagram, and connects to the upstream once the
+// ClientHello is complete
+func (rs *relayServer) feed(s *session, b []byte) {
+	s.touch()
+	if len(s.pending) >= rs.cfg.MaxPending {
+		rs.fail(s, errors.New("ClientHello incomplete"))
+		return
+	}
+	s.pending = append(s.pending, bytes.Clone(b))
+
+	for rest := b; len(rest) > 0; {
+		p, next, err := ParsePacket(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+
+		if err := rs.addInitial(s, p); err != nil {
+			rs.fail(s, err)
+			return
+		}
+	}
+
+	ch, err := s.crypto.ClientHello()
+	switch {
+	case err != nil:
+		rs.fail(s, err)
+	case ch != nil:
+		rs.connect(s, ch)
+	}
+}
+
+func (*relayServer) addInitial(s *session, p *Packet) error {
+	if p.Type != PacketInitial {
+		return nil
+	}
+
+	payload, err := p.Decrypt()
+	if err != nil {
+		// not for us to judge
+		return nil
+	}
+
+	frames, err := CryptoFrames(payload)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range frames {
+		if err := s.crypto.Add(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect routes the connection and sends the datagrams
+// held so far
+func (rs *relayServer) connect(s *session, ch *hello.ClientHello) {
+	upstream, err := rs.cfg.Route(rs.ctx, ch, s.clientAddr())
+	if err != nil {
+		rs.fail(s, core.Wrap(err, ch.ServerName))
+		return
+	}
+
+	rs.mu.Lock()
+	s.upstream = upstream
+	rs.mu.Unlock()
+
+	for _, b := range s.pending {
+		_, _ = upstream.Write(b)
+	}
+	s.pending, s.crypto = nil, CryptoStream{}
+
+	go rs.pump(s)
+}
+
+// pump relays the datagrams of the upstream to the client
+func (rs *relayServer) pump(s *session) {
+	defer rs.remove(s)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		s.touch()
+		rs.learnCIDs(s, buf[:n])
+		_, _ = rs.pc.WriteTo(buf[:n], s.clientAddr())
+	}
+}
+
+// learnCIDs remembers the connection IDs chosen by the
+// upstream, used by the client as Destination Connection ID
+func (rs *relayServer) learnCIDs(s *session, b []byte) {
+	for len(b) > 0 {
+		p, next, err := ParsePacket(b)
+		if err != nil {
+			return
+		}
+		b = next
+
+		if len(p.SCID) > 0 {
+			rs.mu.Lock()
+			rs.addCID(s, p.SCID)
+			rs.mu.Unlock()
+		}
+	}
+}
+
+func (rs *relayServer) addCID(s *session, cid []byte) {
+	key := string(cid)
+	if s.removed || rs.byCID[key] == s {
+		return
+	}
+
+	rs.byCID[key] = s
+	rs.lens[len(cid)] = true
+	s.cids = append(s.cids, key)
+}
+
+func (rs *relayServer) fail(s *session, err error) {
+	if log, ok := rs.warn(err); ok {
+		log.WithField("client", s.clientAddr().String()).Print("QUIC connection dropped")
+	}
+	rs.remove(s)
+}
+
+func (rs *relayServer) remove(s *session) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.removeUnlocked(s)
+}
+
+func (rs *relayServer) removeUnlocked(s *session) {
+	if s.removed {
+		return
+	}
+	s.removed = true
+
+	if key := s.clientAddr().String(); rs.byAddr[key] == s {
+		delete(rs.byAddr, key)
+	}
+	for _, key := range s.cids {
+		delete(rs.byCID, key)
+	}
+	if s.upstream != nil {
+		_ = s.upstream.Close()
+	}
+}
+
+// expire removes the connections idle for too long
+func (rs *relayServer) expire() {
+	ticker := time.NewTicker(max(rs.cfg.IdleTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.ctx.Done():
+			return
+		case now := <-ticker.C:
+			rs.expireIdle(now.Add(-rs.cfg.IdleTimeout))
+		}
+	}
+}
+
+func (rs *relayServer) expireIdle(cutoff time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, s := range rs.byAddr {
+		if s.lastSeen.Load() < cutoff.UnixNano() {
+			rs.removeUnlocked(s)
+		}
+	}
+}
+
+func (rs *relayServer) closeAll() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, s := range rs.byAddr {
+		rs.removeUnlocked(s)
+	}
+}
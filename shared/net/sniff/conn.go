@@ -0,0 +1,160 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"darvaza.org/darvaza/shared/net/proxyproto"
+)
+
+// BufferSize is the size of the read buffer of a Conn, which
+// limits how much data can be peeked. Large enough for
+// any TLS record
+const BufferSize = 32 << 10
+
+// Conn is a net.Conn whose first bytes can be peeked
+// without consuming them
+type Conn struct {
+	net.Conn
+
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+
+	// ProxyHeader is the PROXY protocol header received
+	// on the connection, if any
+	ProxyHeader *proxyproto.Header
+}
+
+// NewConn wraps a net.Conn to allow peeking. If it's
+// already a *Conn it's returned as is
+func NewConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+
+	return &Conn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, BufferSize),
+	}
+}
+
+// Read reads data from the connection, starting with
+// anything peeked
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Peek returns the next n bytes without consuming them
+func (c *Conn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// Reader returns the buffered reader of the connection
+func (c *Conn) Reader() *bufio.Reader {
+	return c.r
+}
+
+// RemoteAddr returns the remote address of the connection,
+// as told by the PROXY protocol if present
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection,
+// as told by the PROXY protocol if present
+func (c *Conn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite closes the Write stream of the underlying
+// connection if supported
+func (c *Conn) CloseWrite() error {
+	if w, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return w.CloseWrite()
+	}
+	return nil
+}
+
+// ReadProxyHeader consumes a PROXY protocol header and
+// applies its addresses to the connection
+func (c *Conn) ReadProxyHeader() (*proxyproto.Header, error) {
+	h, err := proxyproto.Read(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ProxyHeader = h
+	if !h.IsLocal() {
+		c.remote = h.SourceAddr()
+		c.local = h.DestinationAddr()
+	}
+	return h, nil
+}
+
+// Sniff peeks the first bytes of the connection until
+// it can be classified, within the given timeout
+func (c *Conn) Sniff(timeout time.Duration) (Class, error) {
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+		defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+	}
+
+	for n := 1; n <= MaxSniffLength; n++ {
+		b, err := c.r.Peek(n)
+		if class, ok := Classify(b); ok {
+			return class, nil
+		} else if err != nil {
+			return Unknown, err
+		}
+
+		// use whatever is already buffered
+		if m := c.r.Buffered(); m > n {
+			n = min(m, MaxSniffLength) - 1
+		}
+	}
+
+	return Unknown, nil
+}
+
+// PeekHTTPHost returns the Host of the HTTP/1.x request at
+// the start of the connection without consuming it
+func (c *Conn) PeekHTTPHost() (string, error) {
+	for n := c.r.Buffered(); ; {
+		b, err := c.r.Peek(max(n, 1))
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			return parseHost(b[:i+4])
+		} else if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				err = errors.New("request header too large")
+			}
+			return "", err
+		}
+
+		n = max(c.r.Buffered(), len(b)+1)
+	}
+}
+
+func parseHost(b []byte) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return "", err
+	}
+	_ = req.Body.Close()
+
+	if req.Host == "" {
+		return "", io.ErrUnexpectedEOF
+	}
+	return req.Host, nil
+}
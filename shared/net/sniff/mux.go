@@ -0,0 +1,82 @@
+package sniff
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// DefaultTimeout is the maximum time given to a client to
+// send enough data to classify the connection
+const DefaultTimeout = 10 * time.Second
+
+// Handler handles a classified connection
+type Handler func(ctx context.Context, conn *Conn) error
+
+// Middleware wraps a Handler
+type Middleware func(Handler) Handler
+
+// Mux dispatches connections to a handler chain by their Class
+type Mux struct {
+	// Timeout is the maximum time to classify a connection
+	Timeout time.Duration
+	// Fallback optionally handles unknown protocols
+	Fallback Handler
+
+	handlers map[Class]Handler
+}
+
+// Handle sets the handler chain for a Class. Middleware are
+// applied in order, the first being the outermost
+func (m *Mux) Handle(class Class, h Handler, mw ...Middleware) {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	if m.handlers == nil {
+		m.handlers = make(map[Class]Handler)
+	}
+	m.handlers[class] = h
+}
+
+// AcceptProxyProtocol makes the Mux consume PROXY protocol
+// headers, applying their addresses to the connection and
+// dispatching again what follows them
+func (m *Mux) AcceptProxyProtocol(mw ...Middleware) {
+	m.Handle(ProxyProtocol, m.serveProxyProtocol, mw...)
+}
+
+func (m *Mux) serveProxyProtocol(ctx context.Context, conn *Conn) error {
+	if conn.ProxyHeader != nil {
+		return core.Wrap(ErrUnknownProtocol, "repeated PROXY header")
+	}
+
+	if _, err := conn.ReadProxyHeader(); err != nil {
+		return err
+	}
+
+	return m.ServeConn(ctx, conn)
+}
+
+// ServeConn classifies the connection and passes it
+// to the corresponding handler
+func (m *Mux) ServeConn(ctx context.Context, c net.Conn) error {
+	conn := NewConn(c)
+
+	class, err := conn.Sniff(core.IIf(m.Timeout > 0, m.Timeout, DefaultTimeout))
+	if err != nil {
+		return err
+	}
+
+	h, ok := m.handlers[class]
+	switch {
+	case ok:
+		return h(ctx, conn)
+	case m.Fallback != nil:
+		return m.Fallback(ctx, conn)
+	default:
+		return core.Wrap(ErrUnknownProtocol, class.String())
+	}
+}
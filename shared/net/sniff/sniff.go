@@ -0,0 +1,155 @@
+// Package sniff classifies connections by their first bytes
+// so one port can carry several protocols
+package sniff
+
+import (
+	"bytes"
+	"errors"
+
+	"darvaza.org/darvaza/shared/net/proxyproto"
+)
+
+var (
+	// ErrUnknownProtocol indicates the connection couldn't
+	// be classified, or there is no handler for its class
+	ErrUnknownProtocol = errors.New("unknown protocol")
+)
+
+// Class is the kind of protocol detected on a connection
+type Class int
+
+const (
+	// Unknown is an unrecognised protocol
+	Unknown Class = iota
+	// TLS is a TLS ClientHello
+	TLS
+	// HTTP1 is a plaintext HTTP/1.x request
+	HTTP1
+	// HTTP2 is the HTTP/2 prior-knowledge connection preface
+	HTTP2
+	// SSH is an SSH client banner
+	SSH
+	// ProxyProtocol is a PROXY protocol header, v1 or v2
+	ProxyProtocol
+	// SOCKS5 is a SOCKS version 5 greeting
+	SOCKS5
+)
+
+var classNames = map[Class]string{
+	Unknown:       "unknown",
+	TLS:           "tls",
+	HTTP1:         "http/1",
+	HTTP2:         "h2c",
+	SSH:           "ssh",
+	ProxyProtocol: "proxy",
+	SOCKS5:        "socks5",
+}
+
+func (c Class) String() string {
+	if s, ok := classNames[c]; ok {
+		return s
+	}
+	return classNames[Unknown]
+}
+
+var (
+	// HTTP2Preface is the HTTP/2 client connection preface
+	HTTP2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+	sshBanner = []byte("SSH-")
+
+	httpMethods = [][]byte{
+		[]byte("GET "),
+		[]byte("HEAD "),
+		[]byte("POST "),
+		[]byte("PUT "),
+		[]byte("DELETE "),
+		[]byte("OPTIONS "),
+		[]byte("PATCH "),
+		[]byte("CONNECT "),
+		[]byte("TRACE "),
+	}
+)
+
+// MaxSniffLength is the number of bytes needed to
+// classify any connection
+var MaxSniffLength = len(HTTP2Preface)
+
+// Classify tells the class of a connection from its first bytes.
+// When more data is needed to decide it returns false
+func Classify(b []byte) (Class, bool) {
+	if len(b) == 0 {
+		return Unknown, false
+	}
+
+	switch b[0] {
+	case 0x16:
+		// TLS handshake record, version 3.x
+		return classifyTLS(b)
+	case 0x05:
+		// SOCKS version
+		return SOCKS5, true
+	}
+
+	undecided := false
+	for _, m := range []struct {
+		class  Class
+		prefix []byte
+	}{
+		{HTTP2, HTTP2Preface},
+		{SSH, sshBanner},
+		{ProxyProtocol, proxyproto.SignatureV1},
+		{ProxyProtocol, proxyproto.SignatureV2},
+	} {
+		switch matchPrefix(b, m.prefix) {
+		case matchFull:
+			return m.class, true
+		case matchPartial:
+			undecided = true
+		}
+	}
+
+	for _, method := range httpMethods {
+		switch matchPrefix(b, method) {
+		case matchFull:
+			return HTTP1, true
+		case matchPartial:
+			undecided = true
+		}
+	}
+
+	return Unknown, !undecided
+}
+
+func classifyTLS(b []byte) (Class, bool) {
+	switch {
+	case len(b) < 3:
+		return Unknown, false
+	case b[1] == 3 && b[2] <= 4:
+		return TLS, true
+	default:
+		return Unknown, true
+	}
+}
+
+type match int
+
+const (
+	matchNone match = iota
+	matchPartial
+	matchFull
+)
+
+func matchPrefix(b, prefix []byte) match {
+	switch {
+	case len(b) >= len(prefix):
+		if bytes.Equal(b[:len(prefix)], prefix) {
+			return matchFull
+		}
+		return matchNone
+	case bytes.Equal(b, prefix[:len(b)]):
+		return matchPartial
+	default:
+		return matchNone
+	}
+}
@@ -0,0 +1,32 @@
+package sniff
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		data    string
+		class   Class
+		decided bool
+	}{
+		{"", Unknown, false},
+		{"\x16\x03\x01\x02\x00", TLS, true},
+		{"\x16\x03", Unknown, false},
+		{"\x16\x05\x01", Unknown, true},
+		{"GET / HTTP/1.1\r\n", HTTP1, true},
+		{"GE", Unknown, false},
+		{"OPTIONS * HTTP/1.1\r\n", HTTP1, true},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", HTTP2, true},
+		{"PRI * HTTP/2.0", Unknown, false},
+		{"SSH-2.0-OpenSSH_9.6\r\n", SSH, true},
+		{"PROXY TCP4 ", ProxyProtocol, true},
+		{"\r\n\r\n\x00\r\nQUIT\n\x21", ProxyProtocol, true},
+		{"\r\n\r\n", Unknown, false},
+		{"HELO example.com\r\n", Unknown, true},
+		{"\x05\x01\x00", SOCKS5, true},
+	} {
+		class, ok := Classify([]byte(tc.data))
+		if class != tc.class || ok != tc.decided {
+			t.Errorf("Classify(%q): %s/%v (expected %s/%v)", tc.data, class, ok, tc.class, tc.decided)
+		}
+	}
+}
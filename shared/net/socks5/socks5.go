@@ -0,0 +1,298 @@
+// Package socks5 implements the server side of the SOCKS version 5
+// protocol, RFC 1928, with username/password authentication as
+// described by RFC 1929. Only the CONNECT command is supported
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+// Version is the version of the protocol
+const Version = 0x05
+
+// Authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+)
+
+// CmdConnect is the command asking for a TCP connection
+const CmdConnect = 0x01
+
+// Address types
+const (
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+)
+
+// userPassVersion is the version of the
+// username/password sub-negotiation
+const userPassVersion = 0x01
+
+var (
+	// ErrVersion indicates the client doesn't speak SOCKS5
+	ErrVersion = errors.New("socks5: unsupported version")
+	// ErrNoMethod indicates the client offered no acceptable
+	// authentication method
+	ErrNoMethod = errors.New("socks5: no acceptable authentication method")
+	// ErrAuth indicates the client credentials were rejected
+	ErrAuth = errors.New("socks5: authentication failed")
+	// ErrCommand indicates the client asked for a command
+	// other than CONNECT
+	ErrCommand = errors.New("socks5: command not supported")
+	// ErrAddressType indicates the client used an unknown
+	// address type
+	ErrAddressType = errors.New("socks5: address type not supported")
+)
+
+// ReplyCode is the status of a reply to a request
+type ReplyCode byte
+
+// Reply codes
+const (
+	Succeeded           ReplyCode = 0x00
+	GeneralFailure      ReplyCode = 0x01
+	NotAllowed          ReplyCode = 0x02
+	NetworkUnreachable  ReplyCode = 0x03
+	HostUnreachable     ReplyCode = 0x04
+	ConnectionRefused   ReplyCode = 0x05
+	TTLExpired          ReplyCode = 0x06
+	CommandNotSupported ReplyCode = 0x07
+	AddressNotSupported ReplyCode = 0x08
+)
+
+// Request is what a client asks for after authenticating
+type Request struct {
+	// Host is the hostname or IP address requested
+	Host string
+	Port uint16
+	// User is the name the client authenticated with, if any
+	User string
+}
+
+// Addr returns the host:port requested
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// Server negotiates the SOCKS5 protocol with clients
+type Server struct {
+	// Authenticate checks the username and password of
+	// clients. If nil clients aren't asked for credentials
+	Authenticate func(user, password string) bool
+	// Anonymous accepts clients offering no credentials
+	// even if Authenticate is set
+	Anonymous bool
+}
+
+// Handshake authenticates the client and reads its request.
+// The request must be answered using WriteReply, unless an
+// error is returned, in which case the client was told
+// when the protocol allows it
+func (s *Server) Handshake(rw io.ReadWriter) (*Request, error) {
+	method, err := s.negotiate(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	var user string
+	if method == MethodUserPass {
+		user, err = s.authenticate(rw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := readRequest(rw)
+	switch {
+	case errors.Is(err, ErrCommand):
+		_ = WriteReply(rw, CommandNotSupported, netip.AddrPort{})
+	case errors.Is(err, ErrAddressType):
+		_ = WriteReply(rw, AddressNotSupported, netip.AddrPort{})
+	case err == nil:
+		req.User = user
+	}
+	return req, err
+}
+
+// negotiate reads the methods offered by the client
+// and chooses one
+func (s *Server) negotiate(rw io.ReadWriter) (byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return 0, err
+	} else if hdr[0] != Version {
+		return 0, ErrVersion
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return 0, err
+	}
+
+	method := s.choose(methods)
+	if _, err := rw.Write([]byte{Version, method}); err != nil {
+		return 0, err
+	} else if method == MethodNoAcceptable {
+		return 0, ErrNoMethod
+	}
+	return method, nil
+}
+
+// choose picks the authentication method, preferring
+// credentials when they can be checked
+func (s *Server) choose(offered []byte) byte {
+	var noAuth bool
+	for _, m := range offered {
+		switch {
+		case m == MethodUserPass && s.Authenticate != nil:
+			return MethodUserPass
+		case m == MethodNoAuth:
+			noAuth = true
+		}
+	}
+
+	if noAuth && (s.Authenticate == nil || s.Anonymous) {
+		return MethodNoAuth
+	}
+	return MethodNoAcceptable
+}
+
+// authenticate runs the username/password sub-negotiation
+func (s *Server) authenticate(rw io.ReadWriter) (string, error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return "", err
+	} else if ver[0] != userPassVersion {
+		return "", ErrVersion
+	}
+
+	user, err := readString(rw)
+	if err != nil {
+		return "", err
+	}
+	password, err := readString(rw)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.Authenticate(user, password) {
+		_, _ = rw.Write([]byte{userPassVersion, 0x01})
+		return "", ErrAuth
+	}
+
+	_, err = rw.Write([]byte{userPassVersion, 0x00})
+	return user, err
+}
+
+// readString reads a string prefixed by its length
+func readString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readRequest reads a CONNECT request
+func readRequest(r io.Reader) (*Request, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	} else if hdr[0] != Version {
+		return nil, ErrVersion
+	}
+
+	host, err := readHost(r, hdr[3])
+	if err != nil {
+		return nil, err
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[1] != CmdConnect {
+		return nil, fmt.Errorf("%w: %#02x", ErrCommand, hdr[1])
+	}
+
+	return &Request{
+		Host: host,
+		Port: binary.BigEndian.Uint16(port[:]),
+	}, nil
+}
+
+// readHost reads the destination address of a request
+func readHost(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case addrIPv4, addrIPv6:
+		b := make([]byte, net.IPv6len)
+		if atyp == addrIPv4 {
+			b = b[:net.IPv4len]
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		return addr.String(), nil
+	case addrDomain:
+		return readString(r)
+	default:
+		return "", fmt.Errorf("%w: %#02x", ErrAddressType, atyp)
+	}
+}
+
+// WriteReply answers a request, with the address the server
+// bound to reach the destination when Succeeded
+func WriteReply(w io.Writer, code ReplyCode, bound netip.AddrPort) error {
+	addr := bound.Addr().Unmap()
+
+	b := []byte{Version, byte(code), 0x00, addrIPv4}
+	switch {
+	case addr.Is6():
+		b[3] = addrIPv6
+		b = append(b, addr.AsSlice()...)
+	case addr.Is4():
+		b = append(b, addr.AsSlice()...)
+	default:
+		b = append(b, 0, 0, 0, 0)
+	}
+	b = binary.BigEndian.AppendUint16(b, bound.Port())
+
+	_, err := w.Write(b)
+	return err
+}
+
+// ReplyCodeOf returns the ReplyCode describing
+// the error connecting to a destination
+func ReplyCodeOf(err error) ReplyCode {
+	var te interface{ Timeout() bool }
+
+	switch {
+	case err == nil:
+		return Succeeded
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &te) && te.Timeout():
+		return HostUnreachable
+	default:
+		return GeneralFailure
+	}
+}
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// pipeDialer returns the client side of a net.Pipe
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(_, _ string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func TestHandshake(t *testing.T) {
+	srv := &Server{
+		Authenticate: func(user, password string) bool {
+			return user == "build" && password == "secret"
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		auth *proxy.Auth
+		addr string
+		user string
+		err  error
+	}{
+		{"user", &proxy.Auth{User: "build", Password: "secret"}, "example.com:443", "build", nil},
+		{"ipv6", &proxy.Auth{User: "build", Password: "secret"}, "[2001:db8::1]:22", "build", nil},
+		{"password", &proxy.Auth{User: "build", Password: "wrong"}, "example.com:443", "", ErrAuth},
+		{"anonymous", nil, "example.com:443", "", ErrNoMethod},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testHandshake(t, srv, tc.auth, tc.addr, tc.user, tc.err)
+		})
+	}
+}
+
+func testHandshake(t *testing.T, srv *Server, auth *proxy.Auth, addr, user string, expected error) {
+	client, conn := net.Pipe()
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		d, err := proxy.SOCKS5("tcp", "proxy", auth, pipeDialer{client})
+		if err == nil {
+			_, err = d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", addr)
+		}
+		done <- err
+	}()
+
+	req, err := srv.Handshake(conn)
+	if err != expected {
+		t.Fatalf("Handshake: %v (expected %v)", err, expected)
+	} else if err != nil {
+		_ = conn.Close()
+		if <-done == nil {
+			t.Error("client connected")
+		}
+		return
+	}
+
+	if req.Addr() != addr || req.User != user {
+		t.Errorf("request %+v (expected %q by %q)", req, addr, user)
+	}
+
+	bound := netip.MustParseAddrPort("192.0.2.1:40000")
+	if err := WriteReply(conn, Succeeded, bound); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
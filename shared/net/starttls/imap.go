@@ -0,0 +1,96 @@
+package starttls
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	imapCapability = "IMAP4rev1 STARTTLS LOGINDISABLED"
+	imapTag        = "t1"
+)
+
+func acceptIMAP(w io.Writer, r *bufio.Reader, hostname string) error {
+	greeting := "* OK [CAPABILITY " + imapCapability + "] " + hostname + " ready"
+	if err := writeLines(w, greeting); err != nil {
+		return err
+	}
+
+	for range MaxCommands {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+
+		if done, err := replyIMAP(w, line, hostname); done || err != nil {
+			return err
+		}
+	}
+
+	_ = writeLines(w, "* BYE Too many commands")
+	return tooManyCommands()
+}
+
+// replyIMAP answers a command, telling if the preamble is over
+func replyIMAP(w io.Writer, line, hostname string) (bool, error) {
+	tag, cmd, _ := strings.Cut(line, " ")
+	cmd, _, _ = strings.Cut(cmd, " ")
+
+	switch strings.ToUpper(cmd) {
+	case "":
+		return false, writeLines(w, "* BAD Missing command")
+	case "CAPABILITY":
+		return false, writeLines(w, "* CAPABILITY "+imapCapability, tag+" OK CAPABILITY completed")
+	case "NOOP":
+		return false, writeLines(w, tag+" OK NOOP completed")
+	case "STARTTLS":
+		return true, writeLines(w, tag+" OK Begin TLS negotiation now")
+	case "LOGOUT":
+		_ = writeLines(w, "* BYE "+hostname+" logging out", tag+" OK LOGOUT completed")
+		return true, ErrNoTLS
+	default:
+		return false, writeLines(w, tag+" NO STARTTLS required")
+	}
+}
+
+func startIMAP(w io.Writer, r *bufio.Reader) error {
+	if err := skipIMAP(r); err != nil {
+		return err
+	}
+
+	if err := writeLines(w, imapTag+" STARTTLS"); err != nil {
+		return err
+	}
+
+	return expectIMAP(r, imapTag)
+}
+
+// skipIMAP reads the greeting of the server
+func skipIMAP(r *bufio.Reader) error {
+	line, err := readLine(r)
+	switch {
+	case err != nil:
+		return err
+	case !strings.HasPrefix(line, "* OK"):
+		return unexpectedReply(line)
+	default:
+		return nil
+	}
+}
+
+// expectIMAP reads until the tagged response, ignoring
+// untagged ones, and checks it's OK
+func expectIMAP(r *bufio.Reader, tag string) error {
+	for {
+		line, err := readLine(r)
+		switch {
+		case err != nil:
+			return err
+		case strings.HasPrefix(line, tag+" OK"):
+			return nil
+		case strings.HasPrefix(line, tag+" "):
+			return unexpectedReply(line)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package starttls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/sniff"
+)
+
+const (
+	mysqlClientSSL        = 0x0800
+	mysqlSSLRequestLength = 32
+	mysqlMaxGreeting      = 1 << 12
+)
+
+var errMySQLMalformed = errors.New("malformed MySQL packet")
+
+// RelayMySQL forwards the greeting of a MySQL server to the client
+// and the SSL request of the client back, leaving both ready for
+// TLS. Clients authenticate against the nonce of the greeting so,
+// unlike other protocols, the server has to be chosen before the
+// client speaks
+func RelayMySQL(client *sniff.Conn, upstream net.Conn) error {
+	greeting, err := readMySQLPacket(upstream, mysqlMaxGreeting)
+	if err != nil {
+		return core.Wrap(err, "upstream")
+	}
+
+	err = checkMySQLGreeting(greeting[4:])
+	if _, werr := client.Write(greeting); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := readMySQLPacket(client.Reader(), mysqlMaxGreeting)
+	if err != nil {
+		return err
+	} else if err := checkMySQLSSLRequest(req[4:]); err != nil {
+		return err
+	}
+
+	_, err = upstream.Write(req)
+	return err
+}
+
+// readMySQLPacket reads a whole packet, including its header
+func readMySQLPacket(r io.Reader, maxSize int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if n == 0 || n > maxSize {
+		return nil, errMySQLMalformed
+	}
+
+	b := make([]byte, 4+n)
+	copy(b, hdr[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkMySQLGreeting checks the server offers SSL on its
+// HandshakeV10 packet
+func checkMySQLGreeting(p []byte) error {
+	switch {
+	case p[0] == 0xff:
+		return core.Wrap(ErrNoTLS, "upstream refused the connection")
+	case p[0] != 10:
+		return core.Wrap(ErrNoTLS, fmt.Sprintf("unsupported protocol version %d", p[0]))
+	}
+
+	// server version, connection id, auth-plugin-data-part-1, filler
+	i := bytes.IndexByte(p[1:], 0)
+	off := 1 + i + 1 + 4 + 8 + 1
+	if i < 0 || len(p) < off+2 {
+		return errMySQLMalformed
+	}
+
+	if binary.LittleEndian.Uint16(p[off:])&mysqlClientSSL == 0 {
+		return core.Wrap(ErrNoTLS, "upstream doesn't support SSL")
+	}
+	return nil
+}
+
+// checkMySQLSSLRequest checks the client answered with an
+// SSLRequest and not a plaintext HandshakeResponse
+func checkMySQLSSLRequest(p []byte) error {
+	if len(p) != mysqlSSLRequestLength || binary.LittleEndian.Uint32(p)&mysqlClientSSL == 0 {
+		return core.Wrap(ErrNoTLS, "client didn't request SSL")
+	}
+	return nil
+}
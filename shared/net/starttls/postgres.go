@@ -0,0 +1,73 @@
+package starttls
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"darvaza.org/core"
+)
+
+const (
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+)
+
+// acceptPostgres accepts the SSLRequest of a client, declining
+// GSSAPI encryption first if asked. Clients using direct TLS
+// negotiation need nothing
+func acceptPostgres(w io.Writer, r *bufio.Reader) error {
+	// GSSENCRequest, SSLRequest
+	for range 2 {
+		if b, err := r.Peek(1); err != nil {
+			return err
+		} else if b[0] == 0x16 {
+			return nil
+		}
+
+		code, err := readPostgresRequest(r)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write([]byte{core.IIf[byte](code == pgSSLRequest, 'S', 'N')}); err != nil {
+			return err
+		} else if code == pgSSLRequest {
+			return nil
+		}
+	}
+
+	return core.Wrap(ErrNoTLS, "SSLRequest expected")
+}
+
+// readPostgresRequest reads the code of an SSLRequest or
+// GSSENCRequest. Anything else can't be routed
+func readPostgresRequest(r io.Reader) (uint32, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+
+	length, code := binary.BigEndian.Uint32(b[:]), binary.BigEndian.Uint32(b[4:])
+	if length != 8 || (code != pgSSLRequest && code != pgGSSENCRequest) {
+		return 0, core.Wrap(ErrNoTLS, fmt.Sprintf("unexpected request %d", code))
+	}
+	return code, nil
+}
+
+func startPostgres(w io.Writer, r io.Reader) error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:], 8)
+	binary.BigEndian.PutUint32(b[4:], pgSSLRequest)
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return err
+	} else if b[0] != 'S' {
+		return unexpectedReply(string(b[:1]))
+	}
+	return nil
+}
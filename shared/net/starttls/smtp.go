@@ -0,0 +1,86 @@
+package starttls
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+func acceptSMTP(w io.Writer, r *bufio.Reader, hostname string) error {
+	if err := writeLines(w, "220 "+hostname+" ESMTP"); err != nil {
+		return err
+	}
+
+	for range MaxCommands {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+
+		if done, err := replySMTP(w, line, hostname); done || err != nil {
+			return err
+		}
+	}
+
+	_ = writeLines(w, "421 4.7.0 Too many commands")
+	return tooManyCommands()
+}
+
+// replySMTP answers a command, telling if the preamble is over
+func replySMTP(w io.Writer, line, hostname string) (bool, error) {
+	verb, _, _ := strings.Cut(line, " ")
+
+	switch strings.ToUpper(verb) {
+	case "EHLO":
+		return false, writeLines(w, "250-"+hostname, "250 STARTTLS")
+	case "HELO":
+		return false, writeLines(w, "250 "+hostname)
+	case "NOOP", "RSET":
+		return false, writeLines(w, "250 2.0.0 OK")
+	case "STARTTLS":
+		return true, writeLines(w, "220 2.0.0 Ready to start TLS")
+	case "QUIT":
+		_ = writeLines(w, "221 2.0.0 Bye")
+		return true, ErrNoTLS
+	default:
+		return false, writeLines(w, "530 5.7.0 Must issue a STARTTLS command first")
+	}
+}
+
+func startSMTP(w io.Writer, r *bufio.Reader, hostname string) error {
+	if err := expectSMTP(r, "220"); err != nil {
+		return err
+	}
+
+	for _, step := range []struct {
+		cmd  string
+		code string
+	}{
+		{"EHLO " + hostname, "250"},
+		{"STARTTLS", "220"},
+	} {
+		if err := writeLines(w, step.cmd); err != nil {
+			return err
+		}
+		if err := expectSMTP(r, step.code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectSMTP reads a reply, possibly multiline, and
+// checks its code
+func expectSMTP(r *bufio.Reader, code string) error {
+	for {
+		line, err := readLine(r)
+		switch {
+		case err != nil:
+			return err
+		case len(line) < 3 || line[:3] != code:
+			return unexpectedReply(line)
+		case len(line) == 3 || line[3] != '-':
+			return nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package starttls implements the plaintext preambles of protocols
+// negotiating TLS after connecting, on both the server and the
+// client side
+package starttls
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/sniff"
+)
+
+var (
+	// ErrNoTLS indicates the peer finished or refused the
+	// preamble without starting TLS
+	ErrNoTLS = errors.New("TLS not started")
+	// ErrUnexpectedData indicates the peer sent data after
+	// the preamble before the TLS handshake
+	ErrUnexpectedData = errors.New("unexpected data after preamble")
+)
+
+const (
+	// MaxLineLength limits the lines read in text preambles
+	MaxLineLength = 1024
+	// MaxCommands limits the commands a client can send
+	// before starting TLS
+	MaxCommands = 16
+)
+
+// Protocol is a protocol starting TLS after a plaintext preamble
+type Protocol string
+
+const (
+	// SMTP uses the STARTTLS command of RFC 3207
+	SMTP Protocol = "smtp"
+	// IMAP uses the STARTTLS command of RFC 3501
+	IMAP Protocol = "imap"
+	// Postgres uses the SSLRequest message
+	Postgres Protocol = "postgres"
+	// MySQL uses the SSL capability of the handshake
+	MySQL Protocol = "mysql"
+)
+
+// ParseProtocol validates the name of a Protocol
+func ParseProtocol(s string) (Protocol, error) {
+	switch p := Protocol(strings.ToLower(s)); p {
+	case SMTP, IMAP, Postgres, MySQL:
+		return p, nil
+	default:
+		return "", core.Wrap(core.ErrInvalid, fmt.Sprintf("unknown STARTTLS protocol %q", s))
+	}
+}
+
+// Accept performs the server side of the preamble on a client
+// connection, leaving it ready to send its ClientHello. The
+// hostname is announced on greetings. MySQL needs RelayMySQL instead
+func Accept(conn *sniff.Conn, proto Protocol, hostname string) error {
+	switch proto {
+	case SMTP:
+		return acceptSMTP(conn, conn.Reader(), hostname)
+	case IMAP:
+		return acceptIMAP(conn, conn.Reader(), hostname)
+	case Postgres:
+		return acceptPostgres(conn, conn.Reader())
+	default:
+		return core.Wrap(core.ErrInvalid, fmt.Sprintf("%q can't be accepted", proto))
+	}
+}
+
+// Start performs the client side of the preamble towards a
+// server, leaving it ready to receive a ClientHello. The
+// hostname is used to introduce ourselves
+func Start(conn net.Conn, proto Protocol, hostname string) error {
+	var err error
+
+	r := bufio.NewReaderSize(conn, MaxLineLength)
+	switch proto {
+	case SMTP:
+		err = startSMTP(conn, r, hostname)
+	case IMAP:
+		err = startIMAP(conn, r)
+	case Postgres:
+		err = startPostgres(conn, r)
+	default:
+		err = core.Wrap(core.ErrInvalid, fmt.Sprintf("%q can't be started", proto))
+	}
+
+	return checkDrained(r, err)
+}
+
+// Skip consumes the greeting of a server used without TLS,
+// so a client that already started TLS with us can continue
+// as if the server had just restarted the session
+func Skip(conn net.Conn, proto Protocol) error {
+	var err error
+
+	r := bufio.NewReaderSize(conn, MaxLineLength)
+	switch proto {
+	case SMTP:
+		err = expectSMTP(r, "220")
+	case IMAP:
+		err = skipIMAP(r)
+	case Postgres:
+		// nothing to skip
+	default:
+		err = core.Wrap(core.ErrInvalid, fmt.Sprintf("%q can't be skipped", proto))
+	}
+
+	return checkDrained(r, err)
+}
+
+// checkDrained fails if the server sent anything beyond the
+// preamble, as it would be lost and could have been injected
+func checkDrained(r *bufio.Reader, err error) error {
+	if err == nil && r.Buffered() > 0 {
+		err = ErrUnexpectedData
+	}
+	return err
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line without its terminator
+func readLine(r *bufio.Reader) (string, error) {
+	b, err := r.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull), len(b) > MaxLineLength:
+		return "", errLineTooLong
+	case err != nil:
+		return "", err
+	default:
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+}
+
+// writeLines writes CRLF terminated lines at once
+func writeLines(w io.Writer, lines ...string) error {
+	_, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+func unexpectedReply(line string) error {
+	return core.Wrapf(ErrNoTLS, "unexpected reply %q", line)
+}
+
+func tooManyCommands() error {
+	return core.Wrap(ErrNoTLS, "too many commands")
+}
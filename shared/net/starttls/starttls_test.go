@@ -0,0 +1,149 @@
+package starttls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"darvaza.org/darvaza/shared/net/sniff"
+)
+
+var clientHelloStart = []byte{0x16, 0x03, 0x01}
+
+func TestPreambles(t *testing.T) {
+	for _, proto := range []Protocol{SMTP, IMAP, Postgres} {
+		client, server := net.Pipe()
+
+		errs := make(chan error, 1)
+		go func() {
+			defer server.Close()
+
+			conn := sniff.NewConn(server)
+			if err := Accept(conn, proto, "proxy.example.org"); err != nil {
+				errs <- err
+				return
+			}
+
+			// the ClientHello follows untouched
+			b := make([]byte, len(clientHelloStart))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				errs <- err
+			} else if !bytes.Equal(b, clientHelloStart) {
+				errs <- errors.New("unexpected data")
+			}
+			close(errs)
+		}()
+
+		err := Start(client, proto, "client.example.org")
+		if err == nil {
+			_, err = client.Write(clientHelloStart)
+		}
+		if err == nil {
+			err = <-errs
+		}
+		if err != nil {
+			t.Errorf("%s: %s", proto, err)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestAcceptRefused(t *testing.T) {
+	for _, tc := range []struct {
+		proto  Protocol
+		script string
+	}{
+		{SMTP, "EHLO a.example.org\r\nQUIT\r\n"},
+		{IMAP, "a1 CAPABILITY\r\na2 LOGOUT\r\n"},
+		{Postgres, "\x00\x00\x00\x08\x04\xd2\x16\x30\x00\x00\x00\x08\x04\xd2\x16\x30"},
+		{Postgres, "\x00\x00\x00\x10\x04\xd2\x16\x2e"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			_, _ = client.Write([]byte(tc.script))
+		}()
+		go func() {
+			_, _ = io.Copy(io.Discard, client)
+		}()
+
+		err := Accept(sniff.NewConn(server), tc.proto, "proxy.example.org")
+		if !errors.Is(err, ErrNoTLS) {
+			t.Errorf("%s %q: %v (expected %v)", tc.proto, tc.script, err, ErrNoTLS)
+		}
+		_ = server.Close()
+	}
+}
+
+func TestRelayMySQL(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		serverSSL bool
+		clientSSL bool
+		ok        bool
+	}{
+		{"ssl", true, true, true},
+		{"server without ssl", false, true, false},
+		{"client without ssl", true, false, false},
+	} {
+		err := testRelayMySQL(tc.serverSSL, tc.clientSSL)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func testRelayMySQL(serverSSL, clientSSL bool) error {
+	client, front := net.Pipe()
+	back, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	go func() {
+		_, _ = upstream.Write(mysqlPacket(0, mysqlGreeting(serverSSL)))
+		_, _ = io.Copy(io.Discard, upstream)
+	}()
+
+	go func() {
+		if _, err := readMySQLPacket(client, mysqlMaxGreeting); err == nil {
+			_, _ = client.Write(mysqlPacket(1, mysqlSSLRequest(clientSSL)))
+		}
+		_, _ = io.Copy(io.Discard, client)
+	}()
+
+	err := RelayMySQL(sniff.NewConn(front), back)
+	_ = front.Close()
+	_ = back.Close()
+	return err
+}
+
+func mysqlPacket(seq byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+}
+
+func mysqlGreeting(ssl bool) []byte {
+	var caps uint16 = 0x0200
+	if ssl {
+		caps |= mysqlClientSSL
+	}
+
+	b := []byte("\x0a8.4.0\x00")
+	b = append(b, 1, 0, 0, 0)            // connection id
+	b = append(b, []byte("12345678")...) // auth-plugin-data-part-1
+	b = append(b, 0)                     // filler
+	b = binary.LittleEndian.AppendUint16(b, caps)
+	return append(b, make([]byte, 13)...)
+}
+
+func mysqlSSLRequest(ssl bool) []byte {
+	var caps uint32 = 0x0200
+	if ssl {
+		caps |= mysqlClientSSL
+	}
+
+	b := binary.LittleEndian.AppendUint32(nil, caps)
+	return append(b, make([]byte, mysqlSSLRequestLength-4)...)
+}
@@ -0,0 +1,235 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// AgentConfig describes an Agent
+type AgentConfig struct {
+	// Edge is the host:port of the tunnel listener of the edge
+	Edge string
+	// TLSConfig provides the client certificate and verifies
+	// the edge. Its NextProtos are replaced
+	TLSConfig *tls.Config
+	// Targets maps the hostnames to register to the local
+	// host:port their connections are forwarded to
+	Targets map[string]string
+
+	// DialTimeout is the maximum time given to connect
+	// to the edge and to the targets
+	DialTimeout time.Duration
+	// Backoff is the wait between attempts to connect
+	// to the edge
+	Backoff proxy.Backoff
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+}
+
+// SetDefaults fills the gaps in the AgentConfig
+func (cfg *AgentConfig) SetDefaults() error {
+	switch {
+	case cfg.TLSConfig == nil:
+		return core.Wrap(core.ErrInvalid, "TLSConfig missing")
+	case len(cfg.Targets) == 0:
+		return core.Wrap(core.ErrInvalid, "no targets")
+	}
+
+	cfg.DialTimeout = core.IIf(cfg.DialTimeout > 0, cfg.DialTimeout, proxy.DefaultDialTimeout)
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+	return nil
+}
+
+// New creates an Agent from the AgentConfig
+func (cfg *AgentConfig) New() (*Agent, error) {
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	} else if _, _, err := net.SplitHostPort(cfg.Edge); err != nil {
+		return nil, core.Wrap(err, "edge")
+	}
+
+	targets, err := sanitisedTargets(cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := cfg.TLSConfig.Clone()
+	conf.NextProtos = []string{Protocol}
+
+	return &Agent{
+		cfg:     *cfg,
+		tls:     conf,
+		targets: targets,
+		h2:      &http2.Server{},
+	}, nil
+}
+
+func sanitisedTargets(targets map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(targets))
+	for hostname, addr := range targets {
+		name, ok := sanitisedName(hostname)
+		if !ok {
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid hostname %q", hostname))
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, core.Wrapf(err, "target of %q", hostname)
+		}
+		out[name] = addr
+	}
+	return out, nil
+}
+
+// Agent connects to an edge and serves the connections
+// it forwards for the registered hostnames
+type Agent struct {
+	cfg     AgentConfig
+	tls     *tls.Config
+	targets map[string]string
+	h2      *http2.Server
+}
+
+// Run keeps the tunnel to the edge open, reconnecting when
+// it fails, until the context is cancelled
+func (a *Agent) Run(ctx context.Context) error {
+	for retry := 0; ctx.Err() == nil; retry++ {
+		start := time.Now()
+		a.disconnected(ctx, a.connect(ctx))
+
+		if time.Since(start) > a.cfg.Backoff.Duration(retry) {
+			// it worked for a while
+			retry = 0
+		}
+
+		_ = a.cfg.Backoff.Wait(ctx, retry)
+	}
+	return nil
+}
+
+func (a *Agent) disconnected(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if log, ok := a.warn(err); ok {
+		log.WithField("edge", a.cfg.Edge).Print("disconnected")
+	}
+}
+
+// connect opens a tunnel and serves it until it's closed
+func (a *Agent) connect(ctx context.Context) error {
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if err := a.register(conn); err != nil {
+		return err
+	}
+
+	if log, ok := a.info(); ok {
+		log.WithField("edge", a.cfg.Edge).Print("connected")
+	}
+
+	a.h2.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: a,
+	})
+	return ErrSessionClosed
+}
+
+func (a *Agent) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.DialTimeout)
+	defer cancel()
+
+	d := &tls.Dialer{Config: a.tls}
+	return d.DialContext(ctx, "tcp", a.cfg.Edge)
+}
+
+// register tells the edge the hostnames we serve
+func (a *Agent) register(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	reg := Registration{Hostnames: core.SortedKeys(a.targets)}
+	if err := writeMessage(conn, reg); err != nil {
+		return err
+	}
+
+	var reply Reply
+	if err := readMessage(conn, &reply); err != nil {
+		return core.Wrap(err, "registration")
+	} else if reply.Error != "" {
+		return core.Wrap(errors.New(reply.Error), "registration refused")
+	}
+	return nil
+}
+
+// ServeHTTP forwards a stream opened by the edge
+// to the target of its hostname
+func (a *Agent) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name, _ := sanitisedName(req.Host)
+	addr, ok := a.targets[name]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(req.Context(), a.cfg.DialTimeout)
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteHeader(http.StatusOK)
+	fw := &flushWriter{w: rw, rc: http.NewResponseController(rw)}
+	_ = fw.rc.Flush()
+
+	go func() {
+		_, _ = io.Copy(conn, req.Body)
+		if w, ok := conn.(proxy.CloseWriter); ok {
+			_ = w.CloseWrite()
+		}
+	}()
+
+	// returning ends the stream
+	_, _ = io.Copy(fw, conn)
+}
+
+// flushWriter flushes every write so the stream
+// isn't delayed
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if err == nil {
+		err = fw.rc.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Addr is the address of the agent end of a tunnelled
+// connection, the hostname it was opened for
+type Addr string
+
+// Network returns "tunnel"
+func (Addr) Network() string { return "tunnel" }
+
+func (a Addr) String() string { return string(a) }
+
+// streamConn is a connection forwarded as an HTTP/2 stream.
+// Deadlines abort the stream when they expire
+type streamConn struct {
+	r      io.ReadCloser
+	w      io.WriteCloser
+	cancel context.CancelFunc
+	addr   Addr
+
+	closeOnce sync.Once
+	rd, wd    deadline
+}
+
+func newStreamConn(r io.ReadCloser, w io.WriteCloser, cancel context.CancelFunc, addr Addr) *streamConn {
+	return &streamConn{r: r, w: w, cancel: cancel, addr: addr}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err != nil && c.rd.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil && c.wd.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// CloseWrite ends the request stream, telling the
+// agent the client is done sending
+func (c *streamConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.w.Close()
+		_ = c.r.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.addr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.rd.set(t, c.cancel)
+	c.wd.set(t, c.cancel)
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t, c.cancel)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t, c.cancel)
+	return nil
+}
+
+// deadline calls a function when it expires
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (d *deadline) set(t time.Time, expire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.expired.Load() || t.IsZero() {
+		// aborted streams can't be resumed
+		return
+	}
+
+	d.timer = time.AfterFunc(time.Until(t), func() {
+		d.expired.Store(true)
+		expire()
+	})
+}
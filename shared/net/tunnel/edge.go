@@ -0,0 +1,405 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/x509utils"
+)
+
+const (
+	// DefaultHandshakeTimeout is the time given to agents to
+	// complete the TLS handshake and register
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultPingInterval is how long a tunnel can be quiet
+	// before checking the agent is still there
+	DefaultPingInterval = 30 * time.Second
+)
+
+// AuthorizeFunc decides if the agent presenting a client
+// certificate can serve a hostname
+type AuthorizeFunc func(cert *x509.Certificate, hostname string) error
+
+// EdgeConfig describes an Edge
+type EdgeConfig struct {
+	// TLSConfig accepts agents. Their client certificates are
+	// always required and verified against its ClientCAs, also
+	// when returned by GetConfigForClient
+	TLSConfig *tls.Config
+	// Authorize decides if an agent can serve a hostname. By
+	// default the hostname has to be valid for its certificate
+	Authorize AuthorizeFunc
+	// HandshakeTimeout is the time given to agents to
+	// complete the TLS handshake and register
+	HandshakeTimeout time.Duration
+	// PingInterval is how long a tunnel can be quiet
+	// before checking the agent is still there
+	PingInterval time.Duration
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+}
+
+// SetDefaults fills the gaps in the EdgeConfig
+func (cfg *EdgeConfig) SetDefaults() error {
+	if cfg.TLSConfig == nil {
+		return core.Wrap(core.ErrInvalid, "TLSConfig missing")
+	}
+
+	if cfg.Authorize == nil {
+		cfg.Authorize = AuthorizeByCertificate
+	}
+
+	cfg.HandshakeTimeout = core.IIf(cfg.HandshakeTimeout > 0, cfg.HandshakeTimeout, DefaultHandshakeTimeout)
+	cfg.PingInterval = core.IIf(cfg.PingInterval > 0, cfg.PingInterval, DefaultPingInterval)
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+	return nil
+}
+
+// New creates an Edge from the EdgeConfig
+func (cfg *EdgeConfig) New() (*Edge, error) {
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	return &Edge{
+		cfg:      *cfg,
+		tls:      edgeTLSConfig(cfg.TLSConfig),
+		sessions: make(map[string][]*session),
+		tunnels:  make(map[*session]struct{}),
+		h2: &http2.Transport{
+			ReadIdleTimeout: cfg.PingInterval,
+			PingTimeout:     cfg.PingInterval / 2,
+		},
+	}, nil
+}
+
+// edgeTLSConfig enforces the tunnel requirements on a
+// tls.Config and those it returns for each agent
+func edgeTLSConfig(base *tls.Config) *tls.Config {
+	conf := base.Clone()
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	conf.NextProtos = []string{Protocol}
+
+	if fn := conf.GetConfigForClient; fn != nil {
+		conf.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := fn(chi)
+			if c != nil {
+				c = c.Clone()
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+				c.NextProtos = []string{Protocol}
+			}
+			return c, err
+		}
+	}
+	return conf
+}
+
+// AuthorizeByCertificate allows agents to serve the
+// hostnames their certificates are valid for
+func AuthorizeByCertificate(cert *x509.Certificate, hostname string) error {
+	if err := cert.VerifyHostname(hostname); err != nil {
+		return core.Wrap(ErrUnauthorized, hostname)
+	}
+	return nil
+}
+
+// Edge accepts agents and forwards connections through them
+type Edge struct {
+	cfg EdgeConfig
+	tls *tls.Config
+	h2  *http2.Transport
+
+	mu       sync.Mutex
+	sessions map[string][]*session
+	tunnels  map[*session]struct{}
+}
+
+// ServeConn handles an agent connection until the
+// tunnel is closed or the context cancelled
+func (e *Edge) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	tc, names, err := e.accept(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	s, err := e.newSession(ctx, tc, names)
+	if err != nil {
+		return err
+	}
+
+	e.add(s)
+	defer e.remove(s)
+
+	if log, ok := e.info(); ok {
+		log.WithField("agent", conn.RemoteAddr()).
+			Printf("serving %s", strings.Join(names, ", "))
+	}
+
+	return s.wait()
+}
+
+// accept completes the handshake with the agent and
+// reads its registration
+func (e *Edge) accept(ctx context.Context, conn net.Conn) (*tls.Conn, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.HandshakeTimeout)
+	defer cancel()
+
+	tc := tls.Server(conn, e.tls)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	_ = tc.SetDeadline(deadline)
+	defer func() { _ = tc.SetDeadline(time.Time{}) }()
+
+	var reg Registration
+	if err := readMessage(tc, &reg); err != nil {
+		return nil, nil, core.Wrap(err, "registration")
+	}
+
+	names, err := e.authorize(tc.ConnectionState().PeerCertificates[0], reg.Hostnames)
+
+	var reply Reply
+	if err != nil {
+		reply.Error = err.Error()
+	}
+
+	if werr := writeMessage(tc, reply); err == nil {
+		err = werr
+	}
+	return tc, names, err
+}
+
+// authorize checks the agent can serve all the hostnames
+// and returns them sanitised
+func (e *Edge) authorize(cert *x509.Certificate, hostnames []string) ([]string, error) {
+	if len(hostnames) == 0 {
+		return nil, core.Wrap(core.ErrInvalid, "no hostnames")
+	}
+
+	names := make([]string, 0, len(hostnames))
+	for _, s := range hostnames {
+		name, ok := sanitisedName(s)
+		if !ok {
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid hostname %q", s))
+		} else if err := e.cfg.Authorize(cert, name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func sanitisedName(s string) (string, bool) {
+	name, ok := x509utils.SanitiseName(strings.TrimSuffix(strings.ToLower(s), "."))
+	return name, ok && name != "" && !strings.Contains(name, "*")
+}
+
+func (e *Edge) add(s *session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, name := range s.names {
+		e.sessions[name] = append(e.sessions[name], s)
+	}
+	e.tunnels[s] = struct{}{}
+}
+
+func (e *Edge) remove(s *session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, name := range s.names {
+		list := core.SliceMinus(e.sessions[name], []*session{s})
+		if len(list) == 0 {
+			delete(e.sessions, name)
+		} else {
+			e.sessions[name] = list
+		}
+	}
+	delete(e.tunnels, s)
+}
+
+// session returns the most recent tunnel serving a hostname
+func (e *Edge) session(hostname string) (*session, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := e.sessions[hostname]
+	if n := len(list); n > 0 {
+		return list[n-1], true
+	}
+	return nil, false
+}
+
+// Registered tells if an agent serves the hostname
+func (e *Edge) Registered(hostname string) bool {
+	name, ok := sanitisedName(hostname)
+	if ok {
+		_, ok = e.session(name)
+	}
+	return ok
+}
+
+// Hostnames returns the hostnames served by the agents
+func (e *Edge) Hostnames() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return core.SortedKeys(e.sessions)
+}
+
+// DialContext opens a connection to the agent serving the
+// host of the address, ignoring the port. The proxy.Hint
+// attached to the context, if any, is passed to the agent
+func (e *Edge) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	name, _ := sanitisedName(host)
+	s, ok := e.session(name)
+	if !ok {
+		return nil, core.Wrap(ErrNotRegistered, host)
+	}
+
+	hint, _ := proxy.HintFromContext(ctx)
+	return s.open(ctx, name, hint)
+}
+
+// Shutdown closes all tunnels once their streams finish,
+// or when the context is cancelled
+func (e *Edge) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	all := core.Keys(e.tunnels)
+	e.mu.Unlock()
+
+	var errs []error
+	for _, s := range all {
+		if err := s.cc.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// session is an established tunnel
+type session struct {
+	names  []string
+	cc     *http2.ClientConn
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (e *Edge) newSession(ctx context.Context, conn net.Conn, names []string) (*session, error) {
+	wc := &watchConn{Conn: conn, done: make(chan struct{})}
+
+	cc, err := e.h2.NewClientConn(wc)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &session{
+		names:  names,
+		cc:     cc,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   wc.done,
+	}, nil
+}
+
+// wait waits until the tunnel is closed or the
+// context cancelled
+func (s *session) wait() error {
+	defer s.cancel()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-s.ctx.Done():
+		_ = s.cc.Close()
+		return s.ctx.Err()
+	}
+}
+
+// open starts a stream for a connection to the hostname. The
+// context only bounds the wait for the agent to accept it
+func (s *session) open(ctx context.Context, hostname string, hint proxy.Hint) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	sctx, cancel := context.WithCancel(s.ctx)
+
+	req, err := http.NewRequestWithContext(sctx, http.MethodPost, "https://"+hostname+"/", pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	setHintHeaders(req.Header, hint)
+
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := s.cc.RoundTrip(req)
+	if !stop() {
+		err = core.CoalesceError(ctx.Err(), err)
+	}
+
+	switch {
+	case err != nil:
+		cancel()
+		return nil, err
+	case resp.StatusCode != http.StatusOK:
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("agent: %s", resp.Status)
+	default:
+		return newStreamConn(resp.Body, pw, cancel, Addr(hostname)), nil
+	}
+}
+
+func setHintHeaders(h http.Header, hint proxy.Hint) {
+	if hint.Source.IsValid() {
+		h.Set(HeaderClient, hint.Source.String())
+	}
+	if hint.ServerName != "" {
+		h.Set(HeaderServerName, hint.ServerName)
+	}
+}
+
+// watchConn tells when the connection fails
+type watchConn struct {
+	net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *watchConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	return n, err
+}
@@ -0,0 +1,29 @@
+package tunnel
+
+import (
+	"darvaza.org/slog"
+)
+
+func withLogger(l slog.Logger, level slog.LogLevel) (slog.Logger, bool) {
+	return l.WithLevel(level).WithEnabled()
+}
+
+func withError(l slog.Logger, ok bool, err error) (slog.Logger, bool) {
+	if ok && err != nil {
+		l = l.WithField(slog.ErrorFieldName, err)
+	}
+	return l, ok
+}
+
+func (e *Edge) info() (slog.Logger, bool) {
+	return withLogger(e.cfg.Logger, slog.Info)
+}
+
+func (a *Agent) info() (slog.Logger, bool) {
+	return withLogger(a.cfg.Logger, slog.Info)
+}
+
+func (a *Agent) warn(err error) (slog.Logger, bool) {
+	l, ok := withLogger(a.cfg.Logger, slog.Warn)
+	return withError(l, ok, err)
+}
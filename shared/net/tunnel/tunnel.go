@@ -0,0 +1,73 @@
+// Package tunnel implements reverse tunnels. Agents behind NAT
+// connect to an Edge over mutual TLS and register the hostnames
+// they serve, and the Edge forwards connections for those names
+// through the tunnel, each as an HTTP/2 stream opened by the Edge
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	// Protocol is the ALPN protocol of tunnel connections
+	Protocol = "darvaza-tunnel/1"
+
+	// HeaderClient carries the address of the client of
+	// a forwarded connection
+	HeaderClient = "Tunnel-Client"
+	// HeaderServerName carries the server name the client
+	// of a forwarded connection asked for
+	HeaderServerName = "Tunnel-Server-Name"
+
+	maxMessageLength = 16 << 10
+)
+
+var (
+	// ErrNotRegistered indicates no agent serves a hostname
+	ErrNotRegistered = errors.New("hostname not registered")
+	// ErrUnauthorized indicates an agent can't serve a hostname
+	ErrUnauthorized = errors.New("hostname not authorized")
+	// ErrSessionClosed indicates the tunnel was closed
+	ErrSessionClosed = errors.New("tunnel closed")
+)
+
+// Registration is the first message of an agent, telling
+// the hostnames it serves
+type Registration struct {
+	Hostnames []string `json:"hostnames"`
+}
+
+// Reply is the answer of the Edge to a Registration
+type Reply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// writeMessage sends a JSON message terminated by a newline
+func writeMessage(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// readMessage reads a JSON message terminated by a newline.
+// It reads byte by byte as HTTP/2 follows without waiting
+func readMessage(r io.Reader, v any) error {
+	var b [1]byte
+	var buf []byte
+
+	for len(buf) < maxMessageLength {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return err
+		} else if b[0] == '\n' {
+			return json.Unmarshal(buf, v)
+		}
+		buf = append(buf, b[0])
+	}
+	return errors.New("message too long")
+}
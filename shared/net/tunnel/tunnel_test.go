@@ -0,0 +1,209 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	ca := newTestCA(t)
+
+	edge, err := (&EdgeConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "edge.example.org")},
+			ClientCAs:    ca.pool(),
+		},
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = edge.ServeConn(ctx, conn) }()
+		}
+	}()
+
+	target := echoServer(t)
+	defer target.Close()
+
+	agent, err := (&AgentConfig{
+		Edge: lsn.Addr().String(),
+		TLSConfig: &tls.Config{
+			ServerName:   "edge.example.org",
+			RootCAs:      ca.pool(),
+			Certificates: []tls.Certificate{ca.issue(t, "app.example.org")},
+		},
+		Targets: map[string]string{"App.Example.org": target.Addr().String()},
+	}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = agent.Run(ctx) }()
+
+	waitRegistered(t, edge, "app.example.org")
+
+	conn, err := edge.DialContext(ctx, "tcp", "app.example.org:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello through the tunnel")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(*streamConn).CloseWrite()
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(b) != string(msg) {
+		t.Errorf("received %q (expected %q)", b, msg)
+	}
+
+	if _, err := edge.DialContext(ctx, "tcp", "other.example.org:443"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("unregistered hostname: %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	ca := newTestCA(t)
+	cert, err := x509.ParseCertificate(ca.issue(t, "app.example.org").Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Edge{cfg: EdgeConfig{Authorize: AuthorizeByCertificate}}
+	for _, tc := range []struct {
+		hostnames []string
+		ok        bool
+	}{
+		{[]string{"app.example.org"}, true},
+		{[]string{"APP.example.org."}, true},
+		{[]string{"app.example.org", "db.example.org"}, false},
+		{[]string{"*.example.org"}, false},
+		{nil, false},
+	} {
+		_, err := e.authorize(cert, tc.hostnames)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%q: %v", tc.hostnames, err)
+		}
+	}
+}
+
+func waitRegistered(t *testing.T, edge *Edge, hostname string) {
+	for range 100 {
+		if edge.Registered(hostname) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%q not registered", hostname)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lsn
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key := newTestKey(t)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key := newTestKey(t)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
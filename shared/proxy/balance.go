@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Strategy is a load balancing strategy
+type Strategy string
+
+const (
+	// RoundRobin takes members in turn
+	RoundRobin Strategy = "round_robin"
+	// LeastConn takes the member with fewer active connections
+	LeastConn Strategy = "least_conn"
+	// RandomTwo takes the member with fewer active connections
+	// out of two random choices
+	RandomTwo Strategy = "random_two"
+	// ConsistentHash takes the member owning the hash key
+	// on a hash ring
+	ConsistentHash Strategy = "consistent_hash"
+)
+
+// HashKey selects what the ConsistentHash strategy hashes
+type HashKey string
+
+const (
+	// HashByClientIP hashes the address of the client
+	HashByClientIP HashKey = "client_ip"
+	// HashByServerName hashes the requested server name
+	HashByServerName HashKey = "sni"
+)
+
+// ringReplicas is the number of virtual nodes of each
+// member on the hash ring
+const ringReplicas = 100
+
+type balancer interface {
+	// Pick returns an acceptable member, or nil
+	Pick(key string, ok func(*Member) bool) *Member
+}
+
+func newBalancer(s Strategy, members []*Member) (balancer, error) {
+	switch s {
+	case RoundRobin:
+		return &roundRobin{members: members}, nil
+	case LeastConn:
+		return &leastConn{members: members}, nil
+	case RandomTwo:
+		return &randomTwo{members: members}, nil
+	case ConsistentHash:
+		return newHashRing(members), nil
+	default:
+		return nil, fmt.Errorf("invalid strategy %q", s)
+	}
+}
+
+type roundRobin struct {
+	members []*Member
+	next    atomic.Uint32
+}
+
+func (b *roundRobin) Pick(_ string, ok func(*Member) bool) *Member {
+	n := len(b.members)
+	start := int((b.next.Add(1) - 1) % uint32(n))
+
+	for i := 0; i < n; i++ {
+		if m := b.members[(start+i)%n]; ok(m) {
+			return m
+		}
+	}
+	return nil
+}
+
+type leastConn struct {
+	members []*Member
+	next    atomic.Uint32
+}
+
+func (b *leastConn) Pick(_ string, ok func(*Member) bool) *Member {
+	var best *Member
+
+	// rotate the starting point so ties are spread
+	n := len(b.members)
+	start := int((b.next.Add(1) - 1) % uint32(n))
+
+	for i := 0; i < n; i++ {
+		m := b.members[(start+i)%n]
+		if ok(m) && (best == nil || m.ActiveConns() < best.ActiveConns()) {
+			best = m
+		}
+	}
+	return best
+}
+
+type randomTwo struct {
+	members []*Member
+}
+
+func (b *randomTwo) Pick(_ string, ok func(*Member) bool) *Member {
+	candidates := make([]*Member, 0, len(b.members))
+	for _, m := range b.members {
+		if ok(m) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b2 := candidates[i], candidates[j]
+	if b2.ActiveConns() < a.ActiveConns() {
+		return b2
+	}
+	return a
+}
+
+type ringNode struct {
+	hash   uint64
+	member *Member
+}
+
+type hashRing struct {
+	nodes []ringNode
+}
+
+func newHashRing(members []*Member) *hashRing {
+	r := &hashRing{
+		nodes: make([]ringNode, 0, len(members)*ringReplicas),
+	}
+
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			r.nodes = append(r.nodes, ringNode{
+				hash:   hashString(m.Addr + "#" + strconv.Itoa(i)),
+				member: m,
+			})
+		}
+	}
+
+	sort.Slice(r.nodes, func(i, j int) bool {
+		return r.nodes[i].hash < r.nodes[j].hash
+	})
+	return r
+}
+
+// Pick walks the ring clockwise from the key's hash until
+// an acceptable member is found
+func (r *hashRing) Pick(key string, ok func(*Member) bool) *Member {
+	n := len(r.nodes)
+	h := hashString(key)
+	start := sort.Search(n, func(i int) bool {
+		return r.nodes[i].hash >= h
+	})
+
+	for i := 0; i < n; i++ {
+		if m := r.nodes[(start+i)%n].member; ok(m) {
+			return m
+		}
+	}
+	return nil
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit Breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets connections through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects connections until the open time passes
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through, which
+	// closes the circuit on success or opens it again on failure
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker is a circuit breaker opening after a number of
+// consecutive failures
+type Breaker struct {
+	// MaxFails is the number of consecutive failures opening
+	// the circuit. Zero or negative disables the Breaker
+	MaxFails int
+	// OpenTime is how long the circuit stays open before
+	// probing again
+	OpenTime time.Duration
+
+	mu         sync.Mutex
+	state      BreakerState
+	fails      int
+	lastFail   time.Time
+	openUntil  time.Time
+	probeStart time.Time
+}
+
+// State returns the state of the Breaker. An open circuit
+// whose time has passed is reported as half-open
+func (b *Breaker) State(now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Idle tells if the Breaker holds nothing worth remembering,
+// being closed without recent failures, or due for probing
+// for longer than OpenTime
+func (b *Breaker) Idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return b.fails == 0 || now.Sub(b.lastFail) >= b.OpenTime
+	case BreakerOpen:
+		return now.Sub(b.openUntil) >= b.OpenTime
+	default:
+		// the probe was presumed lost over OpenTime ago
+		return now.Sub(b.probeStart) >= 2*b.OpenTime
+	}
+}
+
+// Ready tells if Allow would let a connection through,
+// without reserving the probe
+func (b *Breaker) Ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.ready(now)
+}
+
+func (b *Breaker) ready(now time.Time) bool {
+	switch b.state {
+	case BreakerOpen:
+		return !now.Before(b.openUntil)
+	case BreakerHalfOpen:
+		// a probe taking longer than OpenTime is presumed lost
+		return now.Sub(b.probeStart) >= b.OpenTime
+	default:
+		return true
+	}
+}
+
+// Allow tells if a connection may be attempted. On a circuit
+// due for probing only the first caller is allowed
+func (b *Breaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.ready(now) {
+		return false
+	} else if b.state != BreakerClosed {
+		b.state, b.probeStart = BreakerHalfOpen, now
+	}
+	return true
+}
+
+// Success reports a successful connection, closing the circuit
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state, b.fails = BreakerClosed, 0
+}
+
+// Failure reports a failed connection. It returns true if
+// the circuit was opened by it
+func (b *Breaker) Failure(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.MaxFails <= 0 {
+		return false
+	}
+
+	b.fails++
+	b.lastFail = now
+	if b.state == BreakerClosed && b.fails < b.MaxFails {
+		return false
+	}
+
+	// a failed probe opens again
+	b.state, b.fails = BreakerOpen, 0
+	b.openUntil = now.Add(b.OpenTime)
+	return true
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+)
+
+var (
+	// ErrCircuitOpen indicates the upstream is rejected by
+	// its circuit breaker
+	ErrCircuitOpen = errors.New("circuit open")
+	// ErrDialTimeout indicates the upstream didn't accept
+	// the connection in time
+	ErrDialTimeout = errors.New("dial timeout")
+)
+
+const (
+	// DefaultBackoffMin is the default wait before retrying
+	DefaultBackoffMin = 50 * time.Millisecond
+	// DefaultBackoffMax is the default maximum wait between retries
+	DefaultBackoffMax = 2 * time.Second
+)
+
+// DialError describes a failure to connect to an upstream
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial %s: %s", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout tells if the error was a timeout
+func (e *DialError) Timeout() bool {
+	return errors.Is(e.Err, ErrDialTimeout)
+}
+
+// newDialError wraps the error of a dial attempt, identifying
+// timeouts as ErrDialTimeout
+func newDialError(addr string, err error) *DialError {
+	var ne net.Error
+
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		err = core.Wrap(ErrDialTimeout, err.Error())
+	}
+	return &DialError{Addr: addr, Err: err}
+}
+
+// IsUnavailable tells if the error indicates there is no
+// upstream able to take the connection at the moment, instead
+// of a failure connecting to it
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrNoMembers) || errors.Is(err, ErrCircuitOpen)
+}
+
+// StatusCode returns the HTTP status describing a dial error.
+// 503 when no upstream is available, 504 on timeouts and
+// 502 otherwise
+func StatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case IsUnavailable(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrDialTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// Backoff computes exponentially growing waits
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Duration returns the wait before the given retry, starting at zero
+func (b Backoff) Duration(retry int) time.Duration {
+	lo := core.IIf(b.Min > 0, b.Min, DefaultBackoffMin)
+	hi := core.IIf(b.Max > 0, b.Max, DefaultBackoffMax)
+
+	d := lo
+	for i := 0; i < retry && d < hi; i++ {
+		d *= 2
+	}
+	return min(d, hi)
+}
+
+// Wait waits before the given retry, or until the context
+// is cancelled
+func (b Backoff) Wait(ctx context.Context, retry int) error {
+	t := time.NewTimer(b.Duration(retry))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Dialer connects to upstream addresses with a timeout,
+// retrying with exponential backoff, and a circuit breaker
+// per address. Idle breakers are forgotten every OpenTime
+type Dialer struct {
+	// Timeout is the maximum time given to each attempt
+	Timeout time.Duration
+	// Retries is the number of additional attempts
+	Retries int
+	// Backoff is the wait between attempts
+	Backoff Backoff
+
+	// MaxFails is the number of consecutive failures opening
+	// the circuit of an address. Negative disables it
+	MaxFails int
+	// OpenTime is how long a circuit stays open
+	OpenTime time.Duration
+
+	mu        sync.Mutex
+	breakers  map[string]*Breaker
+	nextSweep time.Time
+}
+
+// DefaultDialer is the Dialer used by Forward
+var DefaultDialer = &Dialer{}
+
+// DialContext connects to the address using the context
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	b := d.breaker(addr)
+
+	var err error
+	for retry := 0; retry <= d.Retries; retry++ {
+		if retry > 0 {
+			if werr := d.Backoff.Wait(ctx, retry-1); werr != nil {
+				return nil, newDialError(addr, werr)
+			}
+		}
+
+		if !b.Allow(time.Now()) {
+			return nil, &DialError{Addr: addr, Err: ErrCircuitOpen}
+		}
+
+		var conn net.Conn
+		conn, err = dialTimeout(ctx, network, addr, d.timeout())
+		if err == nil {
+			b.Success()
+			return conn, nil
+		} else if ctx.Err() != nil {
+			break
+		}
+		b.Failure(time.Now())
+	}
+
+	return nil, newDialError(addr, err)
+}
+
+func (d *Dialer) timeout() time.Duration {
+	return core.IIf(d.Timeout > 0, d.Timeout, DefaultDialTimeout)
+}
+
+// noBreaker is the disabled Breaker shared by Dialers
+// without circuit breakers
+var noBreaker = &Breaker{}
+
+func (d *Dialer) breaker(addr string) *Breaker {
+	if d.MaxFails < 0 {
+		// not tracking addresses
+		return noBreaker
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	openTime := core.IIf(d.OpenTime > 0, d.OpenTime, DefaultEjectTime)
+	if now := time.Now(); now.After(d.nextSweep) {
+		d.sweepUnlocked(now)
+		d.nextSweep = now.Add(openTime)
+	}
+
+	b, ok := d.breakers[addr]
+	if !ok {
+		b = &Breaker{
+			MaxFails: core.IIf(d.MaxFails != 0, d.MaxFails, DefaultMaxFails),
+			OpenTime: openTime,
+		}
+
+		if d.breakers == nil {
+			d.breakers = make(map[string]*Breaker)
+		}
+		d.breakers[addr] = b
+	}
+	return b
+}
+
+// sweepUnlocked forgets the idle breakers, so addresses
+// dialed once don't accumulate
+func (d *Dialer) sweepUnlocked(now time.Time) {
+	for addr, b := range d.breakers {
+		if b.Idle(now) {
+			delete(d.breakers, addr)
+		}
+	}
+}
+
+func dialTimeout(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	var d net.Dialer
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, addr)
+}
@@ -4,11 +4,11 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"net/netip"
+	"time"
 
-	"darvaza.org/core"
+	"darvaza.org/darvaza/shared/net/proxyproto"
 )
 
 // CloseWriter represents a connection that can close its Write stream
@@ -16,10 +16,127 @@ type CloseWriter interface {
 	CloseWrite() error
 }
 
+// ForwardOption modifies the behaviour of Forward
+type ForwardOption func(*forwardConfig)
+
+type forwardConfig struct {
+	dialer       *Dialer
+	proxyVersion int
+	proxyTLVs    []proxyproto.TLV
+
+	idleSend    time.Duration
+	idleReceive time.Duration
+	maxLifetime time.Duration
+	bandwidth   int64
+	limiters    []*Limiter
+	onClose     func(Stats)
+	reply       func(net.Conn, error) error
+	mirror      *Mirror
+}
+
+func newForwardConfig(opts []ForwardOption) *forwardConfig {
+	fc := &forwardConfig{dialer: DefaultDialer}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(fc)
+		}
+	}
+	return fc
+}
+
+// newLimiters returns the limiters of one direction, the shared
+// ones and a new one for the bandwidth of the connection, if set
+func (fc *forwardConfig) newLimiters() []*Limiter {
+	out := make([]*Limiter, 0, len(fc.limiters)+1)
+	if l := NewLimiter(fc.bandwidth, 0); l != nil {
+		out = append(out, l)
+	}
+	for _, l := range fc.limiters {
+		if l != nil {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// WithDialer makes Forward use the given Dialer instead
+// of the DefaultDialer
+func WithDialer(d *Dialer) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.dialer = d
+	}
+}
+
+// WithProxyProtocol makes Forward send a PROXY protocol header
+// of the given version describing the downstream connection,
+// with the optional TLVs on version 2
+func WithProxyProtocol(version int, tlvs ...proxyproto.TLV) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.proxyVersion, fc.proxyTLVs = version, tlvs
+	}
+}
+
+// WithIdleTimeout closes the connection if no data is moved
+// in either direction in the given time, as seen while waiting
+// for the client (send) or for the upstream (receive). Zero
+// disables the timeout of that side
+func WithIdleTimeout(send, receive time.Duration) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.idleSend, fc.idleReceive = send, receive
+	}
+}
+
+// WithMaxLifetime closes the connection once it has been
+// forwarded for the given time
+func WithMaxLifetime(d time.Duration) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.maxLifetime = d
+	}
+}
+
+// WithBandwidth limits each direction of the connection
+// to the given bytes per second
+func WithBandwidth(bytesPerSecond int64) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.bandwidth = bytesPerSecond
+	}
+}
+
+// WithLimiter makes both directions of the connection pass through
+// the given Limiter, which can be shared by many connections, e.g.
+// all those of a route
+func WithLimiter(l *Limiter) ForwardOption {
+	return func(fc *forwardConfig) {
+		if l != nil {
+			fc.limiters = append(fc.limiters, l)
+		}
+	}
+}
+
+// WithStats sets a function called with the Stats of the
+// connection once it's closed
+func WithStats(fn func(Stats)) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.onClose = fn
+	}
+}
+
+// WithReply sets a function called once the upstream is dialed,
+// with the error if it failed, so protocols like CONNECT or SOCKS
+// can answer the client before any data is forwarded. If it
+// returns an error the connection isn't forwarded
+func WithReply(fn func(upstream net.Conn, err error) error) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.reply = fn
+	}
+}
+
 // Forward will take a context, a "downstream" net.Conn and a netip.Addr it will
 // create a new connection "upstream" and it will move bytes between the two.
 // Practically it will proxy between the two connections
-func Forward(ctx context.Context, conn net.Conn, addr netip.AddrPort) error {
+func Forward(ctx context.Context, conn net.Conn, addr netip.AddrPort, opts ...ForwardOption) error {
+	fc := newForwardConfig(opts)
+
 	defer conn.Close()
 	select {
 	case <-ctx.Done():
@@ -31,36 +148,57 @@ func Forward(ctx context.Context, conn net.Conn, addr netip.AddrPort) error {
 		return fmt.Errorf("invalid upstream address")
 	}
 
-	upstream, err := net.Dial("tcp", addr.String())
+	upstream, err := fc.dial(ctx, addr)
 	if err != nil {
-		// TODO: Need to retry?
 		return err
 	}
 	defer upstream.Close()
 
-	var wg core.WaitGroup
+	if fc.proxyVersion > 0 {
+		hint := Hint{
+			Source:      addrPort(conn.RemoteAddr()),
+			Destination: addrPort(conn.LocalAddr()),
+			TLVs:        fc.proxyTLVs,
+		}
+		if _, err := hint.ProxyHeader(fc.proxyVersion).WriteTo(upstream); err != nil {
+			return err
+		}
+	}
 
-	wg.Go(func() error {
-		return copyConn(conn, upstream)
-	})
+	return fc.pipe(ctx, conn, upstream)
+}
 
-	if err := copyConn(upstream, conn); err != nil {
-		return err
+// dial connects to the upstream and lets the
+// reply function know the outcome
+func (fc *forwardConfig) dial(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	upstream, err := fc.dialer.DialContext(ctx, "tcp", addr.String())
+	if fc.reply == nil {
+		return upstream, err
 	}
 
-	_ = wg.Wait()
-	return nil
+	rerr := fc.reply(upstream, err)
+	switch {
+	case err != nil:
+		return nil, err
+	case rerr != nil:
+		_ = upstream.Close()
+		return nil, rerr
+	default:
+		return upstream, nil
+	}
 }
 
-func copyConn(from, to net.Conn) error {
-	// We just want to CloseWrite to signal that we finished writing
-	// but naked net.Conn does not have it so we transform to TCPConn
-	if w, ok := from.(CloseWriter); ok {
-		defer func() {
-			_ = w.CloseWrite()
-		}()
+// addrPort converts a net.Addr into netip.AddrPort, if possible
+func addrPort(addr net.Addr) netip.AddrPort {
+	if addr == nil {
+		return netip.AddrPort{}
 	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
 
-	_, err := io.Copy(from, to)
-	return err
+// Pipe moves bytes between two established connections until
+// both directions are finished
+func Pipe(conn, upstream net.Conn) error {
+	return PipeContext(context.Background(), conn, upstream)
 }
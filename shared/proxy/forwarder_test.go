@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(1000, 100)
+	now := time.Now()
+
+	for i, tc := range []struct {
+		after    time.Duration
+		n        int
+		expected time.Duration
+	}{
+		{n: 100},
+		{n: 50, expected: 50 * time.Millisecond},
+		{after: 50 * time.Millisecond, n: 0},
+		{after: time.Second, n: 150, expected: 50 * time.Millisecond},
+	} {
+		now = now.Add(tc.after)
+		if d := l.reserve(now, tc.n); d != tc.expected {
+			t.Errorf("%v: %s (expected %s)", i, d, tc.expected)
+		}
+	}
+}
+
+func TestPipeContextLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opt      ForwardOption
+		expected error
+	}{
+		{"idle", WithIdleTimeout(50*time.Millisecond, 0), ErrIdleTimeout},
+		{"lifetime", WithMaxLifetime(50 * time.Millisecond), ErrMaxLifetime},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testPipeContextLimit(t, tc.opt, tc.expected)
+		})
+	}
+}
+
+func testPipeContextLimit(t *testing.T, opt ForwardOption, expected error) {
+	client, conn := net.Pipe()
+	upstream, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var stats Stats
+	done := make(chan error)
+	go func() {
+		done <- PipeContext(context.Background(), conn, upstream,
+			opt, WithStats(func(s Stats) { stats = s }))
+	}()
+
+	go func() { _, _ = client.Write([]byte("hello")) }()
+	buf := make([]byte, 5)
+	if _, err := server.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, expected) {
+			t.Errorf("%v (expected %v)", err, expected)
+		}
+		if stats.Sent != 5 || stats.Received != 0 {
+			t.Errorf("sent:%v received:%v (expected 5 and 0)", stats.Sent, stats.Received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestPipeContextOneWay(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	const chunks = 50
+
+	client, conn := net.Pipe()
+	upstream, server := net.Pipe()
+
+	var stats Stats
+	done := make(chan error)
+	go func() {
+		done <- PipeContext(context.Background(), conn, upstream,
+			WithIdleTimeout(idle, idle), WithStats(func(s Stats) { stats = s }))
+	}()
+
+	// a download taking longer than the idle timeout,
+	// without the client sending anything
+	go func() {
+		defer server.Close()
+		for i := 0; i < chunks; i++ {
+			if _, err := server.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(idle / 10)
+		}
+	}()
+
+	buf := make([]byte, 4*chunks)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+		if stats.Received != 4*chunks {
+			t.Errorf("received %v (expected %v)", stats.Received, 4*chunks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// HealthCheckType is the kind of active health check
+type HealthCheckType string
+
+const (
+	// HealthCheckTCP only checks the member accepts connections
+	HealthCheckTCP HealthCheckType = "tcp"
+	// HealthCheckTLS checks the member completes a TLS handshake
+	HealthCheckTLS HealthCheckType = "tls"
+	// HealthCheckHTTP checks the member answers an HTTP request
+	HealthCheckHTTP HealthCheckType = "http"
+)
+
+const (
+	// DefaultHealthInterval is the time between health checks
+	DefaultHealthInterval = 10 * time.Second
+	// DefaultHealthTimeout is the maximum time given to a health check
+	DefaultHealthTimeout = 2 * time.Second
+	// DefaultHealthRise is the number of consecutive successes
+	// needed to bring a member back
+	DefaultHealthRise = 2
+	// DefaultHealthFall is the number of consecutive failures
+	// needed to pull a member out
+	DefaultHealthFall = 3
+)
+
+// HealthCheck describes the active health checks of a Pool
+type HealthCheck struct {
+	Type     HealthCheckType
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+
+	// TLSConfig is used by TLS checks, and by HTTP checks
+	// when present
+	TLSConfig *tls.Config
+
+	// Path is the HTTP path requested, defaults to "/"
+	Path string
+	// Host is the optional Host header of HTTP checks
+	Host string
+	// ExpectStatus is the HTTP status expected. If zero any
+	// 2xx or 3xx is accepted
+	ExpectStatus int
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (hc *HealthCheck) SetDefaults() error {
+	switch hc.Type {
+	case "":
+		hc.Type = HealthCheckTCP
+	case HealthCheckTCP, HealthCheckTLS, HealthCheckHTTP:
+	default:
+		return fmt.Errorf("invalid health check type %q", hc.Type)
+	}
+
+	if hc.Type == HealthCheckTLS && hc.TLSConfig == nil {
+		hc.TLSConfig = &tls.Config{}
+	}
+
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+
+	hc.Interval = core.IIf(hc.Interval > 0, hc.Interval, DefaultHealthInterval)
+	hc.Timeout = core.IIf(hc.Timeout > 0, hc.Timeout, DefaultHealthTimeout)
+	hc.Rise = core.IIf(hc.Rise > 0, hc.Rise, DefaultHealthRise)
+	hc.Fall = core.IIf(hc.Fall > 0, hc.Fall, DefaultHealthFall)
+	return nil
+}
+
+// Run performs the active health checks of the Pool until
+// the context is cancelled. Without HealthCheck it only waits
+func (p *Pool) Run(ctx context.Context) error {
+	var wg core.WaitGroup
+
+	if p.cfg.HealthCheck == nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	for _, m := range p.members {
+		wg.Go(func() error {
+			p.runHealthCheck(ctx, m)
+			return nil
+		})
+	}
+
+	return wg.Wait()
+}
+
+func (p *Pool) runHealthCheck(ctx context.Context, m *Member) {
+	var rise, fall int
+
+	hc := p.cfg.HealthCheck
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.check(ctx, m)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			rise, fall = rise+1, 0
+			if !m.Healthy() && rise >= hc.Rise {
+				p.setHealthy(m, true, nil)
+			}
+		default:
+			rise, fall = 0, fall+1
+			if m.Healthy() && fall >= hc.Fall {
+				p.setHealthy(m, false, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) setHealthy(m *Member, healthy bool, err error) {
+	m.healthy.Store(healthy)
+
+	if healthy {
+		if log, ok := p.info(); ok {
+			log.WithField("pool", p.cfg.Name).
+				WithField("member", m.Addr).
+				Print("member is healthy")
+		}
+	} else if log, ok := p.warn(err); ok {
+		log.WithField("pool", p.cfg.Name).
+			WithField("member", m.Addr).
+			Print("member is unhealthy")
+	}
+}
+
+func (p *Pool) check(ctx context.Context, m *Member) error {
+	hc := p.cfg.HealthCheck
+
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	switch hc.Type {
+	case HealthCheckHTTP:
+		return checkHTTP(ctx, hc, m.Addr)
+	case HealthCheckTLS:
+		return checkTLS(ctx, hc, m.Addr)
+	default:
+		return checkTCP(ctx, m.Addr)
+	}
+}
+
+func checkTCP(ctx context.Context, addr string) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkTLS(ctx context.Context, hc *HealthCheck, addr string) error {
+	d := tls.Dialer{
+		Config: hc.TLSConfig,
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkHTTP(ctx context.Context, hc *HealthCheck, addr string) error {
+	scheme := core.IIf(hc.TLSConfig != nil, "https", "http")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   hc.TLSConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	switch {
+	case hc.ExpectStatus != 0 && res.StatusCode != hc.ExpectStatus:
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	case hc.ExpectStatus == 0 && (res.StatusCode < 200 || res.StatusCode >= 400):
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	default:
+		return nil
+	}
+}
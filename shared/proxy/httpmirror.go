@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+)
+
+const (
+	// DefaultMirrorBodySize is the default largest request
+	// body copied to a shadow upstream
+	DefaultMirrorBodySize = 64 << 10
+	// DefaultMirrorTimeout is the default time given to
+	// the shadow to answer a request
+	DefaultMirrorTimeout = 10 * time.Second
+	// DefaultMirrorConcurrency is the default number of
+	// requests sent to the shadow at the same time
+	DefaultMirrorConcurrency = 64
+)
+
+// hopHeaders are not copied to the shadow
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// HTTPMirrorConfig describes the duplication of the requests
+// served by a handler to a shadow upstream. Requests are sent
+// to the shadow once served, and its responses are discarded
+type HTTPMirrorConfig struct {
+	// Shadow is the Pool receiving the copies
+	Shadow *Pool
+	// TLSConfig, if set, is used to speak TLS to the shadow
+	TLSConfig *tls.Config
+
+	// Percent of the requests mirrored. Zero mirrors all
+	Percent float64
+	// MaxBodySize is the largest request body copied. Requests
+	// with larger bodies aren't mirrored
+	MaxBodySize int64
+	// Timeout is the time given to the shadow to answer
+	Timeout time.Duration
+	// MaxConcurrent is the most requests sent to the shadow
+	// at the same time. Requests beyond it aren't mirrored
+	MaxConcurrent int
+}
+
+// SetDefaults fills the gaps in the HTTPMirrorConfig
+func (cfg *HTTPMirrorConfig) SetDefaults() {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMirrorBodySize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultMirrorTimeout
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = DefaultMirrorConcurrency
+	}
+}
+
+// New wraps a handler mirroring the requests it serves
+func (cfg *HTTPMirrorConfig) New(next http.Handler) (http.Handler, error) {
+	if cfg.Shadow == nil {
+		return nil, core.Wrap(core.ErrInvalid, "mirror: no shadow")
+	}
+	cfg.SetDefaults()
+
+	m := &httpMirror{
+		cfg:  *cfg,
+		next: next,
+		transport: &http.Transport{
+			DialContext:       cfg.Shadow.DialContext,
+			TLSClientConfig:   cfg.TLSConfig,
+			ForceAttemptHTTP2: cfg.TLSConfig != nil,
+			DisableKeepAlives: cfg.Shadow.cfg.ProxyProtocol > 0,
+		},
+		slots: make(chan struct{}, cfg.MaxConcurrent),
+	}
+	return m, nil
+}
+
+type httpMirror struct {
+	cfg       HTTPMirrorConfig
+	next      http.Handler
+	transport *http.Transport
+	slots     chan struct{}
+}
+
+func (m *httpMirror) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !m.accepts(req) {
+		m.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// copied before the handler can touch it
+	out := req.Clone(context.WithoutCancel(req.Context()))
+
+	body := &capturedBody{
+		ReadCloser: req.Body,
+		max:        m.cfg.MaxBodySize,
+		// bodyless requests aren't read
+		eof: req.ContentLength == 0,
+	}
+	req.Body = body
+	m.next.ServeHTTP(rw, req)
+
+	if b, ok := body.captured(); ok {
+		m.send(out, b)
+	}
+}
+
+// accepts tells if a request can be mirrored
+func (m *httpMirror) accepts(req *http.Request) bool {
+	switch {
+	case req.Method == http.MethodConnect, req.Header.Get("Upgrade") != "":
+		return false
+	case req.ContentLength > m.cfg.MaxBodySize:
+		return false
+	default:
+		return sampled(m.cfg.Percent)
+	}
+}
+
+// send sends the copy of a request to the shadow in the
+// background, unless too many are already in flight
+func (m *httpMirror) send(out *http.Request, body []byte) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	out.RequestURI = ""
+	out.URL.Scheme = core.IIf(m.cfg.TLSConfig != nil, "https", "http")
+	out.URL.Host = m.cfg.Shadow.Name()
+	out.ContentLength = int64(len(body))
+	out.Body = http.NoBody
+	if len(body) > 0 {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		m.roundTrip(out)
+	}()
+}
+
+func (m *httpMirror) roundTrip(out *http.Request) {
+	ctx, cancel := context.WithTimeout(out.Context(), m.cfg.Timeout)
+	defer cancel()
+
+	resp, err := m.transport.RoundTrip(out.WithContext(ctx))
+	if err != nil {
+		if log, ok := m.cfg.Shadow.warn(err); ok {
+			log.WithField("pool", m.cfg.Shadow.Name()).
+				Printf("mirror %s %s", out.Method, out.Host)
+		}
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// capturedBody keeps a copy of a request body as the
+// handler reads it
+type capturedBody struct {
+	io.ReadCloser
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+	eof      bool
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.overflow:
+	case int64(b.buf.Len()+n) > b.max:
+		b.overflow = true
+		b.buf = bytes.Buffer{}
+	default:
+		b.buf.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// captured returns the body read, if it was read
+// completely and it isn't too large
+func (b *capturedBody) captured() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflow || !b.eof {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
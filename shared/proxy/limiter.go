@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultBurst is the largest burst allowed by a Limiter
+// when none is specified
+const DefaultBurst = 32 * 1024
+
+// Limiter is a token bucket limiting the bytes per second
+// passing through it. A Limiter can be shared by many
+// connections to limit them together
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter allowing the given bytes per
+// second, in bursts of up to burst bytes. Zero burst uses
+// the rate up to DefaultBurst. Non-positive rates return nil,
+// which doesn't limit
+func NewLimiter(bytesPerSecond int64, burst int) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = int(min(bytesPerSecond, DefaultBurst))
+	}
+
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Burst returns the size of the largest burst allowed
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+// WaitN blocks until n bytes are allowed through, or
+// the context is cancelled
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	d := l.reserve(time.Now(), n)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-t.C:
+		return nil
+	}
+}
+
+// reserve takes n tokens from the bucket, going into debt if
+// needed, and returns how long until the debt is paid
+func (l *Limiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		l.tokens = min(l.tokens, l.burst)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"darvaza.org/slog"
+)
+
+func (p *Pool) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return p.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (p *Pool) info() (slog.Logger, bool) {
+	return p.withLogger(slog.Info)
+}
+
+func (p *Pool) warn(err error) (slog.Logger, bool) {
+	if l, ok := p.withLogger(slog.Warn); ok {
+		if err != nil {
+			l = l.WithField(slog.ErrorFieldName, err)
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// DefaultMirrorBuffer is the default number of bytes queued
+// for the shadow of each connection
+const DefaultMirrorBuffer = 1 << 20
+
+// mirrorQueueLen is the most writes queued for a shadow
+const mirrorQueueLen = 256
+
+// Mirror copies what clients send to a shadow upstream,
+// discarding its responses. The forwarded connection is never
+// slowed down nor broken by it, if the shadow fails or falls
+// behind the mirroring of that connection stops
+type Mirror struct {
+	// Dial connects to the shadow upstream
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Percent of the connections mirrored. Zero mirrors all
+	Percent float64
+	// BufferSize is the most bytes queued for the shadow
+	// of each connection
+	BufferSize int
+	// Timeout is the time given to the shadow to connect, and
+	// to take what's queued once the connection is closed
+	Timeout time.Duration
+}
+
+// WithMirror makes Forward copy what the client sends
+// to the shadow upstream of the Mirror
+func WithMirror(m *Mirror) ForwardOption {
+	return func(fc *forwardConfig) {
+		fc.mirror = m
+	}
+}
+
+// sampled tells if a connection or request is mirrored
+func sampled(percent float64) bool {
+	return percent <= 0 || percent >= 100 || rand.Float64()*100 < percent
+}
+
+// start begins mirroring a connection, if sampled
+func (m *Mirror) start(ctx context.Context) *shadow {
+	if m == nil || m.Dial == nil || !sampled(m.Percent) {
+		return nil
+	}
+
+	s := &shadow{
+		queue:   make(chan []byte, mirrorQueueLen),
+		closed:  make(chan struct{}),
+		limit:   int64(core.IIf(m.BufferSize > 0, m.BufferSize, DefaultMirrorBuffer)),
+		timeout: core.IIf(m.Timeout > 0, m.Timeout, DefaultMirrorTimeout),
+	}
+	go s.run(ctx, m.Dial)
+	return s
+}
+
+// shadow is the mirror of a connection
+type shadow struct {
+	queue   chan []byte
+	closed  chan struct{}
+	queued  atomic.Int64
+	limit   int64
+	timeout time.Duration
+	failed  atomic.Bool
+}
+
+// write queues a copy of the data, giving up if the
+// shadow fell behind. Nil shadows ignore it
+func (s *shadow) write(b []byte) {
+	if s == nil || s.failed.Load() {
+		return
+	}
+
+	if s.queued.Add(int64(len(b))) > s.limit {
+		s.failed.Store(true)
+		return
+	}
+
+	select {
+	case s.queue <- bytes.Clone(b):
+	default:
+		s.failed.Store(true)
+	}
+}
+
+// close ends the mirrored stream once the queue is sent
+func (s *shadow) close() {
+	if s != nil {
+		close(s.queue)
+		close(s.closed)
+	}
+}
+
+func (s *shadow) run(ctx context.Context, dial func(context.Context) (net.Conn, error)) {
+	// the shadow outlives the connection to flush its queue
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.timeout)
+	conn, err := dial(ctx)
+	cancel()
+	if err != nil {
+		s.failed.Store(true)
+		return
+	}
+	defer conn.Close()
+
+	// once the connection is closed the shadow has
+	// the timeout to take the rest
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.closed:
+			_ = conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		case <-done:
+		}
+	}()
+
+	// responses are discarded
+	go func() { _, _ = io.Copy(io.Discard, conn) }()
+
+	for b := range s.queue {
+		s.queued.Add(-int64(len(b)))
+		if _, err := conn.Write(b); err != nil {
+			s.failed.Store(true)
+			return
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		broken bool
+	}{
+		{"shadow", false},
+		{"broken shadow", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testMirror(t, tc.broken)
+		})
+	}
+}
+
+func testMirror(t *testing.T, broken bool) {
+	client, conn := net.Pipe()
+	upstream, server := net.Pipe()
+	shadowConn, shadowPeer := net.Pipe()
+	defer shadowPeer.Close()
+
+	m := &Mirror{
+		Dial: func(context.Context) (net.Conn, error) {
+			if broken {
+				return nil, errors.New("broken")
+			}
+			return shadowConn, nil
+		},
+	}
+
+	mirrored := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(shadowPeer)
+		mirrored <- string(b)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- PipeContext(context.Background(), conn, upstream, WithMirror(m))
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		_ = client.Close()
+	}()
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "hello" {
+		t.Fatalf("%q, %v (expected \"hello\")", b, err)
+	}
+	_ = server.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	if broken {
+		return
+	}
+
+	select {
+	case s := <-mirrored:
+		if s != "hello" {
+			t.Errorf("%q (expected \"hello\")", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shadow")
+	}
+}
+
+func TestMirrorTail(t *testing.T) {
+	client, conn := net.Pipe()
+	upstream, server := net.Pipe()
+	shadowConn, shadowPeer := net.Pipe()
+	defer shadowPeer.Close()
+
+	// the shadow connects after the connection is closed
+	release := make(chan struct{})
+	m := &Mirror{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			<-release
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return shadowConn, nil
+		},
+	}
+
+	mirrored := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(shadowPeer)
+		mirrored <- string(b)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- PipeContext(ctx, conn, upstream, WithMirror(m))
+	}()
+
+	go func() { _, _ = client.Write([]byte("hello")) }()
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "hello" {
+		t.Fatalf("%q, %v (expected \"hello\")", b, err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	close(release)
+
+	select {
+	case s := <-mirrored:
+		if s != "hello" {
+			t.Errorf("%q (expected \"hello\")", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shadow")
+	}
+}
+
+func TestHTTPMirror(t *testing.T) {
+	received := make(chan string, 4)
+	shadow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		received <- req.Method + " " + req.URL.Path + " " + string(b)
+	}))
+	defer shadow.Close()
+
+	cfg := &HTTPMirrorConfig{
+		Shadow:      newTestPool(t, RoundRobin, shadow.Listener.Addr().String()),
+		MaxBodySize: 8,
+	}
+
+	h, err := cfg.New(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		expected           string
+	}{
+		{"GET", "/get", "", "GET /get "},
+		{"POST", "/small", "hello", "POST /small hello"},
+		{"POST", "/large", "hello world", ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("%s: %v (expected %v)", tc.path, rec.Code, http.StatusNoContent)
+		}
+
+		select {
+		case s := <-received:
+			if s != tc.expected {
+				t.Errorf("%s: %q (expected %q)", tc.path, s, tc.expected)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if tc.expected != "" {
+				t.Errorf("%s: not mirrored", tc.path)
+			}
+		}
+	}
+}
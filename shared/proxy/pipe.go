@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+)
+
+var (
+	// ErrIdleTimeout indicates a forwarded connection
+	// was closed for not moving data in time
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrMaxLifetime indicates a forwarded connection
+	// was closed for exceeding its maximum lifetime
+	ErrMaxLifetime = errors.New("maximum lifetime exceeded")
+)
+
+// Stats describes a forwarded connection once it's closed
+type Stats struct {
+	Client   net.Addr
+	Upstream net.Addr
+
+	// Sent is the number of bytes from the client to the upstream
+	Sent int64
+	// Received is the number of bytes from the upstream to the client
+	Received int64
+	// Duration is how long the connection was forwarded
+	Duration time.Duration
+	// Err is the reason the connection was closed, if
+	// not finished normally
+	Err error
+}
+
+// PipeContext moves bytes between two established connections like
+// Pipe, but applying the given options and closing both when the
+// context is cancelled
+func PipeContext(ctx context.Context, conn, upstream net.Conn, opts ...ForwardOption) error {
+	fc := newForwardConfig(opts)
+	return fc.pipe(ctx, conn, upstream)
+}
+
+func (fc *forwardConfig) pipe(ctx context.Context, conn, upstream net.Conn) error {
+	start := time.Now()
+	if fc.maxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, fc.maxLifetime, ErrMaxLifetime)
+		defer cancel()
+	}
+
+	closeBoth := func() {
+		_ = conn.Close()
+		_ = upstream.Close()
+	}
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	// the idle timeouts consider both directions
+	var active *atomic.Int64
+	if fc.idleSend > 0 || fc.idleReceive > 0 {
+		active = new(atomic.Int64)
+		active.Store(start.UnixNano())
+	}
+
+	send := &stream{dst: upstream, src: conn, idle: fc.idleSend, limiters: fc.newLimiters(),
+		tee: fc.mirror.start(ctx), active: active}
+	receive := &stream{dst: conn, src: upstream, idle: fc.idleReceive, limiters: fc.newLimiters(),
+		active: active}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var err error
+
+	for _, s := range []*stream{send, receive} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := s.run(ctx); e != nil {
+				once.Do(func() {
+					err = e
+					// unblock the other direction
+					closeBoth()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		// closed by us
+		err = core.IIf(errors.Is(context.Cause(ctx), ErrMaxLifetime), ErrMaxLifetime, nil)
+	}
+
+	if fc.onClose != nil {
+		fc.onClose(Stats{
+			Client:   conn.RemoteAddr(),
+			Upstream: upstream.RemoteAddr(),
+			Sent:     send.count.Load(),
+			Received: receive.count.Load(),
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+	return err
+}
+
+// stream is one direction of a forwarded connection
+type stream struct {
+	dst, src net.Conn
+	idle     time.Duration
+	limiters []*Limiter
+	count    atomic.Int64
+	// tee is the mirror of what's moved, if any
+	tee *shadow
+	// active is when data last moved in either direction,
+	// if idle timeouts are enabled
+	active *atomic.Int64
+}
+
+// run moves bytes from src to dst until EOF, counting them.
+// Unless shaped or mirrored io.Copy is used to allow splicing
+func (s *stream) run(ctx context.Context) error {
+	defer s.tee.close()
+
+	if w, ok := s.dst.(CloseWriter); ok {
+		defer func() {
+			_ = w.CloseWrite()
+		}()
+	}
+
+	if s.active == nil && len(s.limiters) == 0 && s.tee == nil {
+		n, err := io.Copy(s.dst, s.src)
+		s.count.Add(n)
+		return err
+	}
+
+	return s.copyShaped(ctx)
+}
+
+func (s *stream) copyShaped(ctx context.Context) error {
+	buf := make([]byte, chunkSize(s.limiters))
+	for {
+		if s.idle > 0 {
+			_ = s.src.SetReadDeadline(s.lastActive().Add(s.idle))
+		}
+
+		n, err := s.src.Read(buf)
+		if n > 0 {
+			s.touch()
+			if err := waitLimiters(ctx, s.limiters, n); err != nil {
+				return err
+			}
+
+			setDeadline(s.dst.SetWriteDeadline, s.idle)
+			if _, err := s.dst.Write(buf[:n]); err != nil {
+				return idleError(err)
+			}
+			s.count.Add(int64(n))
+			s.tee.write(buf[:n])
+		}
+
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, os.ErrDeadlineExceeded) && time.Since(s.lastActive()) < s.idle:
+			// the other direction moved data, wait again
+		default:
+			return idleError(err)
+		}
+	}
+}
+
+// touch records data moving through the connection
+func (s *stream) touch() {
+	if s.active != nil {
+		s.active.Store(time.Now().UnixNano())
+	}
+}
+
+// lastActive returns when data last moved in either direction
+func (s *stream) lastActive() time.Time {
+	if s.active == nil {
+		return time.Now()
+	}
+	return time.Unix(0, s.active.Load())
+}
+
+// chunkSize is the largest read allowed by all limiters
+func chunkSize(limiters []*Limiter) int {
+	size := DefaultBurst
+	for _, l := range limiters {
+		if b := l.Burst(); b > 0 {
+			size = min(size, b)
+		}
+	}
+	return size
+}
+
+func waitLimiters(ctx context.Context, limiters []*Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setDeadline(fn func(time.Time) error, idle time.Duration) {
+	if idle > 0 {
+		_ = fn(time.Now().Add(idle))
+	}
+}
+
+// idleError replaces deadline errors with ErrIdleTimeout
+func idleError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrIdleTimeout
+	}
+	return err
+}
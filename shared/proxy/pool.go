@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/net/proxyproto"
+)
+
+var (
+	// ErrNoMembers indicates no member of a Pool is available
+	ErrNoMembers = errors.New("no available upstream members")
+)
+
+const (
+	// DefaultMaxFails is the number of consecutive dial errors
+	// after which a member is ejected
+	DefaultMaxFails = 3
+	// DefaultEjectTime is how long a member stays ejected
+	DefaultEjectTime = 30 * time.Second
+	// DefaultDialTimeout is the maximum time given to a dial attempt
+	DefaultDialTimeout = 5 * time.Second
+)
+
+// PoolConfig describes a Pool of upstream servers
+type PoolConfig struct {
+	// Name identifies the pool
+	Name string
+	// Servers is the list of host:port of the members
+	Servers []string
+	// Strategy is the load balancing strategy, defaults
+	// to RoundRobin
+	Strategy Strategy
+	// HashKey selects the key used by the ConsistentHash
+	// strategy, defaults to HashByClientIP
+	HashKey HashKey
+
+	// MaxFails is the number of consecutive dial errors after
+	// which the circuit of a member opens, ejecting it.
+	// Negative disables ejection
+	MaxFails int
+	// EjectTime is how long a member stays ejected before
+	// a connection is attempted again to probe it
+	EjectTime time.Duration
+	// DialTimeout is the maximum time given to a dial attempt
+	DialTimeout time.Duration
+	// Retries is the number of additional passes over the
+	// members when all fail, waiting Backoff between them
+	Retries int
+	// Backoff is the wait between passes
+	Backoff Backoff
+
+	// ProxyProtocol is the version of the PROXY protocol header
+	// sent to the members before any payload. Zero disables it.
+	// Only TCP connections get it
+	ProxyProtocol int
+
+	// TLSConfig is used by those speaking TLS to the
+	// members, if they do
+	TLSConfig *tls.Config
+
+	// HealthCheck is the optional active health check
+	HealthCheck *HealthCheck
+
+	// DialContext optionally replaces the net.Dialer used to
+	// connect to the members. The Hint is attached to the context
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *PoolConfig) SetDefaults() error {
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	if cfg.Strategy == "" {
+		cfg.Strategy = RoundRobin
+	}
+
+	if cfg.HashKey == "" {
+		cfg.HashKey = HashByClientIP
+	}
+
+	if cfg.MaxFails == 0 {
+		cfg.MaxFails = DefaultMaxFails
+	}
+
+	cfg.EjectTime = core.IIf(cfg.EjectTime > 0, cfg.EjectTime, DefaultEjectTime)
+	cfg.DialTimeout = core.IIf(cfg.DialTimeout > 0, cfg.DialTimeout, DefaultDialTimeout)
+	cfg.Retries = max(cfg.Retries, 0)
+
+	if cfg.HealthCheck != nil {
+		return cfg.HealthCheck.SetDefaults()
+	}
+	return nil
+}
+
+// New validates the config and creates a Pool
+func (cfg *PoolConfig) New() (*Pool, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("pool %q: no servers", cfg.Name)
+	}
+
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, core.Wrap(err, cfg.Name)
+	} else if cfg.ProxyProtocol < 0 || cfg.ProxyProtocol > 2 {
+		return nil, fmt.Errorf("pool %q: invalid PROXY protocol version %v", cfg.Name, cfg.ProxyProtocol)
+	}
+
+	p := &Pool{
+		cfg:     *cfg,
+		members: make([]*Member, 0, len(cfg.Servers)),
+	}
+
+	for _, addr := range cfg.Servers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("pool %q: %w", cfg.Name, err)
+		}
+
+		m := &Member{Addr: addr}
+		m.breaker.MaxFails = cfg.MaxFails
+		m.breaker.OpenTime = cfg.EjectTime
+		m.healthy.Store(true)
+		p.members = append(p.members, m)
+	}
+
+	balancer, err := newBalancer(cfg.Strategy, p.members)
+	if err != nil {
+		return nil, fmt.Errorf("pool %q: %w", cfg.Name, err)
+	}
+	p.balancer = balancer
+
+	return p, nil
+}
+
+// Hint carries what balancing strategies may use to
+// choose a member, and what PROXY protocol headers tell
+// the members
+type Hint struct {
+	ServerName string
+	Client     netip.Addr
+
+	// Source and Destination are the addresses of the
+	// client connection
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	// TLVs are additional fields for PROXY protocol v2 headers
+	TLVs []proxyproto.TLV
+}
+
+// ProxyHeader returns the PROXY protocol header describing
+// the client connection
+func (hint Hint) ProxyHeader(version int) *proxyproto.Header {
+	h := &proxyproto.Header{
+		Version:     version,
+		Command:     proxyproto.CommandProxy,
+		Transport:   proxyproto.TransportStream,
+		Source:      hint.Source,
+		Destination: hint.Destination,
+	}
+
+	if version > 1 {
+		h.TLVs = hint.TLVs
+	}
+	return h
+}
+
+// Pool is a group of upstream servers connections
+// are balanced across
+type Pool struct {
+	cfg      PoolConfig
+	members  []*Member
+	balancer balancer
+}
+
+// Name returns the name of the Pool
+func (p *Pool) Name() string {
+	return p.cfg.Name
+}
+
+// TLSConfig returns a copy of the tls.Config used to speak TLS
+// to the members, or nil if none was provided
+func (p *Pool) TLSConfig() *tls.Config {
+	return p.cfg.TLSConfig.Clone()
+}
+
+// Members returns the members of the Pool
+func (p *Pool) Members() []*Member {
+	out := make([]*Member, len(p.members))
+	copy(out, p.members)
+	return out
+}
+
+// Pick chooses an available member for the given hint
+func (p *Pool) Pick(hint Hint) (*Member, error) {
+	return p.pick(hint, nil)
+}
+
+func (p *Pool) pick(hint Hint, tried []*Member) (*Member, error) {
+	now := time.Now()
+	ok := func(m *Member) bool {
+		return m.Available(now) && !core.SliceContains(tried, m)
+	}
+
+	if m := p.balancer.Pick(p.hashKey(hint), ok); m != nil {
+		return m, nil
+	}
+
+	for _, m := range p.members {
+		if m.Healthy() && !core.SliceContains(tried, m) {
+			// healthy but ejected
+			return nil, fmt.Errorf("pool %q: %w", p.cfg.Name, ErrCircuitOpen)
+		}
+	}
+	return nil, fmt.Errorf("pool %q: %w", p.cfg.Name, ErrNoMembers)
+}
+
+func (p *Pool) hashKey(hint Hint) string {
+	switch {
+	case p.cfg.HashKey == HashByServerName && hint.ServerName != "":
+		return hint.ServerName
+	case hint.Client.IsValid():
+		return hint.Client.Unmap().String()
+	default:
+		return hint.ServerName
+	}
+}
+
+// Dial connects to a member of the Pool chosen for the hint,
+// moving on to others on failure
+func (p *Pool) Dial(ctx context.Context, hint Hint) (net.Conn, error) {
+	return p.dial(ctx, "tcp", hint)
+}
+
+// DialUDP is like Dial but connecting a UDP socket to the
+// chosen member instead
+func (p *Pool) DialUDP(ctx context.Context, hint Hint) (net.Conn, error) {
+	return p.dial(ctx, "udp", hint)
+}
+
+func (p *Pool) dial(ctx context.Context, network string, hint Hint) (net.Conn, error) {
+	var errs []error
+
+	for retry := 0; retry <= p.cfg.Retries; retry++ {
+		if retry > 0 {
+			if err := p.cfg.Backoff.Wait(ctx, retry-1); err != nil {
+				break
+			}
+		}
+
+		conn, err := p.dialPass(ctx, network, hint)
+		switch {
+		case err == nil:
+			return conn, nil
+		case IsUnavailable(err) && len(errs) > 0:
+			// all ejected by now, the errors of
+			// the members tell more
+			return nil, errors.Join(errs...)
+		default:
+			errs = append(errs, err)
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialPass tries each available member once
+func (p *Pool) dialPass(ctx context.Context, network string, hint Hint) (net.Conn, error) {
+	var tried []*Member
+	var errs []error
+
+	for len(tried) < len(p.members) {
+		m, err := p.pick(hint, tried)
+		if err != nil {
+			if len(errs) == 0 {
+				errs = append(errs, err)
+			}
+			break
+		}
+		tried = append(tried, m)
+
+		conn, err := p.dialMember(ctx, network, m, hint)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (p *Pool) dialMember(ctx context.Context, network string, m *Member,
+	hint Hint) (net.Conn, error) {
+	//
+	if !m.breaker.Allow(time.Now()) {
+		// another is probing it
+		return nil, &DialError{Addr: m.Addr, Err: ErrCircuitOpen}
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, p.cfg.DialTimeout)
+	defer cancel()
+
+	conn, err := p.dialContext(WithHint(ctx2, hint), network, m.Addr)
+	if err != nil {
+		if ctx.Err() == nil {
+			// don't blame the member for our cancellations
+			p.reportFailure(m, err)
+		}
+		return nil, newDialError(m.Addr, err)
+	}
+
+	if p.cfg.ProxyProtocol > 0 && network == "tcp" {
+		if err := writeProxyHeader(ctx2, conn, hint.ProxyHeader(p.cfg.ProxyProtocol)); err != nil {
+			_ = conn.Close()
+			p.reportFailure(m, err)
+			return nil, newDialError(m.Addr, err)
+		}
+	}
+
+	m.breaker.Success()
+	m.active.Add(1)
+	return &memberConn{Conn: conn, m: m}, nil
+}
+
+func (p *Pool) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if fn := p.cfg.DialContext; fn != nil {
+		return fn(ctx, network, addr)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// writeProxyHeader sends a PROXY protocol header within
+// the deadline of the context
+func writeProxyHeader(ctx context.Context, conn net.Conn, h *proxyproto.Header) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	}
+
+	_, err := h.WriteTo(conn)
+	return err
+}
+
+// reportFailure is the passive outlier detection
+func (p *Pool) reportFailure(m *Member, err error) {
+	if !m.breaker.Failure(time.Now()) {
+		return
+	}
+
+	if log, ok := p.warn(err); ok {
+		log.WithField("pool", p.cfg.Name).
+			WithField("member", m.Addr).
+			Printf("ejected for %s", p.cfg.EjectTime)
+	}
+}
+
+// Member is one upstream server of a Pool
+type Member struct {
+	Addr string
+
+	active  atomic.Int32
+	healthy atomic.Bool
+	breaker Breaker
+}
+
+// Available tells if the member is healthy and not ejected
+func (m *Member) Available(now time.Time) bool {
+	return m.healthy.Load() && m.breaker.Ready(now)
+}
+
+// Healthy tells the result of the active health checks
+func (m *Member) Healthy() bool {
+	return m.healthy.Load()
+}
+
+// Ejected tells if the member is ejected by passive checks
+func (m *Member) Ejected() bool {
+	return m.breaker.State(time.Now()) == BreakerOpen
+}
+
+// Circuit returns the state of the circuit breaker of the member
+func (m *Member) Circuit() BreakerState {
+	return m.breaker.State(time.Now())
+}
+
+// ActiveConns tells how many connections to the member are open
+func (m *Member) ActiveConns() int {
+	return int(m.active.Load())
+}
+
+// memberConn tracks the lifetime of connections to a Member
+type memberConn struct {
+	net.Conn
+	m    *Member
+	once sync.Once
+}
+
+func (c *memberConn) Close() error {
+	c.once.Do(func() {
+		c.m.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// ReadFrom lets io.Copy splice into the connection
+// when the underlying one allows it
+func (c *memberConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+// CloseWrite closes the Write stream of the connection
+func (c *memberConn) CloseWrite() error {
+	if w, ok := c.Conn.(CloseWriter); ok {
+		return w.CloseWrite()
+	}
+	return nil
+}
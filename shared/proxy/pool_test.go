@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, strategy Strategy, servers ...string) *Pool {
+	t.Helper()
+
+	cfg := &PoolConfig{
+		Name:     "test",
+		Servers:  servers,
+		Strategy: strategy,
+	}
+
+	p, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := newTestPool(t, RoundRobin, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+
+	for i, expected := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"} {
+		m, err := p.Pick(Hint{})
+		if err != nil {
+			t.Fatal(err)
+		} else if m.Addr != expected {
+			t.Errorf("pick %v: %q (expected %q)", i, m.Addr, expected)
+		}
+	}
+
+	// unhealthy members are skipped
+	p.members[1].healthy.Store(false)
+	for i := 0; i < 4; i++ {
+		if m, _ := p.Pick(Hint{}); m == p.members[1] {
+			t.Errorf("pick %v: unhealthy member chosen", i)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	p := newTestPool(t, LeastConn, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	p.members[0].active.Store(3)
+	p.members[1].active.Store(1)
+	p.members[2].active.Store(2)
+
+	for i := 0; i < 3; i++ {
+		if m, _ := p.Pick(Hint{}); m != p.members[1] {
+			t.Errorf("pick %v: %q (expected %q)", i, m.Addr, p.members[1].Addr)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	p := newTestPool(t, ConsistentHash, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	hint := Hint{Client: netip.MustParseAddr("192.0.2.10")}
+
+	first, err := p.Pick(hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if m, _ := p.Pick(hint); m != first {
+			t.Fatalf("pick %v: %q (expected %q)", i, m.Addr, first.Addr)
+		}
+	}
+
+	// when the owner is gone, another takes over
+	first.healthy.Store(false)
+	if m, _ := p.Pick(hint); m == nil || m == first {
+		t.Error("owner not replaced")
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	// find a port nobody listens to
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := lsn.Addr().String()
+	_ = lsn.Close()
+
+	cfg := &PoolConfig{
+		Name:     "test",
+		Servers:  []string{addr},
+		MaxFails: 2,
+	}
+	p, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := p.Dial(ctx, Hint{}); err == nil {
+			t.Fatal("unexpected connection")
+		}
+	}
+
+	if !p.members[0].Ejected() {
+		t.Error("member not ejected")
+	} else if _, err := p.Pick(Hint{}); err == nil {
+		t.Error("ejected member picked")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &Breaker{MaxFails: 2, OpenTime: time.Second}
+	now := time.Now()
+
+	for i, tc := range []struct {
+		fail   bool
+		after  time.Duration
+		allow  bool
+		opened bool
+		state  BreakerState
+	}{
+		{fail: true, allow: true, state: BreakerClosed},
+		{fail: true, allow: true, opened: true, state: BreakerOpen},
+		{allow: false, state: BreakerOpen},
+		{fail: true, after: time.Second, allow: true, opened: true, state: BreakerOpen},
+		{after: 2 * time.Second, allow: true, state: BreakerClosed},
+	} {
+		now = now.Add(tc.after)
+		if allow := b.Allow(now); allow != tc.allow {
+			t.Errorf("%v: Allow: %v (expected %v)", i, allow, tc.allow)
+		}
+
+		switch {
+		case !tc.allow:
+		case tc.fail:
+			if opened := b.Failure(now); opened != tc.opened {
+				t.Errorf("%v: Failure: %v (expected %v)", i, opened, tc.opened)
+			}
+		default:
+			b.Success()
+		}
+
+		if state := b.State(now); state != tc.state {
+			t.Errorf("%v: State: %s (expected %s)", i, state, tc.state)
+		}
+	}
+}
+
+func TestDialerBreakers(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	// nobody listens on the second
+	up := lsn.Addr().String()
+	down := "127.0.0.1:1"
+
+	d := &Dialer{MaxFails: 1, OpenTime: time.Minute}
+	ctx := context.Background()
+
+	if conn, err := d.DialContext(ctx, "tcp", up); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = conn.Close()
+	}
+	if _, err := d.DialContext(ctx, "tcp", down); err == nil {
+		t.Fatal("unexpected connection")
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		after    time.Duration
+		expected int
+	}{
+		// the closed one goes, the open one stays
+		{0, 1},
+		{time.Minute, 1},
+		{2 * time.Minute, 0},
+	} {
+		d.mu.Lock()
+		d.sweepUnlocked(now.Add(tc.after))
+		n := len(d.breakers)
+		d.mu.Unlock()
+
+		if n != tc.expected {
+			t.Errorf("after %s: %v breakers (expected %v)", tc.after, n, tc.expected)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+
+	for retry, expected := range []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	} {
+		if d := b.Duration(retry); d != expected {
+			t.Errorf("retry %v: %s (expected %s)", retry, d, expected)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+
+	"darvaza.org/core"
+)
+
+type hintContextKey struct{}
+
+// WithHint attaches a balancing Hint to a context, used
+// by DialContext
+func WithHint(ctx context.Context, hint Hint) context.Context {
+	return context.WithValue(ctx, hintContextKey{}, hint)
+}
+
+// HintFromContext extracts the balancing Hint attached to a context
+func HintFromContext(ctx context.Context) (Hint, bool) {
+	hint, ok := ctx.Value(hintContextKey{}).(Hint)
+	return hint, ok
+}
+
+// DialContext is a dialer ignoring the address and connecting
+// to a member of the Pool instead, for use in http.Transport
+func (p *Pool) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	hint, _ := HintFromContext(ctx)
+	return p.Dial(ctx, hint)
+}
+
+// ForwardPool is like Forward but the upstream is a member of
+// the Pool chosen for the hint. Dialing options are ignored as
+// the Pool dials the upstream
+func ForwardPool(ctx context.Context, conn net.Conn, pool *Pool, hint Hint, opts ...ForwardOption) error {
+	defer conn.Close()
+
+	upstream, err := pool.Dial(ctx, hint)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	return PipeContext(ctx, conn, upstream, opts...)
+}
+
+// NewReverseProxy creates an HTTP reverse proxy balancing requests
+// across the members of a Pool. If tlsConfig is provided the
+// upstreams are spoken to over TLS, and its ServerName should be
+// set as the request URLs carry the pool name
+func NewReverseProxy(pool *Pool, tlsConfig *tls.Config) *httputil.ReverseProxy {
+	scheme := core.IIf(tlsConfig != nil, "https", "http")
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = scheme
+			// pooled connections are shared by all members of the pool
+			r.Out.URL.Host = pool.Name()
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+
+			// start from the hint of the connection, if any
+			hint, _ := HintFromContext(r.In.Context())
+			hint.ServerName = r.In.Host
+			if ap, err := netip.ParseAddrPort(r.In.RemoteAddr); err == nil {
+				hint.Client, hint.Source = ap.Addr(), ap
+			}
+			if addr, ok := r.In.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				hint.Destination = addrPort(addr)
+			}
+			r.Out = r.Out.WithContext(WithHint(r.Out.Context(), hint))
+		},
+		Transport: &http.Transport{
+			DialContext:       pool.DialContext,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: tlsConfig != nil,
+			// PROXY protocol headers describe a single client,
+			// so such connections can't be shared
+			DisableKeepAlives: pool.cfg.ProxyProtocol > 0,
+		},
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			if log, ok := pool.warn(err); ok {
+				log.WithField("pool", pool.Name()).
+					Printf("%s %s", req.Method, req.Host)
+			}
+			rw.WriteHeader(StatusCode(err))
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/x509utils"
+)
+
+var (
+	// ErrPinMismatch indicates no certificate presented by
+	// an upstream matches the configured pins
+	ErrPinMismatch = errors.New("upstream public key not pinned")
+)
+
+// TLSClientConfig describes how to speak TLS to upstreams
+type TLSClientConfig struct {
+	// ServerName is sent as SNI and verified on the upstream
+	// certificates. If empty the caller needs to set it on
+	// the exported tls.Config
+	ServerName string
+	// Roots verify the upstream certificates. If nil the
+	// system roots are used
+	Roots x509utils.CertPooler
+
+	// Store provides the client certificate
+	Store storage.Store
+	// Certificate is the name of the client certificate to
+	// get from the Store, if any
+	Certificate string
+
+	// Pins are base64 encoded SHA256 hashes of the SubjectPublicKey
+	// of certificates presented by the upstreams. If set, at least
+	// one has to match in addition to the regular verification
+	Pins []string
+
+	// NextProtos are the ALPN protocols offered
+	NextProtos []string
+}
+
+// Export creates a tls.Config from the TLSClientConfig
+func (cfg *TLSClientConfig) Export() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: cfg.ServerName,
+		NextProtos: cfg.NextProtos,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.Roots != nil {
+		conf.RootCAs = cfg.Roots.Export()
+	}
+
+	if cfg.Certificate != "" {
+		if cfg.Store == nil {
+			return nil, core.Wrap(core.ErrInvalid, "client certificate without store")
+		}
+		conf.GetClientCertificate = cfg.getClientCertificate
+	}
+
+	if len(cfg.Pins) > 0 {
+		pins, err := decodePins(cfg.Pins)
+		if err != nil {
+			return nil, err
+		}
+		conf.VerifyConnection = pins.verify
+	}
+
+	return conf, nil
+}
+
+// getClientCertificate gets the client certificate from the Store
+// on every handshake, so renewals are picked up
+func (cfg *TLSClientConfig) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := cfg.Store.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: cfg.Certificate,
+	})
+	if err != nil {
+		return nil, core.Wrapf(err, "client certificate %q", cfg.Certificate)
+	}
+	return cert, nil
+}
+
+// SPKIPin returns the pin of a certificate, the base64 encoded
+// SHA256 hash of its SubjectPublicKey
+func SPKIPin(cert *x509.Certificate) (string, error) {
+	b, err := x509utils.SubjectPublicKeyBytes(cert.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+type pinSet [][sha256.Size]byte
+
+func decodePins(pins []string) (pinSet, error) {
+	out := make(pinSet, 0, len(pins))
+	for _, s := range pins {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			return nil, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid pin %q", s))
+		}
+		out = append(out, [sha256.Size]byte(b))
+	}
+	return out, nil
+}
+
+// verify checks any of the certificates presented matches
+// a pin
+func (pins pinSet) verify(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		b, err := x509utils.SubjectPublicKeyBytes(cert.PublicKey)
+		if err == nil && slices.Contains(pins, sha256.Sum256(b)) {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+func TestTLSClientConfigPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var roots certpool.CertPool
+	roots.AddCert(srv.Certificate())
+
+	pin, err := SPKIPin(srv.Certificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pins     []string
+		expected error
+	}{
+		{nil, nil},
+		{[]string{pin}, nil},
+		{[]string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}, ErrPinMismatch},
+	} {
+		cfg := &TLSClientConfig{
+			ServerName: "example.com",
+			Roots:      &roots,
+			Pins:       tc.pins,
+		}
+
+		conf, err := cfg.Export()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), conf)
+		if err == nil {
+			_ = conn.Close()
+		}
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%v: %v (expected %v)", tc.pins, err, tc.expected)
+		}
+	}
+
+	if _, err := (&TLSClientConfig{Pins: []string{"short"}}).Export(); err == nil {
+		t.Error("invalid pin accepted")
+	}
+}
@@ -0,0 +1,186 @@
+package renewal
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"darvaza.org/core"
+)
+
+var (
+	_ WindowSource = (*ARIClient)(nil)
+)
+
+var (
+	// ErrNoRenewalInfo indicates the ACME directory doesn't
+	// advertise the renewalInfo endpoint
+	ErrNoRenewalInfo = errors.New("renewalInfo not supported by the CA")
+	// ErrNoAuthorityKeyID indicates the certificate can't be
+	// identified for ARI as it lacks the Authority Key Identifier
+	ErrNoAuthorityKeyID = errors.New("certificate without Authority Key Identifier")
+)
+
+const (
+	// ARIMaxResponseSize is the maximum size we accept for
+	// directory and renewalInfo responses
+	ARIMaxResponseSize = 1 << 16
+)
+
+// ARIClient fetches suggested renewal windows from an ACME server
+// implementing the ACME Renewal Information (ARI) extension
+type ARIClient struct {
+	// DirectoryURL is the URL of the ACME directory
+	DirectoryURL string
+	// HTTPClient is an optional client to use for the requests
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	baseURL string
+}
+
+type ariDirectory struct {
+	RenewalInfo string `json:"renewalInfo"`
+}
+
+type ariResponse struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+// ARICertID returns the unique identifier used by ARI
+// to refer to a certificate
+func ARICertID(leaf *x509.Certificate) (string, error) {
+	if leaf == nil || leaf.SerialNumber == nil {
+		return "", core.ErrInvalid
+	} else if len(leaf.AuthorityKeyId) == 0 {
+		return "", ErrNoAuthorityKeyID
+	}
+
+	// DER encoding of the serial's value, which requires a
+	// leading zero when the high bit is set
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	enc := base64.RawURLEncoding
+	s := enc.EncodeToString(leaf.AuthorityKeyId) + "." + enc.EncodeToString(serial)
+	return s, nil
+}
+
+// RenewalWindow asks the CA for the suggested renewal window
+// of a certificate
+func (c *ARIClient) RenewalWindow(ctx context.Context, leaf *x509.Certificate) (Window, error) {
+	id, err := ARICertID(leaf)
+	if err != nil {
+		return Window{}, err
+	}
+
+	base, err := c.getBaseURL(ctx)
+	if err != nil {
+		return Window{}, err
+	}
+
+	var out ariResponse
+	u := strings.TrimSuffix(base, "/") + "/" + id
+	hdr, err := c.getJSON(ctx, u, &out)
+	if err != nil {
+		return Window{}, err
+	}
+
+	w := Window{
+		Start:      out.SuggestedWindow.Start,
+		End:        out.SuggestedWindow.End,
+		RetryAfter: parseRetryAfter(hdr.Get("Retry-After")),
+	}
+
+	if !w.Valid() {
+		err = fmt.Errorf("%s: invalid suggestedWindow", u)
+		return Window{}, err
+	}
+
+	return w, nil
+}
+
+func (c *ARIClient) getBaseURL(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.baseURL == "" {
+		var dir ariDirectory
+
+		if c.DirectoryURL == "" {
+			return "", core.Wrap(core.ErrInvalid, "DirectoryURL not specified")
+		}
+
+		if _, err := c.getJSON(ctx, c.DirectoryURL, &dir); err != nil {
+			return "", err
+		} else if dir.RenewalInfo == "" {
+			return "", ErrNoRenewalInfo
+		}
+
+		c.baseURL = dir.RenewalInfo
+	}
+
+	return c.baseURL, nil
+}
+
+func (c *ARIClient) getJSON(ctx context.Context, url string, out any) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", url, resp.Status)
+		return nil, err
+	}
+
+	body := io.LimitReader(resp.Body, ARIMaxResponseSize)
+	if err := json.NewDecoder(body).Decode(out); err != nil {
+		err = core.Wrap(err, url)
+		return nil, err
+	}
+
+	return resp.Header, nil
+}
+
+func parseRetryAfter(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Now().Add(time.Duration(secs) * time.Second)
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,55 @@
+package renewal
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestARICertID(t *testing.T) {
+	// example from draft-ietf-acme-ari
+	leaf := &x509.Certificate{
+		AuthorityKeyId: []byte{
+			0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3,
+			0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4,
+		},
+		SerialNumber: big.NewInt(0x87654321),
+	}
+
+	const expected = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+
+	s, err := ARICertID(leaf)
+	if err != nil {
+		t.Fatal(err)
+	} else if s != expected {
+		t.Errorf("ARICertID() -> %q, expected %q", s, expected)
+	}
+
+	leaf.AuthorityKeyId = nil
+	if _, err := ARICertID(leaf); err != ErrNoAuthorityKeyID {
+		t.Errorf("ARICertID() without AKI -> %v", err)
+	}
+}
+
+func TestDefaultWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{
+		NotBefore: start,
+		NotAfter:  start.Add(90 * 24 * time.Hour),
+	}
+
+	w := DefaultWindow(leaf, 0)
+	if s := start.Add(60 * 24 * time.Hour); !w.Start.Equal(s) {
+		t.Errorf("DefaultWindow().Start -> %s, expected %s", w.Start, s)
+	}
+	if e := start.Add(75 * 24 * time.Hour); !w.End.Equal(e) {
+		t.Errorf("DefaultWindow().End -> %s, expected %s", w.End, e)
+	}
+
+	for i := 0; i < 10; i++ {
+		if p := w.Pick(); p.Before(w.Start) || !p.Before(w.End) {
+			t.Errorf("Window.Pick() -> %s out of window", p)
+		}
+	}
+}
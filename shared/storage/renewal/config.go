@@ -0,0 +1,102 @@
+package renewal
+
+import (
+	"context"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+const (
+	// DefaultScanInterval is how often the Store is scanned
+	// for new or replaced certificates
+	DefaultScanInterval = time.Hour
+	// DefaultRetryMin is the initial wait after a failed renewal
+	DefaultRetryMin = time.Minute
+	// DefaultRetryMax is the maximum wait after a failed renewal
+	DefaultRetryMax = 6 * time.Hour
+	// DefaultWindowRefresh is how often a suggested window is
+	// checked again when the source doesn't say otherwise
+	DefaultWindowRefresh = 6 * time.Hour
+)
+
+// Config describes how the Manager renews certificates
+type Config struct {
+	// Context is the parent context of the Manager
+	Context context.Context
+	// Logger is an optional slog.Logger
+	Logger slog.Logger
+
+	// Store is the watched certificates storage
+	Store Store
+	// Issuer acquires the new certificates
+	Issuer Issuer
+	// Windows is an optional source of suggested renewal windows,
+	// the default window is used when absent or failing
+	Windows WindowSource
+
+	// Fraction of the validity period after which a certificate
+	// enters its default renewal window
+	Fraction float64
+	// ScanInterval is how often the Store is scanned
+	ScanInterval time.Duration
+	// RetryMin is the initial backoff after a failure
+	RetryMin time.Duration
+	// RetryMax is the maximum backoff after repeated failures
+	RetryMax time.Duration
+	// WindowRefresh is how often a suggested window is re-checked
+	WindowRefresh time.Duration
+
+	// OnEvent is an optional callback to be notified of renewals
+	// and failures. It must not block.
+	OnEvent func(Event)
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *Config) SetDefaults() error {
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	if cfg.Fraction <= 0 || cfg.Fraction >= 1 {
+		cfg.Fraction = DefaultFraction
+	}
+
+	cfg.ScanInterval = core.IIf(cfg.ScanInterval > 0, cfg.ScanInterval, DefaultScanInterval)
+	cfg.RetryMin = core.IIf(cfg.RetryMin > 0, cfg.RetryMin, DefaultRetryMin)
+	cfg.RetryMax = core.IIf(cfg.RetryMax >= cfg.RetryMin, cfg.RetryMax, DefaultRetryMax)
+	cfg.WindowRefresh = core.IIf(cfg.WindowRefresh > 0, cfg.WindowRefresh, DefaultWindowRefresh)
+
+	return nil
+}
+
+// New creates a new Manager from a Config
+func (cfg *Config) New() (*Manager, error) {
+	if cfg.Store == nil || cfg.Issuer == nil {
+		return nil, core.Wrap(core.ErrInvalid, "Store and Issuer are required")
+	}
+
+	if err := cfg.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(cfg.Context)
+
+	m := &Manager{
+		cfg:     *cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+		entries: make(map[certpool.Hash]*entry),
+		wakeup:  make(chan struct{}, 1),
+	}
+
+	return m, nil
+}
@@ -0,0 +1,61 @@
+package renewal
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// EventKind identifies the type of Event
+type EventKind int
+
+const (
+	// EventScheduled is emitted when a renewal time has been
+	// chosen for a certificate
+	EventScheduled EventKind = iota
+	// EventRenewed is emitted after a certificate has been
+	// renewed and swapped in the Store
+	EventRenewed
+	// EventRenewalFailed is emitted when an attempt to renew
+	// a certificate fails. Another attempt will follow.
+	EventRenewalFailed
+	// EventWindowFailed is emitted when the WindowSource fails
+	// and the default window is used instead
+	EventWindowFailed
+	// EventExpired is emitted when a certificate expires before
+	// it could be renewed
+	EventExpired
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventScheduled:
+		return "scheduled"
+	case EventRenewed:
+		return "renewed"
+	case EventRenewalFailed:
+		return "renewal-failed"
+	case EventWindowFailed:
+		return "window-failed"
+	case EventExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something that happened to a watched certificate
+type Event struct {
+	Kind EventKind
+	// Names are the names the certificate covers
+	Names []string
+	// Leaf is the certificate the event refers to
+	Leaf *x509.Certificate
+	// Renewed is the new certificate on EventRenewed
+	Renewed *x509.Certificate
+	// Err is the reason of a failure
+	Err error
+	// Attempt is the number of failed attempts so far
+	Attempt int
+	// Next is when the next attempt will happen
+	Next time.Time
+}
@@ -0,0 +1,27 @@
+package renewal
+
+import (
+	"darvaza.org/slog"
+)
+
+func (m *Manager) withLogger(level slog.LogLevel) (slog.Logger, bool) {
+	return m.cfg.Logger.WithLevel(level).WithEnabled()
+}
+
+func (m *Manager) debug() (slog.Logger, bool) {
+	return m.withLogger(slog.Debug)
+}
+
+func (m *Manager) info() (slog.Logger, bool) {
+	return m.withLogger(slog.Info)
+}
+
+func (m *Manager) error(err error) (slog.Logger, bool) {
+	if l, ok := m.withLogger(slog.Error); ok {
+		if err != nil {
+			l = l.WithField(slog.ErrorFieldName, err)
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,368 @@
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+var (
+	// ErrNoSigner indicates the certificate's private key can't
+	// be reused to request a new one
+	ErrNoSigner = errors.New("private key is not a crypto.Signer")
+)
+
+// Manager watches the certificates of a Store and renews them
+// when they enter their renewal window
+type Manager struct {
+	mu        sync.Mutex
+	wg        core.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled atomic.Bool
+
+	cfg     Config
+	entries map[certpool.Hash]*entry
+	wakeup  chan struct{}
+}
+
+type entry struct {
+	cert  *tls.Certificate
+	names []string
+
+	window     Window
+	windowNext time.Time
+	due        time.Time
+
+	attempts int
+	running  bool
+	expired  bool
+	seen     bool
+}
+
+// Run scans the Store and renews certificates until
+// the Manager is cancelled
+func (m *Manager) Run() error {
+	for {
+		m.scan()
+		next := m.dispatch()
+
+		select {
+		case <-m.ctx.Done():
+			_ = m.wg.Wait()
+			return nil
+		case <-m.wakeup:
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// Cancel stops the Manager, renewals in progress are cancelled
+func (m *Manager) Cancel() error {
+	if m.cancelled.CompareAndSwap(false, true) {
+		m.cancel()
+	}
+	return nil
+}
+
+// Rescan asks the Manager to scan the Store immediately
+func (m *Manager) Rescan() {
+	select {
+	case m.wakeup <- struct{}{}:
+	default:
+		// already pending
+	}
+}
+
+// scan refreshes the entries from the Store
+func (m *Manager) scan() {
+	m.mu.Lock()
+	for _, e := range m.entries {
+		e.seen = false
+	}
+	m.mu.Unlock()
+
+	err := m.cfg.Store.ForEachCertificate(m.ctx, func(c *tls.Certificate) error {
+		m.scanCert(c)
+		return nil
+	})
+
+	if err != nil && m.ctx.Err() == nil {
+		if log, ok := m.error(err); ok {
+			log.Print("failed to scan store")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, e := range m.entries {
+		if !e.seen && !e.running {
+			// gone
+			delete(m.entries, hash)
+		}
+	}
+}
+
+func (m *Manager) scanCert(c *tls.Certificate) {
+	hash := certpool.HashCert(c.Leaf)
+
+	m.mu.Lock()
+	e, ok := m.entries[hash]
+	if !ok {
+		e = &entry{
+			cert:  c,
+			names: certNames(c.Leaf),
+		}
+		m.entries[hash] = e
+	}
+	e.seen = true
+	refresh := !e.running && !time.Now().Before(e.windowNext)
+	m.mu.Unlock()
+
+	if refresh {
+		m.refreshWindow(e)
+	}
+}
+
+// refreshWindow computes the renewal window of an entry
+// and picks the moment to renew
+func (m *Manager) refreshWindow(e *entry) {
+	leaf := e.cert.Leaf
+	w, next := m.getWindow(leaf)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.windowNext = next
+	if !w.Equal(e.window) {
+		e.window = w
+		if e.attempts == 0 {
+			e.due = w.Pick()
+			m.emit(Event{
+				Kind:  EventScheduled,
+				Names: e.names,
+				Leaf:  leaf,
+				Next:  e.due,
+			})
+		}
+	}
+}
+
+func (m *Manager) getWindow(leaf *x509.Certificate) (Window, time.Time) {
+	now := time.Now()
+
+	if src := m.cfg.Windows; src != nil {
+		w, err := src.RenewalWindow(m.ctx, leaf)
+		if err == nil {
+			next := w.RetryAfter
+			if next.Before(now) {
+				next = now.Add(m.cfg.WindowRefresh)
+			}
+			return w, next
+		}
+
+		m.emit(Event{
+			Kind:  EventWindowFailed,
+			Names: certNames(leaf),
+			Leaf:  leaf,
+			Err:   err,
+		})
+	}
+
+	// default windows don't change, no need to
+	// check again
+	w := DefaultWindow(leaf, m.cfg.Fraction)
+	next := core.IIf(m.cfg.Windows != nil, now.Add(m.cfg.WindowRefresh), leaf.NotAfter)
+	return w, next
+}
+
+// dispatch spawns the renewals that are due and returns
+// when dispatch needs to be called again
+func (m *Manager) dispatch() time.Time {
+	now := time.Now()
+	next := now.Add(m.cfg.ScanInterval)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.entries {
+		switch {
+		case e.running:
+			// in progress
+		case !now.Before(e.due):
+			e.running = true
+			m.wg.Go(func() error {
+				m.renew(e)
+				return nil
+			})
+		case e.due.Before(next):
+			next = e.due
+		}
+	}
+
+	return next
+}
+
+func (m *Manager) renew(e *entry) {
+	leaf := e.cert.Leaf
+	cert, err := m.issue(e)
+	if err == nil {
+		err = m.cfg.Store.ReplaceCert(m.ctx, leaf, cert)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.running = false
+
+	if err == nil {
+		m.doRenewed(e, cert)
+		return
+	} else if m.ctx.Err() != nil {
+		// cancelled
+		return
+	}
+
+	m.doFailed(e, err)
+}
+
+func (m *Manager) issue(e *entry) (*tls.Certificate, error) {
+	key, ok := e.cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrNoSigner
+	}
+
+	if log, ok := m.debug(); ok {
+		log.WithField("names", e.names).Print("renewing certificate")
+	}
+
+	cert, err := m.cfg.Issuer.Issue(m.ctx, key, e.names)
+	switch {
+	case err != nil:
+		return nil, err
+	case cert == nil || len(cert.Certificate) == 0:
+		return nil, core.Wrap(core.ErrInvalid, "issuer returned no certificate")
+	case cert.Leaf == nil:
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+	}
+
+	if cert.PrivateKey == nil {
+		cert.PrivateKey = key
+	}
+
+	return cert, nil
+}
+
+func (m *Manager) doRenewed(e *entry, cert *tls.Certificate) {
+	// the entry of the new certificate will be
+	// created on the next scan
+	delete(m.entries, certpool.HashCert(e.cert.Leaf))
+
+	if log, ok := m.info(); ok {
+		log.WithField("names", e.names).
+			Printf("certificate renewed, valid until %s", cert.Leaf.NotAfter)
+	}
+
+	m.emit(Event{
+		Kind:    EventRenewed,
+		Names:   e.names,
+		Leaf:    e.cert.Leaf,
+		Renewed: cert.Leaf,
+		Attempt: e.attempts,
+	})
+
+	m.Rescan()
+}
+
+func (m *Manager) doFailed(e *entry, err error) {
+	now := time.Now()
+	leaf := e.cert.Leaf
+
+	e.attempts++
+	e.due = now.Add(m.backoff(e.attempts))
+
+	if log, ok := m.error(err); ok {
+		log.WithField("names", e.names).
+			Printf("failed to renew certificate (attempt %v), retrying at %s",
+				e.attempts, e.due)
+	}
+
+	m.emit(Event{
+		Kind:    EventRenewalFailed,
+		Names:   e.names,
+		Leaf:    leaf,
+		Err:     err,
+		Attempt: e.attempts,
+		Next:    e.due,
+	})
+
+	if !e.expired && now.After(leaf.NotAfter) {
+		e.expired = true
+
+		m.emit(Event{
+			Kind:    EventExpired,
+			Names:   e.names,
+			Leaf:    leaf,
+			Err:     err,
+			Attempt: e.attempts,
+			Next:    e.due,
+		})
+	}
+
+	// wake Run up so the retry is dispatched in time
+	m.Rescan()
+}
+
+// backoff returns a jittered exponential wait for the
+// given number of failed attempts
+func (m *Manager) backoff(attempts int) time.Duration {
+	d := m.cfg.RetryMin
+	for i := 1; i < attempts && d < m.cfg.RetryMax; i++ {
+		d *= 2
+	}
+
+	if d > m.cfg.RetryMax {
+		d = m.cfg.RetryMax
+	}
+
+	// between 50% and 100%
+	half := int64(d / 2)
+	// #nosec G404 -- jitter doesn't need to be cryptographically secure
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (m *Manager) emit(ev Event) {
+	if fn := m.cfg.OnEvent; fn != nil {
+		fn(ev)
+	}
+}
+
+// certNames returns the names a certificate was issued for
+func certNames(leaf *x509.Certificate) []string {
+	names := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses))
+	names = append(names, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+
+	return names
+}
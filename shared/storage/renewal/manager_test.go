@@ -0,0 +1,313 @@
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("failed")
+
+// testStore is a Store holding certificates in memory
+type testStore struct {
+	mu       sync.Mutex
+	certs    []*tls.Certificate
+	replaced int
+}
+
+func (s *testStore) ForEachCertificate(_ context.Context, f func(*tls.Certificate) error) error {
+	s.mu.Lock()
+	certs := slices.Clone(s.certs)
+	s.mu.Unlock()
+
+	for _, c := range certs {
+		if err := f(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *testStore) ReplaceCert(_ context.Context, old *x509.Certificate, cert *tls.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.certs {
+		if c.Leaf.Equal(old) {
+			s.certs[i] = cert
+			s.replaced++
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (s *testStore) get() ([]*tls.Certificate, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.certs), s.replaced
+}
+
+// testIssuer fails its first calls, then issues
+// certificates valid for a day
+type testIssuer struct {
+	t     *testing.T
+	fails int
+
+	mu    sync.Mutex
+	calls int
+	keys  []crypto.Signer
+}
+
+func (iss *testIssuer) Issue(_ context.Context, key crypto.Signer, names []string) (*tls.Certificate, error) {
+	iss.mu.Lock()
+	iss.calls++
+	iss.keys = append(iss.keys, key)
+	failed := iss.calls <= iss.fails
+	iss.mu.Unlock()
+
+	if failed {
+		return nil, errTest
+	}
+
+	now := time.Now()
+	c := newTestCert(iss.t, key.(*ecdsa.PrivateKey), names[0], now, now.Add(24*time.Hour))
+	// Leaf is left for the Manager to parse
+	c.Leaf = nil
+	return c, nil
+}
+
+// windowFunc is a WindowSource
+type windowFunc func(*x509.Certificate) (Window, error)
+
+func (fn windowFunc) RenewalWindow(_ context.Context, leaf *x509.Certificate) (Window, error) {
+	return fn(leaf)
+}
+
+// dueWindow makes the given certificate due immediately, and
+// leaves the rest in the future
+func dueWindow(due *tls.Certificate) windowFunc {
+	return func(leaf *x509.Certificate) (Window, error) {
+		if leaf.Equal(due.Leaf) {
+			past := time.Now().Add(-time.Minute)
+			return Window{Start: past, End: past}, nil
+		}
+		return DefaultWindow(leaf, 0), nil
+	}
+}
+
+func newTestCert(t *testing.T, key *ecdsa.PrivateKey, name string, notBefore, notAfter time.Time) *tls.Certificate {
+	if key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func newTestManager(t *testing.T, cfg *Config) (*Manager, <-chan Event) {
+	events := make(chan Event, 64)
+	cfg.OnEvent = func(ev Event) {
+		select {
+		case events <- ev:
+		default:
+			t.Error("events overflow")
+		}
+	}
+
+	m, err := cfg.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, events
+}
+
+func runManager(t *testing.T, m *Manager) {
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+
+	t.Cleanup(func() {
+		_ = m.Cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Manager didn't stop")
+		}
+	})
+}
+
+// waitEvents collects Events until one of the given kind arrives
+func waitEvents(t *testing.T, events <-chan Event, last EventKind) []EventKind {
+	t.Helper()
+
+	var out []EventKind
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			out = append(out, ev.Kind)
+			if ev.Kind == last {
+				return out
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s, got %v", last, out)
+			return nil
+		}
+	}
+}
+
+func TestManagerRenew(t *testing.T) {
+	now := time.Now()
+	cert := newTestCert(t, nil, "example.org", now.Add(-time.Hour), now.Add(time.Hour))
+	store := &testStore{certs: []*tls.Certificate{cert}}
+	iss := &testIssuer{t: t}
+
+	m, events := newTestManager(t, &Config{
+		Store:   store,
+		Issuer:  iss,
+		Windows: dueWindow(cert),
+	})
+	runManager(t, m)
+
+	got := waitEvents(t, events, EventRenewed)
+	expected := []EventKind{EventScheduled, EventRenewed}
+	if !slices.Equal(got, expected) {
+		t.Errorf("%v (expected %v)", got, expected)
+	}
+
+	certs, replaced := store.get()
+	switch {
+	case replaced != 1:
+		t.Errorf("%v replaced (expected 1)", replaced)
+	case certs[0] == cert:
+		t.Error("certificate not replaced")
+	case certs[0].Leaf == nil:
+		t.Error("renewed certificate not parsed")
+	case !slices.Equal(certs[0].Leaf.DNSNames, cert.Leaf.DNSNames):
+		t.Errorf("renewed for %q (expected %q)", certs[0].Leaf.DNSNames, cert.Leaf.DNSNames)
+	case iss.keys[0] != cert.PrivateKey:
+		t.Error("private key not reused")
+	}
+
+	// the renewed certificate is scheduled, but not renewed again
+	if got := waitEvents(t, events, EventScheduled); len(got) != 1 {
+		t.Errorf("%v (expected %v)", got, EventScheduled)
+	}
+}
+
+func TestManagerBackoff(t *testing.T) {
+	now := time.Now()
+	cert := newTestCert(t, nil, "example.org", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	store := &testStore{certs: []*tls.Certificate{cert}}
+	iss := &testIssuer{t: t, fails: 2}
+
+	m, events := newTestManager(t, &Config{
+		Store:    store,
+		Issuer:   iss,
+		Windows:  dueWindow(cert),
+		RetryMin: time.Millisecond,
+		RetryMax: 4 * time.Millisecond,
+	})
+	runManager(t, m)
+
+	got := waitEvents(t, events, EventRenewed)
+	expected := []EventKind{
+		EventScheduled,
+		EventRenewalFailed,
+		EventExpired,
+		EventRenewalFailed,
+		EventRenewed,
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("%v (expected %v)", got, expected)
+	}
+
+	if _, replaced := store.get(); replaced != 1 {
+		t.Errorf("%v replaced (expected 1)", replaced)
+	}
+}
+
+func TestManagerBackoffRange(t *testing.T) {
+	m := &Manager{cfg: Config{RetryMin: time.Second, RetryMax: 8 * time.Second}}
+
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{10, 8 * time.Second},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := m.backoff(tc.attempts); d < tc.max/2 || d > tc.max {
+				t.Errorf("backoff(%v) -> %s (expected %s to %s)",
+					tc.attempts, d, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+func TestManagerRetryAfter(t *testing.T) {
+	now := time.Now()
+	cert := newTestCert(t, nil, "example.org", now, now.Add(24*time.Hour))
+	store := &testStore{certs: []*tls.Certificate{cert}}
+	w := DefaultWindow(cert.Leaf, 0)
+
+	m, events := newTestManager(t, &Config{
+		Store:  store,
+		Issuer: &testIssuer{t: t},
+		Windows: windowFunc(func(*x509.Certificate) (Window, error) {
+			// same window, asked to check again right away
+			w.RetryAfter = time.Now()
+			return w, nil
+		}),
+	})
+
+	for i := 0; i < 3; i++ {
+		m.scan()
+	}
+
+	if n := len(events); n != 1 {
+		t.Errorf("%v events (expected 1)", n)
+	}
+	if ev := <-events; ev.Kind != EventScheduled {
+		t.Errorf("%s (expected %s)", ev.Kind, EventScheduled)
+	}
+}
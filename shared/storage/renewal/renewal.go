@@ -0,0 +1,36 @@
+// Package renewal provides a manager that watches the lifetime of
+// the certificates in a Store and renews them in the background
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+
+	"darvaza.org/darvaza/shared/storage/simple"
+)
+
+var (
+	_ Store = (*simple.Store)(nil)
+)
+
+// Store is the certificates storage watched by the Manager
+type Store interface {
+	// ForEachCertificate iterates over all the bundled certificates
+	ForEachCertificate(ctx context.Context, f func(*tls.Certificate) error) error
+	// ReplaceCert atomically swaps an old certificate for a new one
+	ReplaceCert(ctx context.Context, old *x509.Certificate, cert *tls.Certificate) error
+}
+
+// Issuer is the entity capable of issuing a new certificate for
+// a list of names reusing a given key
+type Issuer interface {
+	Issue(ctx context.Context, key crypto.Signer, names []string) (*tls.Certificate, error)
+}
+
+// WindowSource is an optional provider of suggested renewal windows,
+// like the ACME Renewal Information (ARI) extension
+type WindowSource interface {
+	RenewalWindow(ctx context.Context, leaf *x509.Certificate) (Window, error)
+}
@@ -0,0 +1,79 @@
+package renewal
+
+import (
+	"crypto/x509"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultFraction is the portion of the validity period that
+	// needs to elapse before a certificate is considered for renewal
+	DefaultFraction = 2.0 / 3
+)
+
+// Window represents the period of time when a certificate
+// should be renewed
+type Window struct {
+	Start time.Time
+	End   time.Time
+
+	// RetryAfter optionally indicates when the window should
+	// be checked again
+	RetryAfter time.Time
+}
+
+// IsZero tells if the Window hasn't been set
+func (w Window) IsZero() bool {
+	return w.Start.IsZero() && w.End.IsZero()
+}
+
+// Valid tells if the window is usable
+func (w Window) Valid() bool {
+	return !w.Start.IsZero() && !w.End.Before(w.Start)
+}
+
+// Equal tells if two Windows cover the same period,
+// regardless of when they should be checked again
+func (w Window) Equal(o Window) bool {
+	return w.Start.Equal(o.Start) && w.End.Equal(o.End)
+}
+
+// Pick chooses a random moment within the Window, so renewals
+// of many certificates don't happen all at the same time
+func (w Window) Pick() time.Time {
+	d := w.End.Sub(w.Start)
+	if d <= 0 {
+		return w.Start
+	}
+
+	// #nosec G404 -- jitter doesn't need to be cryptographically secure
+	return w.Start.Add(time.Duration(rand.Int63n(int64(d))))
+}
+
+// DefaultWindow computes a renewal Window based on the validity
+// period of the certificate. The window starts once the given
+// fraction of the validity has elapsed, and ends halfway
+// between that and the expiration.
+func DefaultWindow(leaf *x509.Certificate, fraction float64) Window {
+	if fraction <= 0 || fraction >= 1 {
+		fraction = DefaultFraction
+	}
+
+	validity := leaf.NotAfter.Sub(leaf.NotBefore)
+	if validity <= 0 {
+		// expired already
+		return Window{
+			Start: leaf.NotBefore,
+			End:   leaf.NotBefore,
+		}
+	}
+
+	start := leaf.NotBefore.Add(time.Duration(float64(validity) * fraction))
+	end := start.Add(leaf.NotAfter.Sub(start) / 2)
+
+	return Window{
+		Start: start,
+		End:   end,
+	}
+}
@@ -96,3 +96,35 @@ func (s *Store) ForEach(ctx context.Context, f x509utils.StoreIterFunc) error {
 
 	return err
 }
+
+// revive:disable:cognitive-complexity
+
+// ForEachCertificate iterates over all stored bundled certificates,
+// including their private keys
+func (s *Store) ForEachCertificate(ctx context.Context, f func(*tls.Certificate) error) error {
+	// revive:enable:cognitive-complexity
+	var err error
+
+	if f != nil {
+		s.lockInit()
+
+		core.ListForEach(s.certs, func(ci *certInfo) bool {
+			if ci.c.Leaf != nil {
+				s.mu.Unlock()
+				err = f(ci.c)
+				s.mu.Lock()
+			}
+
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return true
+			default:
+				return err != nil
+			}
+		})
+		s.mu.Unlock()
+	}
+
+	return err
+}
@@ -139,6 +139,37 @@ func (s *Store) DeleteCert(_ context.Context, cert *x509.Certificate) error {
 	return fs.ErrNotExist
 }
 
+// ReplaceCert atomically removes a certificate from the store and adds
+// a new bundled one in its place. Readers will either see the old
+// certificate or the new one, never neither.
+func (s *Store) ReplaceCert(_ context.Context, old *x509.Certificate, cert *tls.Certificate) error {
+	if cert == nil || cert.Leaf == nil {
+		return ErrInvalidCert{
+			Reason: "no leaf",
+		}
+	}
+
+	if _, ok := cert.PrivateKey.(x509utils.PrivateKey); !ok {
+		return ErrInvalidCert{
+			Reason: "no private key",
+		}
+	}
+
+	s.lockInit()
+	defer s.mu.Unlock()
+
+	if old != nil {
+		ci := s.findCertInfo(old)
+		if ci == nil {
+			return fs.ErrNotExist
+		}
+		s.deleteByCertInfo(ci)
+	}
+
+	addCerts(s, cert)
+	return nil
+}
+
 func (s *Store) findCertInfo(cert *x509.Certificate) *certInfo {
 	hash := certpool.HashCert(cert)
 	if ci, ok := s.hashed[hash]; ok {
@@ -3,11 +3,13 @@ package httpgroup
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"darvaza.org/core"
 	"darvaza.org/slog"
@@ -15,9 +17,25 @@ import (
 
 var (
 	_ Server = (*http.Server)(nil)
+	_ Runner = (*Worker)(nil)
+	_ Runner = (*ListenerWorker[net.Listener])(nil)
 )
 
-// Server is a subset of the standard *http.Server including what httpgroup uses
+// DefaultShutdownTimeout is the default time given to
+// workers to shut down gracefully
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Runner is a worker controlled by the Group
+type Runner interface {
+	// Run serves until shut down
+	Run() error
+	// Shutdown stops the Runner gracefully, or
+	// abruptly once the context expires
+	Shutdown(context.Context) error
+}
+
+// Server is a subset of the standard *http.Server including what httpgroup uses.
+// Dispatchers like sni.Dispatcher are Servers too
 type Server interface {
 	Serve(net.Listener) error
 	Shutdown(context.Context) error
@@ -31,8 +49,12 @@ type Worker struct {
 
 // IsError filters out errors that can stop the Group
 func (*Worker) IsError(err error) bool {
-	switch err {
-	case nil, http.ErrServerClosed:
+	return isError(err)
+}
+
+func isError(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, http.ErrServerClosed), errors.Is(err, net.ErrClosed):
 		return false
 	default:
 		return true
@@ -54,17 +76,61 @@ func (w *Worker) Run() error {
 
 // Shutdown is the blocking call that stops a Server
 func (w *Worker) Shutdown(ctx context.Context) error {
-	return w.Server.Shutdown(ctx)
+	return shutdown(ctx, w.Server)
+}
+
+// shutdown stops a server gracefully, closing it if the
+// context expires first and it can be closed
+func shutdown(ctx context.Context, srv interface {
+	Shutdown(context.Context) error
+}) error {
+	err := srv.Shutdown(ctx)
+	if err != nil && ctx.Err() != nil {
+		if c, ok := srv.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+	return err
+}
+
+// ListenerServer is a server of listeners of type L, like
+// an *http3.Server on http3.QUICEarlyListeners
+type ListenerServer[L any] interface {
+	ServeListener(L) error
+	Shutdown(context.Context) error
+}
+
+// ListenerWorker is an abstraction of a running ListenerServer
+type ListenerWorker[L any] struct {
+	Listener L
+	Server   ListenerServer[L]
+}
+
+// Run is the blocking call that runs the ListenerServer
+func (w *ListenerWorker[L]) Run() error {
+	if w.Server == nil {
+		return syscall.EINVAL
+	} else if err := w.Server.ServeListener(w.Listener); isError(err) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown is the blocking call that stops a ListenerServer
+func (w *ListenerWorker[L]) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, w.Server)
 }
 
 // Group is a variant of errgroup.Group on which workers
-// are *http.Server/net.Listener instances
+// are Runners, like *http.Server/net.Listener instances,
+// shut down once the Group is cancelled
 type Group struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
 	cancelled atomic.Bool
 	count     atomic.Int32
 	logger    atomic.Value
+	timeout   atomic.Int64
 
 	wg core.WaitGroup
 }
@@ -121,7 +187,20 @@ func (heg *Group) SetLogger(logger slog.Logger) {
 	heg.logger.Store(logger)
 }
 
-// Cancel initiates a shutdown of all *http.Server{}s
+// SetShutdownTimeout sets the time given to workers to shut
+// down gracefully, DefaultShutdownTimeout if not positive
+func (heg *Group) SetShutdownTimeout(d time.Duration) {
+	heg.timeout.Store(int64(d))
+}
+
+func (heg *Group) shutdownTimeout() time.Duration {
+	if d := time.Duration(heg.timeout.Load()); d > 0 {
+		return d
+	}
+	return DefaultShutdownTimeout
+}
+
+// Cancel initiates a shutdown of all Runners
 func (heg *Group) Cancel() error {
 	heg.init(context.TODO())
 
@@ -129,26 +208,36 @@ func (heg *Group) Cancel() error {
 	return nil
 }
 
-// Go spawns a new Server controlled by the Group
+// Go spawns a new Server controlled by the Group, named
+// after the address of the Listener
 func (heg *Group) Go(srv Server, lsn net.Listener) error {
 	if srv == nil || lsn == nil {
 		return syscall.EINVAL
-	} else if heg.Cancelled() {
-		return syscall.ECANCELED
 	}
 
-	heg.init(context.TODO())
+	// make a copy of the Listener's Address
+	// in case something happens to it
+	name := lsn.Addr().String()
+	if addr, ok := core.AddrPort(lsn); ok {
+		name = addr.String()
+	}
 
-	w := &Worker{
+	return heg.Spawn(name, &Worker{
 		Server:   srv,
 		Listener: lsn,
-	}
+	})
+}
 
-	// make a copy of the Listener's Address
-	// in case something happens to it
-	addr, _ := core.AddrPort(lsn)
-	name := fmt.Sprintf("http://%s", addr.String())
+// Spawn runs a Runner controlled by the Group, using the
+// given name when logging
+func (heg *Group) Spawn(name string, w Runner) error {
+	if w == nil {
+		return syscall.EINVAL
+	} else if heg.Cancelled() {
+		return syscall.ECANCELED
+	}
 
+	heg.init(context.TODO())
 	heg.count.Add(1)
 
 	heg.wg.GoCatch(func() error {
@@ -168,7 +257,7 @@ func (heg *Group) Go(srv Server, lsn net.Listener) error {
 	return nil
 }
 
-func (heg *Group) runWorker(w *Worker, name string) error {
+func (heg *Group) runWorker(w Runner, name string) error {
 	if log, ok := heg.debug(); ok {
 		log.Println(name, "started")
 	}
@@ -191,7 +280,7 @@ func (heg *Group) catchWorker(name string, err error) error {
 	return nil
 }
 
-func (heg *Group) runSupervisor(w *Worker, name string) error {
+func (heg *Group) runSupervisor(w Runner, name string) error {
 	if log, ok := heg.debug(); ok {
 		log.Println(name, "supervisor started")
 	}
@@ -203,7 +292,10 @@ func (heg *Group) runSupervisor(w *Worker, name string) error {
 		log.Println(name, "shutting down")
 	}
 
-	return w.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), heg.shutdownTimeout())
+	defer cancel()
+
+	return w.Shutdown(ctx)
 }
 
 func (heg *Group) catchSupervisor(name string, err error) error {
@@ -0,0 +1,94 @@
+package httpgroup
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves nothing until shut down. Stuck
+// ones only stop when closed
+type testServer struct {
+	stuck  bool
+	stop   chan struct{}
+	closed atomic.Bool
+}
+
+func newTestServer(stuck bool) *testServer {
+	return &testServer{stuck: stuck, stop: make(chan struct{})}
+}
+
+func (s *testServer) ServeListener(string) error {
+	<-s.stop
+	return http.ErrServerClosed
+}
+
+func (s *testServer) Shutdown(ctx context.Context) error {
+	if s.stuck {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	close(s.stop)
+	return nil
+}
+
+func (s *testServer) Close() error {
+	if s.closed.CompareAndSwap(false, true) && s.stuck {
+		close(s.stop)
+	}
+	return nil
+}
+
+func TestGroup(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		stuck bool
+	}{
+		{"graceful", false},
+		{"timeout", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testGroup(t, tc.stuck)
+		})
+	}
+}
+
+func testGroup(t *testing.T, stuck bool) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var heg Group
+	heg.SetShutdownTimeout(50 * time.Millisecond)
+
+	srv := newTestServer(stuck)
+	if err := heg.Go(&http.Server{ReadHeaderTimeout: time.Second}, lsn); err != nil {
+		t.Fatal(err)
+	} else if err := heg.Spawn("test", &ListenerWorker[string]{Server: srv}); err != nil {
+		t.Fatal(err)
+	} else if n := heg.Count(); n != 2 {
+		t.Errorf("%v running (expected 2)", n)
+	}
+
+	_ = heg.Cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- heg.Wait() }()
+
+	select {
+	case <-done:
+		if srv.closed.Load() != stuck {
+			t.Errorf("closed:%v (expected %v)", srv.closed.Load(), stuck)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	if err := heg.Spawn("late", &ListenerWorker[string]{Server: srv}); err == nil {
+		t.Error("spawned on a cancelled group")
+	}
+}
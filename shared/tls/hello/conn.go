@@ -0,0 +1,73 @@
+package hello
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Conn is a net.Conn recording the ClientHello read through it,
+// so servers terminating TLS can inspect it after the handshake.
+// Unlike Reader.Read, deadlines are left to the server
+type Conn struct {
+	net.Conn
+
+	once  sync.Once
+	in    io.Reader
+	hello atomic.Pointer[ClientHello]
+}
+
+// NewConn wraps a net.Conn to record its ClientHello
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHello)
+	return c.in.Read(b)
+}
+
+func (c *Conn) readHello() {
+	var r Reader
+	var raw bytes.Buffer
+
+	if msg, err := r.readMessage(io.TeeReader(c.Conn, &raw)); err == nil {
+		if m, err := Parse(msg); err == nil {
+			c.hello.Store(m)
+		}
+	}
+
+	// let the server deal with whatever it was
+	c.in = io.MultiReader(bytes.NewReader(raw.Bytes()), c.Conn)
+}
+
+// ClientHello returns the ClientHello read through the
+// connection, if any
+func (c *Conn) ClientHello() (*ClientHello, bool) {
+	m := c.hello.Load()
+	return m, m != nil
+}
+
+// Listener is a net.Listener whose connections
+// record their ClientHello
+type Listener struct {
+	net.Listener
+}
+
+// NewListener wraps a net.Listener so its connections
+// record their ClientHello
+func NewListener(lsn net.Listener) *Listener {
+	return &Listener{Listener: lsn}
+}
+
+// Accept waits for the next connection and wraps it
+// into a Conn
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
@@ -0,0 +1,160 @@
+package hello
+
+import (
+	"crypto/md5" // #nosec G501 -- JA3 is defined on MD5
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"darvaza.org/core"
+)
+
+// IsGREASE tells if a value is one of the reserved GREASE
+// values of RFC 8701, ignored by fingerprints
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !IsGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// MaxVersion returns the highest TLS version offered by
+// the client
+func (m *ClientHello) MaxVersion() uint16 {
+	var best uint16
+	for _, v := range m.SupportedVersions {
+		if !IsGREASE(v) && v > best {
+			best = v
+		}
+	}
+	return core.IIf(best > 0, best, m.Version)
+}
+
+// JA3 returns the JA3 description of the ClientHello
+func (m *ClientHello) JA3() string {
+	formats := make([]uint16, len(m.PointFormats))
+	for i, v := range m.PointFormats {
+		formats[i] = uint16(v)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(m.Version)),
+		joinUint16(withoutGREASE(m.CipherSuites), "-", 10),
+		joinUint16(withoutGREASE(m.Extensions), "-", 10),
+		joinUint16(withoutGREASE(m.SupportedGroups), "-", 10),
+		joinUint16(formats, "-", 10),
+	}, ",")
+}
+
+// JA3Hash returns the JA3 fingerprint of the ClientHello,
+// the MD5 of its JA3 description in hexadecimal
+func (m *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(m.JA3())) // #nosec G401
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received
+// over TCP
+func (m *ClientHello) JA4() string {
+	return m.ja4('t')
+}
+
+// JA4QUIC returns the JA4 fingerprint of a ClientHello received
+// in QUIC Initial packets
+func (m *ClientHello) JA4QUIC() string {
+	return m.ja4('q')
+}
+
+func (m *ClientHello) ja4(transport byte) string {
+	ciphers := withoutGREASE(m.CipherSuites)
+	exts := withoutGREASE(m.Extensions)
+
+	sni := core.IIf[byte](slices.Contains(m.Extensions, extServerName), 'd', 'i')
+	a := fmt.Sprintf("%c%s%c%02d%02d%s", transport, ja4Version(m.MaxVersion()), sni,
+		min(len(ciphers), 99), min(len(exts), 99), ja4ALPN(m.ALPNProtocols))
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinUint16(ciphers, ",", 16))
+
+	exts = slices.DeleteFunc(exts, func(v uint16) bool {
+		return v == extServerName || v == extALPN
+	})
+	slices.Sort(exts)
+	c := joinUint16(exts, ",", 16)
+	if algs := withoutGREASE(m.SignatureAlgorithms); len(algs) > 0 {
+		c += "_" + joinUint16(algs, ",", 16)
+	}
+
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first
+// ALPN protocol, or of its hexadecimal form if they aren't
+// alphanumeric
+func ja4ALPN(protos []string) string {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+
+	p := protos[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlphaNumeric(first) && isAlphaNumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	s := hex.EncodeToString([]byte{first, last})
+	return s[:1] + s[3:]
+}
+
+func isAlphaNumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ja4Hash returns the first 12 hexadecimal characters of
+// the SHA256 of s, or zeros if s is empty
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinUint16(values []uint16, sep string, base int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		if base == 16 {
+			s[i] = fmt.Sprintf("%04x", v)
+		} else {
+			s[i] = strconv.Itoa(int(v))
+		}
+	}
+	return strings.Join(s, sep)
+}
@@ -0,0 +1,231 @@
+// Package hello reads and parses TLS ClientHello messages
+// without terminating the connection
+package hello
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	// ErrNotTLS indicates the data isn't a TLS handshake
+	ErrNotTLS = errors.New("not a TLS handshake")
+	// ErrNotClientHello indicates the handshake doesn't
+	// start with a ClientHello
+	ErrNotClientHello = errors.New("not a ClientHello")
+	// ErrTooLarge indicates the ClientHello exceeds the size limit
+	ErrTooLarge = errors.New("ClientHello too large")
+	// ErrMalformed indicates the ClientHello couldn't be parsed
+	ErrMalformed = errors.New("malformed ClientHello")
+)
+
+const (
+	recordTypeHandshake = 22
+	typeClientHello     = 1
+)
+
+// TLS extension types we parse
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extPointFormats        uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+	extKeyShare            uint16 = 51
+)
+
+// ClientHello is a parsed TLS ClientHello message
+type ClientHello struct {
+	// Raw is the whole handshake message, header included
+	Raw []byte
+
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+
+	// Extensions lists the types of all extensions, in order
+	Extensions []uint16
+
+	ServerName          string
+	ALPNProtocols       []string
+	SupportedVersions   []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	KeyShareGroups      []uint16
+}
+
+// Parse parses a complete ClientHello handshake message,
+// header included
+func Parse(msg []byte) (*ClientHello, error) {
+	var body cryptobyte.String
+	var typ uint8
+
+	s := cryptobyte.String(msg)
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&body) || !s.Empty() {
+		return nil, ErrMalformed
+	} else if typ != typeClientHello {
+		return nil, ErrNotClientHello
+	}
+
+	m := &ClientHello{Raw: msg}
+	if !m.unmarshal(body) {
+		return nil, ErrMalformed
+	}
+	return m, nil
+}
+
+func (m *ClientHello) unmarshal(s cryptobyte.String) bool {
+	var random, sessionID, compression []byte
+
+	if !s.ReadUint16(&m.Version) ||
+		!s.ReadBytes(&random, 32) ||
+		!readUint8LengthPrefixed(&s, &sessionID) ||
+		!readUint16List(&s, &m.CipherSuites) ||
+		!readUint8LengthPrefixed(&s, &compression) {
+		return false
+	}
+
+	m.Random, m.SessionID, m.CompressionMethods = random, sessionID, compression
+
+	if s.Empty() {
+		// no extensions
+		return true
+	}
+
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) || !s.Empty() {
+		return false
+	}
+
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return false
+		}
+
+		m.Extensions = append(m.Extensions, typ)
+		if !m.unmarshalExtension(typ, data) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *ClientHello) unmarshalExtension(typ uint16, data cryptobyte.String) bool {
+	switch typ {
+	case extServerName:
+		return m.unmarshalServerName(data)
+	case extALPN:
+		return m.unmarshalALPN(data)
+	case extSupportedVersions:
+		return readUint8LengthPrefixedUint16s(&data, &m.SupportedVersions) && data.Empty()
+	case extSupportedGroups:
+		return readUint16List(&data, &m.SupportedGroups) && data.Empty()
+	case extSignatureAlgorithms:
+		return readUint16List(&data, &m.SignatureAlgorithms) && data.Empty()
+	case extPointFormats:
+		return readUint8LengthPrefixed(&data, &m.PointFormats) && data.Empty()
+	case extKeyShare:
+		return m.unmarshalKeyShare(data)
+	default:
+		return true
+	}
+}
+
+func (m *ClientHello) unmarshalServerName(data cryptobyte.String) bool {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) || list.Empty() {
+		return false
+	}
+
+	for !list.Empty() {
+		var nameType uint8
+		var name cryptobyte.String
+
+		if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) || name.Empty() {
+			return false
+		} else if nameType == 0 && m.ServerName == "" {
+			// host_name
+			m.ServerName = string(name)
+		}
+	}
+	return true
+}
+
+func (m *ClientHello) unmarshalALPN(data cryptobyte.String) bool {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) || list.Empty() {
+		return false
+	}
+
+	for !list.Empty() {
+		var proto cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+			return false
+		}
+		m.ALPNProtocols = append(m.ALPNProtocols, string(proto))
+	}
+	return true
+}
+
+func (m *ClientHello) unmarshalKeyShare(data cryptobyte.String) bool {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return false
+	}
+
+	for !list.Empty() {
+		var group uint16
+		var key cryptobyte.String
+
+		if !list.ReadUint16(&group) || !list.ReadUint16LengthPrefixed(&key) {
+			return false
+		}
+		m.KeyShareGroups = append(m.KeyShareGroups, group)
+	}
+	return true
+}
+
+func readUint8LengthPrefixed(s *cryptobyte.String, out *[]byte) bool {
+	var v cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&v) {
+		return false
+	}
+	*out = append([]byte(nil), v...)
+	return true
+}
+
+func readUint16List(s *cryptobyte.String, out *[]uint16) bool {
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || len(list)%2 != 0 {
+		return false
+	}
+	return readUint16s(list, out)
+}
+
+func readUint8LengthPrefixedUint16s(s *cryptobyte.String, out *[]uint16) bool {
+	var list cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&list) || len(list)%2 != 0 {
+		return false
+	}
+	return readUint16s(list, out)
+}
+
+func readUint16s(list cryptobyte.String, out *[]uint16) bool {
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return false
+		}
+		*out = append(*out, v)
+	}
+	return true
+}
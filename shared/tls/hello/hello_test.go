@@ -0,0 +1,139 @@
+package hello
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// clientHello captures the ClientHello sent by crypto/tls
+func clientHello(t *testing.T) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{
+			ServerName: "www.example.org",
+			NextProtos: []string{"h2", "http/1.1"},
+		}).Handshake()
+	}()
+
+	var hdr [recordHeaderLength]byte
+	if _, err := io.ReadFull(server, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// fragment splits a handshake message into records of
+// the given size
+func fragment(msg []byte, size int) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		out = append(out, recordTypeHandshake, 3, 1, byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+func TestReader(t *testing.T) {
+	msg := clientHello(t)
+
+	for _, size := range []int{len(msg), 100, 7, 1} {
+		data := append(fragment(msg, size), "trailing"...)
+
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			_, _ = client.Write(data)
+		}()
+
+		ch, conn, err := ReadClientHello(server)
+		if err != nil {
+			t.Fatalf("fragment size %v: %s", size, err)
+		}
+
+		if ch.ServerName != "www.example.org" {
+			t.Errorf("fragment size %v: ServerName %q", size, ch.ServerName)
+		}
+		if !slices.Equal(ch.ALPNProtocols, []string{"h2", "http/1.1"}) {
+			t.Errorf("fragment size %v: ALPNProtocols %q", size, ch.ALPNProtocols)
+		}
+		if !slices.Contains(ch.SupportedVersions, tls.VersionTLS13) || len(ch.KeyShareGroups) == 0 {
+			t.Errorf("fragment size %v: versions %v key shares %v", size,
+				ch.SupportedVersions, ch.KeyShareGroups)
+		}
+
+		replay, _ := io.ReadAll(conn)
+		if !bytes.Equal(replay, data) {
+			t.Errorf("fragment size %v: replay mismatch", size)
+		}
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	msg := clientHello(t)
+
+	for _, tc := range []struct {
+		data    []byte
+		maxSize int
+		err     error
+	}{
+		{fragment(msg, 100), len(msg) - 1, ErrTooLarge},
+		{[]byte("GET / HTTP/1.1\r\n"), 0, ErrNotTLS},
+		{fragment([]byte{2, 0, 0, 0}, 4), 0, ErrNotClientHello},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			_, _ = client.Write(tc.data)
+		}()
+
+		r := Reader{MaxSize: tc.maxSize}
+		_, _, err := r.Read(server)
+		if err != tc.err {
+			t.Errorf("Read(%q): %v (expected %v)", tc.data[:5], err, tc.err)
+		}
+		server.Close()
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	m, err := Parse(clientHello(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ja4 := m.JA4()
+	parts := strings.Split(ja4, "_")
+	if len(parts) != 3 || len(parts[1]) != 12 || len(parts[2]) != 12 {
+		t.Fatalf("invalid JA4 %q", ja4)
+	}
+
+	ciphers, exts := len(withoutGREASE(m.CipherSuites)), len(withoutGREASE(m.Extensions))
+	if expected := fmt.Sprintf("t13d%02d%02dh2", ciphers, exts); parts[0] != expected {
+		t.Errorf("JA4_a: %q (expected %q)", parts[0], expected)
+	} else if q := m.JA4QUIC(); q[0] != 'q' || q[1:] != ja4[1:] {
+		t.Errorf("JA4 QUIC: %q", q)
+	}
+
+	// GREASE values don't alter fingerprints
+	ja3 := m.JA3Hash()
+	m.CipherSuites = append([]uint16{0x1a1a}, m.CipherSuites...)
+	m.Extensions = append(m.Extensions, 0xfafa)
+	if m.JA3Hash() != ja3 || m.JA4() != ja4 {
+		t.Error("fingerprint altered by GREASE values")
+	}
+}
@@ -0,0 +1,144 @@
+package hello
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"darvaza.org/core"
+)
+
+const (
+	// DefaultMaxSize is the default limit for the size of
+	// a ClientHello handshake message
+	DefaultMaxSize = 64 << 10
+	// DefaultTimeout is the default time given to a client
+	// to send the whole ClientHello
+	DefaultTimeout = 10 * time.Second
+
+	recordHeaderLength = 5
+	// maxRecordLength is the maximum length of a TLSPlaintext
+	// fragment
+	maxRecordLength = 1 << 14
+)
+
+// Reader reads a ClientHello reassembling it from as many
+// TLS records as needed
+type Reader struct {
+	// MaxSize limits the size of the ClientHello message
+	MaxSize int
+	// Timeout is the maximum time to receive the whole ClientHello
+	Timeout time.Duration
+}
+
+// Read reads a ClientHello from the connection. The returned
+// net.Conn replays every byte consumed, and is returned even
+// when the ClientHello couldn't be read
+func (r *Reader) Read(conn net.Conn) (*ClientHello, net.Conn, error) {
+	timeout := core.IIf(r.Timeout > 0, r.Timeout, DefaultTimeout)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	var raw bytes.Buffer
+	msg, err := r.readMessage(io.TeeReader(conn, &raw))
+
+	replay := &replayConn{
+		Conn:   conn,
+		Reader: io.MultiReader(bytes.NewReader(raw.Bytes()), conn),
+	}
+
+	if err != nil {
+		return nil, replay, err
+	}
+
+	m, err := Parse(msg)
+	if err != nil {
+		return nil, replay, err
+	}
+	return m, replay, nil
+}
+
+// ReadClientHello reads a ClientHello using the default limits
+func ReadClientHello(conn net.Conn) (*ClientHello, net.Conn, error) {
+	var r Reader
+	return r.Read(conn)
+}
+
+// readMessage reassembles the handshake message from
+// the fragments carried by the records
+func (r *Reader) readMessage(in io.Reader) ([]byte, error) {
+	var msg []byte
+
+	maxSize := core.IIf(r.MaxSize > 0, r.MaxSize, DefaultMaxSize)
+	want := -1
+
+	for want < 0 || len(msg) < want {
+		fragment, err := readRecord(in)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, fragment...)
+
+		if want < 0 && len(msg) >= 4 {
+			if msg[0] != typeClientHello {
+				return nil, ErrNotClientHello
+			}
+
+			want = 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if want > maxSize {
+				return nil, ErrTooLarge
+			}
+		}
+	}
+
+	if len(msg) > want {
+		// another handshake message follows in the same
+		// record, not expected from a client
+		return nil, ErrMalformed
+	}
+	return msg, nil
+}
+
+// readRecord reads one handshake record and returns its fragment
+func readRecord(in io.Reader) ([]byte, error) {
+	var hdr [recordHeaderLength]byte
+
+	if _, err := io.ReadFull(in, hdr[:]); err != nil {
+		return nil, err
+	} else if hdr[0] != recordTypeHandshake || hdr[1] != 3 {
+		return nil, ErrNotTLS
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if n == 0 || n > maxRecordLength {
+		return nil, ErrMalformed
+	}
+
+	fragment := make([]byte, n)
+	if _, err := io.ReadFull(in, fragment); err != nil {
+		return nil, err
+	}
+	return fragment, nil
+}
+
+// replayConn is a net.Conn giving back what was
+// consumed from it
+type replayConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// CloseWrite closes the Write stream of the underlying
+// connection if supported
+func (c *replayConn) CloseWrite() error {
+	if w, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return w.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDrainTimeout is the default time Cancel waits for
+// active connections to finish
+const DefaultDrainTimeout = 30 * time.Second
+
+// register tracks a new connection and returns its context.
+// The connection is closed when the context is cancelled.
+// It fails if the Proxy is shutting down
+func (p *Proxy) register(conn net.Conn) (context.Context, bool) {
+	return p.track(conn, func() { _ = conn.Close() })
+}
+
+// track counts as active connection anything identified by
+// key, like an HTTP/3 request, calling abort when the returned
+// context is cancelled. It fails if the Proxy is shutting down
+func (p *Proxy) track(key any, abort func()) (context.Context, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.shuttingDown() {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	stop := context.AfterFunc(ctx, abort)
+
+	if p.conns == nil {
+		p.conns = make(map[any]context.CancelFunc)
+	}
+	p.conns[key] = func() {
+		stop()
+		cancel()
+	}
+	p.connsWG.Add(1)
+	return ctx, true
+}
+
+// unregister stops tracking a connection and releases its context
+func (p *Proxy) unregister(key any) {
+	p.mu.Lock()
+	cancel, ok := p.conns[key]
+	delete(p.conns, key)
+	p.mu.Unlock()
+
+	if ok {
+		cancel()
+		p.connsWG.Done()
+	}
+}
+
+type listenAddrKey struct{}
+
+// listenAddr returns the address of the listener
+// that accepted the connection of a context
+func listenAddr(ctx context.Context) string {
+	laddr, _ := ctx.Value(listenAddrKey{}).(string)
+	return laddr
+}
+
+// handle serves a tracked connection accepted on laddr
+func (p *Proxy) handle(laddr string, conn net.Conn) {
+	ctx, ok := p.register(conn)
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+
+	go func() {
+		defer p.unregister(conn)
+		p.tlsHandler(context.WithValue(ctx, listenAddrKey{}, laddr), conn)
+	}()
+}
+
+// Conns returns the number of active connections,
+// counting HTTP/3 requests as such
+func (p *Proxy) Conns() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Draining tells if the Proxy stopped accepting connections
+func (p *Proxy) Draining() bool {
+	return p.shuttingDown()
+}
+
+// StopListening closes the listeners of the Proxy, leaving
+// the active connections to Drain
+func (p *Proxy) StopListening() error {
+	p.mu.Lock()
+	atomic.StoreInt32(&p.inShutdown, 1)
+	p.mu.Unlock()
+
+	return p.closeListeners()
+}
+
+// Drain stops accepting connections and waits for the active
+// ones to finish. If the context expires first the remaining
+// connections are closed and the context's error is returned.
+func (p *Proxy) Drain(ctx context.Context) error {
+	err := p.StopListening()
+
+	// lets the agents know, once their streams finish
+	if p.tunnel != nil {
+		go func() { _ = p.tunnel.Shutdown(ctx) }()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.connsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// closes the remaining connections
+		p.cancel()
+		<-done
+		err = errors.Join(err, ctx.Err())
+	}
+
+	p.cancel()
+	return err
+}
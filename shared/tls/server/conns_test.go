@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitConns waits until the Proxy tracks n connections
+func waitConns(t *testing.T, p *Proxy, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); p.Conns() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v connections (expected %v)", p.Conns(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyConns(t *testing.T) {
+	up := newTestUpstream(t, "a")
+	addr := freeAddr(t)
+	p := newTestProxy(t, testConfig(up, addr))
+
+	c1, _ := dialTest(t, addr)
+	c2, _ := dialTest(t, addr)
+	waitConns(t, p, 2)
+
+	_ = c1.Close()
+	waitConns(t, p, 1)
+
+	c2.echo(t, "ping")
+	_ = c2.Close()
+	waitConns(t, p, 0)
+}
+
+func TestProxyDrain(t *testing.T) {
+	up := newTestUpstream(t, "a")
+	addr := freeAddr(t)
+	p := newTestProxy(t, testConfig(up, addr))
+
+	c, _ := dialTest(t, addr)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- p.Drain(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Drain returned with an open connection: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if !p.Draining() {
+		t.Error("not draining")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("still accepting connections")
+	}
+
+	// open streams continue until they finish
+	c.echo(t, "ping")
+	_ = c.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain didn't return")
+	}
+	waitConns(t, p, 0)
+}
+
+func TestProxyDrainTimeout(t *testing.T) {
+	up := newTestUpstream(t, "a")
+	addr := freeAddr(t)
+	p := newTestProxy(t, testConfig(up, addr))
+
+	c, _ := dialTest(t, addr)
+	waitConns(t, p, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := p.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain: %v (expected %v)", err, context.DeadlineExceeded)
+	}
+
+	// the connection was closed
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("connection still open")
+	}
+	if n := p.Conns(); n != 0 {
+		t.Errorf("%v connections left", n)
+	}
+}
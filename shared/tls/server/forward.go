@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/acl"
+	"darvaza.org/darvaza/shared/net/egress"
+	"darvaza.org/darvaza/shared/net/sniff"
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+const (
+	// ProtocolHTTP is the Protocol of proxies routing
+	// connections to their upstreams
+	ProtocolHTTP = "http"
+	// ProtocolForward is the Protocol of forward proxies,
+	// connecting clients to the destinations they ask for
+	ProtocolForward = "forward"
+)
+
+// ForwardConfig describes the forward proxy served on the
+// listeners of a proxy of the "forward" Protocol. Clients
+// use HTTP CONNECT or SOCKS5, in plaintext or over TLS with
+// the certificates of the Store
+type ForwardConfig struct {
+	// Allow are the destinations allowed, as hostnames,
+	// "*.example.com" for the subdomains of a domain, IP
+	// addresses, CIDR prefixes or "private". If empty
+	// everything not denied is
+	Allow []string `hcl:"allow,optional"`
+	// Deny are the destinations rejected, in the same
+	// forms. They win over Allow
+	Deny []string `hcl:"deny,optional"`
+	// Ports are the destination ports allowed. If
+	// empty any is
+	Ports []int `hcl:"ports,optional"`
+	// Resolver is the address of the DNS server resolving
+	// destinations, like a gnocco resolver
+	Resolver string `hcl:"resolver,optional"`
+
+	// Users maps usernames to their passwords, in plain
+	// or as bcrypt hashes
+	Users map[string]string `hcl:"users,optional"`
+	// ClientCA are PEM contents, files or directories with
+	// the CAs verifying client certificates, authenticating
+	// clients by their CommonName
+	ClientCA []string `hcl:"client_ca,optional"`
+	// Anonymous accepts clients without credentials
+	Anonymous bool `hcl:"anonymous,optional"`
+
+	ConnectTimeout string `hcl:"connect_timeout,optional"`
+	IdleTimeout    string `hcl:"idle_timeout,optional"`
+	MaxLifetime    string `hcl:"max_lifetime,optional"`
+}
+
+// newForwarder creates the forwarder of a proxy of
+// the "forward" Protocol
+func newForwarder(pc *ProxyConfig, store storage.Store) (*forwarder, error) {
+	switch pc.Protocol {
+	case "", ProtocolHTTP:
+		if pc.Forward != nil {
+			return nil, fmt.Errorf("forward requires the %q protocol", ProtocolForward)
+		}
+		return nil, nil
+	case ProtocolForward:
+		if pc.Forward == nil {
+			return nil, fmt.Errorf("%q protocol requires a forward block", ProtocolForward)
+		}
+		f, err := pc.Forward.newForwarder(store)
+		if err == nil && f.tls == nil && len(pc.ListenQUIC) > 0 {
+			err = errors.New("listen_quic requires certificates")
+		}
+		return f, err
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", pc.Protocol)
+	}
+}
+
+// forwards tells if the proxy is of the "forward" Protocol
+func (pc *ProxyConfig) forwards() bool {
+	return pc.Protocol == ProtocolForward
+}
+
+func (fc *ForwardConfig) newForwarder(store storage.Store) (*forwarder, error) {
+	cfg, err := fc.gatewayConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := cfg.New()
+	if err != nil {
+		return nil, core.Wrap(err, "forward")
+	}
+
+	conf, err := fc.export(store)
+	if err != nil {
+		return nil, core.Wrap(err, "forward")
+	}
+
+	return &forwarder{gateway: gateway, tls: conf}, nil
+}
+
+// gatewayConfig resolves the egress.Config of the forward proxy
+func (fc *ForwardConfig) gatewayConfig() (*egress.Config, error) {
+	var connect, idle, lifetime time.Duration
+
+	if err := ParseDuration(fc.ConnectTimeout, &connect); err != nil {
+		return nil, core.Wrap(err, "connect_timeout")
+	} else if err := ParseDuration(fc.IdleTimeout, &idle); err != nil {
+		return nil, core.Wrap(err, "idle_timeout")
+	} else if err := ParseDuration(fc.MaxLifetime, &lifetime); err != nil {
+		return nil, core.Wrap(err, "max_lifetime")
+	}
+
+	ports := make([]uint16, 0, len(fc.Ports))
+	for _, port := range fc.Ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %v", port)
+		}
+		ports = append(ports, uint16(port))
+	}
+
+	return &egress.Config{
+		Allow:       fc.Allow,
+		Deny:        fc.Deny,
+		Ports:       ports,
+		Resolver:    fc.Resolver,
+		Users:       fc.Users,
+		Anonymous:   fc.Anonymous,
+		DialTimeout: connect,
+		Options: []proxy.ForwardOption{
+			proxy.WithIdleTimeout(idle, idle),
+			proxy.WithMaxLifetime(lifetime),
+		},
+		OnSession: logSession,
+	}, nil
+}
+
+// export creates the tls.Config terminating the clients,
+// if there are certificates
+func (fc *ForwardConfig) export(store storage.Store) (*tls.Config, error) {
+	if store == nil {
+		if len(fc.ClientCA) > 0 {
+			return nil, errors.New("client_ca requires certificates")
+		}
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if len(fc.ClientCA) > 0 {
+		var pb certpool.PoolBuffer
+		if err := pb.Add(fc.ClientCA...); err != nil {
+			return nil, core.Wrap(err, "client_ca")
+		}
+		conf.ClientCAs = pb.Pool().Export()
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// logSession logs a finished request of a forward proxy
+func logSession(s *egress.Session) {
+	user := core.Coalesce(s.User, "anonymous")
+	dest := core.Coalesce(s.Destination, "-")
+	if s.Err != nil {
+		log.Printf("%s: %s %s by %s: %s", s.Client, s.Protocol, dest, user, s.Err)
+		return
+	}
+
+	log.Printf("%s: %s %s by %s closed after %s, %v bytes sent, %v received",
+		s.Client, s.Protocol, dest, user,
+		s.Duration.Round(time.Millisecond), s.Sent, s.Received)
+}
+
+// forwarder serves the listeners of a forward proxy
+type forwarder struct {
+	gateway *egress.Gateway
+	// tls is nil without certificates
+	tls *tls.Config
+}
+
+func (f *forwarder) newMux(acceptProxyProtocol bool, list *acl.List) *sniff.Mux {
+	allow := allowClients(list)
+
+	mux := &sniff.Mux{}
+	mux.Handle(sniff.SOCKS5, f.handleSOCKS5, allow)
+	mux.Handle(sniff.HTTP1, f.handleHTTP, allow)
+	mux.Handle(sniff.HTTP2, f.handleH2C, allow)
+
+	if f.tls != nil {
+		mux.Handle(sniff.TLS, f.handleTLS, allow)
+	}
+
+	if acceptProxyProtocol {
+		mux.AcceptProxyProtocol()
+	}
+	return mux
+}
+
+// handleSOCKS5 serves plaintext SOCKS5 clients. Requests
+// are logged by the gateway
+func (f *forwarder) handleSOCKS5(ctx context.Context, conn *sniff.Conn) error {
+	f.gateway.ServeSOCKS5(ctx, conn, nil)
+	return nil
+}
+
+// handleHTTP serves plaintext HTTP/1.x CONNECT requests
+func (f *forwarder) handleHTTP(ctx context.Context, conn *sniff.Conn) error {
+	return f.serveHTTP(ctx, conn, nil, false)
+}
+
+// handleH2C serves HTTP/2 prior-knowledge CONNECT requests
+func (f *forwarder) handleH2C(ctx context.Context, conn *sniff.Conn) error {
+	return f.serveHTTP(ctx, conn, nil, true)
+}
+
+// handleTLS terminates TLS and serves what follows, HTTP/2,
+// HTTP/1.x or SOCKS5
+func (f *forwarder) handleTLS(ctx context.Context, conn *sniff.Conn) error {
+	tc := tls.Server(conn, f.tls)
+	defer tc.Close()
+
+	hctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	err := tc.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	cs := tc.ConnectionState()
+	if cs.NegotiatedProtocol == "h2" {
+		return f.serveHTTP(ctx, tc, &cs, true)
+	}
+
+	sc := sniff.NewConn(tc)
+	class, err := sc.Sniff(sniff.DefaultTimeout)
+	switch {
+	case err != nil:
+		return err
+	case class == sniff.SOCKS5:
+		f.gateway.ServeSOCKS5(ctx, sc, &cs)
+		return nil
+	default:
+		return f.serveHTTP(ctx, sc, &cs, false)
+	}
+}
+
+// serveForwardH3 serves an HTTP/3 CONNECT request, tracked
+// like a connection so Drain waits for it
+func (p *Proxy) serveForwardH3(rw http.ResponseWriter, req *http.Request) {
+	st := p.current()
+	client, _ := req.Context().Value(http3.RemoteAddrContextKey).(net.Addr)
+
+	switch {
+	case st.forward == nil:
+		http.Error(rw, "not forwarding", http.StatusServiceUnavailable)
+		return
+	case !st.acl.AllowedAddr(client):
+		http.Error(rw, "access denied", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	if _, ok := p.track(req, cancel); !ok {
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.unregister(req)
+
+	st.forward.gateway.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+// serveHTTP serves the CONNECT requests of a connection,
+// waiting for the forwarded ones to finish
+func (f *forwarder) serveHTTP(ctx context.Context, conn net.Conn, cs *tls.ConnectionState, h2 bool) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+
+		if req.TLS == nil {
+			// hidden by the sniffing
+			req.TLS = cs
+		}
+		f.gateway.ServeHTTP(rw, req)
+	})
+
+	return serveConn(ctx, conn, handler, h2)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTestCertificates creates a CA and a certificate for
+// localhost issued by it, returning them and the key in PEM
+func newTestCertificates(t *testing.T) ([]string, *x509.CertPool) {
+	caKey, ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+
+	key, cert := newTestCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"},
+	}, ca, caKey)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return []string{
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}, pool
+}
+
+// newTestCert signs a template with a new key, self-signed
+// if no parent is given
+func newTestCert(t *testing.T, tpl, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	//
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tpl.NotBefore = time.Now().Add(-time.Hour)
+	tpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// newEcho starts a TCP server echoing what it reads
+func newEcho(t *testing.T) string {
+	lsn := listen(t)
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lsn.Addr().String()
+}
+
+// freeUDPAddr returns a UDP address nobody is listening on
+func freeUDPAddr(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+func TestForwardH3(t *testing.T) {
+	echo := newEcho(t)
+	certs, roots := newTestCertificates(t)
+	quicAddr := freeUDPAddr(t)
+
+	p := newTestProxy(t, &ProxyConfig{
+		Protocol:     ProtocolForward,
+		ListenAddr:   []string{freeAddr(t)},
+		ListenQUIC:   []string{quicAddr},
+		Certificates: certs,
+		DrainTimeout: "1s",
+		Forward: &ForwardConfig{
+			Allow:     []string{"127.0.0.1"},
+			Anonymous: true,
+		},
+	})
+
+	tr := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+	}
+	defer tr.Close()
+
+	body, w := io.Pipe()
+	defer w.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "https://"+quicAddr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = echo
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %v (expected %v)", resp.StatusCode, http.StatusOK)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	echoLine := func(s string) {
+		t.Helper()
+
+		if _, err := io.WriteString(w, s+"\n"); err != nil {
+			t.Fatal(err)
+		} else if got, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if got != s+"\n" {
+			t.Errorf("echo: %q (expected %q)", got, s)
+		}
+	}
+
+	echoLine("ping")
+	waitConns(t, p, 1)
+
+	// Drain waits for the stream
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- p.Drain(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Drain returned with an open stream: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	echoLine("pong")
+	_ = w.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain didn't return")
+	}
+}
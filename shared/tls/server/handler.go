@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/acl"
+	"darvaza.org/darvaza/shared/net/proxyproto"
+	"darvaza.org/darvaza/shared/net/sniff"
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+// alertUnrecognizedName is a fatal TLS unrecognized_name(112) alert record
+var alertUnrecognizedName = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x70}
+
+// alertAccessDenied is a fatal TLS access_denied(49) alert record
+var alertAccessDenied = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x31}
+
+// alertInternalError is a fatal TLS internal_error(80) alert record
+var alertInternalError = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x50}
+
+// sendAlert writes a fatal alert record to a client whose
+// handshake hasn't started
+func sendAlert(conn net.Conn, alert []byte) {
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write(alert)
+}
+
+// handleConn classifies the connection and passes it to the
+// handler of its protocol
+func (p *Proxy) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var err error
+	st := p.current()
+	laddr := listenAddr(ctx)
+	if s, ok := st.startTLS[laddr]; ok {
+		err = p.handleStartTLS(ctx, conn, s)
+	} else if core.SliceContains(st.tunnelListen, laddr) {
+		err = p.handleTunnel(ctx, conn)
+	} else {
+		err = st.mux.ServeConn(ctx, conn)
+	}
+
+	if err != nil {
+		log.Printf("%s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (p *Proxy) newMux(router *Router, acceptProxyProtocol bool, list *acl.List) *sniff.Mux {
+	allow := allowClients(list)
+
+	mux := &sniff.Mux{}
+	mux.Handle(sniff.TLS, p.handleTLS, allow)
+	mux.Handle(sniff.HTTP1, p.handleHTTP, allow)
+	mux.Handle(sniff.HTTP2, p.handleH2C, allow)
+
+	if _, ok := router.SSH(); ok {
+		mux.Handle(sniff.SSH, p.handleSSH, allow)
+	}
+
+	if acceptProxyProtocol {
+		mux.AcceptProxyProtocol()
+	}
+	return mux
+}
+
+// handleTLS reads the ClientHello and forwards the connection
+// to the upstream routed for its server name
+func (p *Proxy) handleTLS(ctx context.Context, sc *sniff.Conn) error {
+	var r hello.Reader
+
+	ch, conn, err := r.Read(sc)
+	if err != nil {
+		return err
+	}
+
+	ci := NewClientInfo(ch, false)
+	fingerprints.Add(ci.JA4)
+	serverName, alpn := ch.ServerName, ch.ALPNProtocols
+
+	route, ok := p.current().router.Match(ci)
+	if !ok {
+		sendAlert(conn, alertUnrecognizedName)
+		return fmt.Errorf("no route for %q [%s]", serverName, ci.JA4)
+	}
+
+	if err := checkClient(route, conn.RemoteAddr()); err != nil {
+		sendAlert(conn, alertAccessDenied)
+		return fmt.Errorf("%q [%s]: %w", serverName, ci.JA4, err)
+	}
+
+	hint := newHint(conn.RemoteAddr(), conn.LocalAddr(), serverName)
+	hint.TLVs = proxyTLVs(serverName, singleALPN(alpn))
+
+	err = p.forwardTLS(ctx, conn, route, hint, alpn)
+	if isDialError(err) && route.Mode.dialsFirst() {
+		// the client is still waiting for a ServerHello
+		sendAlert(conn, alertInternalError)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%q [%s]: %w", serverName, ci.JA4, err)
+	}
+	return err
+}
+
+// singleALPN returns the ALPN protocol if only one is offered
+func singleALPN(alpn []string) string {
+	if len(alpn) == 1 {
+		return alpn[0]
+	}
+	return ""
+}
+
+// checkClient rejects clients the ACL of the route doesn't allow
+func checkClient(route *Route, client net.Addr) error {
+	if route.acl.AllowedAddr(client) {
+		return nil
+	}
+	return fmt.Errorf("client %s denied by route to %q", client, route.Upstream.Name())
+}
+
+// allowClients is a sniff.Middleware rejecting clients the ACL of
+// the listeners doesn't allow, after any PROXY protocol header
+func allowClients(list *acl.List) sniff.Middleware {
+	return func(next sniff.Handler) sniff.Handler {
+		if list == nil {
+			return next
+		}
+
+		return func(ctx context.Context, conn *sniff.Conn) error {
+			if !list.AllowedAddr(conn.RemoteAddr()) {
+				return fmt.Errorf("client %s denied", conn.RemoteAddr())
+			}
+			return next(ctx, conn)
+		}
+	}
+}
+
+// forwardTLS handles a TLS connection as its route's Mode says
+func (p *Proxy) forwardTLS(ctx context.Context, conn net.Conn, route *Route, hint proxy.Hint,
+	alpn []string) error {
+	//
+	if _, ok := startTLSFromContext(ctx); ok && route.Mode == ModeHTTP {
+		return errors.New("http routes can't follow a STARTTLS preamble")
+	}
+
+	switch route.Mode {
+	case ModePassthrough:
+		return p.passthrough(ctx, conn, route, hint)
+	case ModeReencrypt:
+		return p.reencrypt(ctx, conn, route, hint, alpn)
+	case ModeHTTP:
+		return p.serveHTTP(ctx, conn, route, hint)
+	default:
+		return p.plaintext(ctx, conn, route, hint)
+	}
+}
+
+// handleHTTP forwards plaintext HTTP/1.x connections by the
+// Host of their first request
+func (p *Proxy) handleHTTP(ctx context.Context, conn *sniff.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	host, err := conn.PeekHTTPHost()
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	route, ok := p.current().router.HTTP().Lookup(host)
+	if !ok {
+		return fmt.Errorf("no http route for %q", host)
+	} else if err := checkClient(route, conn.RemoteAddr()); err != nil {
+		return fmt.Errorf("%q: %w", host, err)
+	}
+
+	return p.passthrough(ctx, conn, route, newHint(conn.RemoteAddr(), conn.LocalAddr(), host))
+}
+
+// handleH2C forwards HTTP/2 prior-knowledge connections
+// to the default HTTP route
+func (p *Proxy) handleH2C(ctx context.Context, conn *sniff.Conn) error {
+	route, ok := p.current().router.HTTP().Lookup("")
+	if !ok {
+		return errors.New("no http route for h2c")
+	} else if err := checkClient(route, conn.RemoteAddr()); err != nil {
+		return err
+	}
+
+	return p.passthrough(ctx, conn, route, newHint(conn.RemoteAddr(), conn.LocalAddr(), ""))
+}
+
+// handleSSH forwards SSH connections
+func (p *Proxy) handleSSH(ctx context.Context, conn *sniff.Conn) error {
+	route, _ := p.current().router.SSH()
+	return p.passthrough(ctx, conn, route, newHint(conn.RemoteAddr(), conn.LocalAddr(), ""))
+}
+
+// newHint describes a client connection for balancing and
+// PROXY protocol headers. local is optional
+func newHint(remote, local net.Addr, serverName string) proxy.Hint {
+	hint := proxy.Hint{
+		ServerName:  serverName,
+		Source:      addrPort(remote),
+		Destination: addrPort(local),
+	}
+
+	if hint.Source.IsValid() {
+		hint.Client = hint.Source.Addr()
+	}
+	return hint
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	if addr == nil {
+		return netip.AddrPort{}
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// proxyTLVs returns the PROXY protocol TLVs describing
+// the server name and ALPN protocol, if known
+func proxyTLVs(serverName, alpn string) []proxyproto.TLV {
+	var tlvs []proxyproto.TLV
+	if serverName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(serverName)})
+	}
+	if alpn != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeALPN, Value: []byte(alpn)})
+	}
+	return tlvs
+}
+
+var sslVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// terminatedTLVs returns the PROXY protocol TLVs describing
+// a terminated TLS connection
+func terminatedTLVs(serverName string, cs tls.ConnectionState) []proxyproto.TLV {
+	si := proxyproto.SSLInfo{
+		Version:      sslVersionNames[cs.Version],
+		Cipher:       tls.CipherSuiteName(cs.CipherSuite),
+		CertVerified: len(cs.VerifiedChains) > 0,
+	}
+	if len(cs.PeerCertificates) > 0 {
+		si.CN = cs.PeerCertificates[0].Subject.CommonName
+	}
+
+	return append(proxyTLVs(serverName, cs.NegotiatedProtocol), si.TLV())
+}
+
+func (p *Proxy) passthrough(ctx context.Context, conn net.Conn, route *Route, hint proxy.Hint) error {
+	upstream, err := dial(ctx, route, hint, true)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	return pipe(ctx, conn, upstream, route.forward...)
+}
+
+// isDialError tells if the upstream couldn't be reached
+func isDialError(err error) bool {
+	var de *proxy.DialError
+	return errors.As(err, &de) || proxy.IsUnavailable(err)
+}
+
+// pipe forwards between conn and upstream until both directions
+// finish or the context is cancelled, applying the given options
+func pipe(ctx context.Context, conn, upstream net.Conn, opts ...proxy.ForwardOption) error {
+	return proxy.PipeContext(ctx, conn, upstream, opts...)
+}
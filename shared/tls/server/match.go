@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+// ClientInfo describes what a TLS client offered, for
+// routing and logging
+type ClientInfo struct {
+	ServerName string
+	ALPN       []string
+	// Version is the highest TLS version offered
+	Version uint16
+	// JA3 is the JA3 fingerprint of the ClientHello
+	JA3 string
+	// JA4 is the JA4 fingerprint of the ClientHello
+	JA4 string
+}
+
+// NewClientInfo describes a ClientHello received over
+// TCP, or QUIC if quic is true
+func NewClientInfo(ch *hello.ClientHello, quic bool) *ClientInfo {
+	return &ClientInfo{
+		ServerName: ch.ServerName,
+		ALPN:       ch.ALPNProtocols,
+		Version:    ch.MaxVersion(),
+		JA3:        ch.JA3Hash(),
+		JA4:        core.IIf(quic, ch.JA4QUIC(), ch.JA4()),
+	}
+}
+
+// routeMatch are the conditions a client must meet,
+// besides the server name, to use a route
+type routeMatch struct {
+	alpn         []string
+	versions     []uint16
+	fingerprints []string
+}
+
+func newRouteMatch(rc *RouteConfig) (routeMatch, error) {
+	m := routeMatch{
+		alpn: rc.MatchALPN,
+	}
+
+	for _, s := range rc.MatchTLSVersions {
+		v, ok := tlsVersions[s]
+		if !ok {
+			return m, core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid TLS version %q", s))
+		}
+		m.versions = append(m.versions, v)
+	}
+
+	for _, s := range rc.MatchFingerprints {
+		m.fingerprints = append(m.fingerprints, strings.ToLower(s))
+	}
+
+	return m, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": 0x0301,
+	"1.1": 0x0302,
+	"1.2": 0x0303,
+	"1.3": 0x0304,
+}
+
+func (m *routeMatch) empty() bool {
+	return len(m.alpn) == 0 && len(m.versions) == 0 && len(m.fingerprints) == 0
+}
+
+func (m *routeMatch) matches(ci *ClientInfo) bool {
+	switch {
+	case len(m.alpn) > 0 && !slices.ContainsFunc(ci.ALPN, m.hasALPN):
+		return false
+	case len(m.versions) > 0 && !slices.Contains(m.versions, ci.Version):
+		return false
+	case len(m.fingerprints) > 0:
+		return m.hasFingerprint(ci.JA3) || m.hasFingerprint(ci.JA4)
+	default:
+		return true
+	}
+}
+
+func (m *routeMatch) hasALPN(proto string) bool {
+	return slices.Contains(m.alpn, proto)
+}
+
+func (m *routeMatch) hasFingerprint(fp string) bool {
+	return fp != "" && slices.Contains(m.fingerprints, fp)
+}
+
+// Conditional tells if the route has conditions
+// besides the server name
+func (r *Route) Conditional() bool {
+	return !r.match.empty()
+}
+
+// Matches tells if the client meets the conditions of
+// the route, besides the server name
+func (r *Route) Matches(ci *ClientInfo) bool {
+	return r.match.matches(ci)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"expvar"
+	"sync"
+)
+
+// MaxFingerprints is the most JA4 fingerprints counted apart.
+// The ClientHellos of any other are counted as "other"
+const MaxFingerprints = 1024
+
+// fingerprints counts the ClientHellos received by their JA4
+// fingerprint, published by expvar as tls_fingerprints
+var fingerprints = &fingerprintCounter{max: MaxFingerprints}
+
+func init() {
+	expvar.Publish("tls_fingerprints", &fingerprints.vars)
+}
+
+type fingerprintCounter struct {
+	mu   sync.Mutex
+	vars expvar.Map
+	max  int
+	n    int
+}
+
+// Add counts a ClientHello with the given fingerprint
+func (fc *fingerprintCounter) Add(fp string) {
+	if fp == "" {
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.vars.Get(fp) == nil {
+		if fc.n >= fc.max {
+			fp = "other"
+		} else {
+			fc.n++
+		}
+	}
+	fc.vars.Add(fp, 1)
+}
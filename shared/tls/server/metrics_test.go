@@ -0,0 +1,20 @@
+package server
+
+import "testing"
+
+func TestFingerprintCounter(t *testing.T) {
+	fc := &fingerprintCounter{max: 2}
+	for _, fp := range []string{"a", "b", "a", "", "c", "d", "b"} {
+		fc.Add(fp)
+	}
+
+	for fp, n := range map[string]string{"a": "2", "b": "2", "other": "2"} {
+		if v := fc.vars.Get(fp); v == nil || v.String() != n {
+			t.Errorf("%s: %v (expected %s)", fp, v, n)
+		}
+	}
+
+	if v := fc.vars.Get("c"); v != nil {
+		t.Errorf("c: counted apart beyond the limit")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/tls/hello"
+)
+
+// routeQUIC chooses the upstream of a QUIC connection. Only
+// passthrough routes can be used as QUIC isn't terminated
+func (p *Proxy) routeQUIC(ctx context.Context, ch *hello.ClientHello, client net.Addr) (net.Conn, error) {
+	ci := NewClientInfo(ch, true)
+	fingerprints.Add(ci.JA4)
+	st := p.current()
+
+	route, ok := st.router.Match(ci)
+	switch {
+	case !st.acl.AllowedAddr(client):
+		return nil, fmt.Errorf("client %s denied", client)
+	case !ok:
+		return nil, fmt.Errorf("no route for %q [%s]", ch.ServerName, ci.JA4)
+	case route.Mode != ModePassthrough:
+		return nil, fmt.Errorf("%q: QUIC requires a passthrough route", ch.ServerName)
+	default:
+		if err := checkClient(route, client); err != nil {
+			return nil, fmt.Errorf("%q [%s]: %w", ch.ServerName, ci.JA4, err)
+		}
+		return route.Upstream.DialUDP(ctx, newHint(client, nil, ch.ServerName))
+	}
+}
+
+// listenNewQUIC opens the QUIC addresses not already open.
+// If any fails all those opened are closed
+func (p *Proxy) listenNewQUIC(addrs []string) (map[string]net.PacketConn, error) {
+	added := make(map[string]net.PacketConn)
+	for _, laddr := range addrs {
+		if _, ok := p.packetConns[laddr]; ok {
+			continue
+		}
+
+		pc, err := net.ListenPacket("udp", laddr)
+		if err != nil {
+			closeAll(added)
+			return nil, err
+		}
+		added[laddr] = pc
+	}
+	return added, nil
+}
+
+func (p *Proxy) addPacketConns(added map[string]net.PacketConn) {
+	for laddr, pc := range added {
+		p.packetConns[laddr] = pc
+		if p.running {
+			p.serveQUIC(pc)
+		}
+	}
+}
+
+// closePacketConns closes the QUIC addresses not listed. Those
+// serving HTTP/3 are closed once their requests finish
+func (p *Proxy) closePacketConns(keep []string) error {
+	var err error
+	for laddr, pc := range p.packetConns {
+		if core.SliceContains(keep, laddr) {
+			continue
+		}
+
+		delete(p.packetConns, laddr)
+		if h3s, ok := p.h3[pc]; ok {
+			delete(p.h3, pc)
+			go func() {
+				_ = h3s.Shutdown(p.ctx)
+				_ = pc.Close()
+			}()
+			continue
+		}
+
+		if cerr := pc.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// serveQUIC relays the QUIC connections of a PacketConn, or
+// serves HTTP/3 on forward proxies, until it's closed
+func (p *Proxy) serveQUIC(pc net.PacketConn) {
+	if p.current().forward != nil {
+		p.serveH3(pc)
+		return
+	}
+
+	p.errGroup.Go(func() error {
+		return p.relay.Serve(p.ctx, pc)
+	})
+}
+
+// serveH3 serves the HTTP/3 requests of a forward proxy
+// on a PacketConn until it's shut down
+func (p *Proxy) serveH3(pc net.PacketConn) {
+	h3s := &http3.Server{
+		Handler: http.HandlerFunc(p.serveForwardH3),
+	}
+
+	if p.h3 == nil {
+		p.h3 = make(map[net.PacketConn]*http3.Server)
+	}
+	p.h3[pc] = h3s
+
+	conf := http3.ConfigureTLSConfig(&tls.Config{
+		GetConfigForClient: p.forwardH3Config,
+	})
+
+	p.errGroup.Go(func() error {
+		lsn, err := quic.ListenEarly(pc, conf, &quic.Config{})
+		if err != nil {
+			return err
+		}
+
+		err = h3s.ServeListener(lsn)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		return err
+	})
+}
+
+// forwardH3Config returns the current tls.Config of the forward proxy
+func (p *Proxy) forwardH3Config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if f := p.current().forward; f != nil && f.tls != nil {
+		return f.tls, nil
+	}
+	return nil, errors.New("not forwarding")
+}
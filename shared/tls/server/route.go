@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/acl"
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// Mode is how a route handles the TLS connections
+type Mode string
+
+const (
+	// ModePassthrough forwards the TLS stream untouched
+	ModePassthrough Mode = "passthrough"
+	// ModePlaintext terminates TLS and forwards the decrypted stream
+	ModePlaintext Mode = "plaintext"
+	// ModeReencrypt terminates TLS and forwards the stream over a
+	// new TLS connection, negotiating ALPN with the upstream first
+	ModeReencrypt Mode = "reencrypt"
+	// ModeHTTP terminates TLS and reverse proxies HTTP/1.1 and h2
+	// requests to the upstream
+	ModeHTTP Mode = "http"
+)
+
+// Terminates tells if the Mode requires completing the handshake
+func (m Mode) Terminates() bool {
+	return m != ModePassthrough
+}
+
+// dialsFirst tells if the upstream is dialed before
+// the handshake with the client
+func (m Mode) dialsFirst() bool {
+	return m == ModePassthrough || m == ModeReencrypt
+}
+
+func parseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return ModePassthrough, nil
+	case ModePassthrough, ModePlaintext, ModeReencrypt, ModeHTTP:
+		return m, nil
+	default:
+		return "", core.Wrap(core.ErrInvalid, fmt.Sprintf("invalid mode %q", s))
+	}
+}
+
+// RouteConfig maps a list of server names to a named upstream.
+// Names can be exact or wildcards of the form `*.example.com`.
+type RouteConfig struct {
+	ServerNames []string `hcl:"server_names"`
+	Upstream    string   `hcl:"upstream"`
+
+	// Mode is one of passthrough, plaintext, reencrypt or http
+	Mode string `hcl:"mode,optional"`
+	// ALPN is the list of protocols offered to clients when
+	// terminating in plaintext or http modes
+	ALPN []string `hcl:"alpn,optional"`
+	// UpstreamTLS enables TLS towards the upstream in http mode
+	UpstreamTLS bool `hcl:"upstream_tls,optional"`
+	// UpstreamServerName is the name verified on the upstream's
+	// certificate. Defaults to the client's SNI
+	UpstreamServerName string `hcl:"upstream_server_name,optional"`
+
+	// MatchALPN restricts the route to clients offering
+	// any of these ALPN protocols
+	MatchALPN []string `hcl:"match_alpn,optional"`
+	// MatchTLSVersions restricts the route to clients whose
+	// highest TLS version is one of these, 1.0 to 1.3
+	MatchTLSVersions []string `hcl:"match_tls_versions,optional"`
+	// MatchFingerprints restricts the route to clients with
+	// any of these JA3 or JA4 fingerprints
+	MatchFingerprints []string `hcl:"match_fingerprints,optional"`
+
+	// IdleTimeout closes connections not moving data in either
+	// direction for this long. Not used in http mode
+	IdleTimeout string `hcl:"idle_timeout,optional"`
+	// MaxLifetime closes connections forwarded for this long.
+	// Not used in http mode
+	MaxLifetime string `hcl:"max_lifetime,optional"`
+	// Bandwidth limits the bytes per second of all the
+	// connections of the route together
+	Bandwidth int64 `hcl:"bandwidth,optional"`
+	// ConnBandwidth limits the bytes per second of each
+	// direction of each connection
+	ConnBandwidth int64 `hcl:"conn_bandwidth,optional"`
+
+	// Allow are the client addresses or CIDR prefixes that
+	// can use the route. If empty everyone not denied can
+	Allow []string `hcl:"allow,optional"`
+	// Deny are the client addresses or CIDR prefixes that
+	// can't use the route. The most specific prefix wins
+	Deny []string `hcl:"deny,optional"`
+
+	// Mirror copies the traffic of the route to a shadow upstream
+	Mirror *MirrorConfig `hcl:"mirror,block"`
+}
+
+// MirrorConfig describes the shadow upstream receiving a copy
+// of the traffic of a route, whose responses are discarded.
+// http routes duplicate requests, others copy what clients send
+// after TLS termination. passthrough routes can't be mirrored
+type MirrorConfig struct {
+	Upstream string `hcl:"upstream"`
+	// Percent of the requests or connections mirrored,
+	// all if omitted. Zero disables the mirror
+	Percent *float64 `hcl:"percent,optional"`
+	// BufferSize is the most bytes queued for the shadow
+	// of each connection. Not used in http mode
+	BufferSize int `hcl:"buffer_size,optional"`
+	// MaxBodySize is the largest request body mirrored.
+	// Only used in http mode
+	MaxBodySize int64 `hcl:"max_body_size,optional"`
+}
+
+// Route is the resolved destination of a connection
+type Route struct {
+	Upstream *proxy.Pool
+	Mode     Mode
+
+	// NextProtos offered to clients when terminating
+	NextProtos []string
+	// UpstreamServerName is the name verified on the upstream's
+	// certificate when re-encrypting
+	UpstreamServerName string
+
+	handler http.Handler
+	forward []proxy.ForwardOption
+	match   routeMatch
+	acl     *acl.List
+}
+
+func newRoute(up *proxy.Pool, rc *RouteConfig, upstreamTLS *tls.Config) (*Route, error) {
+	mode, err := parseMode(rc.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := newRouteMatch(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := acl.New(rc.Allow, rc.Deny)
+	if err != nil {
+		return nil, core.Wrap(err, "acl")
+	}
+
+	r := &Route{
+		Upstream:           up,
+		Mode:               mode,
+		NextProtos:         rc.ALPN,
+		UpstreamServerName: rc.UpstreamServerName,
+
+		match: match,
+		acl:   list,
+	}
+
+	if mode == ModeHTTP {
+		if err := r.setupHTTP(rc.UpstreamTLS, upstreamTLS); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.setupForward(rc); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Route) setupHTTP(useTLS bool, upstreamTLS *tls.Config) error {
+	if len(r.NextProtos) == 0 {
+		r.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	for _, proto := range r.NextProtos {
+		if proto != "h2" && proto != "http/1.1" {
+			return fmt.Errorf("http mode doesn't support %q", proto)
+		}
+	}
+
+	var conf *tls.Config
+	if pc := r.Upstream.TLSConfig(); pc != nil {
+		// the upstream speaks TLS
+		conf = pc
+	} else if useTLS {
+		conf = upstreamTLS.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+	}
+
+	if conf != nil {
+		conf.ServerName = core.Coalesce(r.UpstreamServerName, conf.ServerName)
+		if conf.ServerName == "" {
+			return fmt.Errorf("upstream TLS requires a server name")
+		}
+	}
+
+	r.handler = proxy.NewReverseProxy(r.Upstream, conf)
+	return nil
+}
+
+// setupForward prepares the limits applied to the
+// connections forwarded by the route
+func (r *Route) setupForward(rc *RouteConfig) error {
+	var idle, lifetime time.Duration
+
+	if err := ParseDuration(rc.IdleTimeout, &idle); err != nil {
+		return core.Wrap(err, "idle_timeout")
+	} else if err := ParseDuration(rc.MaxLifetime, &lifetime); err != nil {
+		return core.Wrap(err, "max_lifetime")
+	}
+
+	r.forward = []proxy.ForwardOption{
+		proxy.WithIdleTimeout(idle, idle),
+		proxy.WithMaxLifetime(lifetime),
+		proxy.WithBandwidth(rc.ConnBandwidth),
+		// shared by all connections of the route
+		proxy.WithLimiter(proxy.NewLimiter(rc.Bandwidth, 0)),
+		proxy.WithStats(logStats),
+	}
+	return nil
+}
+
+// setupMirror copies the traffic of the route to
+// a shadow upstream
+func (r *Route) setupMirror(mc *MirrorConfig, pools map[string]*proxy.Pool) error {
+	percent := 100.
+	if mc.Percent != nil {
+		percent = *mc.Percent
+	}
+
+	shadow, ok := pools[mc.Upstream]
+	switch {
+	case !ok:
+		return fmt.Errorf("mirror to unknown upstream %q", mc.Upstream)
+	case r.Mode == ModePassthrough:
+		return errors.New("passthrough routes can't be mirrored")
+	case percent < 0 || percent > 100:
+		return fmt.Errorf("invalid mirror percent %v", percent)
+	case percent == 0:
+		// disabled
+		return nil
+	}
+
+	if r.Mode == ModeHTTP {
+		cfg := &proxy.HTTPMirrorConfig{
+			Shadow:      shadow,
+			TLSConfig:   shadow.TLSConfig(),
+			Percent:     percent,
+			MaxBodySize: mc.MaxBodySize,
+		}
+
+		h, err := cfg.New(r.handler)
+		if err != nil {
+			return err
+		}
+		r.handler = h
+		return nil
+	}
+
+	conf := shadow.TLSConfig()
+	if conf != nil {
+		conf.ServerName = core.Coalesce(conf.ServerName, r.UpstreamServerName)
+		if conf.ServerName == "" {
+			return fmt.Errorf("mirror upstream TLS requires a server name")
+		}
+	}
+
+	r.forward = append(r.forward, proxy.WithMirror(&proxy.Mirror{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			conn, err := shadow.Dial(ctx, proxy.Hint{})
+			if err != nil || conf == nil {
+				return conn, err
+			}
+			// the shadow speaks TLS
+			return tls.Client(conn, conf), nil
+		},
+		Percent:    percent,
+		BufferSize: mc.BufferSize,
+	}))
+	return nil
+}
+
+// logStats logs the counters of a forwarded connection.
+// Errors are logged by the handler
+func logStats(st proxy.Stats) {
+	log.Printf("%s: closed after %s, %v bytes sent, %v received",
+		st.Client, st.Duration.Round(time.Millisecond), st.Sent, st.Received)
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/x509utils"
+)
+
+// Router resolves the route for a given SNI server name and,
+// optionally, other properties of the ClientHello
+type Router struct {
+	exact    map[string][]*Route
+	suffixes map[string][]*Route
+	fallback *Route
+	pools    []*proxy.Pool
+
+	http   *Router
+	ssh    *Route
+	tunnel *tunnelRoutes
+}
+
+// NewRouter builds a Router from the upstreams and routes of a ProxyConfig.
+// The optional store provides the CAs verifying upstreams and their
+// client certificates
+func NewRouter(pc *ProxyConfig, store storage.Store) (*Router, error) {
+	pools, list, err := newPools(pc.Upstreams, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var upstreamTLS *tls.Config
+	if store != nil {
+		upstreamTLS = &tls.Config{
+			RootCAs: store.GetCAPool(),
+		}
+	}
+
+	r, err := newRouter(pools, pc.Routes, pc.DefaultRoute, pc.DefaultMode, upstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+	r.pools = list
+
+	r.http, err = newRouter(pools, pc.HTTPRoutes, pc.HTTPDefaultRoute, "", nil)
+	if err != nil {
+		return nil, core.Wrap(err, "http")
+	} else if r.http.Terminates() {
+		return nil, errors.New("http routes can't terminate TLS")
+	}
+
+	if pc.SSHUpstream != "" {
+		up, ok := pools[pc.SSHUpstream]
+		if !ok {
+			return nil, fmt.Errorf("ssh: unknown upstream %q", pc.SSHUpstream)
+		}
+
+		r.ssh, err = newRoute(up, &RouteConfig{Upstream: pc.SSHUpstream}, nil)
+		if err != nil {
+			return nil, core.Wrap(err, "ssh")
+		}
+	}
+
+	return r, nil
+}
+
+func newPools(upstreams []UpstreamConfig, store storage.Store) (map[string]*proxy.Pool, []*proxy.Pool, error) {
+	pools := make(map[string]*proxy.Pool, len(upstreams))
+	list := make([]*proxy.Pool, 0, len(upstreams))
+
+	for i := range upstreams {
+		up, err := upstreams[i].newPool(store)
+		if err != nil {
+			return nil, nil, err
+		} else if _, dup := pools[up.Name()]; dup {
+			return nil, nil, fmt.Errorf("upstream %q: duplicated", up.Name())
+		}
+		pools[up.Name()] = up
+		list = append(list, up)
+	}
+
+	return pools, list, nil
+}
+
+func newRouter(pools map[string]*proxy.Pool, routes []RouteConfig,
+	defaultRoute, defaultMode string, upstreamTLS *tls.Config) (*Router, error) {
+	//
+	r := &Router{
+		exact:    make(map[string][]*Route),
+		suffixes: make(map[string][]*Route),
+	}
+
+	for i := range routes {
+		rc := &routes[i]
+
+		up, ok := pools[rc.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("route to unknown upstream %q", rc.Upstream)
+		}
+
+		route, err := newRoute(up, rc, upstreamTLS)
+		if err != nil {
+			return nil, fmt.Errorf("route to %q: %w", rc.Upstream, err)
+		}
+
+		if rc.Mirror != nil {
+			if err := route.setupMirror(rc.Mirror, pools); err != nil {
+				return nil, fmt.Errorf("route to %q: %w", rc.Upstream, err)
+			}
+		}
+
+		for _, name := range rc.ServerNames {
+			if err := r.add(name, route); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if defaultRoute != "" {
+		up, ok := pools[defaultRoute]
+		if !ok {
+			return nil, fmt.Errorf("default route to unknown upstream %q", defaultRoute)
+		}
+
+		route, err := newRoute(up, &RouteConfig{Mode: defaultMode}, upstreamTLS)
+		if err != nil {
+			return nil, fmt.Errorf("default route: %w", err)
+		}
+		r.fallback = route
+	}
+
+	return r, nil
+}
+
+func (r *Router) add(name string, route *Route) error {
+	var m map[string][]*Route
+
+	key, isPattern, ok := routeKey(name)
+	switch {
+	case !ok:
+		return core.Wrap(core.ErrInvalid, fmt.Sprintf("route: invalid server name %q", name))
+	case isPattern:
+		m = r.suffixes
+	default:
+		m = r.exact
+	}
+
+	routes := m[key]
+	for _, prev := range routes {
+		switch {
+		case prev == route:
+			return nil
+		case !prev.Conditional() && !route.Conditional():
+			return fmt.Errorf("route %q: conflicting upstreams %q and %q", name,
+				prev.Upstream.Name(), route.Upstream.Name())
+		}
+	}
+
+	// conditional routes are tried in order, before
+	// the unconditional one
+	if n := len(routes); n > 0 && !routes[n-1].Conditional() {
+		m[key] = slices.Insert(routes, n-1, route)
+	} else {
+		m[key] = append(routes, route)
+	}
+	return nil
+}
+
+// routeKey converts a configured server name into the form
+// used for matching, following the rules of certificate names
+func routeKey(name string) (key string, isPattern bool, ok bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if strings.HasPrefix(name, "*.") {
+		// pattern
+		suffix := name[1:]
+		return suffix, true, len(suffix) > 1 && !strings.Contains(suffix[1:], "*")
+	}
+
+	return sanitisedName(name)
+}
+
+// sanitisedName prepares an SNI server name for exact matching
+func sanitisedName(name string) (string, bool, bool) {
+	name, ok := x509utils.SanitiseName(strings.TrimSuffix(strings.ToLower(name), "."))
+	if !ok || strings.Contains(name, "*") {
+		return "", false, false
+	}
+
+	if s, ok := x509utils.NameAsIP(name); ok {
+		return s, false, true
+	}
+	return name, false, true
+}
+
+// Pools returns all the upstream pools of the Router
+func (r *Router) Pools() []*proxy.Pool {
+	return r.pools
+}
+
+// Upstream returns the upstream pool with the given name
+func (r *Router) Upstream(name string) (*proxy.Pool, bool) {
+	for _, pool := range r.pools {
+		if pool.Name() == name {
+			return pool, true
+		}
+	}
+	return nil, false
+}
+
+// HTTP returns the Router for plaintext HTTP connections,
+// routed by their Host header
+func (r *Router) HTTP() *Router {
+	return r.http
+}
+
+// SSH returns the route for SSH connections, if any
+func (r *Router) SSH() (*Route, bool) {
+	return r.ssh, r.ssh != nil
+}
+
+// Terminates tells if any route needs to complete the TLS handshake
+func (r *Router) Terminates() bool {
+	if r.fallback != nil && r.fallback.Mode.Terminates() {
+		return true
+	}
+
+	return r.anyRoute(func(route *Route) bool {
+		return route.Mode.Terminates()
+	})
+}
+
+// anyRoute tells if any route satisfies the condition
+func (r *Router) anyRoute(cond func(*Route) bool) bool {
+	for _, m := range []map[string][]*Route{r.exact, r.suffixes} {
+		for _, routes := range m {
+			if slices.ContainsFunc(routes, cond) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Lookup finds the route for a server name, falling back
+// to the default route if there is one. Conditional routes
+// are skipped
+func (r *Router) Lookup(serverName string) (*Route, bool) {
+	return r.Match(&ClientInfo{ServerName: serverName})
+}
+
+// Match finds the first route for the server name of the
+// client whose conditions are met, then for hostnames
+// served by tunnels, falling back to the default route
+// if there is one
+func (r *Router) Match(ci *ClientInfo) (*Route, bool) {
+	if name, _, ok := sanitisedName(ci.ServerName); ok {
+		if route, ok := matchRoutes(r.exact[name], ci); ok {
+			return route, true
+		}
+
+		if suffix, ok := x509utils.NameAsSuffix(name); ok {
+			if route, ok := matchRoutes(r.suffixes[suffix], ci); ok {
+				return route, true
+			}
+		}
+
+		if route, ok := r.tunnel.match(name); ok && route.Matches(ci) {
+			return route, true
+		}
+	}
+
+	return r.fallback, r.fallback != nil
+}
+
+func matchRoutes(routes []*Route, ci *ClientInfo) (*Route, bool) {
+	for _, route := range routes {
+		if route.Matches(ci) {
+			return route, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,178 @@
+package server
+
+import "testing"
+
+func TestRouterLookup(t *testing.T) {
+	upstreams := []UpstreamConfig{
+		{Name: "web", Servers: []string{"10.0.0.1:443"}},
+		{Name: "api", Servers: []string{"10.0.0.2:443"}},
+		{Name: "fallback", Servers: []string{"10.0.0.3:443"}},
+	}
+	routes := []RouteConfig{
+		{ServerNames: []string{"example.com", "*.example.com"}, Upstream: "web"},
+		{ServerNames: []string{"api.example.com", "192.0.2.1"}, Upstream: "api"},
+	}
+
+	pc := &ProxyConfig{Upstreams: upstreams, Routes: routes}
+	r, err := NewRouter(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		upstream string
+	}{
+		{"example.com", "web"},
+		{"EXAMPLE.com.", "web"},
+		{"www.example.com", "web"},
+		{"api.example.com", "api"},
+		{"192.0.2.1", "api"},
+		{"a.b.example.com", ""},
+		{"example.org", ""},
+		{"", ""},
+	} {
+		up, ok := r.Lookup(tc.name)
+		switch {
+		case tc.upstream == "" && ok:
+			t.Errorf("%q: unexpected route to %q", tc.name, up.Upstream.Name())
+		case tc.upstream != "" && !ok:
+			t.Errorf("%q: no route (expected %q)", tc.name, tc.upstream)
+		case ok && up.Upstream.Name() != tc.upstream:
+			t.Errorf("%q: routed to %q (expected %q)", tc.name, up.Upstream.Name(), tc.upstream)
+		}
+	}
+
+	pc.DefaultRoute = "fallback"
+	r, err = NewRouter(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if up, ok := r.Lookup("example.org"); !ok || up.Upstream.Name() != "fallback" {
+		t.Error("example.org: default route not used")
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	upstreams := []UpstreamConfig{
+		{Name: "web", Servers: []string{"10.0.0.1:443"}},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		routes []RouteConfig
+		def    string
+	}{
+		{"unknown upstream", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "api"}}, ""},
+		{"unknown default", nil, "api"},
+		{"bad pattern", []RouteConfig{{ServerNames: []string{"*.*.a.com"}, Upstream: "web"}}, ""},
+		{"conflict", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "web"},
+			{ServerNames: []string{"a.com"}, Upstream: "web", Mode: "plaintext"}}, ""},
+		{"bad version", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "web",
+			MatchTLSVersions: []string{"1.4"}}}, ""},
+		{"bad acl", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "web",
+			Deny: []string{"10.0.0.0/33"}}}, ""},
+		{"bad mode", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "web", Mode: "magic"}}, ""},
+		{"bad alpn", []RouteConfig{{ServerNames: []string{"a.com"}, Upstream: "web", Mode: "http",
+			ALPN: []string{"h3"}}}, ""},
+	} {
+		pc := &ProxyConfig{Upstreams: upstreams, Routes: tc.routes, DefaultRoute: tc.def}
+		if _, err := NewRouter(pc, nil); err == nil {
+			t.Errorf("%s: error expected", tc.name)
+		}
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	upstreams := []UpstreamConfig{
+		{Name: "web", Servers: []string{"10.0.0.1:443"}},
+		{Name: "grpc", Servers: []string{"10.0.0.2:443"}},
+		{Name: "legacy", Servers: []string{"10.0.0.3:443"}},
+		{Name: "tarpit", Servers: []string{"10.0.0.4:443"}},
+	}
+	routes := []RouteConfig{
+		{ServerNames: []string{"example.com"}, Upstream: "web"},
+		{ServerNames: []string{"example.com"}, Upstream: "grpc", MatchALPN: []string{"h2"}},
+		{ServerNames: []string{"example.com"}, Upstream: "legacy", MatchTLSVersions: []string{"1.0", "1.1"}},
+		{ServerNames: []string{"*.example.com"}, Upstream: "tarpit",
+			MatchFingerprints: []string{"T13D1516H2_8DAAF6152771_B0DA82DD1658"}},
+	}
+
+	r, err := NewRouter(&ProxyConfig{Upstreams: upstreams, Routes: routes}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		ci       ClientInfo
+		upstream string
+	}{
+		{ClientInfo{ServerName: "example.com", Version: 0x0304}, "web"},
+		{ClientInfo{ServerName: "example.com", Version: 0x0304, ALPN: []string{"h2", "http/1.1"}}, "grpc"},
+		{ClientInfo{ServerName: "example.com", Version: 0x0302, ALPN: []string{"http/1.1"}}, "legacy"},
+		{ClientInfo{ServerName: "www.example.com", JA4: "t13d1516h2_8daaf6152771_b0da82dd1658"}, "tarpit"},
+		{ClientInfo{ServerName: "www.example.com", JA4: "t13d1516h2_000000000000_000000000000"}, ""},
+	} {
+		up, ok := r.Match(&tc.ci)
+		switch {
+		case tc.upstream == "" && ok:
+			t.Errorf("%v: unexpected route to %q", i, up.Upstream.Name())
+		case tc.upstream != "" && !ok:
+			t.Errorf("%v: no route (expected %q)", i, tc.upstream)
+		case ok && up.Upstream.Name() != tc.upstream:
+			t.Errorf("%v: routed to %q (expected %q)", i, up.Upstream.Name(), tc.upstream)
+		}
+	}
+}
+
+func TestRouterMirror(t *testing.T) {
+	upstreams := []UpstreamConfig{
+		{Name: "web", Servers: []string{"10.0.0.1:443"}},
+		{Name: "shadow", Servers: []string{"10.0.0.2:443"}},
+	}
+	pct := func(v float64) *float64 { return &v }
+
+	r, err := NewRouter(&ProxyConfig{Upstreams: upstreams, Routes: []RouteConfig{
+		{ServerNames: []string{"a.com"}, Upstream: "web", Mode: "plaintext"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, _ := r.Lookup("a.com")
+	plain := len(route.forward)
+
+	for _, tc := range []struct {
+		name     string
+		mode     string
+		percent  *float64
+		mirrored bool
+		invalid  bool
+	}{
+		{"omitted", "plaintext", nil, true, false},
+		{"half", "plaintext", pct(50), true, false},
+		{"zero", "plaintext", pct(0), false, false},
+		{"negative", "plaintext", pct(-1), false, true},
+		{"too large", "plaintext", pct(101), false, true},
+		{"passthrough", "passthrough", nil, false, true},
+	} {
+		pc := &ProxyConfig{Upstreams: upstreams, Routes: []RouteConfig{
+			{ServerNames: []string{"a.com"}, Upstream: "web", Mode: tc.mode,
+				Mirror: &MirrorConfig{Upstream: "shadow", Percent: tc.percent}},
+		}}
+
+		r, err := NewRouter(pc, nil)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%s: error expected", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		route, _ := r.Lookup("a.com")
+		if mirrored := len(route.forward) > plain; mirrored != tc.mirrored {
+			t.Errorf("%s: mirrored %v (expected %v)", tc.name, mirrored, tc.mirrored)
+		}
+	}
+}
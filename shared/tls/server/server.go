@@ -2,9 +2,9 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,216 +13,524 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/sync/errgroup"
 
-	"darvaza.org/x/tls/sni"
-)
+	"darvaza.org/core"
 
-type emptyStruct struct{}
+	"darvaza.org/darvaza/shared/net/acl"
+	"darvaza.org/darvaza/shared/net/quic"
+	"darvaza.org/darvaza/shared/net/sniff"
+	"darvaza.org/darvaza/shared/net/tunnel"
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/storage/simple"
+)
 
 // ProxyConfig is a configuration for a TLSproxy.
 type ProxyConfig struct {
+	// Protocol is "http" to route connections to the
+	// upstreams, or "forward" to serve Forward
 	Protocol   string   `default:"http" hcl:"protocol,label"`
 	ListenAddr []string `default:"[\":8080\"]" hcl:"listen"`
+
+	// Upstreams are the named pools of servers connections
+	// are forwarded to
+	Upstreams []UpstreamConfig `hcl:"upstream,block"`
+	// Routes map SNI server names to upstreams
+	Routes []RouteConfig `hcl:"route,block"`
+	// DefaultRoute is the upstream used for unknown names.
+	// If empty those connections get an unrecognized_name alert
+	DefaultRoute string `hcl:"default_route,optional"`
+	// DefaultMode is the Mode of the default route
+	DefaultMode string `hcl:"default_mode,optional"`
+
+	// HTTPRoutes map plaintext HTTP/1.x connections to upstreams
+	// by the Host header of their first request
+	HTTPRoutes []RouteConfig `hcl:"http_route,block"`
+	// HTTPDefaultRoute is the upstream for plaintext HTTP connections
+	// with unknown Host, and for HTTP/2 prior-knowledge ones
+	HTTPDefaultRoute string `hcl:"http_default_route,optional"`
+	// SSHUpstream is the upstream for SSH connections
+	SSHUpstream string `hcl:"ssh_upstream,optional"`
+	// ProxyProtocol enables accepting PROXY protocol headers
+	// from the clients
+	ProxyProtocol bool `hcl:"proxy_protocol,optional"`
+	// StartTLS are listeners of protocols negotiating TLS
+	// after a plaintext preamble
+	StartTLS []StartTLSConfig `hcl:"starttls,block"`
+	// Forward is the forward proxy served on the listeners
+	// of the "forward" Protocol
+	Forward *ForwardConfig `hcl:"forward,block"`
+	// Tunnel are listeners where agents open reverse tunnels
+	// for the hostnames they serve
+	Tunnel *TunnelConfig `hcl:"tunnel,block"`
+	// ListenQUIC are the UDP addresses where QUIC connections
+	// are routed by SNI to passthrough routes or, on proxies
+	// of the "forward" Protocol, HTTP/3 CONNECT is served
+	ListenQUIC []string `hcl:"listen_quic,optional"`
+	// DrainTimeout is how long active connections are given
+	// to finish when the proxy is cancelled
+	DrainTimeout string `hcl:"drain_timeout,optional"`
+
+	// Allow are the client addresses or CIDR prefixes accepted
+	// by the listeners. If empty everyone not denied is
+	Allow []string `hcl:"allow,optional"`
+	// Deny are the client addresses or CIDR prefixes rejected
+	// by the listeners. The most specific prefix wins
+	Deny []string `hcl:"deny,optional"`
+
+	// Certificates are PEM contents, files or directories to
+	// load into a Store when none is provided
+	Certificates []string `hcl:"certificates,optional"`
+	// Store provides the certificates of terminating routes,
+	// and the CAs used to verify upstreams
+	Store storage.Store
 }
 
 // Proxy implements a TLSproxy.
 type Proxy struct {
 	errGroup    *errgroup.Group
 	errCtx      context.Context
+	ctx         context.Context
 	cancel      context.CancelFunc
 	inShutdown  int32
 	mu          sync.Mutex
-	listeners   map[net.Listener]emptyStruct
-	activeConns map[net.Conn]emptyStruct
-	tlsHandler  func(net.Conn)
+	running     bool
+	config      *ProxyConfig
+	listeners   map[string]net.Listener
+	packetConns map[string]net.PacketConn
+	relay       *quic.Relay
+	h3          map[net.PacketConn]*http3.Server
+	tunnel      *tunnel.Edge
+	conns       map[any]context.CancelFunc
+	connsWG     sync.WaitGroup
+	tlsHandler  func(context.Context, net.Conn)
+	state       atomic.Pointer[proxyState]
 }
 
-func (p *Proxy) shuttingDown() bool {
-	return atomic.LoadInt32(&p.inShutdown) != 0
+// proxyState is the part of a Proxy replaced when
+// the configuration is reloaded
+type proxyState struct {
+	router *Router
+	store  storage.Store
+	mux    *sniff.Mux
+	acl    *acl.List
+	cancel context.CancelFunc
+
+	// forward is the forward proxy, if any
+	forward *forwarder
+
+	// startTLS are the preambles of the StartTLS
+	// listeners, by address
+	startTLS map[string]*startTLS
+	// tunnelTLS accepts agents on the tunnelListen
+	// addresses, if enabled
+	tunnelTLS    *tls.Config
+	tunnelListen []string
+
+	drainTimeout time.Duration
 }
 
-func (p *Proxy) trackL(ln net.Listener) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.listeners == nil {
-		p.listeners = make(map[net.Listener]emptyStruct)
-	}
-	if !p.shuttingDown() {
-		if _, found := p.listeners[ln]; !found {
-			p.listeners[ln] = emptyStruct{}
-		} else {
-			delete(p.listeners, ln)
-		}
+// start runs the health checks of the upstreams until
+// the state is stopped
+func (st *proxyState) start(ctx context.Context) {
+	ctx, st.cancel = context.WithCancel(ctx)
+
+	for _, pool := range st.router.Pools() {
+		go func() {
+			if err := pool.Run(ctx); err != nil {
+				log.Printf("upstream %q: %s", pool.Name(), err)
+			}
+		}()
 	}
 }
 
-func (p *Proxy) trackConn(c net.Conn) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.activeConns == nil {
-		p.activeConns = make(map[net.Conn]emptyStruct)
+// stop stops the health checks of a started state
+func (st *proxyState) stop() {
+	if st != nil && st.cancel != nil {
+		st.cancel()
 	}
+}
 
-	if !p.shuttingDown() {
-		if _, found := p.activeConns[c]; !found {
-			p.activeConns[c] = emptyStruct{}
-		} else {
-			delete(p.activeConns, c)
-		}
-	}
+func (p *Proxy) shuttingDown() bool {
+	return atomic.LoadInt32(&p.inShutdown) != 0
+}
+
+func (p *Proxy) current() *proxyState {
+	return p.state.Load()
 }
 
 // New returns a pointer to a TLSproxy created from a TLSproxy configuration.
-func (pc *ProxyConfig) New() *Proxy {
-	var p = new(Proxy)
+func (pc *ProxyConfig) New() (*Proxy, error) {
+	var p = &Proxy{
+		config: pc,
+	}
+
+	// the Edge survives reloads, keeping the tunnels
+	edge, err := p.newEdge()
+	if err != nil {
+		return nil, err
+	}
+	p.tunnel = edge
+
+	st, err := p.newState(pc)
+	if err != nil {
+		return nil, err
+	}
+	p.state.Store(st)
+
+	p.relay, err = (&quic.RelayConfig{Route: p.routeQUIC}).New()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := p.listenNew(pc.listenAddrs())
+	if err != nil {
+		return nil, err
+	}
+
+	packetConns, err := p.listenNewQUIC(pc.ListenQUIC)
+	if err != nil {
+		closeAll(listeners)
+		return nil, err
+	}
+	p.listeners, p.packetConns = listeners, packetConns
 
 	ctx, cancel := context.WithCancel(context.Background())
-	p.cancel = cancel
+	p.ctx, p.cancel = ctx, cancel
 	p.errGroup, p.errCtx = errgroup.WithContext(ctx)
 
-	for _, laddr := range pc.ListenAddr {
-		// TODO: do we want UDP/IP and or others?
-		l, err := net.Listen("tcp", laddr)
-		if err != nil {
-			log.Printf("cannot listen on %s.\n %q\n", laddr, err)
-			continue
-		}
-		p.trackL(l)
+	p.tlsHandler = p.handleConn
+	return p, nil
+}
+
+// Validate checks the configuration can be used to
+// create or reload a Proxy
+func (pc *ProxyConfig) Validate() error {
+	_, err := new(Proxy).newState(pc)
+	return err
+}
+
+func (p *Proxy) newState(pc *ProxyConfig) (*proxyState, error) {
+	store, err := pc.getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	drainTimeout := DefaultDrainTimeout
+	if err := ParseDuration(pc.DrainTimeout, &drainTimeout); err != nil {
+		return nil, core.Wrap(err, "drain_timeout")
+	}
+
+	list, err := acl.New(pc.Allow, pc.Deny)
+	if err != nil {
+		return nil, core.Wrap(err, "acl")
+	}
+
+	router, err := NewRouter(pc, store)
+	if err != nil {
+		return nil, err
+	} else if store == nil && router.Terminates() {
+		return nil, errors.New("terminating routes require certificates")
+	}
+
+	starts, err := newStartTLS(pc, router, store != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelTLS, err := newTunnelState(pc, router, store, p.tunnel)
+	if err != nil {
+		return nil, core.Wrap(err, "tunnel")
+	}
+
+	fwd, err := newForwarder(pc, store)
+	if err != nil {
+		return nil, err
 	}
-	p.tlsHandler = defaultTLSHandler
-	return p
+
+	mux := p.newMux(router, pc.ProxyProtocol, list)
+	if fwd != nil {
+		mux = fwd.newMux(pc.ProxyProtocol, list)
+	}
+
+	return &proxyState{
+		router: router,
+		store:  store,
+		mux:    mux,
+		acl:    list,
+
+		forward: fwd,
+
+		startTLS:     starts,
+		tunnelTLS:    tunnelTLS,
+		tunnelListen: pc.tunnelAddrs(),
+
+		drainTimeout: drainTimeout,
+	}, nil
 }
 
-// TODO: fix revive
-//revive:disable:cognitive-complexity
+// listenAddrs returns the TCP addresses of all listeners
+func (pc *ProxyConfig) listenAddrs() []string {
+	addrs := append([]string{}, pc.ListenAddr...)
+	for _, s := range pc.StartTLS {
+		addrs = append(addrs, s.Listen...)
+	}
+	return append(addrs, pc.tunnelAddrs()...)
+}
+
+// tunnelAddrs returns the TCP addresses of the
+// tunnel listeners
+func (pc *ProxyConfig) tunnelAddrs() []string {
+	if pc.Tunnel == nil {
+		return nil
+	}
+	return pc.Tunnel.Listen
+}
+
+func (pc *ProxyConfig) getStore() (storage.Store, error) {
+	switch {
+	case pc.Store != nil:
+		return pc.Store, nil
+	case len(pc.Certificates) > 0:
+		return simple.New(pc.Certificates...)
+	default:
+		return nil, nil
+	}
+}
 
 // Run is starting a TLSproxy that accepts connections.
 func (p *Proxy) Run() error {
-	//revive:enable:cognitive:complexity
-	for lsn := range p.listeners {
-		p.errGroup.Go(func() error {
-			for {
-				if p.shuttingDown() {
-					return fmt.Errorf("server shutting down")
-				}
-				conn, err := (lsn).Accept()
-				if err != nil {
-					select {
-					case <-p.errCtx.Done():
-						return fmt.Errorf("server shutting down")
-					default:
-						return err
-					}
-				}
-				p.trackConn(conn)
-				go p.tlsHandler(conn)
-			}
-		})
+	p.mu.Lock()
+	p.running = true
+	p.current().start(p.ctx)
+	for laddr, lsn := range p.listeners {
+		p.serve(laddr, lsn)
 	}
+	for _, pc := range p.packetConns {
+		p.serveQUIC(pc)
+	}
+	p.mu.Unlock()
+
 	return p.errGroup.Wait()
 }
 
-//revive:disable:cognitive-complexity
+// serve accepts connections on a listener until
+// it's closed
+func (p *Proxy) serve(laddr string, lsn net.Listener) {
+	p.errGroup.Go(func() error {
+		for {
+			if p.shuttingDown() {
+				return fmt.Errorf("server shutting down")
+			}
+			conn, err := lsn.Accept()
+			switch {
+			case err == nil:
+				p.handle(laddr, conn)
+			case p.errCtx.Err() != nil:
+				return fmt.Errorf("server shutting down")
+			case !p.isListening(laddr, lsn):
+				// removed by Apply
+				return nil
+			default:
+				return err
+			}
+		}
+	})
+}
+
+func (p *Proxy) isListening(laddr string, lsn net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listeners[laddr] == lsn
+}
+
 func (p *Proxy) closeListeners() error {
-	//revive:enable:cognitive-complexity
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	var err error
-	for ln := range p.listeners {
-		cerr := ln.Close()
-		if cerr != nil {
-			if cerr.(*net.OpError).Unwrap().Error() != "use of closed network connection" {
-				if err == nil {
-					err = cerr
-				}
-			}
+	for laddr, ln := range p.listeners {
+		if cerr := ln.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
 		}
-		p.trackL(ln)
+		delete(p.listeners, laddr)
+	}
+
+	if cerr := p.closePacketConns(nil); err == nil {
+		err = cerr
 	}
 	return err
 }
 
-// Reload wil re-read the configuration of a TLSproxy and apply it.
-func (*Proxy) Reload() error {
-	// TODO: For now this is a no-op that returns nil.
+// Apply replaces the configuration of the Proxy. Listeners
+// no longer configured are closed, letting their connections
+// finish, new ones are opened, and new connections use the
+// new routes. If the configuration can't be applied the
+// Proxy remains unchanged.
+func (p *Proxy) Apply(pc *ProxyConfig) error {
+	st, err := p.newState(pc)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.shuttingDown() {
+		return errors.New("server shutting down")
+	} else if err := p.config.checkProtocolChange(pc); err != nil {
+		return err
+	}
+
+	addrs := pc.listenAddrs()
+	added, err := p.listenNew(addrs)
+	if err != nil {
+		return err
+	}
+
+	addedQUIC, err := p.listenNewQUIC(pc.ListenQUIC)
+	if err != nil {
+		closeAll(added)
+		return err
+	}
+
+	if p.running {
+		st.start(p.ctx)
+	}
+	p.state.Swap(st).stop()
+	p.config = pc
+
+	p.addListeners(added)
+	p.addPacketConns(addedQUIC)
+
+	for laddr, lsn := range p.listeners {
+		if !core.SliceContains(addrs, laddr) {
+			delete(p.listeners, laddr)
+			_ = lsn.Close()
+		}
+	}
+	_ = p.closePacketConns(pc.ListenQUIC)
 	return nil
 }
 
-// TLSHandler returns the handler function of a TLSproxy.
-func (p *Proxy) TLSHandler(fn func(net.Conn)) {
-	p.tlsHandler = fn
+// checkProtocolChange fails if the QUIC addresses kept would
+// change between relaying and serving HTTP/3, as that's
+// decided when they are opened
+func (pc *ProxyConfig) checkProtocolChange(next *ProxyConfig) error {
+	if pc.forwards() == next.forwards() {
+		return nil
+	}
+
+	for _, laddr := range next.ListenQUIC {
+		if core.SliceContains(pc.ListenQUIC, laddr) {
+			return fmt.Errorf("listen_quic %s: changing the protocol requires a restart", laddr)
+		}
+	}
+	return nil
 }
 
-// Cancel is canceling/shutting down a TLSproxy.
-func (p *Proxy) Cancel() error {
-	defer p.cancel()
+func (p *Proxy) addListeners(added map[string]net.Listener) {
+	for laddr, lsn := range added {
+		p.listeners[laddr] = lsn
+		if p.running {
+			p.serve(laddr, lsn)
+		}
+	}
+}
 
-	atomic.StoreInt32(&p.inShutdown, 1)
+// listenNew opens the listeners not already open. If any
+// fails all those opened are closed
+func (p *Proxy) listenNew(addrs []string) (map[string]net.Listener, error) {
+	added := make(map[string]net.Listener)
+	for _, laddr := range addrs {
+		if _, ok := p.listeners[laddr]; ok {
+			continue
+		}
 
-	for c := range p.activeConns {
-		err := c.Close()
-		if err != nil && err.(*net.OpError).Unwrap().Error() != "use of closed network connection" {
-			log.Println(err)
+		lsn, err := net.Listen("tcp", laddr)
+		if err != nil {
+			closeAll(added)
+			return nil, err
 		}
-		p.trackConn(c)
+		added[laddr] = lsn
 	}
+	return added, nil
+}
 
-	err := p.closeListeners()
-	if err != nil {
-		log.Println(err)
-		return err
+func closeAll[T io.Closer](m map[string]T) {
+	for _, c := range m {
+		_ = c.Close()
+	}
+}
+
+// ApplyAll applies configurations to proxies by position,
+// validating them all first. If one can't be applied the
+// proxies already changed get their previous configuration
+// back, so either all change or none
+func ApplyAll(proxies []*Proxy, configs []ProxyConfig) error {
+	if len(configs) != len(proxies) {
+		return core.Wrap(core.ErrInvalid, fmt.Sprintf("%d configurations for %d proxies",
+			len(configs), len(proxies)))
+	}
+
+	for i := range configs {
+		if err := configs[i].Validate(); err != nil {
+			return core.Wrapf(err, "proxy %v", i)
+		}
 	}
 
+	prev := make([]*ProxyConfig, 0, len(proxies))
+	for i, p := range proxies {
+		p.mu.Lock()
+		pc := p.config
+		p.mu.Unlock()
+
+		if err := p.Apply(&configs[i]); err != nil {
+			restore(proxies, prev)
+			return core.Wrapf(err, "proxy %v", i)
+		}
+		prev = append(prev, pc)
+	}
 	return nil
 }
 
-type prefixConn struct {
-	net.Conn
-	io.Reader
+// restore applies the previous configurations to
+// the first proxies, in reverse order
+func restore(proxies []*Proxy, prev []*ProxyConfig) {
+	for i := len(prev) - 1; i >= 0; i-- {
+		if err := proxies[i].Apply(prev[i]); err != nil {
+			log.Printf("proxy %v: restoring: %s", i, err)
+		}
+	}
 }
 
-// Read reads data into p.
-// It returns the number of bytes read into p.
-func (c prefixConn) Read(p []byte) (int, error) {
-	return c.Reader.Read(p)
+// Reload rebuilds the Proxy from its current configuration,
+// reloading certificates and resetting the upstreams.
+func (p *Proxy) Reload() error {
+	p.mu.Lock()
+	pc := p.config
+	p.mu.Unlock()
+
+	return p.Apply(pc)
 }
 
-func defaultTLSHandler(conn net.Conn) {
-	defer conn.Close()
-	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	var buf bytes.Buffer
-	if _, err := io.CopyN(&buf, conn, 1+2+2); err != nil {
-		log.Println(err)
-		return
+// TLSHandler returns the handler function of a TLSproxy.
+func (p *Proxy) TLSHandler(fn func(net.Conn)) {
+	p.tlsHandler = func(_ context.Context, conn net.Conn) {
+		fn(conn)
 	}
-	length := binary.BigEndian.Uint16(buf.Bytes()[3:5])
-	if _, err := io.CopyN(&buf, conn, int64(length)); err != nil {
-		log.Println(err)
-		return
-	}
-	sn := sni.GetInfo(buf.Bytes())
-	// TODO: Deal with non TLS connections
-	if sn != nil && sn.ServerName != "" {
-		c := prefixConn{
-			Conn:   conn,
-			Reader: io.MultiReader(&buf, conn),
-		}
-		_ = conn.SetReadDeadline(time.Time{})
-		defer c.Close()
-		var upstream net.Conn
-		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
-		// TODO: after we will have backends we can drop the hardcoded 443.
-		upstream, err := net.Dial("tcp", fmt.Sprintf("%s:%d", sn.ServerName, 443))
-		if err != nil {
-			// TODO: Need to retry.
-			log.Println(err)
-			return
-		}
-		defer upstream.Close()
+}
 
-		go func() {
-			_, _ = io.Copy(upstream, io.MultiReader(bytes.NewReader(buf.Bytes()), c))
-		}()
+// Cancel is canceling/shutting down a TLSproxy, giving active
+// connections up to the DrainTimeout to finish.
+func (p *Proxy) Cancel() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.current().drainTimeout)
+	defer cancel()
 
-		_, _ = io.Copy(c, upstream)
+	err := p.Drain(ctx)
+	if err != nil {
+		log.Println(err)
 	}
+	return err
 }
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUpstream is a TCP server that reads the request, answers
+// with its name and echoes every line after it
+type testUpstream struct {
+	name string
+	lsn  net.Listener
+}
+
+func newTestUpstream(t *testing.T, name string) *testUpstream {
+	up := &testUpstream{name: name, lsn: listen(t)}
+	go up.serve()
+	return up
+}
+
+func (up *testUpstream) Addr() string {
+	return up.lsn.Addr().String()
+}
+
+func (up *testUpstream) serve() {
+	for {
+		conn, err := up.lsn.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			if _, err := http.ReadRequest(r); err != nil {
+				return
+			}
+			_, _ = io.WriteString(conn, up.name+"\n")
+			_, _ = io.Copy(conn, r)
+		}()
+	}
+}
+
+// listen opens a TCP listener on a random port, closed
+// with the test
+func listen(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lsn.Close() })
+	return lsn
+}
+
+// freeAddr returns an address nobody is listening on
+func freeAddr(t *testing.T) string {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+	return lsn.Addr().String()
+}
+
+// testConfig routes plaintext HTTP from the given
+// listeners to an upstream
+func testConfig(up *testUpstream, addrs ...string) *ProxyConfig {
+	return &ProxyConfig{
+		ListenAddr:       addrs,
+		Upstreams:        []UpstreamConfig{{Name: up.name, Servers: []string{up.Addr()}}},
+		HTTPDefaultRoute: up.name,
+		DrainTimeout:     "1s",
+	}
+}
+
+func newTestProxy(t *testing.T, pc *ProxyConfig) *Proxy {
+	p, err := pc.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = p.Run()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		_ = p.Cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Proxy didn't stop")
+		}
+	})
+	return p
+}
+
+// testConn is a client connection through the Proxy
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialTest connects to the Proxy and returns the name
+// of the upstream the connection was routed to
+func dialTest(t *testing.T, addr string) (*testConn, string) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testConn{Conn: conn, r: bufio.NewReader(conn)}
+	return c, c.readLine(t)
+}
+
+func (c *testConn) readLine(t *testing.T) string {
+	t.Helper()
+
+	s, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(s, "\n")
+}
+
+// echo checks the connection is still alive
+func (c *testConn) echo(t *testing.T, s string) {
+	t.Helper()
+
+	if _, err := io.WriteString(c, s+"\n"); err != nil {
+		t.Fatal(err)
+	} else if got := c.readLine(t); got != s {
+		t.Errorf("echo: %q (expected %q)", got, s)
+	}
+}
+
+func TestProxyApply(t *testing.T) {
+	upA, upB := newTestUpstream(t, "a"), newTestUpstream(t, "b")
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+
+	p := newTestProxy(t, testConfig(upA, addr1))
+
+	c, name := dialTest(t, addr1)
+	if name != "a" {
+		t.Fatalf("routed to %q (expected %q)", name, "a")
+	}
+
+	// swap the route and the listener
+	if err := p.Apply(testConfig(upB, addr2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection in flight remains on the old upstream
+	c.echo(t, "ping")
+
+	if _, err := net.DialTimeout("tcp", addr1, time.Second); err == nil {
+		t.Errorf("%s: still listening", addr1)
+	}
+
+	if _, name := dialTest(t, addr2); name != "b" {
+		t.Errorf("routed to %q (expected %q)", name, "b")
+	}
+
+	// the same configuration again
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.echo(t, "pong")
+	if _, name := dialTest(t, addr2); name != "b" {
+		t.Errorf("after Reload: routed to %q (expected %q)", name, "b")
+	}
+
+	if n := p.Conns(); n != 3 {
+		t.Errorf("%v connections (expected 3)", n)
+	}
+}
+
+func TestProxyApplyRollback(t *testing.T) {
+	upA, upB := newTestUpstream(t, "a"), newTestUpstream(t, "b")
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	busy := listen(t).Addr().String()
+
+	p := newTestProxy(t, testConfig(upA, addr1))
+
+	// the second listener can't be opened
+	if err := p.Apply(testConfig(upB, addr1, addr2, busy)); err == nil {
+		t.Fatal("Apply: unexpected success")
+	}
+
+	if _, err := net.DialTimeout("tcp", addr2, time.Second); err == nil {
+		t.Errorf("%s: listening after the rollback", addr2)
+	}
+
+	if _, name := dialTest(t, addr1); name != "a" {
+		t.Errorf("routed to %q (expected %q)", name, "a")
+	}
+
+	// an invalid configuration
+	pc := testConfig(upB, addr1)
+	pc.HTTPDefaultRoute = "unknown"
+	if err := p.Apply(pc); err == nil {
+		t.Fatal("Apply: unexpected success")
+	}
+
+	if _, name := dialTest(t, addr1); name != "a" {
+		t.Errorf("routed to %q (expected %q)", name, "a")
+	}
+}
+
+func TestProxyNewListenError(t *testing.T) {
+	up := newTestUpstream(t, "a")
+	addr := freeAddr(t)
+	busy := listen(t).Addr().String()
+
+	if _, err := testConfig(up, addr, busy).New(); err == nil {
+		t.Fatal("New: unexpected success")
+	}
+
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Errorf("%s: listening after failing", addr)
+	}
+}
+
+func TestApplyAll(t *testing.T) {
+	upA, upB := newTestUpstream(t, "a"), newTestUpstream(t, "b")
+	addr1, addr2, addr3 := freeAddr(t), freeAddr(t), freeAddr(t)
+	busy := listen(t).Addr().String()
+
+	p1 := newTestProxy(t, testConfig(upA, addr1))
+	p2 := newTestProxy(t, testConfig(upA, addr2))
+	proxies := []*Proxy{p1, p2}
+
+	// the second proxy can't be changed
+	err := ApplyAll(proxies, []ProxyConfig{*testConfig(upB, addr1), *testConfig(upB, addr2, busy)})
+	if err == nil {
+		t.Fatal("ApplyAll: unexpected success")
+	}
+
+	for _, addr := range []string{addr1, addr2} {
+		if _, name := dialTest(t, addr); name != "a" {
+			t.Errorf("%s: routed to %q (expected %q)", addr, name, "a")
+		}
+	}
+
+	if err := ApplyAll(proxies, []ProxyConfig{*testConfig(upB, addr1), *testConfig(upB, addr3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{addr1, addr3} {
+		if _, name := dialTest(t, addr); name != "b" {
+			t.Errorf("%s: routed to %q (expected %q)", addr, name, "b")
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/sniff"
+	"darvaza.org/darvaza/shared/net/starttls"
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// PreambleTimeout is the maximum time given to complete the
+// plaintext preamble of STARTTLS protocols, on either side
+const PreambleTimeout = 30 * time.Second
+
+// StartTLSConfig describes listeners whose clients negotiate
+// TLS after a plaintext preamble. Once TLS starts, connections
+// are routed by SNI like those of the main listeners, repeating
+// the preamble towards upstreams in passthrough and reencrypt
+// modes. MySQL connections are forwarded to a fixed Upstream
+// instead. If the ProxyConfig accepts the PROXY protocol the
+// header is required, as these clients wait for the server
+type StartTLSConfig struct {
+	// Protocol is one of smtp, imap, postgres or mysql
+	Protocol string   `hcl:"protocol,label"`
+	Listen   []string `hcl:"listen"`
+	// Hostname is announced on greetings to clients and
+	// upstreams. Defaults to the name of the host
+	Hostname string `hcl:"hostname,optional"`
+
+	// Upstream is where MySQL connections are forwarded,
+	// as it has to greet the client
+	Upstream string `hcl:"upstream,optional"`
+	// Mode of the MySQL connections, passthrough
+	// or reencrypt
+	Mode string `hcl:"mode,optional"`
+}
+
+// startTLS is a resolved StartTLSConfig
+type startTLS struct {
+	proto         starttls.Protocol
+	hostname      string
+	proxyProtocol bool
+	// route of MySQL connections
+	route *Route
+}
+
+// newStartTLS resolves the StartTLS listeners of a
+// ProxyConfig, by listen address. canTerminate tells if
+// there are certificates to terminate TLS
+func newStartTLS(pc *ProxyConfig, router *Router, canTerminate bool) (map[string]*startTLS, error) {
+	out := make(map[string]*startTLS)
+	for i := range pc.StartTLS {
+		cfg := &pc.StartTLS[i]
+
+		s, err := cfg.resolve(router, pc.ProxyProtocol, canTerminate)
+		if err == nil {
+			err = s.addListeners(out, cfg.Listen, pc.ListenAddr)
+		}
+		if err != nil {
+			return nil, core.Wrapf(err, "starttls %q", cfg.Protocol)
+		}
+	}
+	return out, nil
+}
+
+// addListeners assigns the preamble to its listen addresses,
+// unless used by other listeners
+func (s *startTLS) addListeners(m map[string]*startTLS, addrs, main []string) error {
+	for _, laddr := range addrs {
+		if _, dup := m[laddr]; dup || core.SliceContains(main, laddr) {
+			return fmt.Errorf("%q already in use", laddr)
+		}
+		m[laddr] = s
+	}
+	return nil
+}
+
+func (cfg *StartTLSConfig) resolve(router *Router, proxyProtocol, canTerminate bool) (*startTLS, error) {
+	proto, err := starttls.ParseProtocol(cfg.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &startTLS{
+		proto:         proto,
+		hostname:      cfg.Hostname,
+		proxyProtocol: proxyProtocol,
+	}
+
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+		s.hostname = core.Coalesce(s.hostname, "localhost")
+	}
+
+	switch {
+	case proto == starttls.MySQL:
+		s.route, err = cfg.mysqlRoute(router, canTerminate)
+	case cfg.Upstream != "" || cfg.Mode != "":
+		err = errors.New("upstream and mode are only used by mysql")
+	}
+	return s, err
+}
+
+func (cfg *StartTLSConfig) mysqlRoute(router *Router, canTerminate bool) (*Route, error) {
+	up, ok := router.Upstream(cfg.Upstream)
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream %q", cfg.Upstream)
+	}
+
+	route, err := newRoute(up, &RouteConfig{Upstream: cfg.Upstream, Mode: cfg.Mode}, nil)
+	switch {
+	case err != nil:
+		return nil, err
+	case route.Mode != ModePassthrough && route.Mode != ModeReencrypt:
+		return nil, fmt.Errorf("mysql doesn't support %q mode", route.Mode)
+	case route.Mode.Terminates() && !canTerminate:
+		return nil, errors.New("terminating routes require certificates")
+	default:
+		return route, nil
+	}
+}
+
+type startTLSKey struct{}
+
+// withStartTLS attaches the preamble of a connection
+// to its context, so upstreams can be prepared
+func withStartTLS(ctx context.Context, s *startTLS) context.Context {
+	return context.WithValue(ctx, startTLSKey{}, s)
+}
+
+func startTLSFromContext(ctx context.Context) (*startTLS, bool) {
+	s, ok := ctx.Value(startTLSKey{}).(*startTLS)
+	return s, ok
+}
+
+// handleStartTLS performs the plaintext preamble with the client
+// and handles the TLS connection that follows
+func (p *Proxy) handleStartTLS(ctx context.Context, conn net.Conn, s *startTLS) error {
+	sc := sniff.NewConn(conn)
+	_ = sc.SetDeadline(time.Now().Add(PreambleTimeout))
+
+	if s.proxyProtocol {
+		if _, err := sc.ReadProxyHeader(); err != nil {
+			return err
+		}
+	}
+
+	if !p.current().acl.AllowedAddr(sc.RemoteAddr()) {
+		return fmt.Errorf("client %s denied", sc.RemoteAddr())
+	}
+
+	if s.proto == starttls.MySQL {
+		return p.relayMySQL(ctx, sc, s.route)
+	}
+
+	if err := starttls.Accept(sc, s.proto, s.hostname); err != nil {
+		return core.Wrap(err, string(s.proto))
+	}
+	_ = sc.SetDeadline(time.Time{})
+
+	return p.handleTLS(withStartTLS(ctx, s), sc)
+}
+
+// prepare repeats the preamble towards an upstream, or only
+// skips its greeting if TLS doesn't follow
+func (s *startTLS) prepare(upstream net.Conn, useTLS bool) error {
+	var err error
+
+	_ = upstream.SetDeadline(time.Now().Add(PreambleTimeout))
+	if useTLS {
+		err = starttls.Start(upstream, s.proto, s.hostname)
+	} else {
+		err = starttls.Skip(upstream, s.proto)
+	}
+	_ = upstream.SetDeadline(time.Time{})
+
+	if err != nil {
+		err = core.Wrapf(err, "upstream %s", s.proto)
+	}
+	return err
+}
+
+// dial connects to the upstream of a route, preparing it for the
+// preamble the client went through, if any. useTLS tells if TLS
+// will be spoken with the upstream
+func dial(ctx context.Context, route *Route, hint proxy.Hint, useTLS bool) (net.Conn, error) {
+	upstream, err := route.Upstream.Dial(ctx, hint)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := startTLSFromContext(ctx); ok {
+		if err := s.prepare(upstream, useTLS); err != nil {
+			_ = upstream.Close()
+			return nil, err
+		}
+	}
+	return upstream, nil
+}
+
+// relayMySQL lets the upstream greet the client, and forwards
+// the connection once both are ready for TLS
+func (p *Proxy) relayMySQL(ctx context.Context, conn *sniff.Conn, route *Route) error {
+	upstream, err := route.Upstream.Dial(ctx, newHint(conn.RemoteAddr(), conn.LocalAddr(), ""))
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	_ = upstream.SetDeadline(time.Now().Add(PreambleTimeout))
+	if err := starttls.RelayMySQL(conn, upstream); err != nil {
+		return core.Wrap(err, "mysql")
+	}
+	_ = upstream.SetDeadline(time.Time{})
+	_ = conn.SetDeadline(time.Time{})
+
+	if route.Mode == ModeReencrypt {
+		return p.reencryptMySQL(ctx, conn, upstream, route)
+	}
+	return pipe(ctx, conn, upstream, route.forward...)
+}
+
+// reencryptMySQL terminates the client and speaks TLS with the
+// upstream, verifying the name the client asked for
+func (p *Proxy) reencryptMySQL(ctx context.Context, conn, upstream net.Conn, route *Route) error {
+	tc, err := p.handshake(ctx, conn, nil)
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+
+	serverName := tc.ConnectionState().ServerName
+	uc := tls.Client(upstream, p.upstreamTLS(route, serverName, nil))
+
+	hctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+	if err := uc.HandshakeContext(hctx); err != nil {
+		return core.Wrapf(err, "upstream %q", serverName)
+	}
+
+	return pipe(ctx, tc, uc, route.forward...)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"darvaza.org/darvaza/shared/proxy"
+)
+
+// HandshakeTimeout is the maximum time given to complete
+// TLS handshakes when terminating
+const HandshakeTimeout = 10 * time.Second
+
+// serverConfig returns the tls.Config used to terminate
+// client connections
+func (p *Proxy) serverConfig(nextProtos []string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: p.current().store.GetCertificate,
+		NextProtos:     nextProtos,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+func (p *Proxy) handshake(ctx context.Context, conn net.Conn, nextProtos []string) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+
+	tc := tls.Server(conn, p.serverConfig(nextProtos))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+	return tc, nil
+}
+
+// plaintext terminates TLS and forwards the decrypted stream
+func (p *Proxy) plaintext(ctx context.Context, conn net.Conn, route *Route, hint proxy.Hint) error {
+	tc, err := p.handshake(ctx, conn, route.NextProtos)
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+
+	hint.TLVs = terminatedTLVs(hint.ServerName, tc.ConnectionState())
+	upstream, err := dial(ctx, route, hint, false)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	return pipe(ctx, tc, upstream, route.forward...)
+}
+
+// reencrypt connects to the upstream first, offering the ALPN
+// protocols of the client, and then terminates the client
+// offering only what the upstream accepted
+func (p *Proxy) reencrypt(ctx context.Context, conn net.Conn, route *Route, hint proxy.Hint,
+	alpn []string) error {
+	//
+	upstream, err := p.dialTLS(ctx, route, hint, alpn)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	var nextProtos []string
+	if proto := upstream.ConnectionState().NegotiatedProtocol; proto != "" {
+		nextProtos = []string{proto}
+	}
+
+	tc, err := p.handshake(ctx, conn, nextProtos)
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+
+	return pipe(ctx, tc, upstream, route.forward...)
+}
+
+func (p *Proxy) dialTLS(ctx context.Context, route *Route, hint proxy.Hint,
+	alpn []string) (*tls.Conn, error) {
+	//
+	ctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+
+	raw, err := dial(ctx, route, hint, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(raw, p.upstreamTLS(route, hint.ServerName, alpn))
+
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// upstreamTLS returns the tls.Config to re-encrypt towards the
+// upstream of a route. The name verified is that of the route,
+// the upstream or the client, in that order
+func (p *Proxy) upstreamTLS(route *Route, serverName string, alpn []string) *tls.Config {
+	conf := route.Upstream.TLSConfig()
+	if conf == nil {
+		conf = &tls.Config{
+			RootCAs:    p.current().store.GetCAPool(),
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	switch {
+	case route.UpstreamServerName != "":
+		conf.ServerName = route.UpstreamServerName
+	case conf.ServerName == "":
+		conf.ServerName = serverName
+	}
+
+	conf.NextProtos = alpn
+	return conf
+}
+
+// serveHTTP terminates TLS and serves the connection
+// using the reverse proxy of the route
+func (p *Proxy) serveHTTP(ctx context.Context, conn net.Conn, route *Route, hint proxy.Hint) error {
+	tc, err := p.handshake(ctx, conn, route.NextProtos)
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+
+	// requests are proxied with the hint of their connection
+	hint.TLVs = terminatedTLVs(hint.ServerName, tc.ConnectionState())
+	ctx = proxy.WithHint(ctx, hint)
+
+	h2 := tc.ConnectionState().NegotiatedProtocol == "h2"
+	return serveConn(ctx, tc, route.handler, h2)
+}
+
+// serveConn serves HTTP requests on a single connection,
+// using HTTP/2 or HTTP/1.x
+func serveConn(ctx context.Context, conn net.Conn, handler http.Handler, h2 bool) error {
+	hs := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	if h2 {
+		h2s := &http2.Server{}
+		h2s.ServeConn(conn, &http2.ServeConnOpts{
+			Context:    ctx,
+			BaseConfig: hs,
+			Handler:    handler,
+		})
+		return nil
+	}
+
+	lsn := newConnListener(conn)
+	hs.ConnState = lsn.connState
+
+	err := hs.Serve(lsn)
+	if errors.Is(err, errListenerDone) {
+		err = nil
+	}
+	return err
+}
+
+var errListenerDone = errors.New("connection finished")
+
+// connListener is a net.Listener serving a single connection
+// and finishing when the http.Server is done with it
+type connListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr net.Addr
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{
+		conn: conn,
+		addr: conn.LocalAddr(),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.done
+	return nil, errListenerDone
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
+
+func (l *connListener) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		_ = l.Close()
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"darvaza.org/core"
+
+	"darvaza.org/darvaza/shared/net/tunnel"
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+// TunnelConfig describes the listeners where agents open
+// reverse tunnels. Agents present client certificates valid
+// for the hostnames they register, and connections for those
+// hostnames not matched by any route are forwarded through
+// their tunnels. Agents get the certificates of the Store
+type TunnelConfig struct {
+	Listen []string `hcl:"listen"`
+	// CA are PEM contents, files or directories with the CAs
+	// verifying the agents. Defaults to the CAs of the Store
+	CA []string `hcl:"ca,optional"`
+	// Mode of the TLS connections forwarded to the agents,
+	// plaintext by default to use the certificates of the
+	// Store, or passthrough. Plaintext HTTP connections are
+	// always passed through
+	Mode string `hcl:"mode,optional"`
+}
+
+// export creates the tls.Config accepting agents
+func (tc *TunnelConfig) export(store storage.Store) (*tls.Config, error) {
+	if store == nil {
+		return nil, errors.New("tunnels require certificates")
+	}
+
+	roots := store.GetCAPool()
+	if len(tc.CA) > 0 {
+		var pb certpool.PoolBuffer
+		if err := pb.Add(tc.CA...); err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		roots = pb.Pool().Export()
+	}
+
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+		ClientCAs:      roots,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// checkListeners fails if an address is used by other listeners
+func (tc *TunnelConfig) checkListeners(pc *ProxyConfig) error {
+	used := append([]string{}, pc.ListenAddr...)
+	for _, s := range pc.StartTLS {
+		used = append(used, s.Listen...)
+	}
+
+	for _, laddr := range tc.Listen {
+		if core.SliceContains(used, laddr) {
+			return fmt.Errorf("%q already in use", laddr)
+		}
+	}
+	return nil
+}
+
+// newTunnelState resolves the TunnelConfig of a ProxyConfig,
+// adding the routes of the registered hostnames to the Router.
+// It returns the tls.Config accepting agents
+func newTunnelState(pc *ProxyConfig, router *Router, store storage.Store,
+	edge *tunnel.Edge) (*tls.Config, error) {
+	//
+	tc := pc.Tunnel
+	if tc == nil {
+		return nil, nil
+	}
+
+	mode, err := parseMode(core.Coalesce(tc.Mode, string(ModePlaintext)))
+	switch {
+	case err != nil:
+		return nil, err
+	case mode != ModePlaintext && mode != ModePassthrough:
+		return nil, fmt.Errorf("tunnels don't support %q mode", mode)
+	}
+
+	if err := tc.checkListeners(pc); err != nil {
+		return nil, err
+	}
+
+	conf, err := tc.export(store)
+	if err != nil {
+		return nil, err
+	}
+
+	router.tunnel = newTunnelRoutes(edge, mode)
+	router.http.tunnel = newTunnelRoutes(edge, ModePassthrough)
+	return conf, nil
+}
+
+// newEdge creates the Edge accepting the agents of the
+// Proxy, using the tls.Config of the current state
+func (p *Proxy) newEdge() (*tunnel.Edge, error) {
+	getConfig := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if conf := p.current().tunnelTLS; conf != nil {
+			return conf, nil
+		}
+		return nil, errors.New("tunnels disabled")
+	}
+
+	return (&tunnel.EdgeConfig{
+		TLSConfig: &tls.Config{GetConfigForClient: getConfig},
+	}).New()
+}
+
+// handleTunnel serves an agent connected to a tunnel listener
+func (p *Proxy) handleTunnel(ctx context.Context, conn net.Conn) error {
+	if !p.current().acl.AllowedAddr(conn.RemoteAddr()) {
+		return fmt.Errorf("agent %s denied", conn.RemoteAddr())
+	}
+
+	err := p.tunnel.ServeConn(ctx, conn)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return core.Wrap(err, "tunnel")
+}
+
+// tunnelRoutes are the routes of the hostnames registered
+// by the agents, created on demand
+type tunnelRoutes struct {
+	edge *tunnel.Edge
+	mode Mode
+
+	mu     sync.Mutex
+	routes map[string]*Route
+}
+
+func newTunnelRoutes(edge *tunnel.Edge, mode Mode) *tunnelRoutes {
+	return &tunnelRoutes{
+		edge:   edge,
+		mode:   mode,
+		routes: make(map[string]*Route),
+	}
+}
+
+// match returns the route of a sanitised hostname if
+// an agent serves it
+func (tr *tunnelRoutes) match(name string) (*Route, bool) {
+	if tr == nil {
+		return nil, false
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if !tr.edge.Registered(name) {
+		delete(tr.routes, name)
+		return nil, false
+	}
+
+	route, ok := tr.routes[name]
+	if !ok {
+		var err error
+		route, err = tr.newRoute(name)
+		if err != nil {
+			return nil, false
+		}
+		tr.routes[name] = route
+	}
+	return route, true
+}
+
+func (tr *tunnelRoutes) newRoute(name string) (*Route, error) {
+	up, err := (&proxy.PoolConfig{
+		Name:        "tunnel/" + name,
+		Servers:     []string{net.JoinHostPort(name, "0")},
+		MaxFails:    -1,
+		DialContext: tr.edge.DialContext,
+	}).New()
+	if err != nil {
+		return nil, err
+	}
+
+	return newRoute(up, &RouteConfig{Mode: string(tr.mode)}, nil)
+}
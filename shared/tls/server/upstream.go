@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"darvaza.org/darvaza/shared/proxy"
+	"darvaza.org/darvaza/shared/storage"
+	"darvaza.org/darvaza/shared/storage/certpool"
+)
+
+// UpstreamConfig describes a named pool of upstream servers
+type UpstreamConfig struct {
+	Name    string   `hcl:"name,label"`
+	Servers []string `hcl:"servers"`
+
+	// Strategy is one of round_robin, least_conn,
+	// random_two or consistent_hash
+	Strategy string `hcl:"strategy,optional"`
+	// HashKey is sni or client_ip
+	HashKey string `hcl:"hash_key,optional"`
+	// MaxFails is the number of consecutive dial errors
+	// before ejecting a server, negative to disable
+	MaxFails int `hcl:"max_fails,optional"`
+	// EjectTime is how long a server stays ejected
+	EjectTime string `hcl:"eject_time,optional"`
+	// ConnectTimeout is the maximum time given to a connection attempt
+	ConnectTimeout string `hcl:"connect_timeout,optional"`
+	// Retries is the number of additional passes over the servers
+	// when all fail, with exponential backoff between them
+	Retries int `hcl:"retries,optional"`
+	// SendProxy is the version of PROXY protocol header
+	// to send to the servers, if any
+	SendProxy int `hcl:"send_proxy,optional"`
+
+	// TLS describes how to speak TLS to the servers when
+	// re-encrypting or proxying HTTP over TLS
+	TLS *UpstreamTLSConfig `hcl:"tls,block"`
+
+	HealthCheck *HealthCheckConfig `hcl:"health_check,block"`
+}
+
+// UpstreamTLSConfig describes how to speak TLS to an upstream
+type UpstreamTLSConfig struct {
+	// ServerName is the SNI sent and verified on the certificates
+	// of the servers, unless the route sets its own. Defaults to
+	// the SNI of the client
+	ServerName string `hcl:"server_name,optional"`
+	// CA are PEM contents, files or directories with the CAs
+	// verifying the servers. Defaults to the CAs of the Store
+	CA []string `hcl:"ca,optional"`
+	// Certificate is the name of the client certificate to
+	// get from the Store, for servers requiring mTLS
+	Certificate string `hcl:"certificate,optional"`
+	// Pins are base64 encoded SHA256 hashes of the public
+	// keys accepted, in addition to the CA verification
+	Pins []string `hcl:"pins,optional"`
+}
+
+// export creates the tls.Config to speak to the upstream
+func (tc *UpstreamTLSConfig) export(store storage.Store) (*tls.Config, error) {
+	cfg := &proxy.TLSClientConfig{
+		ServerName:  tc.ServerName,
+		Certificate: tc.Certificate,
+		Pins:        tc.Pins,
+		Store:       store,
+	}
+
+	if len(tc.CA) > 0 {
+		var pb certpool.PoolBuffer
+		if err := pb.Add(tc.CA...); err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		cfg.Roots = pb.Pool()
+	}
+
+	conf, err := cfg.Export()
+	if err != nil {
+		return nil, err
+	} else if conf.RootCAs == nil && store != nil {
+		conf.RootCAs = store.GetCAPool()
+	}
+	return conf, nil
+}
+
+// HealthCheckConfig describes the active health checks of an upstream
+type HealthCheckConfig struct {
+	// Type is one of tcp, tls or http
+	Type     string `hcl:"type,label"`
+	Interval string `hcl:"interval,optional"`
+	Timeout  string `hcl:"timeout,optional"`
+	Rise     int    `hcl:"rise,optional"`
+	Fall     int    `hcl:"fall,optional"`
+
+	// Path and Host of HTTP checks
+	Path string `hcl:"path,optional"`
+	Host string `hcl:"host,optional"`
+	// Status is the expected HTTP status
+	Status int `hcl:"status,optional"`
+}
+
+// New validates the config and creates the proxy.Pool
+func (uc *UpstreamConfig) New() (*proxy.Pool, error) {
+	return uc.newPool(nil)
+}
+
+// newPool creates the proxy.Pool using the optional Store
+// for TLS towards the servers
+func (uc *UpstreamConfig) newPool(store storage.Store) (*proxy.Pool, error) {
+	if uc.Name == "" {
+		return nil, errors.New("upstream without name")
+	}
+
+	cfg := &proxy.PoolConfig{
+		Name:     uc.Name,
+		Servers:  uc.Servers,
+		Strategy: proxy.Strategy(uc.Strategy),
+		HashKey:  proxy.HashKey(uc.HashKey),
+		MaxFails: uc.MaxFails,
+		Retries:  uc.Retries,
+
+		ProxyProtocol: uc.SendProxy,
+	}
+
+	if err := ParseDuration(uc.EjectTime, &cfg.EjectTime); err != nil {
+		return nil, fmt.Errorf("upstream %q: eject_time: %w", uc.Name, err)
+	}
+
+	if err := ParseDuration(uc.ConnectTimeout, &cfg.DialTimeout); err != nil {
+		return nil, fmt.Errorf("upstream %q: connect_timeout: %w", uc.Name, err)
+	}
+
+	if uc.TLS != nil {
+		conf, err := uc.TLS.export(store)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: tls: %w", uc.Name, err)
+		}
+		cfg.TLSConfig = conf
+	}
+
+	if uc.HealthCheck != nil {
+		hc, err := uc.HealthCheck.export()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: health_check: %w", uc.Name, err)
+		} else if hc.Type != proxy.HealthCheckTCP {
+			// checks speak TLS like everyone else
+			hc.TLSConfig = cfg.TLSConfig.Clone()
+		}
+		cfg.HealthCheck = hc
+	}
+
+	return cfg.New()
+}
+
+func (hcc *HealthCheckConfig) export() (*proxy.HealthCheck, error) {
+	hc := &proxy.HealthCheck{
+		Type:         proxy.HealthCheckType(hcc.Type),
+		Rise:         hcc.Rise,
+		Fall:         hcc.Fall,
+		Path:         hcc.Path,
+		Host:         hcc.Host,
+		ExpectStatus: hcc.Status,
+	}
+
+	if err := ParseDuration(hcc.Interval, &hc.Interval); err != nil {
+		return nil, err
+	}
+	if err := ParseDuration(hcc.Timeout, &hc.Timeout); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// ParseDuration parses a duration into out, leaving it
+// untouched if the string is empty
+func ParseDuration(s string, out *time.Duration) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*out = d
+	return nil
+}
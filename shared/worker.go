@@ -1,114 +1,231 @@
 package shared
 
 import (
-	"errors"
-	"log"
-	"sync"
+	"fmt"
+	"time"
 )
 
-type emptyStruct struct{}
+const (
+	// DefaultMinBackoff is the default delay before
+	// restarting a worker the first time
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the default longest delay
+	// before restarting a worker
+	DefaultMaxBackoff = 30 * time.Second
+)
 
-// Worker is a routing that runs supervised
+// Worker is a routine that runs supervised. Run is called
+// once, unless the Worker is a Restarter
 type Worker interface {
 	Run() error
 	Cancel() error
 }
 
-// WorkGroup governs a slice of Workers
-type WorkGroup struct {
-	workers map[Worker]emptyStruct
-	wg      sync.WaitGroup
-	Done    chan error
+// Restarter is a Worker whose Run can be called again once
+// it returns. Only they can have a RestartPolicy other than
+// RestartNever
+type Restarter interface {
+	Worker
+	// Restartable tells if Run can be called again
+	Restartable() bool
+}
+
+// canRestart tells if a Worker declares Run can be
+// called again
+func canRestart(r Worker) bool {
+	v, ok := r.(Restarter)
+	return ok && v.Restartable()
+}
+
+// Readier is a Worker telling when it's ready to work.
+// The WorkGroup waits for it before starting the next
+// one
+type Readier interface {
+	Ready() <-chan struct{}
 }
 
-// Run invokes all Workers and waits for them to finish
-func (s *WorkGroup) Run() error {
-	var err error
-	for k := range s.workers {
-		s.wg.Add(1)
-		go func(k Worker) {
-			defer s.wg.Done()
-			err = s.runWorker(k)
-		}(k)
+// RestartPolicy tells when a Worker is restarted after
+// its Run returns
+type RestartPolicy int
+
+const (
+	// RestartNever leaves workers finished
+	RestartNever RestartPolicy = iota
+	// RestartOnFailure restarts workers failing with an error
+	RestartOnFailure
+	// RestartAlways restarts workers however they finish
+	RestartAlways
+)
+
+var restartPolicyNames = map[RestartPolicy]string{
+	RestartNever:     "never",
+	RestartOnFailure: "on-failure",
+	RestartAlways:    "always",
+}
+
+func (p RestartPolicy) String() string {
+	if s, ok := restartPolicyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("RestartPolicy(%d)", int(p))
+}
+
+// ParseRestartPolicy parses the name of a RestartPolicy
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	for p, name := range restartPolicyNames {
+		if s == name {
+			return p, nil
+		}
 	}
-	s.wg.Wait()
-	return err
+	return RestartNever, fmt.Errorf("invalid restart policy %q", s)
 }
 
-func (s *WorkGroup) trySendError(err error) {
-	select {
-	case s.Done <- err:
+// shouldRestart tells if a Worker finishing with the
+// given error is to be restarted
+func (p RestartPolicy) shouldRestart(err error) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
 	default:
-		// non blocking send
+		return false
 	}
 }
 
-func (s *WorkGroup) runWorker(k Worker) error {
-	err := k.Run()
-	if err != nil {
-		s.trySendError(err)
-		log.Println(err)
+// WorkerOption configures the supervision of a Worker
+type WorkerOption func(*workerConfig)
 
-		err = k.Cancel()
-		if err != nil {
-			log.Println(err)
-		}
+type workerConfig struct {
+	name       string
+	restart    RestartPolicy
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
 
-		s.Remove(k)
-		if len(s.workers) == 0 {
-			s.trySendError(errors.New("no more workers running"))
-		}
+func (wc *workerConfig) setDefaults() {
+	if wc.minBackoff <= 0 {
+		wc.minBackoff = DefaultMinBackoff
 	}
+	if wc.maxBackoff < wc.minBackoff {
+		wc.maxBackoff = max(wc.minBackoff, DefaultMaxBackoff)
+	}
+}
 
-	return err
+// backoff returns the delay before the next restart, doubling
+// the previous one. Workers that ran for longer than the
+// longest delay start over
+func (wc *workerConfig) backoff(prev, ran time.Duration) time.Duration {
+	switch {
+	case prev == 0, ran > wc.maxBackoff:
+		return wc.minBackoff
+	default:
+		return min(2*prev, wc.maxBackoff)
+	}
 }
 
-// Cancel interrupts the execution of all workers
-func (s *WorkGroup) Cancel() error {
-	var err error
-	defer close(s.Done)
-	for k := range s.workers {
-		err = k.Cancel()
-		s.Remove(k)
-		if err != nil {
-			s.trySendError(err)
-			log.Println(err)
-		}
+// WithName sets the name of a Worker in its WorkerStatus.
+// By default it's its String() or a sequential one
+func WithName(name string) WorkerOption {
+	return func(wc *workerConfig) {
+		wc.name = name
 	}
-	return err
 }
 
-// Reload calls Reload() on all workers that support it
-func (s *WorkGroup) Reload() error {
-	var err error
-	for k := range s.workers {
-		if w, ok := k.(Reloader); ok {
-			if e := w.Reload(); e != nil {
-				err = e
-			}
-		}
+// WithRestart sets the RestartPolicy of a Worker.
+// RestartNever by default, and the only one allowed
+// to Workers that aren't a Restarter
+func WithRestart(policy RestartPolicy) WorkerOption {
+	return func(wc *workerConfig) {
+		wc.restart = policy
 	}
-	return err
 }
 
-// NewWorkGroup creates a new empty group of workers
-func NewWorkGroup() *WorkGroup {
-	s := make(map[Worker]emptyStruct)
-	d := make(chan error)
-	return &WorkGroup{
-		workers: s,
-		Done:    d,
+// WithBackoff sets the shortest and longest delays before
+// restarting a Worker. Delays double on each restart
+func WithBackoff(minDelay, maxDelay time.Duration) WorkerOption {
+	return func(wc *workerConfig) {
+		wc.minBackoff = minDelay
+		wc.maxBackoff = maxDelay
 	}
 }
 
-// Append adds a worker to the group
-func (s *WorkGroup) Append(r Worker) {
-	if s.workers != nil {
-		s.workers[r] = emptyStruct{}
+// EventType identifies the lifecycle Events of Workers
+type EventType int
+
+const (
+	// EventStarted is emitted when a Worker's Run is called
+	EventStarted EventType = iota
+	// EventExited is emitted when a Worker's Run returns
+	EventExited
+	// EventRestarting is emitted when a Worker is going
+	// to be restarted after a Delay
+	EventRestarting
+	// EventStopped is emitted when a Worker won't run again
+	EventStopped
+)
+
+var eventTypeNames = map[EventType]string{
+	EventStarted:    "started",
+	EventExited:     "exited",
+	EventRestarting: "restarting",
+	EventStopped:    "stopped",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventTypeNames[t]; ok {
+		return s
 	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes a change in the lifecycle of a Worker
+type Event struct {
+	Type   EventType
+	Worker Worker
+	Name   string
+	Time   time.Time
+
+	// Err is the error returned by Run, on EventExited
+	Err error
+	// Restarts is the number of times the Worker was restarted
+	Restarts int
+	// Delay is the time until the restart, on EventRestarting
+	Delay time.Duration
 }
 
-// Remove removes a worker from the group
-func (s *WorkGroup) Remove(r Worker) {
-	delete(s.workers, r)
+// WorkerState is the state of a Worker in a WorkGroup
+type WorkerState string
+
+const (
+	// StateIdle is the state of Workers not started yet
+	StateIdle WorkerState = "idle"
+	// StateStarting is the state of Workers running but
+	// not ready yet
+	StateStarting WorkerState = "starting"
+	// StateRunning is the state of Workers working
+	StateRunning WorkerState = "running"
+	// StateRestarting is the state of Workers waiting
+	// to be restarted
+	StateRestarting WorkerState = "restarting"
+	// StateDraining is the state of Workers cancelled
+	// but still finishing
+	StateDraining WorkerState = "draining"
+	// StateStopped is the state of Workers finished
+	StateStopped WorkerState = "stopped"
+	// StateFailed is the state of Workers that failed
+	// and won't be restarted
+	StateFailed WorkerState = "failed"
+)
+
+// WorkerStatus describes a Worker of a WorkGroup
+type WorkerStatus struct {
+	Name     string      `json:"name"`
+	State    WorkerState `json:"state"`
+	Restarts int         `json:"restarts"`
+	// LastError is the last error returned by its Run
+	LastError string `json:"last_error,omitempty"`
+	// Since is when it was last started
+	Since  time.Time     `json:"since"`
+	Uptime time.Duration `json:"uptime"`
 }
@@ -0,0 +1,561 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxRestarts is the default number of restarts
+	// allowed within the RestartPeriod
+	DefaultMaxRestarts = 10
+	// DefaultRestartPeriod is the default window in which
+	// restarts are counted
+	DefaultRestartPeriod = time.Minute
+	// DefaultStopTimeout is the default time given to each
+	// Worker to finish once cancelled
+	DefaultStopTimeout = 30 * time.Second
+)
+
+var (
+	// ErrRestartIntensity indicates Workers were restarted
+	// too often and the WorkGroup gave up
+	ErrRestartIntensity = errors.New("too many restarts")
+	// ErrNoWorkers indicates all the Workers finished
+	ErrNoWorkers = errors.New("no more workers running")
+	// ErrCancelled indicates the WorkGroup was cancelled
+	ErrCancelled = errors.New("workgroup cancelled")
+)
+
+// WorkGroupConfig describes the supervision of a WorkGroup
+type WorkGroupConfig struct {
+	// MaxRestarts is the most restarts allowed within the
+	// RestartPeriod before cancelling the whole WorkGroup.
+	// Negative disables the limit
+	MaxRestarts int
+	// RestartPeriod is the window in which restarts are counted
+	RestartPeriod time.Duration
+	// StopTimeout is the time given to each Worker to finish
+	// once cancelled before moving on to the previous one
+	StopTimeout time.Duration
+}
+
+// SetDefaults fills the gaps in the WorkGroupConfig
+func (cfg *WorkGroupConfig) SetDefaults() {
+	if cfg.MaxRestarts == 0 {
+		cfg.MaxRestarts = DefaultMaxRestarts
+	}
+	if cfg.RestartPeriod <= 0 {
+		cfg.RestartPeriod = DefaultRestartPeriod
+	}
+	if cfg.StopTimeout <= 0 {
+		cfg.StopTimeout = DefaultStopTimeout
+	}
+}
+
+// New creates an empty WorkGroup from the WorkGroupConfig
+func (cfg *WorkGroupConfig) New() *WorkGroup {
+	cfg.SetDefaults()
+
+	return &WorkGroup{
+		cfg:  *cfg,
+		stop: make(chan struct{}),
+		idle: make(chan struct{}),
+		Done: make(chan error),
+	}
+}
+
+// NewWorkGroup creates a new empty group of workers
+func NewWorkGroup() *WorkGroup {
+	return (&WorkGroupConfig{}).New()
+}
+
+// WorkGroup supervises a set of Workers, started in the order
+// they were appended and cancelled in reverse. Workers can be
+// appended and removed while running
+type WorkGroup struct {
+	cfg WorkGroupConfig
+
+	mu          sync.Mutex
+	members     []*member
+	restarts    []time.Time
+	subscribers []chan Event
+	err         error
+	named       int
+	// active counts the supervised Workers, and Run
+	// while starting them
+	active    int
+	running   bool
+	finished  bool
+	cancelled bool
+	closed    bool
+	stop      chan struct{}
+	idle      chan struct{}
+
+	// Done receives the errors making Workers stop, and
+	// is closed when the WorkGroup is cancelled
+	Done chan error
+}
+
+// member is a Worker of the WorkGroup
+type member struct {
+	worker Worker
+	cfg    workerConfig
+
+	// done is closed when the Worker won't run again,
+	// nil if it never started
+	done      chan struct{}
+	restarts  int
+	removed   bool
+	cancelled bool
+
+	state   WorkerState
+	lastErr error
+	since   time.Time
+	// run counts the calls to Run
+	run int
+}
+
+// Append adds a worker to the group, starting it if
+// the group is running
+func (s *WorkGroup) Append(r Worker, opts ...WorkerOption) error {
+	m := &member{worker: r, state: StateIdle}
+	for _, opt := range opts {
+		opt(&m.cfg)
+	}
+	m.cfg.setDefaults()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.cfg.name == "" {
+		m.cfg.name = s.defaultName(r)
+	}
+
+	switch {
+	case s.cancelled:
+		return ErrCancelled
+	case s.find(r) >= 0:
+		return fmt.Errorf("worker %q already in the group", m.cfg.name)
+	case s.findName(m.cfg.name) >= 0:
+		return fmt.Errorf("duplicated worker name %q", m.cfg.name)
+	case m.cfg.restart != RestartNever && !canRestart(r):
+		return fmt.Errorf("worker %q can't be restarted", m.cfg.name)
+	}
+
+	s.members = append(s.members, m)
+	if s.running && !s.finished {
+		s.startLocked(m)
+	}
+	return nil
+}
+
+func (s *WorkGroup) defaultName(r Worker) string {
+	if v, ok := r.(fmt.Stringer); ok {
+		return v.String()
+	}
+
+	s.named++
+	return fmt.Sprintf("worker-%v", s.named)
+}
+
+// Remove removes a worker from the group, cancelling it
+// and waiting up to StopTimeout for it to finish if running
+func (s *WorkGroup) Remove(r Worker) error {
+	return s.Detach(r)()
+}
+
+// Detach removes a worker from the group, freeing its name
+// right away, and returns the function cancelling it and
+// waiting for it to finish as Remove does
+func (s *WorkGroup) Detach(r Worker) func() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(r)
+	if i < 0 {
+		return func() error { return nil }
+	}
+
+	m := s.members[i]
+	m.removed = true
+	s.members = slices.Delete(s.members, i, i+1)
+	if m.done == nil {
+		// never started
+		return func() error { return nil }
+	}
+	return func() error { return s.cancel(m) }
+}
+
+func (s *WorkGroup) find(r Worker) int {
+	return slices.IndexFunc(s.members, func(m *member) bool {
+		return m.worker == r
+	})
+}
+
+func (s *WorkGroup) findName(name string) int {
+	return slices.IndexFunc(s.members, func(m *member) bool {
+		return m.cfg.name == name
+	})
+}
+
+// Run starts all Workers, one after the other, and waits for
+// them to finish. It returns the first error stopping a Worker
+func (s *WorkGroup) Run() error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return errors.New("workgroup already running")
+	}
+	s.running = true
+	// don't finish while starting
+	s.active++
+	members := slices.Clone(s.members)
+	s.mu.Unlock()
+
+	for _, m := range members {
+		if !s.start(m) {
+			break
+		}
+		s.waitReady(m)
+	}
+
+	s.release()
+	<-s.idle
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// release accounts a supervisor finishing, finishing
+// the WorkGroup if it was the last
+func (s *WorkGroup) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.active == 0 {
+		s.finished = true
+		close(s.idle)
+	}
+}
+
+// start spawns the supervisor of a member, unless
+// the WorkGroup was cancelled
+func (s *WorkGroup) start(m *member) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.cancelled:
+		return false
+	case m.removed, m.done != nil:
+		return true
+	}
+
+	s.startLocked(m)
+	return true
+}
+
+// startLocked spawns the supervisor of a member. s.mu is held
+func (s *WorkGroup) startLocked(m *member) {
+	m.done = make(chan struct{})
+	s.active++
+	go s.supervise(m)
+}
+
+// waitReady waits until a Worker tells it's ready,
+// finishes, or the WorkGroup is cancelled
+func (s *WorkGroup) waitReady(m *member) {
+	r, ok := m.worker.(Readier)
+	if !ok || m.done == nil {
+		return
+	}
+
+	select {
+	case <-r.Ready():
+	case <-m.done:
+	case <-s.stop:
+	}
+}
+
+// supervise runs a Worker until it isn't to be restarted
+func (s *WorkGroup) supervise(m *member) {
+	defer s.release()
+	defer close(m.done)
+
+	var delay time.Duration
+	for {
+		started := s.started(m)
+		err := m.worker.Run()
+		s.exited(m, err)
+
+		delay = m.cfg.backoff(delay, time.Since(started))
+		if !s.restart(m, err, delay) {
+			s.stopped(m, err)
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			s.stopped(m, nil)
+			return
+		}
+	}
+}
+
+// started marks a Worker as starting, and as running once
+// ready
+func (s *WorkGroup) started(m *member) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.run++
+	m.since = time.Now()
+	m.state = StateStarting
+	s.emitLocked(m, Event{Type: EventStarted})
+
+	if r, ok := m.worker.(Readier); ok {
+		go s.watchReady(m, m.run, r.Ready())
+	} else {
+		m.state = StateRunning
+	}
+	return m.since
+}
+
+// watchReady marks a Worker as running when ready, unless
+// that run already finished
+func (s *WorkGroup) watchReady(m *member, run int, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-m.done:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.run == run && m.state == StateStarting {
+		m.state = StateRunning
+	}
+}
+
+// exited records what a Worker's Run returned
+func (s *WorkGroup) exited(m *member, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.state != StateDraining {
+		m.lastErr = err
+	}
+	s.emitLocked(m, Event{Type: EventExited, Err: err})
+}
+
+// restart tells if a Worker is to be restarted, counting
+// the restart if so
+func (s *WorkGroup) restart(m *member, err error, delay time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.cancelled, m.removed, m.cancelled, !m.cfg.restart.shouldRestart(err):
+		return false
+	case !s.allowRestart(time.Now()):
+		log.Println(ErrRestartIntensity)
+		s.setError(ErrRestartIntensity)
+		// cancels everyone else, this one included
+		go func() { _ = s.Cancel() }()
+		return false
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	m.restarts++
+	m.state = StateRestarting
+	s.emitLocked(m, Event{Type: EventRestarting, Err: err, Delay: delay})
+	return true
+}
+
+// allowRestart counts a restart unless the limit
+// for the period has been reached
+func (s *WorkGroup) allowRestart(now time.Time) bool {
+	if s.cfg.MaxRestarts < 0 {
+		return true
+	}
+
+	since := now.Add(-s.cfg.RestartPeriod)
+	s.restarts = slices.DeleteFunc(s.restarts, func(t time.Time) bool {
+		return t.Before(since)
+	})
+
+	if len(s.restarts) >= s.cfg.MaxRestarts {
+		return false
+	}
+	s.restarts = append(s.restarts, now)
+	return true
+}
+
+// stopped finishes a Worker that won't run again
+func (s *WorkGroup) stopped(m *member, err error) {
+	if err != nil {
+		log.Println(err)
+	}
+
+	if s.failed(m, err) {
+		// release what the failed worker holds
+		if e := m.worker.Cancel(); e != nil {
+			log.Println(e)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.state != StateFailed {
+		m.state = StateStopped
+	}
+	s.emitLocked(m, Event{Type: EventStopped, Err: err})
+
+	if !s.cancelled && !s.anyRunning(m) {
+		s.trySendError(ErrNoWorkers)
+	}
+}
+
+// failed records the error of a Worker stopping on its own,
+// telling if it still needs to be cancelled
+func (s *WorkGroup) failed(m *member, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil || s.cancelled || m.cancelled {
+		return false
+	}
+
+	s.setError(err)
+	s.trySendError(err)
+	m.cancelled = true
+	m.state = StateFailed
+	return true
+}
+
+// anyRunning tells if a Worker other than the given
+// is still supervised
+func (s *WorkGroup) anyRunning(except *member) bool {
+	for _, m := range s.members {
+		if m == except || m.done == nil {
+			continue
+		}
+
+		select {
+		case <-m.done:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WorkGroup) setError(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// trySendError sends an error to Done if someone is
+// listening. s.mu is held
+func (s *WorkGroup) trySendError(err error) {
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.Done <- err:
+	default:
+		// non blocking send
+	}
+}
+
+// Cancel interrupts the execution of all workers, in the
+// reverse order they were started, waiting up to StopTimeout
+// for each to finish
+func (s *WorkGroup) Cancel() error {
+	s.mu.Lock()
+	if s.cancelled {
+		s.mu.Unlock()
+		return nil
+	}
+	s.cancelled = true
+	close(s.stop)
+	members := slices.Clone(s.members)
+	s.mu.Unlock()
+
+	var err error
+	for i := len(members) - 1; i >= 0; i-- {
+		if e := s.cancel(members[i]); e != nil {
+			log.Println(e)
+			err = e
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	close(s.Done)
+	for _, ch := range s.subscribers {
+		close(ch)
+	}
+	s.subscribers = nil
+	return err
+}
+
+// cancel cancels a Worker and waits for it to finish
+func (s *WorkGroup) cancel(m *member) error {
+	s.mu.Lock()
+	skip := m.cancelled
+	m.cancelled = true
+	done := m.done
+	if done != nil && !skip {
+		m.state = StateDraining
+	}
+	s.mu.Unlock()
+
+	if skip {
+		return nil
+	}
+
+	err := m.worker.Cancel()
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(s.cfg.StopTimeout):
+			log.Printf("worker %q didn't stop after %s", m.cfg.name, s.cfg.StopTimeout)
+		}
+	}
+	return err
+}
+
+// Reload calls Reload() on all workers that support it
+func (s *WorkGroup) Reload() error {
+	s.mu.Lock()
+	members := slices.Clone(s.members)
+	s.mu.Unlock()
+
+	var err error
+	for _, m := range members {
+		if w, ok := m.worker.(Reloader); ok {
+			if e := w.Reload(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
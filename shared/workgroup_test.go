@@ -0,0 +1,295 @@
+package shared
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("failed")
+
+// testWorker fails its first runs, then works until cancelled
+type testWorker struct {
+	name  string
+	fails int
+	log   *testLog
+
+	mu   sync.Mutex
+	runs int
+	stop chan struct{}
+}
+
+func (w *testWorker) Run() error {
+	w.mu.Lock()
+	w.runs++
+	failed := w.runs <= w.fails
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+	}
+	stop := w.stop
+	w.log.add("run " + w.name)
+	w.mu.Unlock()
+
+	if failed {
+		return errTest
+	}
+	<-stop
+	return nil
+}
+
+func (w *testWorker) Cancel() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.log.add("cancel " + w.name)
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+	}
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	return nil
+}
+
+func (*testWorker) Restartable() bool { return true }
+
+func (w *testWorker) Runs() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.runs
+}
+
+type testLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLog) add(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, s)
+}
+
+func (l *testLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.lines)
+}
+
+func appendWorker(t *testing.T, s *WorkGroup, w Worker, opts ...WorkerOption) {
+	t.Helper()
+
+	if err := s.Append(w, opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runGroup(t *testing.T, s *WorkGroup) <-chan error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	return done
+}
+
+func waitGroup(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		return nil
+	}
+}
+
+func TestWorkGroupRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   RestartPolicy
+		fails    int
+		runs     int
+		expected error
+	}{
+		{"never", RestartNever, 1, 1, errTest},
+		{"on-failure", RestartOnFailure, 2, 3, nil},
+		{"always", RestartAlways, 0, 1, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &testWorker{name: "w", fails: tc.fails, log: &testLog{}}
+			s := NewWorkGroup()
+			appendWorker(t, s, w, WithRestart(tc.policy), WithBackoff(time.Millisecond, time.Millisecond))
+
+			events, stop := s.Events()
+			defer stop()
+
+			done := runGroup(t, s)
+			if tc.expected == nil {
+				waitEvent(t, events, EventStarted, tc.runs-1)
+				if err := s.Cancel(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := waitGroup(t, done); err != tc.expected {
+				t.Errorf("%v (expected %v)", err, tc.expected)
+			}
+			if n := w.Runs(); n != tc.runs {
+				t.Errorf("%v runs (expected %v)", n, tc.runs)
+			}
+		})
+	}
+}
+
+func TestWorkGroupNotRestartable(t *testing.T) {
+	// only Run and Cancel
+	w := struct{ Worker }{&testWorker{name: "w", log: &testLog{}}}
+	s := NewWorkGroup()
+
+	if err := s.Append(w, WithRestart(RestartOnFailure)); err == nil {
+		t.Fatal("Append: unexpected success")
+	}
+	appendWorker(t, s, w, WithRestart(RestartNever))
+}
+
+// waitEvent waits for an Event of the given type and restarts
+func waitEvent(t *testing.T, events <-chan Event, typ EventType, restarts int) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ && ev.Restarts == restarts {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s after %v restarts", typ, restarts)
+		}
+	}
+}
+
+func TestWorkGroupRestartIntensity(t *testing.T) {
+	w := &testWorker{name: "w", fails: 100, log: &testLog{}}
+	s := (&WorkGroupConfig{MaxRestarts: 3}).New()
+	appendWorker(t, s, w, WithRestart(RestartOnFailure), WithBackoff(time.Millisecond, time.Millisecond))
+
+	if err := waitGroup(t, runGroup(t, s)); err != ErrRestartIntensity {
+		t.Errorf("%v (expected %v)", err, ErrRestartIntensity)
+	}
+	if n := w.Runs(); n != 4 {
+		t.Errorf("%v runs (expected 4)", n)
+	}
+}
+
+func TestWorkGroupOrder(t *testing.T) {
+	log := &testLog{}
+	s := NewWorkGroup()
+	for _, name := range []string{"a", "b", "c"} {
+		appendWorker(t, s, &readyWorker{testWorker{name: name, log: log}})
+	}
+
+	events, stop := s.Events()
+	defer stop()
+	done := runGroup(t, s)
+
+	for len(log.get()) < 3 {
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+
+	if err := s.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitGroup(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"run a", "run b", "run c", "cancel c", "cancel b", "cancel a"}
+	if lines := log.get(); !slices.Equal(lines, expected) {
+		t.Errorf("%q (expected %q)", lines, expected)
+	}
+}
+
+// readyWorker is ready once running
+type readyWorker struct {
+	testWorker
+}
+
+func (w *readyWorker) Ready() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for w.Runs() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return ch
+}
+
+func TestWorkGroupDynamic(t *testing.T) {
+	log := &testLog{}
+	a := &testWorker{name: "a", log: log}
+	b := &testWorker{name: "b", log: log}
+
+	s := NewWorkGroup()
+	appendWorker(t, s, a, WithName("a"))
+
+	events, stop := s.Events()
+	defer stop()
+	done := runGroup(t, s)
+	waitEvent(t, events, EventStarted, 0)
+
+	appendWorker(t, s, b, WithName("b"))
+	waitEvent(t, events, EventStarted, 0)
+
+	if err := s.Append(&testWorker{log: log}, WithName("b")); err == nil {
+		t.Error("duplicated name accepted")
+	}
+
+	expectStatus(t, s, map[string]WorkerState{"a": StateRunning, "b": StateRunning})
+
+	if err := s.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s, map[string]WorkerState{"b": StateRunning})
+
+	// the name is free before b finishes
+	wait := s.Detach(b)
+	appendWorker(t, s, &testWorker{name: "c", log: log}, WithName("b"))
+	waitEvent(t, events, EventStarted, 0)
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s, map[string]WorkerState{"b": StateRunning})
+
+	if err := s.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitGroup(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s, map[string]WorkerState{"b": StateStopped})
+}
+
+func expectStatus(t *testing.T, s *WorkGroup, expected map[string]WorkerState) {
+	t.Helper()
+
+	got := make(map[string]WorkerState)
+	for _, st := range s.Status() {
+		got[st.Name] = st.State
+	}
+
+	if !maps.Equal(got, expected) {
+		t.Errorf("%v (expected %v)", got, expected)
+	}
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"slices"
+	"time"
+)
+
+// eventsBuffer is the number of Events kept for
+// each subscriber
+const eventsBuffer = 64
+
+// Status returns a snapshot of the state of the Workers,
+// in the order they are started
+func (s *WorkGroup) Status() []WorkerStatus {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]WorkerStatus, 0, len(s.members))
+	for _, m := range s.members {
+		out = append(out, m.status(now))
+	}
+	return out
+}
+
+func (m *member) status(now time.Time) WorkerStatus {
+	st := WorkerStatus{
+		Name:     m.cfg.name,
+		State:    m.state,
+		Restarts: m.restarts,
+		Since:    m.since,
+	}
+
+	if m.lastErr != nil {
+		st.LastError = m.lastErr.Error()
+	}
+
+	switch m.state {
+	case StateStarting, StateRunning, StateDraining:
+		st.Uptime = now.Sub(m.since)
+	}
+	return st
+}
+
+// Events returns a channel receiving the lifecycle Events of
+// the Workers, and a function to stop receiving them. Events
+// are dropped if not read in time, and the channel is closed
+// when the WorkGroup is cancelled
+func (s *WorkGroup) Events() (<-chan Event, func()) {
+	ch := make(chan Event, eventsBuffer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	s.subscribers = append(s.subscribers, ch)
+	return ch, func() { s.unsubscribe(ch) }
+}
+
+func (s *WorkGroup) unsubscribe(ch chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := slices.Index(s.subscribers, ch); i >= 0 {
+		s.subscribers = slices.Delete(s.subscribers, i, i+1)
+		close(ch)
+	}
+}
+
+// emitLocked sends an Event to all subscribers. s.mu is held
+func (s *WorkGroup) emitLocked(m *member, ev Event) {
+	ev.Worker = m.worker
+	ev.Name = m.cfg.name
+	ev.Time = time.Now()
+	ev.Restarts = m.restarts
+
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// slow subscriber
+		}
+	}
+}